@@ -1,6 +1,7 @@
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
@@ -10,6 +11,18 @@ import (
 // Snapshot points at an OCI reference containing Firecracker snapshot artifacts.
 type SporeletSpec struct {
 	Snapshot string `json:"snapshot,omitempty"`
+	// ImagePullSecrets name docker config secrets in the Sporelet's namespace
+	// used to authenticate to the snapshot registry
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+	// UpdatePolicy, if set, re-resolves the snapshot tag periodically and
+	// restores the snapshot again when the tag has moved
+	UpdatePolicy *UpdatePolicy `json:"updatePolicy,omitempty"`
+}
+
+// UpdatePolicy controls how a Sporelet follows a moving snapshot tag.
+type UpdatePolicy struct {
+	// Interval between resolves of the snapshot tag
+	Interval metav1.Duration `json:"interval"`
 }
 
 // SporeletStatus defines the observed state of Sporelet
@@ -19,6 +32,9 @@ type SporeletStatus struct {
 	Phase string `json:"phase,omitempty"`
 	// Snapshot records the OCI reference last successfully restored
 	Snapshot string `json:"snapshot,omitempty"`
+	// SnapshotDigest records the manifest digest the snapshot reference
+	// resolved to when it was restored
+	SnapshotDigest string `json:"snapshotDigest,omitempty"`
 	// Conditions detail the status of snapshot operations
 	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
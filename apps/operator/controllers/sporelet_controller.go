@@ -2,31 +2,64 @@ package controllers
 
 import (
 	"context"
+	"crypto/ed25519"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/quinnovator/sporelet/apps/operator/api/v1alpha1"
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/cache"
 	fcoci "github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/oci"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 )
 
 var (
-	pullSnapshotFn = fcoci.PullSnapshot
-	execCommandCtx = exec.CommandContext
-	execCommand    = exec.Command
-	baseWorkDir    = "/var/lib/sporelet"
+	pullSnapshotFn   = fcoci.PullSnapshot
+	verifySnapshotFn = fcoci.VerifySnapshot
+	resolveDigestFn  = fcoci.ResolveDigest
+	execCommandCtx   = exec.CommandContext
+	execCommand      = exec.Command
+	// progressInterval is the time between pull progress updates
+	progressInterval = 2 * time.Second
+	baseWorkDir      = "/var/lib/sporelet"
 )
 
 type SporeletReconciler struct {
 	client.Client
+	// TrustedKeys, if set, is the verification policy: only snapshots
+	// signed by one of the keys are restored
+	TrustedKeys []ed25519.PublicKey
+	// Keys, if set, decrypts encrypted snapshot layers
+	Keys fcoci.KeyProvider
+	// Cache, if set, is the node-local snapshot cache: snapshots are pulled
+	// into it once and checked out into each work directory
+	Cache *cache.Cache
+	// LayoutRoot is the directory oci-layout:// snapshot references are
+	// resolved in; layout references are rejected if it is empty
+	LayoutRoot string
+	// CPUTemplate is the Firecracker CPU template of the node; snapshots
+	// taken with it are preferred when pulling from an image index
+	CPUTemplate string
+	// MaxConcurrentReconciles is the number of Sporelets reconciled at
+	// once, so that a large pull does not hold up the others
+	MaxConcurrentReconciles int
+	// Registries, if set, lists registry mirrors to pull through and
+	// registries reached over plain HTTP or without verifying TLS
+	Registries *fcoci.RegistryConfig
 }
 
 func (r *SporeletReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
@@ -36,11 +69,13 @@ func (r *SporeletReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 	}
 
 	workDir := filepath.Join(baseWorkDir, req.Namespace, req.Name)
+	// Sporelet names cannot start with a dot, so this is never another's
+	stagingDir := filepath.Join(baseWorkDir, req.Namespace, "."+req.Name+".next")
 	vmID := fmt.Sprintf("%s-%s", req.Namespace, req.Name)
 
 	if !sp.ObjectMeta.DeletionTimestamp.IsZero() {
-		execCommand("pkill", "-f", fmt.Sprintf("--id %s", vmID)).Run()
-		os.RemoveAll(workDir)
+		r.stopVM(vmID, workDir)
+		r.discard(stagingDir)
 		r.updateStatus(ctx, &sp, v1alpha1.PhaseStopped, metav1.Condition{})
 		if containsString(sp.Finalizers, v1alpha1.SporeletFinalizer) {
 			sp.Finalizers = removeString(sp.Finalizers, v1alpha1.SporeletFinalizer)
@@ -58,17 +93,102 @@ func (r *SporeletReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 		}
 	}
 
+	var interval time.Duration
+	if sp.Spec.UpdatePolicy != nil {
+		interval = sp.Spec.UpdatePolicy.Interval.Duration
+	}
 	if sp.Status.Phase == v1alpha1.PhaseReady && sp.Status.Snapshot == sp.Spec.Snapshot {
+		if interval <= 0 {
+			return ctrl.Result{}, nil
+		}
+		moved, err := r.snapshotMoved(ctx, &sp)
+		if err != nil {
+			log.FromContext(ctx).Error(err, "failed to resolve snapshot", "snapshot", sp.Spec.Snapshot)
+		}
+		if !moved {
+			return ctrl.Result{RequeueAfter: interval}, nil
+		}
+	}
+
+	creds, err := r.pullCredentials(ctx, &sp)
+	if err != nil {
+		cond := metav1.Condition{Type: "Ready", Status: metav1.ConditionFalse, Reason: "PullSecretInvalid", Message: err.Error(), LastTransitionTime: metav1.Now()}
+		r.updateStatus(ctx, &sp, v1alpha1.PhaseError, cond)
+		return ctrl.Result{RequeueAfter: time.Minute}, nil
+	}
+
+	snapshot, err := r.resolveLayout(sp.Spec.Snapshot)
+	if err != nil {
+		cond := metav1.Condition{Type: "Ready", Status: metav1.ConditionFalse, Reason: "InvalidSnapshot", Message: err.Error(), LastTransitionTime: metav1.Now()}
+		r.updateStatus(ctx, &sp, v1alpha1.PhaseError, cond)
 		return ctrl.Result{}, nil
 	}
+	if len(r.TrustedKeys) > 0 {
+		pinned, err := r.verifySnapshot(ctx, snapshot, creds)
+		if err != nil {
+			cond := metav1.Condition{Type: "Ready", Status: metav1.ConditionFalse, Reason: "SignatureInvalid", Message: err.Error(), LastTransitionTime: metav1.Now()}
+			r.updateStatus(ctx, &sp, v1alpha1.PhaseError, cond)
+			return ctrl.Result{RequeueAfter: time.Minute}, nil
+		}
+		snapshot = pinned
+	}
 
-	r.updateStatus(ctx, &sp, v1alpha1.PhasePending, metav1.Condition{})
+	opts := r.pullOptions(creds)
+	digest, err := resolveDigestFn(ctx, snapshot, opts...)
+	if err != nil {
+		cond := metav1.Condition{Type: "Ready", Status: metav1.ConditionFalse, Reason: "ResolveFailed", Message: err.Error(), LastTransitionTime: metav1.Now()}
+		r.updateStatus(ctx, &sp, v1alpha1.PhaseError, cond)
+		return ctrl.Result{RequeueAfter: time.Minute}, nil
+	}
+	if sp.Status.Phase == v1alpha1.PhaseReady && sp.Status.SnapshotDigest == digest {
+		// the new reference names the snapshot that is already running
+		sp.Status.Snapshot = sp.Spec.Snapshot
+		r.updateStatus(ctx, &sp, v1alpha1.PhaseReady, metav1.Condition{})
+		return ctrl.Result{RequeueAfter: interval}, nil
+	}
+	pinned, err := fcoci.ParseReference(snapshot)
+	if err != nil {
+		cond := metav1.Condition{Type: "Ready", Status: metav1.ConditionFalse, Reason: "InvalidSnapshot", Message: err.Error(), LastTransitionTime: metav1.Now()}
+		r.updateStatus(ctx, &sp, v1alpha1.PhaseError, cond)
+		return ctrl.Result{}, nil
+	}
 
-	if err := pullSnapshotFn(ctx, sp.Spec.Snapshot, workDir); err != nil {
+	// the VM restored from the previous digest keeps running until the new
+	// one is pulled next to it
+	replacing := sp.Status.Phase == v1alpha1.PhaseReady && sp.Status.SnapshotDigest != ""
+	pullDir := workDir
+	if replacing {
+		pullDir = stagingDir
+		r.discard(stagingDir)
+	} else {
+		r.updateStatus(ctx, &sp, v1alpha1.PhasePending, metav1.Condition{})
+	}
+	progress := &pullProgress{r: r, ctx: ctx, sp: &sp}
+	opts = append(opts, fcoci.WithProgress(progress.update), fcoci.WithEndpointReport(progress.endpoint))
+	progress.start()
+	err = r.pullSnapshot(ctx, pinned.WithDigest(digest).String(), pullDir, opts...)
+	progress.stop()
+	if err != nil {
+		if replacing {
+			r.discard(stagingDir)
+			cond := metav1.Condition{Type: "Pulled", Status: metav1.ConditionFalse, Reason: "PullFailed", Message: err.Error(), LastTransitionTime: metav1.Now()}
+			r.updateStatus(ctx, &sp, v1alpha1.PhaseReady, cond)
+			return ctrl.Result{RequeueAfter: time.Minute}, nil
+		}
 		cond := metav1.Condition{Type: "Ready", Status: metav1.ConditionFalse, Reason: "PullFailed", Message: err.Error(), LastTransitionTime: metav1.Now()}
 		r.updateStatus(ctx, &sp, v1alpha1.PhaseError, cond)
 		return ctrl.Result{RequeueAfter: time.Minute}, nil
 	}
+	progress.finish()
+	if replacing {
+		r.stopVM(vmID, workDir)
+		if err := r.moveCheckout(stagingDir, workDir); err != nil {
+			r.discard(stagingDir)
+			cond := metav1.Condition{Type: "Ready", Status: metav1.ConditionFalse, Reason: "PullFailed", Message: err.Error(), LastTransitionTime: metav1.Now()}
+			r.updateStatus(ctx, &sp, v1alpha1.PhaseError, cond)
+			return ctrl.Result{RequeueAfter: time.Minute}, nil
+		}
+	}
 
 	r.updateStatus(ctx, &sp, v1alpha1.PhaseRestoring, metav1.Condition{})
 
@@ -82,8 +202,228 @@ func (r *SporeletReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 
 	cond := metav1.Condition{Type: "Ready", Status: metav1.ConditionTrue, Reason: "Restored", Message: "snapshot restored", LastTransitionTime: metav1.Now()}
 	sp.Status.Snapshot = sp.Spec.Snapshot
+	sp.Status.SnapshotDigest = digest
 	r.updateStatus(ctx, &sp, v1alpha1.PhaseReady, cond)
-	return ctrl.Result{}, nil
+	return ctrl.Result{RequeueAfter: interval}, nil
+}
+
+// pullProgress records the bytes pulled so far in the Pulled condition of a
+// Sporelet and the registry endpoints that served them once the pull is
+// done. The transfers only record the latest progress; a separate goroutine
+// writes it to the status every progressInterval, so a slow API server does
+// not hold up the pull. Pulls served from the node cache transfer nothing
+// and leave the condition alone.
+type pullProgress struct {
+	r   *SporeletReconciler
+	ctx context.Context
+	sp  *v1alpha1.Sporelet
+
+	last   atomic.Pointer[fcoci.Progress]
+	mu     sync.Mutex
+	served []string
+	stopc  chan struct{}
+	done   chan struct{}
+}
+
+// update records the progress of the pull.
+func (p *pullProgress) update(progress fcoci.Progress) {
+	p.last.Store(&progress)
+}
+
+// current returns the latest progress recorded.
+func (p *pullProgress) current() fcoci.Progress {
+	if last := p.last.Load(); last != nil {
+		return *last
+	}
+	return fcoci.Progress{}
+}
+
+// start publishes the progress to the status until stop. The Sporelet must
+// not be changed in between.
+func (p *pullProgress) start() {
+	p.stopc, p.done = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		var published fcoci.Progress
+		for {
+			select {
+			case <-p.stopc:
+				return
+			case <-ticker.C:
+			}
+			progress := p.current()
+			if progress == published || progress.Total == 0 {
+				continue
+			}
+			published = progress
+			cond := metav1.Condition{Type: "Pulled", Status: metav1.ConditionFalse, Reason: "Pulling", Message: fmt.Sprintf("pulled %d of %d bytes", progress.Done, progress.Total), LastTransitionTime: metav1.Now()}
+			p.r.updateStatus(p.ctx, p.sp, p.sp.Status.Phase, cond)
+		}
+	}()
+}
+
+// stop stops publishing and waits for a status write in flight.
+func (p *pullProgress) stop() {
+	close(p.stopc)
+	<-p.done
+}
+
+// endpoint records a registry or mirror that served part of the pull.
+func (p *pullProgress) endpoint(e string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.served = append(p.served, e)
+}
+
+// finish marks the pull complete; the status is written with the next
+// phase change.
+func (p *pullProgress) finish() {
+	last := p.current()
+	if last.Total == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	msg := fmt.Sprintf("pulled %d bytes", last.Done)
+	if len(p.served) > 0 {
+		msg += " from " + strings.Join(p.served, ", ")
+	}
+	cond := metav1.Condition{Type: "Pulled", Status: metav1.ConditionTrue, Reason: "Pulled", Message: msg, LastTransitionTime: metav1.Now()}
+	meta.SetStatusCondition(&p.sp.Status.Conditions, cond)
+}
+
+// snapshotMoved resolves the snapshot reference of a restored Sporelet and
+// reports whether it points at a different manifest than the one restored.
+func (r *SporeletReconciler) snapshotMoved(ctx context.Context, sp *v1alpha1.Sporelet) (bool, error) {
+	creds, err := r.pullCredentials(ctx, sp)
+	if err != nil {
+		return false, err
+	}
+	snapshot, err := r.resolveLayout(sp.Spec.Snapshot)
+	if err != nil {
+		return false, err
+	}
+	digest, err := resolveDigestFn(ctx, snapshot, r.pullOptions(creds)...)
+	if err != nil {
+		return false, err
+	}
+	return digest != sp.Status.SnapshotDigest, nil
+}
+
+// pullOptions returns the options to resolve and pull snapshots with.
+func (r *SporeletReconciler) pullOptions(creds fcoci.CredentialStore) []fcoci.Option {
+	platform := fcoci.HostPlatform()
+	platform.Variant = r.CPUTemplate
+	opts := []fcoci.Option{fcoci.WithCredentialStore(creds), fcoci.WithChunkStore(filepath.Join(baseWorkDir, "chunks")), fcoci.WithPlatform(platform)}
+	if r.Keys != nil {
+		opts = append(opts, fcoci.WithKeyProvider(r.Keys))
+	}
+	if r.Registries != nil {
+		opts = append(opts, fcoci.WithRegistryConfig(r.Registries))
+	}
+	return opts
+}
+
+// stopVM kills the VM and removes its work directory.
+func (r *SporeletReconciler) stopVM(vmID, workDir string) {
+	execCommand("pkill", "-f", fmt.Sprintf("--id %s", vmID)).Run()
+	r.discard(workDir)
+}
+
+// discard releases the cache checkout in dir, if any, and removes it.
+func (r *SporeletReconciler) discard(dir string) {
+	if r.Cache != nil {
+		r.Cache.Release(dir)
+	}
+	os.RemoveAll(dir)
+}
+
+// moveCheckout moves a snapshot pulled to dir into workDir, keeping the
+// cache reference of the checkout.
+func (r *SporeletReconciler) moveCheckout(dir, workDir string) error {
+	if r.Cache != nil {
+		return r.Cache.Move(dir, workDir)
+	}
+	return os.Rename(dir, workDir)
+}
+
+// resolveLayout resolves an oci-layout:// reference against LayoutRoot:
+// relative paths are taken from it and paths outside it are rejected. Other
+// references are returned unchanged.
+func (r *SporeletReconciler) resolveLayout(snapshot string) (string, error) {
+	ref, err := fcoci.ParseReference(snapshot)
+	if err != nil || ref.Layout == "" {
+		return snapshot, nil
+	}
+	if r.LayoutRoot == "" {
+		return "", fmt.Errorf("oci-layout references are not enabled on this node")
+	}
+	path := ref.Layout
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(r.LayoutRoot, path)
+	}
+	rel, err := filepath.Rel(r.LayoutRoot, path)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("image layout %s is outside %s", ref.Layout, r.LayoutRoot)
+	}
+	ref.Layout = filepath.Join(r.LayoutRoot, rel)
+	return ref.String(), nil
+}
+
+// pullSnapshot places the snapshot in workDir, through the node cache when
+// one is configured.
+func (r *SporeletReconciler) pullSnapshot(ctx context.Context, snapshot, workDir string, opts ...fcoci.Option) error {
+	if r.Cache == nil {
+		return pullSnapshotFn(ctx, snapshot, workDir, opts...)
+	}
+	_, err := r.Cache.PullTo(ctx, snapshot, workDir, opts...)
+	return err
+}
+
+// verifySnapshot checks the snapshot signature against the trusted keys and
+// returns the reference pinned to the verified manifest digest, so that the
+// pull cannot fetch a different manifest.
+func (r *SporeletReconciler) verifySnapshot(ctx context.Context, snapshot string, creds fcoci.CredentialStore) (string, error) {
+	ref, err := fcoci.ParseReference(snapshot)
+	if err != nil {
+		return "", err
+	}
+	// signatures are fetched from the same registries as the snapshot
+	digest, err := verifySnapshotFn(ctx, snapshot, r.TrustedKeys, r.pullOptions(creds)...)
+	if err != nil {
+		return "", err
+	}
+	return ref.WithDigest(digest).String(), nil
+}
+
+// pullCredentials builds a credential store from the Sporelet's image pull
+// secrets, falling back to the operator's own docker config.
+func (r *SporeletReconciler) pullCredentials(ctx context.Context, sp *v1alpha1.Sporelet) (fcoci.CredentialStore, error) {
+	var stores fcoci.CredentialStores
+	for _, ref := range sp.Spec.ImagePullSecrets {
+		var secret corev1.Secret
+		if err := r.Get(ctx, types.NamespacedName{Namespace: sp.Namespace, Name: ref.Name}, &secret); err != nil {
+			return nil, fmt.Errorf("failed to get pull secret %s: %w", ref.Name, err)
+		}
+		data, ok := secret.Data[corev1.DockerConfigJsonKey]
+		if !ok {
+			data, ok = secret.Data[corev1.DockerConfigKey]
+		}
+		if !ok {
+			return nil, fmt.Errorf("pull secret %s has no %s or %s key", ref.Name, corev1.DockerConfigJsonKey, corev1.DockerConfigKey)
+		}
+		cfg, err := fcoci.ParseDockerConfig(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse pull secret %s: %w", ref.Name, err)
+		}
+		stores = append(stores, cfg)
+	}
+	if cfg, err := fcoci.LoadDockerConfig(); err == nil {
+		stores = append(stores, cfg)
+	}
+	return stores, nil
 }
 
 func (r *SporeletReconciler) updateStatus(ctx context.Context, sp *v1alpha1.Sporelet, phase string, cond metav1.Condition) {
@@ -103,6 +443,7 @@ func (r *SporeletReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	})
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&v1alpha1.Sporelet{}, ctrl.WithEventFilter(pred)).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
 		Complete(r)
 }
 
@@ -2,13 +2,23 @@ package controllers
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	v1alpha1 "github.com/quinnovator/sporelet/apps/operator/api/v1alpha1"
+	fcoci "github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/oci"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -31,7 +41,7 @@ func TestReconcileCreate(t *testing.T) {
 	dir := t.TempDir()
 	baseWorkDir = dir
 	pullCalled := false
-	pullSnapshotFn = func(ctx context.Context, ociRef, outDir string) error {
+	pullSnapshotFn = func(ctx context.Context, ociRef, outDir string, opts ...fcoci.Option) error {
 		pullCalled = true
 		return os.MkdirAll(outDir, 0755)
 	}
@@ -40,6 +50,10 @@ func TestReconcileCreate(t *testing.T) {
 		execCalled = true
 		return exec.CommandContext(ctx, "true")
 	}
+	const digest = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	resolveDigestFn = func(ctx context.Context, ociRef string, opts ...fcoci.Option) (string, error) {
+		return digest, nil
+	}
 	_, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "ns", Name: "sp"}})
 	if err != nil {
 		t.Fatalf("reconcile: %v", err)
@@ -52,11 +66,272 @@ func TestReconcileCreate(t *testing.T) {
 	if !pullCalled || !execCalled {
 		t.Fatalf("expected pull and exec to be called")
 	}
+	if out.Status.SnapshotDigest != digest {
+		t.Fatalf("snapshot digest %q", out.Status.SnapshotDigest)
+	}
 	if !containsString(out.Finalizers, v1alpha1.SporeletFinalizer) {
 		t.Fatalf("finalizer missing")
 	}
 }
 
+func TestReconcileVerifiesSignature(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = v1alpha1.AddToScheme(scheme)
+
+	const digest = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	for _, signed := range []bool{true, false} {
+		sp := &v1alpha1.Sporelet{
+			ObjectMeta: metav1.ObjectMeta{Name: "sp", Namespace: "ns"},
+			Spec:       v1alpha1.SporeletSpec{Snapshot: "ghcr.io/quinnovator/sporelet/layer1:dev"},
+		}
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(sp).Build()
+		pub, _, _ := ed25519.GenerateKey(nil)
+		r := &SporeletReconciler{Client: c, TrustedKeys: []ed25519.PublicKey{pub}}
+
+		baseWorkDir = t.TempDir()
+		verifySnapshotFn = func(ctx context.Context, ociRef string, keys []ed25519.PublicKey, opts ...fcoci.Option) (string, error) {
+			if !signed {
+				return "", fcoci.ErrNoValidSignature
+			}
+			return digest, nil
+		}
+		resolveDigestFn = func(ctx context.Context, ociRef string, opts ...fcoci.Option) (string, error) {
+			ref, err := fcoci.ParseReference(ociRef)
+			return ref.Digest, err
+		}
+		pulled := ""
+		pullSnapshotFn = func(ctx context.Context, ociRef, outDir string, opts ...fcoci.Option) error {
+			pulled = ociRef
+			return os.MkdirAll(outDir, 0755)
+		}
+		execCommandCtx = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+			return exec.CommandContext(ctx, "true")
+		}
+		if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "ns", Name: "sp"}}); err != nil {
+			t.Fatalf("reconcile: %v", err)
+		}
+		var out v1alpha1.Sporelet
+		_ = c.Get(context.Background(), types.NamespacedName{Namespace: "ns", Name: "sp"}, &out)
+
+		if signed {
+			if out.Status.Phase != v1alpha1.PhaseReady || pulled != "ghcr.io/quinnovator/sporelet/layer1@"+digest {
+				t.Fatalf("phase %s, pulled %q", out.Status.Phase, pulled)
+			}
+			continue
+		}
+		if out.Status.Phase != v1alpha1.PhaseError || pulled != "" {
+			t.Fatalf("phase %s, pulled %q", out.Status.Phase, pulled)
+		}
+		if len(out.Status.Conditions) != 1 || out.Status.Conditions[0].Reason != "SignatureInvalid" {
+			t.Fatalf("conditions %+v", out.Status.Conditions)
+		}
+	}
+	verifySnapshotFn = fcoci.VerifySnapshot
+}
+
+func TestVerifySnapshotUsesRegistries(t *testing.T) {
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.empty.v1+json","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2},"layers":[]}`)
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(manifest))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case strings.HasPrefix(req.URL.Path, "/v2/sporelet/layer1/manifests/"):
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			w.Header().Set("Docker-Content-Digest", digest)
+			w.Write(manifest)
+		case strings.HasPrefix(req.URL.Path, "/v2/sporelet/layer1/referrers/"):
+			w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+			w.Write([]byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	// the registry is only reachable with the plain HTTP setting of the
+	// registries config, so verification gets as far as the signatures
+	verifySnapshotFn = fcoci.VerifySnapshot
+	pub, _, _ := ed25519.GenerateKey(nil)
+	r := &SporeletReconciler{
+		TrustedKeys: []ed25519.PublicKey{pub},
+		Registries:  &fcoci.RegistryConfig{Registries: map[string]fcoci.RegistryHost{host: {PlainHTTP: true}}},
+	}
+	_, err := r.verifySnapshot(context.Background(), host+"/sporelet/layer1:dev", fcoci.CredentialStores{})
+	if !errors.Is(err, fcoci.ErrNoValidSignature) {
+		t.Fatalf("verifySnapshot: %v, want ErrNoValidSignature", err)
+	}
+}
+
+func TestReconcileFollowsTag(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = v1alpha1.AddToScheme(scheme)
+
+	const (
+		running = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+		moved   = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	)
+	sp := &v1alpha1.Sporelet{
+		ObjectMeta: metav1.ObjectMeta{Name: "sp", Namespace: "ns", Finalizers: []string{v1alpha1.SporeletFinalizer}},
+		Spec: v1alpha1.SporeletSpec{
+			Snapshot:     "ghcr.io/quinnovator/sporelet/layer1:dev",
+			UpdatePolicy: &v1alpha1.UpdatePolicy{Interval: metav1.Duration{Duration: 5 * time.Minute}},
+		},
+		Status: v1alpha1.SporeletStatus{Phase: v1alpha1.PhaseReady, Snapshot: "ghcr.io/quinnovator/sporelet/layer1:dev", SnapshotDigest: running},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(sp).Build()
+	r := &SporeletReconciler{Client: c}
+
+	baseWorkDir = t.TempDir()
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+	tag := running
+	resolveDigestFn = func(ctx context.Context, ociRef string, opts ...fcoci.Option) (string, error) {
+		return tag, nil
+	}
+	pulled := ""
+	pullSnapshotFn = func(ctx context.Context, ociRef, outDir string, opts ...fcoci.Option) error {
+		pulled = ociRef
+		return os.MkdirAll(outDir, 0755)
+	}
+	killed := false
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		killed = true
+		return exec.Command("true")
+	}
+	execCommandCtx = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "true")
+	}
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "ns", Name: "sp"}}
+	res, err := r.Reconcile(context.Background(), req)
+	if err != nil || res.RequeueAfter != 5*time.Minute || pulled != "" || killed {
+		t.Fatalf("unchanged tag: result %+v, err %v, pulled %q, killed %v", res, err, pulled, killed)
+	}
+
+	tag = moved
+	res, err = r.Reconcile(context.Background(), req)
+	if err != nil || res.RequeueAfter != 5*time.Minute {
+		t.Fatalf("moved tag: result %+v, err %v", res, err)
+	}
+	if pulled != "ghcr.io/quinnovator/sporelet/layer1@"+moved || !killed {
+		t.Fatalf("moved tag: pulled %q, killed %v", pulled, killed)
+	}
+	var out v1alpha1.Sporelet
+	_ = c.Get(context.Background(), req.NamespacedName, &out)
+	if out.Status.Phase != v1alpha1.PhaseReady || out.Status.SnapshotDigest != moved {
+		t.Fatalf("phase %s, digest %s", out.Status.Phase, out.Status.SnapshotDigest)
+	}
+}
+
+func TestReconcileKeepsVMOnFailedPull(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = v1alpha1.AddToScheme(scheme)
+
+	const (
+		running = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+		moved   = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	)
+	sp := &v1alpha1.Sporelet{
+		ObjectMeta: metav1.ObjectMeta{Name: "sp", Namespace: "ns", Finalizers: []string{v1alpha1.SporeletFinalizer}},
+		Spec: v1alpha1.SporeletSpec{
+			Snapshot:     "ghcr.io/quinnovator/sporelet/layer1:dev",
+			UpdatePolicy: &v1alpha1.UpdatePolicy{Interval: metav1.Duration{Duration: 5 * time.Minute}},
+		},
+		Status: v1alpha1.SporeletStatus{Phase: v1alpha1.PhaseReady, Snapshot: "ghcr.io/quinnovator/sporelet/layer1:dev", SnapshotDigest: running},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(sp).Build()
+	r := &SporeletReconciler{Client: c}
+
+	baseWorkDir = t.TempDir()
+	workDir := filepath.Join(baseWorkDir, "ns", "sp")
+	os.MkdirAll(workDir, 0755)
+	os.WriteFile(filepath.Join(workDir, "snapshot.mem"), []byte("running"), 0644)
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+	resolveDigestFn = func(ctx context.Context, ociRef string, opts ...fcoci.Option) (string, error) {
+		return moved, nil
+	}
+	staged := ""
+	pullSnapshotFn = func(ctx context.Context, ociRef, outDir string, opts ...fcoci.Option) error {
+		staged = outDir
+		os.MkdirAll(outDir, 0755)
+		return errors.New("registry unavailable")
+	}
+	killed := false
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		killed = true
+		return exec.Command("true")
+	}
+	restored := false
+	execCommandCtx = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		restored = true
+		return exec.CommandContext(ctx, "true")
+	}
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "ns", Name: "sp"}}
+	res, err := r.Reconcile(context.Background(), req)
+	if err != nil || res.RequeueAfter != time.Minute {
+		t.Fatalf("result %+v, err %v", res, err)
+	}
+	if killed || restored {
+		t.Fatalf("killed %v, restored %v after a failed pull", killed, restored)
+	}
+	if staged == "" || staged == workDir {
+		t.Fatalf("pulled into %q, want a staging directory", staged)
+	}
+	if _, err := os.Stat(staged); !os.IsNotExist(err) {
+		t.Errorf("staging directory left behind: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(workDir, "snapshot.mem")); string(data) != "running" {
+		t.Errorf("work directory of the running VM changed: %q", data)
+	}
+	var out v1alpha1.Sporelet
+	_ = c.Get(context.Background(), req.NamespacedName, &out)
+	if out.Status.Phase != v1alpha1.PhaseReady || out.Status.SnapshotDigest != running {
+		t.Fatalf("phase %s, digest %s", out.Status.Phase, out.Status.SnapshotDigest)
+	}
+	if cond := meta.FindStatusCondition(out.Status.Conditions, "Pulled"); cond == nil || cond.Reason != "PullFailed" {
+		t.Fatalf("conditions %+v", out.Status.Conditions)
+	}
+}
+
+func TestPullProgress(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = v1alpha1.AddToScheme(scheme)
+
+	sp := &v1alpha1.Sporelet{
+		ObjectMeta: metav1.ObjectMeta{Name: "sp", Namespace: "ns"},
+		Spec:       v1alpha1.SporeletSpec{Snapshot: "ref"},
+		Status:     v1alpha1.SporeletStatus{Phase: v1alpha1.PhasePending},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(sp).Build()
+	r := &SporeletReconciler{Client: c}
+	p := &pullProgress{r: r, ctx: context.Background(), sp: sp}
+
+	interval := progressInterval
+	progressInterval = 10 * time.Millisecond
+	defer func() { progressInterval = interval }()
+	p.start()
+	p.update(fcoci.Progress{Done: 10, Total: 100})
+	var out v1alpha1.Sporelet
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		_ = c.Get(context.Background(), types.NamespacedName{Namespace: "ns", Name: "sp"}, &out)
+		if len(out.Status.Conditions) > 0 {
+			break
+		}
+	}
+	p.stop()
+	if len(out.Status.Conditions) != 1 || out.Status.Conditions[0].Message != "pulled 10 of 100 bytes" || out.Status.Phase != v1alpha1.PhasePending {
+		t.Fatalf("status %+v", out.Status)
+	}
+
+	p.endpoint("mirror.internal:5000")
+	p.endpoint("ghcr.io")
+	p.update(fcoci.Progress{Done: 100, Total: 100})
+	p.finish()
+	if cond := sp.Status.Conditions[0]; cond.Status != metav1.ConditionTrue || cond.Message != "pulled 100 bytes from mirror.internal:5000, ghcr.io" {
+		t.Fatalf("condition %+v", cond)
+	}
+}
+
 func TestReconcileDelete(t *testing.T) {
 	scheme := runtime.NewScheme()
 	_ = v1alpha1.AddToScheme(scheme)
@@ -101,3 +376,69 @@ func TestReconcileDelete(t *testing.T) {
 		t.Fatalf("expected workdir removed")
 	}
 }
+
+func TestPullCredentials(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = v1alpha1.AddToScheme(scheme)
+	_ = corev1.AddToScheme(scheme)
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "regcred", Namespace: "ns"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: []byte(`{"auths":{"ghcr.io":{"username":"user","password":"secret"}}}`),
+		},
+	}
+	sp := &v1alpha1.Sporelet{
+		ObjectMeta: metav1.ObjectMeta{Name: "sp", Namespace: "ns"},
+		Spec: v1alpha1.SporeletSpec{
+			Snapshot:         "ghcr.io/quinnovator/sporelet/layer1:dev",
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "regcred"}},
+		},
+	}
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(sp, secret).Build()
+	r := &SporeletReconciler{Client: c}
+
+	store, err := r.pullCredentials(context.Background(), sp)
+	if err != nil {
+		t.Fatalf("pullCredentials: %v", err)
+	}
+	cred, err := store.Credential(context.Background(), "ghcr.io")
+	if err != nil || cred.Username != "user" || cred.Password != "secret" {
+		t.Fatalf("Credential = %+v, %v", cred, err)
+	}
+
+	sp.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: "missing"}}
+	if _, err := r.pullCredentials(context.Background(), sp); err == nil {
+		t.Fatal("expected error for missing pull secret")
+	}
+}
+
+func TestResolveLayout(t *testing.T) {
+	r := &SporeletReconciler{LayoutRoot: "/var/lib/sporelet/layouts"}
+	for in, want := range map[string]string{
+		"ghcr.io/a/b:dev":                              "ghcr.io/a/b:dev",
+		"oci-layout://snap:dev":                        "oci-layout:///var/lib/sporelet/layouts/snap:dev",
+		"oci-layout:///var/lib/sporelet/layouts/a/b:x": "oci-layout:///var/lib/sporelet/layouts/a/b:x",
+		"oci-layout://../../etc:dev":                   "",
+		"oci-layout:///etc/snap:dev":                   "",
+	} {
+		got, err := r.resolveLayout(in)
+		if want == "" {
+			if err == nil {
+				t.Errorf("resolveLayout(%q) = %q, want error", in, got)
+			}
+			continue
+		}
+		if err != nil || got != want {
+			t.Errorf("resolveLayout(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+
+	r.LayoutRoot = ""
+	if _, err := r.resolveLayout("oci-layout://snap:dev"); err == nil {
+		t.Error("layout reference accepted without a layout root")
+	}
+}
@@ -1,10 +1,12 @@
 module github.com/quinnovator/sporelet/apps/operator
 
-go 1.21
+go 1.22
 
 require (
     github.com/quinnovator/sporelet/packages/fc-snapshot-tools v0.0.0
     sigs.k8s.io/controller-runtime v0.16.3
 )
 
+require github.com/klauspost/compress v1.18.0 // indirect
+
 replace github.com/quinnovator/sporelet/packages/fc-snapshot-tools => ../../packages/fc-snapshot-tools
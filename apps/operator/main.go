@@ -2,9 +2,13 @@ package main
 
 import (
     "flag"
+    "os"
 
     "github.com/quinnovator/sporelet/apps/operator/api/v1alpha1"
     "github.com/quinnovator/sporelet/apps/operator/controllers"
+    "github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/cache"
+    fcoci "github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/oci"
+    clientgoscheme "k8s.io/client-go/kubernetes/scheme"
     ctrl "sigs.k8s.io/controller-runtime"
     "sigs.k8s.io/controller-runtime/pkg/client/config"
     "sigs.k8s.io/controller-runtime/pkg/log/zap"
@@ -12,7 +16,18 @@ import (
 
 func main() {
     var metricsAddr string
+    var trustedKeys, keyfile string
+    var cacheDir, cacheMaxSize, layoutRoot, cpuTemplate, registriesConfig string
+    var maxConcurrentReconciles int
     flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
+    flag.StringVar(&trustedKeys, "trusted-keys", "", "PEM file of ed25519 public keys; if set, only snapshots signed by one of them are restored.")
+    flag.StringVar(&keyfile, "encryption-keyfile", "", "Keyfile to decrypt encrypted snapshots with.")
+    flag.StringVar(&cacheDir, "cache-dir", "/var/lib/sporelet/cache", "Node-local snapshot cache; empty pulls every Sporelet separately.")
+    flag.StringVar(&cacheMaxSize, "cache-max-size", "0", "Evict unused cached snapshots beyond this size, e.g. 20G; 0 disables the cap.")
+    flag.StringVar(&layoutRoot, "layout-root", "/var/lib/sporelet/layouts", "Directory oci-layout:// snapshot references resolve in; empty rejects them.")
+    flag.StringVar(&cpuTemplate, "cpu-template", "", "Firecracker CPU template of the node, preferred when picking a snapshot from an image index.")
+    flag.StringVar(&registriesConfig, "registries-config", fcoci.DefaultRegistryConfigPath, "Registries config with mirrors to pull snapshots through and plain HTTP or insecure registries.")
+    flag.IntVar(&maxConcurrentReconciles, "max-concurrent-reconciles", 4, "Number of Sporelets reconciled, and snapshots pulled, at once.")
     flag.Parse()
 
     ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
@@ -25,11 +40,48 @@ func main() {
         panic(err)
     }
 
+    if err := clientgoscheme.AddToScheme(mgr.GetScheme()); err != nil {
+        panic(err)
+    }
+
     if err := v1alpha1.AddToScheme(mgr.GetScheme()); err != nil {
         panic(err)
     }
 
-    if err := (&controllers.SporeletReconciler{Client: mgr.GetClient()}).SetupWithManager(mgr); err != nil {
+    reconciler := &controllers.SporeletReconciler{Client: mgr.GetClient(), LayoutRoot: layoutRoot, CPUTemplate: cpuTemplate, MaxConcurrentReconciles: maxConcurrentReconciles}
+    if trustedKeys != "" {
+        data, err := os.ReadFile(trustedKeys)
+        if err != nil {
+            panic(err)
+        }
+        if reconciler.TrustedKeys, err = fcoci.ParsePublicKeys(data); err != nil {
+            panic(err)
+        }
+    }
+
+    if keyfile != "" {
+        kp, err := fcoci.NewKeyfileProvider(keyfile)
+        if err != nil {
+            panic(err)
+        }
+        reconciler.Keys = kp
+    }
+
+    if reconciler.Registries, err = fcoci.LoadRegistryConfig(registriesConfig); err != nil {
+        panic(err)
+    }
+
+    if cacheDir != "" {
+        maxSize, err := cache.ParseSize(cacheMaxSize)
+        if err != nil {
+            panic(err)
+        }
+        if reconciler.Cache, err = cache.Open(cacheDir, cache.WithMaxSize(maxSize)); err != nil {
+            panic(err)
+        }
+    }
+
+    if err := reconciler.SetupWithManager(mgr); err != nil {
         panic(err)
     }
 
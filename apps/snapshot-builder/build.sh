@@ -16,12 +16,17 @@ ROOTFS="$SNAP_DIR/rootfs.ext4"
 
 # 3. Start microVM with Firecracker jailer, run compose‑preheater inside,
 #    then trigger snapshot via FC API
+#    The compose file and guest agent are recorded in the build provenance.
 ./hack/run-and-snapshot.sh \
   --kernel "$KERNEL" \
   --rootfs "$ROOTFS" \
-  --snapshot-prefix "$SNAP_DIR/layer1"
+  --snapshot-prefix "$SNAP_DIR/layer1" \
+  --compose-file "${COMPOSE_FILE:-}" \
+  --guest-agent "$(command -v guest-agent || true)"
 
-# 4. Push snapshot to registry via ORAS (layer1)
-oras push "$OCI_REF" \
-  --artifact-type application/vnd.firecracker.layer.v1 \
-  "$SNAP_DIR/layer1.mem" "$SNAP_DIR/layer1.vmstate" "$SNAP_DIR/layer1.config"
\ No newline at end of file
+# 4. Push snapshot to registry (layer1)
+fc-tools \
+  --out-dir "$SNAP_DIR" \
+  --snapshot-prefix layer1 \
+  --oci-ref "$OCI_REF" \
+  push
\ No newline at end of file
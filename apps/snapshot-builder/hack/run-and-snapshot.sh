@@ -4,9 +4,11 @@ set -euo pipefail
 KERNEL=""
 ROOTFS=""
 SNAP_PREFIX=""
+COMPOSE_FILE=""
+GUEST_AGENT=""
 
 usage() {
-  echo "Usage: $0 --kernel <vmlinux> --rootfs <rootfs.ext4> --snapshot-prefix <prefix>" >&2
+  echo "Usage: $0 --kernel <vmlinux> --rootfs <rootfs.ext4> --snapshot-prefix <prefix> [--compose-file <file>] [--guest-agent <binary>]" >&2
   exit 1
 }
 
@@ -15,6 +17,8 @@ while [[ $# -gt 0 ]]; do
     --kernel) KERNEL=$2; shift 2;;
     --rootfs) ROOTFS=$2; shift 2;;
     --snapshot-prefix) SNAP_PREFIX=$2; shift 2;;
+    --compose-file) COMPOSE_FILE=$2; shift 2;;
+    --guest-agent) GUEST_AGENT=$2; shift 2;;
     *) usage;;
   esac
 done
@@ -28,10 +32,13 @@ if ! ip link show tap0 &>/dev/null; then
   "$(dirname "$0")/setup-tap0.sh"
 fi
 
-# Launch the VM, run compose-preheater inside via SSH, then snapshot
+# Launch the VM, run compose-preheater inside via SSH, then snapshot and
+# record the provenance of the build next to the snapshot files
 go run "$(dirname "$0")/run_and_snapshot.go" \
   --kernel "$KERNEL" \
   --rootfs "$ROOTFS" \
   --cmdline "$CMDLINE" \
-  --snapshot-prefix "$SNAP_PREFIX"
+  --snapshot-prefix "$SNAP_PREFIX" \
+  --compose-file "$COMPOSE_FILE" \
+  --guest-agent "$GUEST_AGENT"
 
@@ -8,6 +8,7 @@ import (
 	"os/exec"
 	"path/filepath"
 
+	fctools "github.com/quinnovator/sporelet/packages/fc-snapshot-tools"
 	fc "github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/firecracker"
 )
 
@@ -16,6 +17,8 @@ func main() {
 	rootfs := flag.String("rootfs", "", "path to rootfs")
 	snapPrefix := flag.String("snapshot-prefix", "snapshot", "snapshot prefix")
 	cmdline := flag.String("cmdline", "console=ttyS0 reboot=k panic=1 pci=off", "kernel cmdline")
+	composeFile := flag.String("compose-file", "", "compose file preheated in the guest, recorded in the provenance")
+	guestAgent := flag.String("guest-agent", "", "guest-agent binary installed in the rootfs, recorded in the provenance")
 	flag.Parse()
 
 	if *kernel == "" || *rootfs == "" || *snapPrefix == "" {
@@ -27,6 +30,21 @@ func main() {
 
 	ctx := context.Background()
 
+	// digest the inputs before the VM boots and writes to the rootfs
+	provenance, err := fctools.NewProvenance(fctools.BuildInputs{
+		Kernel:       *kernel,
+		Rootfs:       *rootfs,
+		ComposeFile:  *composeFile,
+		GuestAgent:   *guestAgent,
+		FCBin:        "firecracker",
+		JailerBin:    "jailer",
+		InvocationID: base,
+		Parameters:   map[string]any{"cmdline": *cmdline, "memSizeMib": 1024, "vcpuCount": 1},
+	})
+	if err != nil {
+		log.Fatalf("provenance: %v", err)
+	}
+
 	client, err := fc.NewClient("firecracker", "jailer", base, "")
 	if err != nil {
 		log.Fatalf("client: %v", err)
@@ -68,4 +86,8 @@ func main() {
 	if err := client.CreateSnapshot(ctx, snapCfg); err != nil {
 		log.Fatalf("snapshot: %v", err)
 	}
+
+	if err := fctools.WriteProvenance(provenance, snapCfg.MemFilePath, snapCfg.ConfigFilePath); err != nil {
+		log.Fatalf("provenance: %v", err)
+	}
 }
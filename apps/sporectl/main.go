@@ -2,19 +2,27 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	fc "github.com/quinnovator/sporelet/packages/fc-snapshot-tools"
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/cache"
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/ksm"
 	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/oci"
 )
 
 // allow tests to stub snapshot logic
 var startAndSnapshot = fc.StartAndSnapshot
-var compareSnapshotDirs = fc.CompareSnapshotDirs
+var diffSnapshotDirs = fc.DiffSnapshotDirs
+var recordParent = fc.RecordParent
 
 func main() {
 	if len(os.Args) < 2 {
@@ -32,6 +40,26 @@ func main() {
 		pullCmd(os.Args[2:])
 	case "diff":
 		diffCmd(os.Args[2:])
+	case "keygen":
+		keygenCmd(os.Args[2:])
+	case "sign":
+		signCmd(os.Args[2:])
+	case "verify":
+		verifyCmd(os.Args[2:])
+	case "cache":
+		cacheCmd(os.Args[2:])
+	case "export":
+		exportCmd(os.Args[2:])
+	case "import":
+		importCmd(os.Args[2:])
+	case "ls":
+		lsCmd(os.Args[2:])
+	case "inspect":
+		inspectCmd(os.Args[2:])
+	case "lineage":
+		lineageCmd(os.Args[2:])
+	case "analyze":
+		analyzeCmd(os.Args[2:])
 	default:
 		usage()
 		os.Exit(1)
@@ -45,6 +73,16 @@ func usage() {
 	fmt.Println("  push        Push snapshot to OCI registry")
 	fmt.Println("  pull        Pull snapshot from OCI registry")
 	fmt.Println("  diff        Snapshot and compare against base layer")
+	fmt.Println("  keygen      Generate an ed25519 signing key pair")
+	fmt.Println("  sign        Sign a snapshot in an OCI registry")
+	fmt.Println("  verify      Verify the signature of a snapshot")
+	fmt.Println("  cache       List or prune the node-local snapshot cache")
+	fmt.Println("  export      Write a snapshot to an OCI image layout archive")
+	fmt.Println("  import      Copy a snapshot from an OCI image layout archive")
+	fmt.Println("  ls          List the snapshots in a repository")
+	fmt.Println("  inspect     Show the manifest, files and parents of a snapshot")
+	fmt.Println("  lineage     Show the parents and children of a snapshot")
+	fmt.Println("  analyze     Report the memory pages snapshots share under KSM")
 }
 
 func snapshotCmd(args []string) {
@@ -59,6 +97,14 @@ func snapshotCmd(args []string) {
 		vcpus   = fs.Int("vcpu", 1, "Number of vCPUs")
 		ociRef  = fs.String("oci-ref", "", "OCI reference to push")
 		push    = fs.Bool("push", false, "Push after snapshot")
+		bundle  = fs.Bool("bundle", false, "Include kernel and rootfs in the pushed artifact")
+		layer   = fs.Int("layer", oci.Layer1, "Snapshot layer level (0, 1 or 2)")
+		keep    = fs.Bool("keep-zero-pages", false, "Do not punch zero pages out of the memory file")
+		keyfile = fs.String("encryption-keyfile", "", "Keyfile to encrypt the pushed memory and vmstate layers with")
+		cpuTmpl = fs.String("cpu-template", "", "Firecracker CPU template to run the VM with, e.g. T2 or V1N1")
+		index   = fs.Bool("index", false, "Add the pushed snapshot to the image index at the tag")
+		compose = fs.String("compose-file", "", "Compose file preheated in the guest, recorded in the provenance")
+		agent   = fs.String("guest-agent", "", "Guest agent binary installed in the rootfs, recorded in the provenance")
 	)
 	fs.Parse(args)
 
@@ -69,11 +115,15 @@ func snapshotCmd(args []string) {
 	}
 
 	spec := fc.SnapshotSpec{
-		Kernel:    *kernel,
-		Rootfs:    *rootfs,
-		Cmdline:   *cmdline,
-		MemSizeMB: *memMB,
-		VCPUCount: *vcpus,
+		Kernel:        *kernel,
+		Rootfs:        *rootfs,
+		Cmdline:       *cmdline,
+		MemSizeMB:     *memMB,
+		VCPUCount:     *vcpus,
+		CPUTemplate:   *cpuTmpl,
+		KeepZeroPages: *keep,
+		ComposeFile:   *compose,
+		GuestAgent:    *agent,
 	}
 
 	if err := os.MkdirAll(*outDir, 0755); err != nil {
@@ -88,7 +138,7 @@ func snapshotCmd(args []string) {
 	}
 
 	if *prefix != "snapshot" {
-		files := []string{"snapshot.mem", "snapshot.vmstate", "snapshot.config"}
+		files := []string{"snapshot.mem", "snapshot.vmstate", "snapshot.config", "snapshot.integrity", "snapshot.provenance"}
 		for _, f := range files {
 			old := filepath.Join(*outDir, f)
 			new := filepath.Join(*outDir, strings.Replace(f, "snapshot", *prefix, 1))
@@ -100,10 +150,19 @@ func snapshotCmd(args []string) {
 		mem := filepath.Join(*outDir, fmt.Sprintf("%s.mem", *prefix))
 		vmstate := filepath.Join(*outDir, fmt.Sprintf("%s.vmstate", *prefix))
 		config := filepath.Join(*outDir, fmt.Sprintf("%s.config", *prefix))
-		if err := fc.PushSnapshot(ctx, *ociRef, mem, vmstate, config); err != nil {
+		opts := []oci.Option{oci.WithMetadata(oci.SnapshotMetadata{Layer: *layer}), oci.WithIndex(*index)}
+		if *bundle {
+			opts = append(opts, oci.WithRootfs(*rootfs), oci.WithKernel(*kernel))
+		}
+		if *keyfile != "" {
+			opts = append(opts, keyProvider(*keyfile))
+		}
+		digest, err := fc.PushSnapshot(ctx, *ociRef, mem, vmstate, config, opts...)
+		if err != nil {
 			fmt.Fprintf(os.Stderr, "push failed: %v\n", err)
 			os.Exit(1)
 		}
+		fmt.Println(digest)
 	}
 }
 
@@ -113,6 +172,22 @@ func pushCmd(args []string) {
 		outDir = fs.String("out-dir", ".", "Directory with snapshot files")
 		prefix = fs.String("snapshot-prefix", "snapshot", "Snapshot file prefix")
 		ociRef = fs.String("oci-ref", "", "OCI reference")
+		rootfs = fs.String("rootfs", "", "Rootfs image to bundle into the artifact")
+		kernel = fs.String("kernel", "", "Kernel image to bundle into the artifact")
+		plain  = fs.Bool("plain-http", false, "Talk to the registry over plain HTTP")
+		layer  = fs.Int("layer", oci.Layer1, "Snapshot layer level (0, 1 or 2)")
+		parent = fs.String("parent", "", "Parent snapshot as a manifest digest in the same repository or a reference pinned by digest (default: the base recorded by diff)")
+		chunk  = fs.Bool("chunked", false, "Push memory and rootfs as deduplicated content-defined chunks")
+		ws     = fs.String("working-set", "", "Working set recorded with spore-shim restore --record-working-set to bundle")
+		sparse = fs.Bool("sparse", true, "Leave holes in the memory file out of the upload")
+		zstd   = fs.String("compression", "auto", "Compression of memory and rootfs layers: auto, none or zstd")
+		keys   = fs.String("encryption-keyfile", "", "Keyfile to encrypt the memory and vmstate layers with")
+		index  = fs.Bool("index", false, "Add the snapshot to the image index at the tag instead of replacing it")
+		plat   = fs.String("platform", "", "Platform of the snapshot as [linux/]arch[/cpu-template] (default: the host architecture and the CPU template in the config)")
+		jobs   = fs.Int("concurrency", 4, "Number of blobs to upload at once")
+		bar    = fs.Bool("progress", isTerminal(os.Stderr), "Show a progress bar")
+		regs   = fs.String("registries-config", oci.DefaultRegistryConfigPath, "Registries config with plain HTTP and insecure registry hosts")
+		delta  = fs.Bool("delta", true, "Push the memory delta written by diff in place of the memory file")
 	)
 	fs.Parse(args)
 
@@ -121,16 +196,74 @@ func pushCmd(args []string) {
 		fs.Usage()
 		os.Exit(1)
 	}
+	compression, err := oci.ParseCompression(*zstd)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	metadata := oci.SnapshotMetadata{Layer: *layer}
+	if strings.Contains(*parent, "@") {
+		p, err := oci.ParseReference(*parent)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		metadata.Parent, metadata.ParentRepository = p.Digest, p.Name()
+	} else {
+		metadata.Parent = *parent
+	}
+	if *plat != "" {
+		p, err := oci.ParsePlatform(*plat)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		metadata.Architecture, metadata.CPUTemplate = p.Architecture, p.Variant
+	}
+
+	opts := []oci.Option{
+		oci.WithPlainHTTP(*plain),
+		registryConfig(*regs),
+		oci.WithMetadata(metadata),
+		oci.WithIndex(*index),
+		oci.WithConcurrency(*jobs),
+		oci.WithChunking(*chunk),
+		oci.WithSparse(*sparse),
+		oci.WithCompression(compression),
+	}
+	if *rootfs != "" {
+		opts = append(opts, oci.WithRootfs(*rootfs))
+	}
+	if *kernel != "" {
+		opts = append(opts, oci.WithKernel(*kernel))
+	}
+	if *ws != "" {
+		opts = append(opts, oci.WithWorkingSet(*ws))
+	}
+	if *keys != "" {
+		opts = append(opts, keyProvider(*keys))
+	}
 
 	mem := filepath.Join(*outDir, fmt.Sprintf("%s.mem", *prefix))
 	vmstate := filepath.Join(*outDir, fmt.Sprintf("%s.vmstate", *prefix))
 	config := filepath.Join(*outDir, fmt.Sprintf("%s.config", *prefix))
+	if d, ok := fc.MemoryDelta(mem); *delta && ok {
+		fmt.Fprintf(os.Stderr, "pushing memory delta %s\n", d)
+		mem = d
+	}
 
 	ctx := context.Background()
-	if err := fc.PushSnapshot(ctx, *ociRef, mem, vmstate, config); err != nil {
+	pb := &progressBar{w: os.Stderr}
+	if *bar {
+		opts = append(opts, oci.WithProgress(pb.update))
+	}
+	digest, err := fc.PushSnapshot(ctx, *ociRef, mem, vmstate, config, opts...)
+	pb.finish()
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "push failed: %v\n", err)
 		os.Exit(1)
 	}
+	fmt.Println(digest)
 }
 
 func pullCmd(args []string) {
@@ -138,6 +271,14 @@ func pullCmd(args []string) {
 	var (
 		ociRef = fs.String("oci-ref", "", "OCI reference")
 		outDir = fs.String("out-dir", ".", "Directory to write snapshot")
+		plain  = fs.Bool("plain-http", false, "Talk to the registry over plain HTTP")
+		store  = fs.String("chunk-store", "", "Directory caching chunks of chunked snapshots across pulls")
+		lazy   = fs.Bool("lazy-memory", false, "Skip the memory file, for restores that load it on demand")
+		keys   = fs.String("encryption-keyfile", "", "Keyfile to decrypt encrypted layers with")
+		plat   = fs.String("platform", "", "Platform to pull from an image index as [linux/]arch[/cpu-template] (default: the host architecture)")
+		jobs   = fs.Int("concurrency", 4, "Number of blobs to download at once")
+		bar    = fs.Bool("progress", isTerminal(os.Stderr), "Show a progress bar")
+		regs   = fs.String("registries-config", oci.DefaultRegistryConfigPath, "Registries config with mirrors to pull through")
 	)
 	fs.Parse(args)
 
@@ -147,11 +288,800 @@ func pullCmd(args []string) {
 		os.Exit(1)
 	}
 
+	var served []string
+	opts := []oci.Option{
+		oci.WithPlainHTTP(*plain),
+		registryConfig(*regs),
+		oci.WithEndpointReport(func(e string) { served = append(served, e) }),
+		oci.WithChunkStore(*store),
+		oci.WithLazyMemory(*lazy),
+		oci.WithConcurrency(*jobs),
+	}
+	if *plat != "" {
+		p, err := oci.ParsePlatform(*plat)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		opts = append(opts, oci.WithPlatform(p))
+	}
+	if *keys != "" {
+		opts = append(opts, keyProvider(*keys))
+	}
+
 	ctx := context.Background()
-	if err := oci.PullSnapshot(ctx, *ociRef, *outDir); err != nil {
+	pb := &progressBar{w: os.Stderr}
+	if *bar {
+		opts = append(opts, oci.WithProgress(pb.update))
+	}
+	err := oci.PullSnapshot(ctx, *ociRef, *outDir, opts...)
+	pb.finish()
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "pull failed: %v\n", err)
 		os.Exit(1)
 	}
+	if len(served) > 0 {
+		fmt.Fprintf(os.Stderr, "pulled from %s\n", strings.Join(served, ", "))
+	}
+}
+
+func keygenCmd(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	prefix := fs.String("output-key-prefix", "sporelet", "Write the key pair to <prefix>.key and <prefix>.pub")
+	fs.Parse(args)
+
+	pub, priv, err := oci.GenerateKey()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "keygen failed: %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(*prefix+".key", priv, 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write private key: %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(*prefix+".pub", pub, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write public key: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func signCmd(args []string) {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	var (
+		ociRef  = fs.String("oci-ref", "", "OCI reference of the snapshot")
+		keyFile = fs.String("key", "", "PEM ed25519 private key")
+		plain   = fs.Bool("plain-http", false, "Talk to the registry over plain HTTP")
+		regs    = fs.String("registries-config", oci.DefaultRegistryConfigPath, "Registries config with plain HTTP and insecure registry hosts")
+	)
+	fs.Parse(args)
+
+	if *ociRef == "" || *keyFile == "" {
+		fmt.Fprintln(os.Stderr, "oci-ref and key are required")
+		fs.Usage()
+		os.Exit(1)
+	}
+	data, err := os.ReadFile(*keyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read key: %v\n", err)
+		os.Exit(1)
+	}
+	key, err := oci.ParsePrivateKey(data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	digest, err := oci.SignSnapshot(ctx, *ociRef, key, oci.WithPlainHTTP(*plain), registryConfig(*regs))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sign failed: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(digest)
+}
+
+func verifyCmd(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	var (
+		ociRef  = fs.String("oci-ref", "", "OCI reference of the snapshot")
+		keyFile = fs.String("key", "", "PEM ed25519 public keys trusted to sign the snapshot")
+		plain   = fs.Bool("plain-http", false, "Talk to the registry over plain HTTP")
+		regs    = fs.String("registries-config", oci.DefaultRegistryConfigPath, "Registries config with mirrors to pull through")
+	)
+	fs.Parse(args)
+
+	if *ociRef == "" || *keyFile == "" {
+		fmt.Fprintln(os.Stderr, "oci-ref and key are required")
+		fs.Usage()
+		os.Exit(1)
+	}
+	data, err := os.ReadFile(*keyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read key: %v\n", err)
+		os.Exit(1)
+	}
+	keys, err := oci.ParsePublicKeys(data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	digest, err := oci.VerifySnapshot(ctx, *ociRef, keys, oci.WithPlainHTTP(*plain), registryConfig(*regs))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "verify failed: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(digest)
+}
+
+func exportCmd(args []string) {
+	if err := runExport(args); err != nil {
+		fmt.Fprintf(os.Stderr, "export failed: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// runExport writes the snapshot of a registry reference or a snapshot
+// directory to an OCI image layout tar archive.
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var (
+		output = fs.String("o", "", "Archive to write")
+		tag    = fs.String("tag", "", "Tag of the snapshot in the archive (default: the reference's tag or latest)")
+		prefix = fs.String("snapshot-prefix", "snapshot", "Snapshot file prefix when exporting a directory")
+		rootfs = fs.String("rootfs", "", "Rootfs image to bundle when exporting a directory")
+		kernel = fs.String("kernel", "", "Kernel image to bundle when exporting a directory")
+		plain  = fs.Bool("plain-http", false, "Talk to the registry over plain HTTP")
+		keys   = fs.String("encryption-keyfile", "", "Keyfile to encrypt the memory and vmstate layers with when exporting a directory")
+	)
+	// accept the source before the flags: sporectl export <ref|dir> -o snap.tar
+	var src string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		src, args = args[0], args[1:]
+	}
+	fs.Parse(args)
+	if src == "" && fs.NArg() > 0 {
+		src = fs.Arg(0)
+	}
+	if src == "" || *output == "" {
+		fs.Usage()
+		return fmt.Errorf("a reference or snapshot directory and -o are required")
+	}
+
+	dir, err := os.MkdirTemp("", "sporelet-export-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	if info, err := os.Stat(src); err == nil && info.IsDir() {
+		if *tag == "" {
+			*tag = "latest"
+		}
+		opts := []oci.Option{}
+		if *rootfs != "" {
+			opts = append(opts, oci.WithRootfs(*rootfs))
+		}
+		if *kernel != "" {
+			opts = append(opts, oci.WithKernel(*kernel))
+		}
+		if *keys != "" {
+			opts = append(opts, keyProvider(*keys))
+		}
+		mem := filepath.Join(src, *prefix+".mem")
+		vmstate := filepath.Join(src, *prefix+".vmstate")
+		config := filepath.Join(src, *prefix+".config")
+		if _, err := fc.PushSnapshot(ctx, oci.LayoutScheme+dir+":"+*tag, mem, vmstate, config, opts...); err != nil {
+			return err
+		}
+	} else {
+		ref, err := oci.ParseReference(src)
+		if err != nil {
+			return err
+		}
+		if *tag == "" {
+			*tag = ref.Tag
+		}
+		if *tag == "" {
+			*tag = "latest"
+		}
+		if _, err := oci.CopySnapshot(ctx, src, oci.LayoutScheme+dir+":"+*tag, oci.WithPlainHTTP(*plain)); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := oci.WriteLayoutTar(f, dir); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func importCmd(args []string) {
+	if err := runImport(args); err != nil {
+		fmt.Fprintf(os.Stderr, "import failed: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// runImport copies the snapshot in an OCI image layout tar archive to a
+// registry or an image layout directory.
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	var (
+		ociRef = fs.String("oci-ref", "", "Destination: a registry reference or oci-layout://<dir>; its tag defaults to the archive's")
+		tag    = fs.String("tag", "", "Snapshot to import from an archive holding several")
+		plain  = fs.Bool("plain-http", false, "Talk to the registry over plain HTTP")
+	)
+	var archive string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		archive, args = args[0], args[1:]
+	}
+	fs.Parse(args)
+	if archive == "" && fs.NArg() > 0 {
+		archive = fs.Arg(0)
+	}
+	if archive == "" || *ociRef == "" {
+		fs.Usage()
+		return fmt.Errorf("an archive and oci-ref are required")
+	}
+
+	dir, err := os.MkdirTemp("", "sporelet-import-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	err = oci.ExtractLayoutTar(f, dir)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	if *tag == "" {
+		tags, err := oci.LayoutTags(dir)
+		if err != nil {
+			return err
+		}
+		if len(tags) != 1 {
+			return fmt.Errorf("archive holds %d snapshots %v; choose one with --tag", len(tags), tags)
+		}
+		*tag = tags[0]
+	}
+
+	ctx := context.Background()
+	digest, err := oci.CopySnapshot(ctx, oci.LayoutScheme+dir+":"+*tag, *ociRef, oci.WithPlainHTTP(*plain))
+	if err != nil {
+		return err
+	}
+	fmt.Println(digest)
+	return nil
+}
+
+func lsCmd(args []string) {
+	if err := runLs(args, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "ls failed: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// runLs lists the snapshots tagged in a repository.
+func runLs(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("ls", flag.ExitOnError)
+	var (
+		plain  = fs.Bool("plain-http", false, "Talk to the registry over plain HTTP")
+		regs   = fs.String("registries-config", oci.DefaultRegistryConfigPath, "Registries config with plain HTTP and insecure registry hosts")
+		asJSON = fs.Bool("json", false, "Print the snapshots as JSON")
+	)
+	// accept the repository before the flags: sporectl ls <repo> --json
+	var repo string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		repo, args = args[0], args[1:]
+	}
+	fs.Parse(args)
+	if repo == "" && fs.NArg() > 0 {
+		repo = fs.Arg(0)
+	}
+	if repo == "" {
+		fs.Usage()
+		return fmt.Errorf("a repository is required")
+	}
+
+	list, err := oci.ListSnapshots(context.Background(), repo, oci.WithPlainHTTP(*plain), registryConfig(*regs))
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		if list == nil {
+			list = []oci.SnapshotSummary{}
+		}
+		return writeJSON(out, list)
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TAG\tDIGEST\tSIZE\tLAYER\tPLATFORM\tCREATED")
+	for _, s := range list {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", s.Tag, s.Digest, humanSize(s.Size), s.Layer, s.Platform, s.Created.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func inspectCmd(args []string) {
+	if err := runInspect(args, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "inspect failed: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// runInspect describes a snapshot: its annotations, files and parent chain.
+func runInspect(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	var (
+		plain  = fs.Bool("plain-http", false, "Talk to the registry over plain HTTP")
+		regs   = fs.String("registries-config", oci.DefaultRegistryConfigPath, "Registries config with plain HTTP and insecure registry hosts")
+		plat   = fs.String("platform", "", "Platform to inspect in an image index as [linux/]arch[/cpu-template] (default: the host architecture)")
+		asJSON = fs.Bool("json", false, "Print the snapshot as JSON, including its manifest")
+		prov   = fs.Bool("provenance", false, "Show the build provenance attached to the snapshot instead")
+	)
+	var ref string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		ref, args = args[0], args[1:]
+	}
+	fs.Parse(args)
+	if ref == "" && fs.NArg() > 0 {
+		ref = fs.Arg(0)
+	}
+	if ref == "" {
+		fs.Usage()
+		return fmt.Errorf("a reference is required")
+	}
+
+	opts := []oci.Option{oci.WithPlainHTTP(*plain), registryConfig(*regs)}
+	if *plat != "" {
+		p, err := oci.ParsePlatform(*plat)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, oci.WithPlatform(p))
+	}
+	if *prov {
+		statements, err := oci.FetchProvenance(context.Background(), ref, opts...)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			if statements == nil {
+				statements = []oci.Statement{}
+			}
+			return writeJSON(out, statements)
+		}
+		return writeProvenance(out, statements)
+	}
+	info, err := oci.InspectSnapshot(context.Background(), ref, opts...)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return writeJSON(out, info)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Reference:\t%s\n", info.Reference)
+	fmt.Fprintf(w, "Digest:\t%s\n", info.Digest)
+	fmt.Fprintf(w, "Platform:\t%s\n", info.Platform)
+	fmt.Fprintf(w, "Size:\t%s\n", humanSize(info.Size))
+	w.Flush()
+
+	fmt.Fprintln(out, "\nAnnotations:")
+	for _, k := range sortedKeys(info.Annotations) {
+		fmt.Fprintf(w, "  %s\t%s\n", k, info.Annotations[k])
+	}
+	w.Flush()
+
+	fmt.Fprintln(out, "\nFiles:")
+	fmt.Fprintln(w, "  NAME\tMEDIA TYPE\tSTORED\tSIZE\tDETAILS")
+	for _, f := range info.Files {
+		size := "-"
+		if f.FileSize > 0 {
+			size = humanSize(f.FileSize)
+		}
+		var details []string
+		if f.Compression != "" {
+			details = append(details, f.Compression)
+		}
+		if f.Encrypted {
+			details = append(details, "encrypted")
+		}
+		if f.Chunks > 0 {
+			details = append(details, fmt.Sprintf("%d chunks", f.Chunks))
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\n", f.Name, f.MediaType, humanSize(f.Size), size, strings.Join(details, ", "))
+	}
+	w.Flush()
+
+	if len(info.Parents) > 0 {
+		fmt.Fprintln(out, "\nParents:")
+		for _, p := range info.Parents {
+			if p.Missing {
+				fmt.Fprintf(w, "  %s\t(not in repository)\n", p.Reference)
+				continue
+			}
+			fmt.Fprintf(w, "  %s\tlayer %d\t%s\n", p.Reference, p.Layer, p.Created.Format(time.RFC3339))
+		}
+		w.Flush()
+	}
+	return nil
+}
+
+func lineageCmd(args []string) {
+	if err := runLineage(args, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "lineage failed: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// runLineage prints the parents of a snapshot, oldest first, and the tree of
+// snapshots built on it.
+func runLineage(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("lineage", flag.ExitOnError)
+	var (
+		plain  = fs.Bool("plain-http", false, "Talk to the registry over plain HTTP")
+		regs   = fs.String("registries-config", oci.DefaultRegistryConfigPath, "Registries config with plain HTTP and insecure registry hosts")
+		plat   = fs.String("platform", "", "Platform to follow in an image index as [linux/]arch[/cpu-template] (default: the host architecture)")
+		asJSON = fs.Bool("json", false, "Print the lineage as JSON")
+	)
+	var ref string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		ref, args = args[0], args[1:]
+	}
+	fs.Parse(args)
+	if ref == "" && fs.NArg() > 0 {
+		ref = fs.Arg(0)
+	}
+	if ref == "" {
+		fs.Usage()
+		return fmt.Errorf("a reference is required")
+	}
+
+	opts := []oci.Option{oci.WithPlainHTTP(*plain), registryConfig(*regs)}
+	if *plat != "" {
+		p, err := oci.ParsePlatform(*plat)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, oci.WithPlatform(p))
+	}
+	lineage, err := oci.Lineage(context.Background(), ref, opts...)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return writeJSON(out, lineage)
+	}
+
+	depth := 0
+	for i := len(lineage.Parents) - 1; i >= 0; i-- {
+		p := lineage.Parents[i]
+		if p.Missing {
+			fmt.Fprintf(out, "%s%s (not in repository)\n", strings.Repeat("  ", depth), p.Reference)
+		} else {
+			fmt.Fprintf(out, "%s%s\n", strings.Repeat("  ", depth), lineageLine(p))
+		}
+		depth++
+	}
+	fmt.Fprintf(out, "%s%s *\n", strings.Repeat("  ", depth), lineageLine(lineage.SnapshotSummary))
+	writeChildren(out, lineage.Children, depth+1)
+	return nil
+}
+
+// writeChildren prints a lineage subtree, indented by depth.
+func writeChildren(out io.Writer, nodes []oci.LineageNode, depth int) {
+	for _, n := range nodes {
+		fmt.Fprintf(out, "%s%s\n", strings.Repeat("  ", depth), lineageLine(n.SnapshotSummary))
+		writeChildren(out, n.Children, depth+1)
+	}
+}
+
+// lineageLine describes a snapshot on one line of a lineage tree.
+func lineageLine(s oci.SnapshotSummary) string {
+	return fmt.Sprintf("%s  layer %d  %s  %s", s.Reference, s.Layer, humanSize(s.Size), s.Created.Format(time.RFC3339))
+}
+
+// writeProvenance prints the builder, inputs and parameters of each
+// provenance statement.
+func writeProvenance(out io.Writer, statements []oci.Statement) error {
+	if len(statements) == 0 {
+		return fmt.Errorf("no provenance attached")
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for i, s := range statements {
+		if i > 0 {
+			fmt.Fprintln(out)
+		}
+		p := s.Predicate
+		fmt.Fprintf(w, "Builder:\t%s\n", p.RunDetails.Builder.ID)
+		fmt.Fprintf(w, "Build type:\t%s\n", p.BuildDefinition.BuildType)
+		if id := p.RunDetails.Metadata.InvocationID; id != "" {
+			fmt.Fprintf(w, "Invocation:\t%s\n", id)
+		}
+		fmt.Fprintf(w, "Started:\t%s\n", p.RunDetails.Metadata.StartedOn.Format(time.RFC3339))
+		fmt.Fprintf(w, "Finished:\t%s\n", p.RunDetails.Metadata.FinishedOn.Format(time.RFC3339))
+		w.Flush()
+
+		fmt.Fprintln(out, "\nVersions:")
+		for _, k := range sortedKeys(p.RunDetails.Builder.Version) {
+			fmt.Fprintf(w, "  %s\t%s\n", k, p.RunDetails.Builder.Version[k])
+		}
+		w.Flush()
+
+		fmt.Fprintln(out, "\nInputs:")
+		fmt.Fprintln(w, "  NAME\tDIGEST\tURI")
+		for _, d := range p.BuildDefinition.ResolvedDependencies {
+			var digests []string
+			for _, alg := range sortedKeys(d.Digest) {
+				digests = append(digests, alg+":"+d.Digest[alg])
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%s\n", d.Name, strings.Join(digests, ","), d.URI)
+		}
+		w.Flush()
+
+		fmt.Fprintln(out, "\nParameters:")
+		for _, k := range sortedKeys(p.BuildDefinition.ExternalParameters) {
+			fmt.Fprintf(w, "  %s\t%v\n", k, p.BuildDefinition.ExternalParameters[k])
+		}
+		w.Flush()
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeJSON writes v to w as indented JSON.
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func analyzeCmd(args []string) {
+	if err := runAnalyze(args, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "analyze failed: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// runAnalyze hashes the memory pages of snapshots and reports the zero,
+// unique and shared pages of each, with the node memory their clones would
+// take with and without KSM.
+func runAnalyze(args []string, out io.Writer) error {
+	if len(args) < 1 || args[0] != "mem" {
+		return fmt.Errorf("usage: sporectl analyze mem <snapshot>... [options]")
+	}
+	fs := flag.NewFlagSet("analyze mem", flag.ExitOnError)
+	var (
+		clones = fs.Int("clones", 100, "VMs restored from each snapshot on the node")
+		asJSON = fs.Bool("json", false, "Print the report as JSON")
+	)
+	// snapshots and flags in any order: sporectl analyze mem a b --clones 50
+	var paths []string
+	args = args[1:]
+	for {
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			break
+		}
+		mem, err := memFile(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		paths = append(paths, mem)
+		args = fs.Args()[1:]
+	}
+	if len(paths) == 0 {
+		fs.Usage()
+		return fmt.Errorf("a memory file or snapshot directory is required")
+	}
+
+	r, err := ksm.Analyze(paths, *clones)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return writeJSON(out, r)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SNAPSHOT\tSIZE\tPAGES\tZERO\tUNIQUE\tSHARED\tMEMORY\tWITH KSM")
+	for _, s := range r.Snapshots {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n", s.Path, humanSize(s.Size), s.Pages,
+			pageShare(s.ZeroPages, s.Pages), pageShare(s.UniquePages, s.Pages), pageShare(s.SharedPages, s.Pages),
+			humanSize(s.Memory), humanSize(s.MemoryKSM))
+	}
+	w.Flush()
+
+	if len(r.Pairs) > 0 {
+		fmt.Fprintln(out, "\nShared between snapshots:")
+		for _, p := range r.Pairs {
+			fmt.Fprintf(w, "  %s\t%s\t%d pages\t%s\n", p.A, p.B, p.SharedPages, humanSize(p.SharedPages*r.PageSize))
+		}
+		w.Flush()
+	}
+
+	fmt.Fprintf(out, "\nNode memory for %d clones of each snapshot:\n", r.Clones)
+	fmt.Fprintf(w, "  without KSM\t%s\n", humanSize(r.Memory))
+	saved := ""
+	if r.Memory > 0 {
+		saved = fmt.Sprintf(" (%.1f%% saved)", 100*float64(r.Memory-r.MemoryKSM)/float64(r.Memory))
+	}
+	fmt.Fprintf(w, "  with KSM\t%s%s\n", humanSize(r.MemoryKSM), saved)
+	return w.Flush()
+}
+
+// memFile returns the memory file of a snapshot given as a .mem file or a
+// directory holding exactly one.
+func memFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return path, nil
+	}
+	matches, err := filepath.Glob(filepath.Join(path, "*.mem"))
+	if err != nil {
+		return "", err
+	}
+	if len(matches) != 1 {
+		return "", fmt.Errorf("%s holds %d memory files, name one of them", path, len(matches))
+	}
+	return matches[0], nil
+}
+
+// pageShare formats a page count with its share of total.
+func pageShare(n, total int64) string {
+	if total == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%d (%.0f%%)", n, 100*float64(n)/float64(total))
+}
+
+func cacheCmd(args []string) {
+	if len(args) < 1 || (args[0] != "ls" && args[0] != "prune") {
+		fmt.Fprintln(os.Stderr, "Usage: sporectl cache ls|prune [options]")
+		os.Exit(1)
+	}
+	fs := flag.NewFlagSet("cache "+args[0], flag.ExitOnError)
+	var (
+		dir     = fs.String("dir", "/var/lib/sporelet/cache", "Cache directory")
+		maxSize = fs.String("max-size", "0", "Evict unused snapshots until the cache is at most this large (prune)")
+	)
+	fs.Parse(args[1:])
+
+	c, err := cache.Open(*dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if args[0] == "prune" {
+		size, err := cache.ParseSize(*maxSize)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		evicted, err := c.Prune(size)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "prune failed: %v\n", err)
+			os.Exit(1)
+		}
+		for _, s := range evicted {
+			fmt.Println(s.Digest)
+		}
+		return
+	}
+
+	list, err := c.List()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DIGEST\tSIZE\tUSERS\tLAST USED\tREFS")
+	for _, s := range list {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", s.Digest, humanSize(s.Size), len(s.Users),
+			s.LastUsed.Format(time.RFC3339), strings.Join(s.Refs, ","))
+	}
+	w.Flush()
+}
+
+// humanSize formats a byte count with a binary unit.
+func humanSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	f, unit := float64(n)/1024, 0
+	for f >= 1024 && unit < 3 {
+		f /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f%c", f, "KMGT"[unit])
+}
+
+// progressBar renders the progress of a push or pull on a terminal line.
+type progressBar struct {
+	w     io.Writer
+	p     oci.Progress
+	drawn time.Time
+}
+
+// update records p and redraws the bar at most ten times a second.
+func (b *progressBar) update(p oci.Progress) {
+	b.p = p
+	if p.Done < p.Total && time.Since(b.drawn) < 100*time.Millisecond {
+		return
+	}
+	b.drawn = time.Now()
+	b.draw()
+}
+
+func (b *progressBar) draw() {
+	const width = 30
+	frac := 0.0
+	if b.p.Total > 0 {
+		frac = min(float64(b.p.Done)/float64(b.p.Total), 1)
+	}
+	n := int(frac * width)
+	fmt.Fprintf(b.w, "\r[%s%s] %3.0f%% %s / %s", strings.Repeat("=", n), strings.Repeat(" ", width-n), frac*100, humanSize(b.p.Done), humanSize(b.p.Total))
+}
+
+// finish draws the final state and ends the line, if anything was drawn.
+func (b *progressBar) finish() {
+	if b.drawn.IsZero() {
+		return
+	}
+	b.draw()
+	fmt.Fprintln(b.w)
+}
+
+// isTerminal reports whether f is a character device such as a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// keyProvider returns the option to encrypt or decrypt with a keyfile,
+// exiting if it cannot be read.
+func keyProvider(path string) oci.Option {
+	kp, err := oci.NewKeyfileProvider(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return oci.WithKeyProvider(kp)
+}
+
+func registryConfig(path string) oci.Option {
+	cfg, err := oci.LoadRegistryConfig(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return oci.WithRegistryConfig(cfg)
 }
 
 func diffCmd(args []string) {
@@ -172,6 +1102,11 @@ func runDiff(args []string) error {
 		prefix  = fs.String("snapshot-prefix", "snapshot", "Snapshot file prefix")
 		memMB   = fs.Int("mem", 1024, "Memory size (MB)")
 		vcpus   = fs.Int("vcpu", 1, "Number of vCPUs")
+		compose = fs.String("compose-file", "", "Compose file preheated in the guest, recorded in the provenance")
+		agent   = fs.String("guest-agent", "", "Guest agent binary installed in the rootfs, recorded in the provenance")
+		ranges  = fs.Int("max-ranges", 20, "Changed ranges to print per file")
+		asJSON  = fs.Bool("json", false, "Print the diff as JSON, with every changed range")
+		delta   = fs.Bool("delta", true, "Encode the memory as a delta against a pulled base, which push sends in place of the full memory file")
 	)
 	fs.Parse(args)
 
@@ -181,11 +1116,13 @@ func runDiff(args []string) error {
 	}
 
 	spec := fc.SnapshotSpec{
-		Kernel:    *kernel,
-		Rootfs:    *rootfs,
-		Cmdline:   *cmdline,
-		MemSizeMB: *memMB,
-		VCPUCount: *vcpus,
+		Kernel:      *kernel,
+		Rootfs:      *rootfs,
+		Cmdline:     *cmdline,
+		MemSizeMB:   *memMB,
+		VCPUCount:   *vcpus,
+		ComposeFile: *compose,
+		GuestAgent:  *agent,
 	}
 
 	if err := os.MkdirAll(*outDir, 0755); err != nil {
@@ -198,7 +1135,7 @@ func runDiff(args []string) error {
 	}
 
 	if *prefix != "snapshot" {
-		files := []string{"snapshot.mem", "snapshot.vmstate", "snapshot.config"}
+		files := []string{"snapshot.mem", "snapshot.vmstate", "snapshot.config", "snapshot.integrity", "snapshot.provenance"}
 		for _, f := range files {
 			old := filepath.Join(*outDir, f)
 			new := filepath.Join(*outDir, strings.Replace(f, "snapshot", *prefix, 1))
@@ -206,19 +1143,33 @@ func runDiff(args []string) error {
 		}
 	}
 
-	changes, err := compareSnapshotDirs(*baseDir, *outDir, *prefix)
+	diff, err := diffSnapshotDirs(*baseDir, *outDir, *prefix)
 	if err != nil {
 		return fmt.Errorf("diff failed: %w", err)
 	}
-
-	if len(changes) == 0 {
-		fmt.Println("no layer changes detected")
-		return nil
+	parent, err := recordParent(*baseDir, *outDir)
+	if err != nil {
+		return err
 	}
-	fmt.Println("changed files:")
-	for _, c := range changes {
-		fmt.Printf("  %s\n", c)
+	// a delta layer can only be pulled through its parent
+	var deltaLine string
+	if *delta && parent != "" {
+		st, err := fc.WriteMemoryDelta(*baseDir, *outDir, *prefix)
+		if err != nil {
+			return err
+		}
+		deltaLine = fmt.Sprintf("memory delta: %s, %s (%d of %d pages stored)\n", fc.MemoryDeltaPath(filepath.Join(*outDir, *prefix+".mem")),
+			humanSize(st.DeltaSize), st.XOR+st.Data, st.Pages)
 	}
-
+	if *asJSON {
+		return writeJSON(os.Stdout, diff)
+	}
+	if parent != "" {
+		fmt.Printf("parent: %s\n", parent)
+	}
+	if err := diff.WriteSummary(os.Stdout, *ranges); err != nil {
+		return err
+	}
+	fmt.Print(deltaLine)
 	return nil
 }
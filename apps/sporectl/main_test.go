@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"io"
 	"os"
 	"path/filepath"
@@ -9,6 +11,8 @@ import (
 	"testing"
 
 	fc "github.com/quinnovator/sporelet/packages/fc-snapshot-tools"
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/ksm"
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/oci"
 )
 
 func TestRunDiffMissingArgs(t *testing.T) {
@@ -59,3 +63,240 @@ func TestRunDiffDetectsChanges(t *testing.T) {
 }
 
 func contains(s, sub string) bool { return strings.Contains(s, sub) }
+
+func TestExportImportDirectory(t *testing.T) {
+	src := t.TempDir()
+	os.WriteFile(filepath.Join(src, "layer.mem"), []byte("memory"), 0644)
+	os.WriteFile(filepath.Join(src, "layer.vmstate"), []byte("vmstate"), 0644)
+	os.WriteFile(filepath.Join(src, "layer.config"), []byte(`{"machine-config":{"vcpu_count":1,"mem_size_mib":128}}`), 0644)
+
+	archive := filepath.Join(t.TempDir(), "snap.tar")
+	if err := runExport([]string{src, "-o", archive, "--snapshot-prefix", "layer", "--tag", "dev"}); err != nil {
+		t.Fatalf("runExport: %v", err)
+	}
+
+	layout := t.TempDir()
+	defer func(old *os.File) { os.Stdout = old }(os.Stdout)
+	os.Stdout, _ = os.Open(os.DevNull)
+	if err := runImport([]string{archive, "--oci-ref", oci.LayoutScheme + layout}); err != nil {
+		t.Fatalf("runImport: %v", err)
+	}
+
+	out := t.TempDir()
+	if err := oci.PullSnapshot(context.Background(), oci.LayoutScheme+layout+":dev", out); err != nil {
+		t.Fatalf("PullSnapshot from imported layout: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(out, "layer.mem")); string(data) != "memory" {
+		t.Fatalf("imported memory = %q", data)
+	}
+}
+
+func TestLsInspectLayout(t *testing.T) {
+	src := t.TempDir()
+	os.WriteFile(filepath.Join(src, "layer.mem"), []byte("memory"), 0644)
+	os.WriteFile(filepath.Join(src, "layer.vmstate"), []byte("vmstate"), 0644)
+	os.WriteFile(filepath.Join(src, "layer.config"), []byte(`{"machine-config":{"vcpu_count":1,"mem_size_mib":128}}`), 0644)
+	mem, vmstate, config := filepath.Join(src, "layer.mem"), filepath.Join(src, "layer.vmstate"), filepath.Join(src, "layer.config")
+
+	repo := oci.LayoutScheme + t.TempDir()
+	ctx := context.Background()
+	base, err := fc.PushSnapshot(ctx, repo+":base", mem, vmstate, config)
+	if err != nil {
+		t.Fatalf("PushSnapshot: %v", err)
+	}
+	md := oci.SnapshotMetadata{Layer: oci.Layer2, Parent: base}
+	app, err := fc.PushSnapshot(ctx, repo+":app", mem, vmstate, config, oci.WithMetadata(md))
+	if err != nil {
+		t.Fatalf("PushSnapshot: %v", err)
+	}
+	regs := filepath.Join(t.TempDir(), "registries.json")
+
+	var out strings.Builder
+	if err := runLs([]string{repo, "--json", "--registries-config", regs}, &out); err != nil {
+		t.Fatalf("runLs: %v", err)
+	}
+	var list []oci.SnapshotSummary
+	if err := json.Unmarshal([]byte(out.String()), &list); err != nil || len(list) != 2 {
+		t.Fatalf("ls --json = %s (%v)", out.String(), err)
+	}
+	if list[0].Tag != "app" || list[0].Digest != app || list[0].Layer != oci.Layer2 || list[1].Tag != "base" {
+		t.Fatalf("snapshots %+v", list)
+	}
+
+	out.Reset()
+	if err := runInspect([]string{repo + ":app", "--registries-config", regs}, &out); err != nil {
+		t.Fatalf("runInspect: %v", err)
+	}
+	for _, want := range []string{app, "layer.mem", oci.MediaTypeMemory, "Parents:", base} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("inspect output lacks %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestInspectProvenanceLayout(t *testing.T) {
+	src := t.TempDir()
+	mem := filepath.Join(src, "snapshot.mem")
+	os.WriteFile(mem, []byte("memory"), 0644)
+	os.WriteFile(filepath.Join(src, "snapshot.vmstate"), []byte("vmstate"), 0644)
+	os.WriteFile(filepath.Join(src, "snapshot.config"), []byte(`{"machine-config":{"vcpu_count":1,"mem_size_mib":128},"firecracker-version":"1.7.0"}`), 0644)
+	kernel := filepath.Join(src, "vmlinux")
+	os.WriteFile(kernel, []byte("kernel"), 0644)
+
+	p, err := fc.NewProvenance(fc.BuildInputs{Kernel: kernel, Parameters: map[string]any{"vcpuCount": 1}})
+	if err != nil {
+		t.Fatalf("NewProvenance: %v", err)
+	}
+	if err := fc.WriteProvenance(p, mem, filepath.Join(src, "snapshot.config")); err != nil {
+		t.Fatalf("WriteProvenance: %v", err)
+	}
+	ref := oci.LayoutScheme + t.TempDir() + ":layer1"
+	if _, err := fc.PushSnapshot(context.Background(), ref, mem, filepath.Join(src, "snapshot.vmstate"), filepath.Join(src, "snapshot.config")); err != nil {
+		t.Fatalf("PushSnapshot: %v", err)
+	}
+
+	regs := filepath.Join(t.TempDir(), "registries.json")
+	var out strings.Builder
+	if err := runInspect([]string{ref, "--provenance", "--registries-config", regs}, &out); err != nil {
+		t.Fatalf("runInspect: %v", err)
+	}
+	for _, want := range []string{fc.BuilderID, "firecracker", "1.7.0", "kernel", "file://" + kernel, "vcpuCount"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("provenance output lacks %q:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	if err := runInspect([]string{ref, "--provenance", "--json", "--registries-config", regs}, &out); err != nil {
+		t.Fatalf("runInspect: %v", err)
+	}
+	var statements []oci.Statement
+	if err := json.Unmarshal([]byte(out.String()), &statements); err != nil || len(statements) != 1 || statements[0].PredicateType != oci.PredicateTypeSLSAProvenance {
+		t.Errorf("inspect --provenance --json = %s (%v)", out.String(), err)
+	}
+}
+
+func TestDiffLineageLayout(t *testing.T) {
+	src := t.TempDir()
+	os.WriteFile(filepath.Join(src, "snapshot.mem"), []byte("memory"), 0644)
+	os.WriteFile(filepath.Join(src, "snapshot.vmstate"), []byte("vmstate"), 0644)
+	os.WriteFile(filepath.Join(src, "snapshot.config"), []byte(`{"machine-config":{"vcpu_count":1,"mem_size_mib":128}}`), 0644)
+	// deltas are only pushed on a parent whose integrity records its memory
+	if err := fc.WriteIntegrity(filepath.Join(src, "snapshot.mem"), filepath.Join(src, "snapshot.vmstate"), filepath.Join(src, "snapshot.config")); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := oci.LayoutScheme + t.TempDir()
+	ctx := context.Background()
+	base, err := fc.PushSnapshot(ctx, repo+":base", filepath.Join(src, "snapshot.mem"), filepath.Join(src, "snapshot.vmstate"), filepath.Join(src, "snapshot.config"))
+	if err != nil {
+		t.Fatalf("PushSnapshot: %v", err)
+	}
+	baseDir := t.TempDir()
+	if err := oci.PullSnapshot(ctx, repo+":base", baseDir); err != nil {
+		t.Fatalf("PullSnapshot: %v", err)
+	}
+
+	startAndSnapshot = func(ctx context.Context, spec fc.SnapshotSpec, dir string) error {
+		os.WriteFile(filepath.Join(dir, "snapshot.mem"), []byte("memory"), 0644)
+		os.WriteFile(filepath.Join(dir, "snapshot.vmstate"), []byte("new vmstate"), 0644)
+		os.WriteFile(filepath.Join(dir, "snapshot.config"), []byte(`{"machine-config":{"vcpu_count":1,"mem_size_mib":128}}`), 0644)
+		return nil
+	}
+	defer func() { startAndSnapshot = fc.StartAndSnapshot }()
+	out := t.TempDir()
+	if err := runDiff([]string{"--base-dir", baseDir, "--kernel", "k", "--rootfs", "r", "--out-dir", out}); err != nil {
+		t.Fatalf("runDiff: %v", err)
+	}
+
+	// the memory is pushed as a delta against the pulled base
+	memDelta, ok := fc.MemoryDelta(filepath.Join(out, "snapshot.mem"))
+	if !ok {
+		t.Fatal("expected diff to write a memory delta")
+	}
+	md := oci.WithMetadata(oci.SnapshotMetadata{Layer: oci.Layer2})
+	app, err := fc.PushSnapshot(ctx, repo+":app", memDelta, filepath.Join(out, "snapshot.vmstate"), filepath.Join(out, "snapshot.config"), md)
+	if err != nil {
+		t.Fatalf("PushSnapshot: %v", err)
+	}
+	pulled := t.TempDir()
+	if err := oci.PullSnapshot(ctx, repo+":app", pulled); err != nil {
+		t.Fatalf("PullSnapshot(app): %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(pulled, "snapshot.mem")); string(got) != "memory" {
+		t.Errorf("pulled memory %q", got)
+	}
+
+	var buf strings.Builder
+	if err := runLineage([]string{repo + ":base", "--registries-config", filepath.Join(t.TempDir(), "registries.json")}, &buf); err != nil {
+		t.Fatalf("runLineage: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], repo+"@"+base) || !strings.HasPrefix(lines[1], "  "+repo+"@"+app) {
+		t.Errorf("lineage output:\n%s", buf.String())
+	}
+
+	// a diff layer cannot be pushed under another parent
+	md = oci.WithMetadata(oci.SnapshotMetadata{Layer: oci.Layer2, Parent: app})
+	if _, err := fc.PushSnapshot(ctx, repo+":other", filepath.Join(out, "snapshot.mem"), filepath.Join(out, "snapshot.vmstate"), filepath.Join(out, "snapshot.config"), md); !errors.Is(err, oci.ErrParentMismatch) {
+		t.Errorf("push with another parent: %v, want ErrParentMismatch", err)
+	}
+}
+
+func TestAnalyzeMem(t *testing.T) {
+	page := func(b byte) []byte { return []byte(strings.Repeat(string(b), ksm.PageSize)) }
+	a, b := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(a, "snapshot.mem"), append(append(page('a'), page(0)...), page('b')...), 0644)
+	os.WriteFile(filepath.Join(b, "layer2.mem"), append(page('a'), page('c')...), 0644)
+
+	var buf strings.Builder
+	if err := runAnalyze([]string{"mem", a, "--clones", "10", filepath.Join(b, "layer2.mem")}, &buf); err != nil {
+		t.Fatalf("runAnalyze: %v", err)
+	}
+	for _, want := range []string{filepath.Join(a, "snapshot.mem"), "1 (33%)", "1 pages", "without KSM  160.0K", "with KSM     12.0K (92.5% saved)"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("output missing %q:\n%s", want, buf.String())
+		}
+	}
+
+	buf.Reset()
+	if err := runAnalyze([]string{"mem", a, b, "--json"}, &buf); err != nil {
+		t.Fatalf("runAnalyze: %v", err)
+	}
+	var r ksm.Report
+	if err := json.Unmarshal([]byte(buf.String()), &r); err != nil {
+		t.Fatalf("decode report: %v", err)
+	}
+	if len(r.Snapshots) != 2 || r.Clones != 100 || r.SharedPages != 1 || r.DistinctPages != 3 {
+		t.Errorf("report = %+v", r)
+	}
+
+	if err := runAnalyze([]string{"mem"}, io.Discard); err == nil {
+		t.Error("expected error without snapshots")
+	}
+	os.WriteFile(filepath.Join(b, "other.mem"), page('d'), 0644)
+	if err := runAnalyze([]string{"mem", b}, io.Discard); err == nil {
+		t.Error("expected error for a directory with two memory files")
+	}
+}
+
+func TestProgressBar(t *testing.T) {
+	var out strings.Builder
+	pb := &progressBar{w: &out}
+	pb.finish()
+	if out.Len() != 0 {
+		t.Fatalf("finish without progress drew %q", out.String())
+	}
+
+	pb.update(oci.Progress{Done: 0, Total: 4 << 20})
+	pb.update(oci.Progress{Done: 1 << 20, Total: 4 << 20}) // throttled
+	pb.update(oci.Progress{Done: 4 << 20, Total: 4 << 20})
+	pb.finish()
+	lines := strings.Split(out.String(), "\r")
+	if len(lines) != 4 {
+		t.Fatalf("expected 3 draws, got %q", out.String())
+	}
+	if want := "[==============================] 100% 4.0M / 4.0M\n"; lines[3] != want {
+		t.Fatalf("final draw %q, want %q", lines[3], want)
+	}
+}
@@ -1,7 +1,9 @@
 module github.com/quinnovator/sporelet/cmd/spore-shim
 
-go 1.21
+go 1.22
 
 require github.com/quinnovator/sporelet/packages/fc-snapshot-tools v0.0.0
 
+require github.com/klauspost/compress v1.18.0 // indirect
+
 replace github.com/quinnovator/sporelet/packages/fc-snapshot-tools => ../../packages/fc-snapshot-tools
@@ -2,13 +2,17 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 
 	fc "github.com/quinnovator/sporelet/packages/fc-snapshot-tools"
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/oci"
 )
 
 func main() {
@@ -77,7 +81,7 @@ func snapshotCmd(args []string) {
 	}
 
 	if *prefix != "snapshot" {
-		files := []string{"snapshot.mem", "snapshot.vmstate", "snapshot.config"}
+		files := []string{"snapshot.mem", "snapshot.vmstate", "snapshot.config", "snapshot.integrity", "snapshot.provenance"}
 		for _, f := range files {
 			old := filepath.Join(*outDir, f)
 			new := filepath.Join(*outDir, strings.Replace(f, "snapshot", *prefix, 1))
@@ -97,6 +101,8 @@ func diffCmd(args []string) {
 		prefix  = fs.String("snapshot-prefix", "snapshot", "Snapshot file prefix")
 		memMB   = fs.Int("mem", 1024, "Memory size (MB)")
 		vcpus   = fs.Int("vcpu", 1, "Number of vCPUs")
+		ranges  = fs.Int("max-ranges", 20, "Changed ranges to print per file")
+		asJSON  = fs.Bool("json", false, "Print the diff as JSON, with every changed range")
 	)
 	fs.Parse(args)
 
@@ -126,7 +132,7 @@ func diffCmd(args []string) {
 	}
 
 	if *prefix != "snapshot" {
-		files := []string{"snapshot.mem", "snapshot.vmstate", "snapshot.config"}
+		files := []string{"snapshot.mem", "snapshot.vmstate", "snapshot.config", "snapshot.integrity", "snapshot.provenance"}
 		for _, f := range files {
 			old := filepath.Join(*outDir, f)
 			new := filepath.Join(*outDir, strings.Replace(f, "snapshot", *prefix, 1))
@@ -134,19 +140,22 @@ func diffCmd(args []string) {
 		}
 	}
 
-	changes, err := fc.CompareSnapshotDirs(*baseDir, *outDir, *prefix)
+	diff, err := fc.DiffSnapshotDirs(*baseDir, *outDir, *prefix)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "diff failed: %v\n", err)
 		os.Exit(1)
 	}
 
-	if len(changes) == 0 {
-		fmt.Println("no layer changes detected")
-		return
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(diff)
+	} else {
+		err = diff.WriteSummary(os.Stdout, *ranges)
 	}
-	fmt.Println("changed files:")
-	for _, c := range changes {
-		fmt.Printf("  %s\n", c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 }
 
@@ -157,6 +166,16 @@ func restoreCmd(args []string) {
 		jailerBin = fs.String("jailer-bin", "jailer", "jailer binary")
 		socket    = fs.String("socket-path", "", "firecracker socket path")
 		id        = fs.String("id", "", "vm id")
+		rootfs    = fs.String("rootfs", "", "rootfs image to clone (default: from snapshot config)")
+		keep      = fs.Bool("keep-rootfs", false, "keep the per-VM rootfs clone after the VM exits")
+		lazy      = fs.Bool("lazy", false, "load guest memory on demand and keep serving it until the VM exits")
+		memRef    = fs.String("mem-ref", "", "OCI reference to load guest memory from lazily instead of snapshot.mem")
+		store     = fs.String("chunk-store", "", "directory caching chunks of chunked snapshots")
+		plain     = fs.Bool("plain-http", false, "talk to the registry over plain HTTP")
+		ws        = fs.String("working-set", "", "working set to prefetch (default: snapshot.workingset in the snapshot directory)")
+		record    = fs.String("record-working-set", "", "record the pages the guest touches to this file until the VM exits or the shim is interrupted")
+		verify    = fs.String("verify", "sampled", "check snapshot files against their integrity manifest: sampled, full or none")
+		keyfile   = fs.String("encryption-keyfile", "", "keyfile to decrypt an encrypted memory layer from --mem-ref with")
 	)
 	fs.Parse(args)
 
@@ -166,18 +185,50 @@ func restoreCmd(args []string) {
 		os.Exit(1)
 	}
 
+	mode, err := fc.ParseVerifyMode(*verify)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	dir := fs.Arg(0)
 	spec := fc.RestoreSpec{
-		MemFile:     filepath.Join(dir, "snapshot.mem"),
-		VMStateFile: filepath.Join(dir, "snapshot.vmstate"),
-		ConfigFile:  filepath.Join(dir, "snapshot.config"),
-		JailerBin:   *jailerBin,
-		FCBin:       *fcBin,
-		SocketPath:  *socket,
-		ID:          *id,
+		MemFile:          filepath.Join(dir, "snapshot.mem"),
+		VMStateFile:      filepath.Join(dir, "snapshot.vmstate"),
+		ConfigFile:       filepath.Join(dir, "snapshot.config"),
+		JailerBin:        *jailerBin,
+		FCBin:            *fcBin,
+		SocketPath:       *socket,
+		ID:               *id,
+		Rootfs:           *rootfs,
+		KeepRootfs:       *keep,
+		LazyMemory:       *lazy || *memRef != "",
+		WorkingSet:       *ws,
+		RecordWorkingSet: *record,
+		Verify:           mode,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *memRef != "" {
+		opts := []oci.Option{oci.WithChunkStore(*store), oci.WithPlainHTTP(*plain)}
+		if *keyfile != "" {
+			kp, err := oci.NewKeyfileProvider(*keyfile)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			opts = append(opts, oci.WithKeyProvider(kp))
+		}
+		mem, err := oci.OpenLayer(ctx, *memRef, oci.MediaTypeMemory, opts...)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		spec.MemSource = mem
 	}
 
-	if err := fc.Restore(context.Background(), spec); err != nil {
+	if err := fc.Restore(ctx, spec); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
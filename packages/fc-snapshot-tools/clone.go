@@ -0,0 +1,94 @@
+package fc
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/sparse"
+)
+
+// cloneFile creates dst as a copy-on-write clone of src. It first tries a
+// reflink (FICLONE) so that the clone shares extents with src, and falls back
+// to a sparse copy when the filesystem does not support reflinks.
+func cloneFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if err := sparse.Reflink(out, in); err != nil {
+		if err := sparse.Copy(out, in, info.Size()); err != nil {
+			out.Close()
+			os.Remove(dst)
+			return fmt.Errorf("failed to copy %s: %w", src, err)
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return nil
+}
+
+// linkRecordedPath makes the rootfs path recorded in a snapshot resolve to
+// clone while Firecracker loads the snapshot, which opens the drives at their
+// recorded paths before they can be overridden. Nothing is linked when
+// anything exists at the recorded path. Restores linking the same path take
+// turns through a lock file in the temporary directory, held until the
+// returned function removes the link once the snapshot is loaded and
+// Firecracker holds the clone open. The directory of the recorded path must
+// exist; it is not created.
+func linkRecordedPath(recorded, clone string) (func(), error) {
+	none := func() {}
+	if recorded == "" {
+		return none, nil
+	}
+	if _, err := os.Lstat(recorded); !errors.Is(err, os.ErrNotExist) {
+		return none, nil
+	}
+
+	sum := sha256.Sum256([]byte(recorded))
+	lockPath := filepath.Join(os.TempDir(), fmt.Sprintf("sporelet-rootfs-%x.lock", sum[:8]))
+	lock, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("failed to lock recorded rootfs %s: %w", recorded, err)
+	}
+
+	// another restore may have linked and unlinked it while we waited, or
+	// something else created it
+	if _, err := os.Lstat(recorded); !errors.Is(err, os.ErrNotExist) {
+		lock.Close()
+		return none, nil
+	}
+	if err := os.Symlink(clone, recorded); err != nil {
+		lock.Close()
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("cannot link recorded rootfs %s: directory %s does not exist on this host", recorded, filepath.Dir(recorded))
+		}
+		return nil, fmt.Errorf("failed to link recorded rootfs %s: %w", recorded, err)
+	}
+	return func() {
+		os.Remove(recorded)
+		lock.Close() // releases the lock
+	}, nil
+}
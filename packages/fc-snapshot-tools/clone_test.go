@@ -0,0 +1,76 @@
+package fc
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCloneFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "rootfs.ext4")
+	dst := filepath.Join(dir, "vm.rootfs")
+
+	// data, a 1 MiB hole, then more data
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("head"))
+	f.WriteAt([]byte("tail"), 1<<20+4)
+	f.Close()
+
+	if err := cloneFile(src, dst); err != nil {
+		t.Fatalf("cloneFile: %v", err)
+	}
+
+	want, _ := os.ReadFile(src)
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("clone content differs from source")
+	}
+
+	// writes to the clone must not reach the source
+	os.WriteFile(dst, []byte("changed"), 0644)
+	if again, _ := os.ReadFile(src); !bytes.Equal(again, want) {
+		t.Fatal("source modified through clone")
+	}
+
+	if err := cloneFile(src, dst); err == nil {
+		t.Fatal("expected error when clone already exists")
+	}
+}
+
+func TestSnapshotRootfs(t *testing.T) {
+	dir := t.TempDir()
+	cfg := filepath.Join(dir, "snapshot.config")
+	os.WriteFile(cfg, []byte(`{"rootfs":{"path_on_host":"/images/rootfs.ext4"}}`), 0644)
+
+	rootfs, err := snapshotRootfs(cfg)
+	if err != nil {
+		t.Fatalf("snapshotRootfs: %v", err)
+	}
+	if rootfs != "/images/rootfs.ext4" {
+		t.Fatalf("rootfs = %q", rootfs)
+	}
+}
+
+func TestRelocate(t *testing.T) {
+	dir := t.TempDir()
+	local := filepath.Join(dir, "rootfs.ext4")
+	os.WriteFile(local, []byte("fs"), 0644)
+
+	if got := relocate("/build/host/rootfs.ext4", dir); got != local {
+		t.Fatalf("relocate missing path = %q, want %q", got, local)
+	}
+	if got := relocate(local, t.TempDir()); got != local {
+		t.Fatalf("relocate existing path = %q, want %q", got, local)
+	}
+	if got := relocate("/build/host/other.ext4", dir); got != "/build/host/other.ext4" {
+		t.Fatalf("relocate unknown path = %q", got)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"syscall"
 
 	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools"
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/oci"
 )
 
 func main() {
@@ -31,6 +32,7 @@ func main() {
 		snapshotPrefix = flag.String("snapshot-prefix", "snapshot", "Prefix for snapshot files")
 		ociRef       = flag.String("oci-ref", "", "OCI reference for pushing snapshot")
 		push         = flag.Bool("push", false, "Push snapshot to OCI registry")
+		layer        = flag.Int("layer", oci.Layer1, "Snapshot layer level recorded when pushing (0, 1 or 2)")
 	)
 
 	// Define subcommands
@@ -61,13 +63,13 @@ func main() {
 	switch os.Args[1] {
 	case "snapshot":
 		snapshotCmd.Parse(os.Args[2:])
-		if err := runSnapshot(ctx, *kernelPath, *rootfsPath, *cmdline, *hostDev, *macAddr, *ipAddr, *netmask, *gateway, *memSize, *vcpuCount, *outDir, *snapshotPrefix, *ociRef, *push); err != nil {
+		if err := runSnapshot(ctx, *kernelPath, *rootfsPath, *cmdline, *hostDev, *macAddr, *ipAddr, *netmask, *gateway, *memSize, *vcpuCount, *outDir, *snapshotPrefix, *ociRef, *push, *layer); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
 	case "push":
 		pushCmd.Parse(os.Args[2:])
-		if err := runPush(ctx, *outDir, *snapshotPrefix, *ociRef); err != nil {
+		if err := runPush(ctx, *outDir, *snapshotPrefix, *ociRef, *layer); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
@@ -86,7 +88,7 @@ func printUsage() {
 	flag.PrintDefaults()
 }
 
-func runSnapshot(ctx context.Context, kernelPath, rootfsPath, cmdline, hostDev, macAddr, ipAddr, netmask, gateway string, memSize, vcpuCount int, outDir, snapshotPrefix, ociRef string, push bool) error {
+func runSnapshot(ctx context.Context, kernelPath, rootfsPath, cmdline, hostDev, macAddr, ipAddr, netmask, gateway string, memSize, vcpuCount int, outDir, snapshotPrefix, ociRef string, push bool, layer int) error {
 	// Validate required parameters
 	if kernelPath == "" {
 		return fmt.Errorf("kernel path is required")
@@ -124,7 +126,7 @@ func runSnapshot(ctx context.Context, kernelPath, rootfsPath, cmdline, hostDev,
 
 	// Rename snapshot files with the specified prefix
 	if snapshotPrefix != "snapshot" {
-		files := []string{"snapshot.mem", "snapshot.vmstate", "snapshot.config"}
+		files := []string{"snapshot.mem", "snapshot.vmstate", "snapshot.config", "snapshot.integrity", "snapshot.provenance"}
 		for _, file := range files {
 			oldPath := filepath.Join(outDir, file)
 			newPath := filepath.Join(outDir, strings.Replace(file, "snapshot", snapshotPrefix, 1))
@@ -138,13 +140,13 @@ func runSnapshot(ctx context.Context, kernelPath, rootfsPath, cmdline, hostDev,
 
 	// Push snapshot to OCI registry if requested
 	if push && ociRef != "" {
-		return runPush(ctx, outDir, snapshotPrefix, ociRef)
+		return runPush(ctx, outDir, snapshotPrefix, ociRef, layer)
 	}
 
 	return nil
 }
 
-func runPush(ctx context.Context, outDir, snapshotPrefix, ociRef string) error {
+func runPush(ctx context.Context, outDir, snapshotPrefix, ociRef string, layer int) error {
 	// Validate required parameters
 	if ociRef == "" {
 		return fmt.Errorf("OCI reference is required")
@@ -157,10 +159,12 @@ func runPush(ctx context.Context, outDir, snapshotPrefix, ociRef string) error {
 
 	// Push snapshot to OCI registry
 	fmt.Printf("Pushing snapshot to %s...\n", ociRef)
-	if err := fc.PushSnapshot(ctx, ociRef, memFile, vmstateFile, configFile); err != nil {
+	metadata := oci.WithMetadata(oci.SnapshotMetadata{Layer: layer})
+	digest, err := fc.PushSnapshot(ctx, ociRef, memFile, vmstateFile, configFile, metadata)
+	if err != nil {
 		return fmt.Errorf("failed to push snapshot: %w", err)
 	}
 
-	fmt.Printf("Snapshot pushed to %s\n", ociRef)
+	fmt.Printf("Snapshot pushed to %s@%s\n", ociRef, digest)
 	return nil
 }
@@ -0,0 +1,54 @@
+package fc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/delta"
+)
+
+// MemoryDeltaPath returns where the memory delta of the snapshot with the
+// given memory file is stored: next to it, with a .delta extension.
+func MemoryDeltaPath(memFile string) string {
+	return memFile + ".delta"
+}
+
+// WriteMemoryDelta encodes the memory file of the snapshot with the given
+// prefix in newDir against the one in baseDir and writes the delta to
+// MemoryDeltaPath of it. PushSnapshot of the delta pushes a memory delta
+// layer, which pulls rebuild from the memory of the parent snapshot.
+func WriteMemoryDelta(baseDir, newDir, prefix string) (delta.Stats, error) {
+	mem := filepath.Join(newDir, prefix+".mem")
+	st, err := delta.Encode(filepath.Join(baseDir, prefix+".mem"), mem, MemoryDeltaPath(mem))
+	if err != nil {
+		return st, fmt.Errorf("failed to encode memory delta: %w", err)
+	}
+	return st, nil
+}
+
+// MemoryDelta returns the memory delta next to memFile if there is one
+// written after the memory file, and so encoded from it.
+func MemoryDelta(memFile string) (string, bool) {
+	path := MemoryDeltaPath(memFile)
+	di, err := os.Stat(path)
+	if err != nil {
+		return "", false
+	}
+	mi, err := os.Stat(memFile)
+	if err != nil || di.ModTime().Before(mi.ModTime()) {
+		return "", false
+	}
+	h, err := delta.ReadHeader(path)
+	if err != nil || h.Size != mi.Size() {
+		return "", false
+	}
+	return path, true
+}
+
+// memoryFileOf returns the memory file memFile stands for: the file a memory
+// delta rebuilds, or memFile itself.
+func memoryFileOf(memFile string) string {
+	return strings.TrimSuffix(memFile, ".delta")
+}
@@ -0,0 +1,41 @@
+package fc
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/delta"
+)
+
+func TestWriteMemoryDelta(t *testing.T) {
+	base, next := t.TempDir(), t.TempDir()
+	memory := bytes.Repeat([]byte{1}, 8*delta.PageSize)
+	os.WriteFile(filepath.Join(base, "layer.mem"), memory, 0644)
+	memory[3*delta.PageSize] = 2
+	mem := filepath.Join(next, "layer.mem")
+	os.WriteFile(mem, memory, 0644)
+
+	st, err := WriteMemoryDelta(base, next, "layer")
+	if err != nil {
+		t.Fatalf("WriteMemoryDelta: %v", err)
+	}
+	if st.Pages != 8 || st.Unchanged != 7 {
+		t.Errorf("stats = %+v", st)
+	}
+	if path, ok := MemoryDelta(mem); !ok || path != MemoryDeltaPath(mem) {
+		t.Errorf("MemoryDelta = %q, %v", path, ok)
+	}
+
+	// a memory file written after the delta was not encoded in it
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(mem, later, later)
+	if _, ok := MemoryDelta(mem); ok {
+		t.Error("expected a stale delta to be ignored")
+	}
+	if _, ok := MemoryDelta(filepath.Join(base, "layer.mem")); ok {
+		t.Error("expected no delta next to the base")
+	}
+}
@@ -0,0 +1,440 @@
+package fc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/sparse"
+)
+
+// DiffBlockSize is the granularity at which snapshot files are compared: a
+// guest page for memory files and a filesystem block for the rootfs.
+const DiffBlockSize = sparse.PageSize
+
+// Kinds of snapshot files in a SnapshotDiff.
+const (
+	FileMemory  = "memory"
+	FileVMState = "vmstate"
+	FileConfig  = "config"
+	FileRootfs  = "rootfs"
+)
+
+// SnapshotDiff describes what a snapshot changes compared to its base.
+type SnapshotDiff struct {
+	// Files are the memory, vmstate, config and, when both snapshots record
+	// one that exists, rootfs files
+	Files []FileDiff `json:"files"`
+	// Config lists the settings that differ between the snapshot configs
+	Config []ConfigChange `json:"config,omitempty"`
+	// ChangedBytes is the size of the changed blocks of all files, what the
+	// snapshot adds on top of its base
+	ChangedBytes int64 `json:"changedBytes"`
+	// DifferingBytes is the number of bytes that actually differ within them
+	DifferingBytes int64 `json:"differingBytes"`
+}
+
+// FileDiff is the block-level comparison of a snapshot file with its base.
+// The shorter of the two is compared as if padded with zeros.
+type FileDiff struct {
+	Name          string `json:"name"`
+	Kind          string `json:"kind"`
+	BlockSize     int64  `json:"blockSize"`
+	BaseSize      int64  `json:"baseSize"`
+	Size          int64  `json:"size"`
+	Blocks        int64  `json:"blocks"` // blocks of the larger file
+	ChangedBlocks int64  `json:"changedBlocks"`
+	// DifferingBytes is the number of bytes that differ in the changed blocks
+	DifferingBytes int64 `json:"differingBytes"`
+	// Ranges are the runs of consecutive changed blocks
+	Ranges []ChangedRange `json:"ranges,omitempty"`
+}
+
+// ChangedRange is a run of changed blocks of a file.
+type ChangedRange struct {
+	Offset         int64 `json:"offset"`
+	Length         int64 `json:"length"`
+	DifferingBytes int64 `json:"differingBytes"`
+}
+
+// ConfigChange is a setting that differs between two snapshot configs. Path
+// names it with dots between object keys and brackets around array indexes,
+// such as machine-config.mem_size_mib or drives[0].path_on_host. Old is
+// missing for added settings and New for removed ones.
+type ConfigChange struct {
+	Path string          `json:"path"`
+	Old  json.RawMessage `json:"old,omitempty"`
+	New  json.RawMessage `json:"new,omitempty"`
+}
+
+// Changed reports whether any block of the file differs from its base.
+func (d FileDiff) Changed() bool {
+	return d.ChangedBlocks > 0
+}
+
+// ChangedBytes returns the size of the changed blocks.
+func (d FileDiff) ChangedBytes() int64 {
+	var n int64
+	for _, r := range d.Ranges {
+		n += r.Length
+	}
+	return n
+}
+
+// Changed returns the names of the files that differ from their base.
+func (d *SnapshotDiff) Changed() []string {
+	var out []string
+	for _, f := range d.Files {
+		if f.Changed() {
+			out = append(out, f.Name)
+		}
+	}
+	return out
+}
+
+// DiffSnapshotDirs compares the snapshot with the given file prefix in newDir
+// against the one in baseDir, block by block, and the settings in their
+// configs. The rootfs images the configs record are compared as well when
+// both exist and are not the same file. Configs that are not JSON are only
+// compared block by block.
+func DiffSnapshotDirs(baseDir, newDir, prefix string) (*SnapshotDiff, error) {
+	d := &SnapshotDiff{}
+	for _, f := range []struct{ ext, kind string }{
+		{".mem", FileMemory},
+		{".vmstate", FileVMState},
+		{".config", FileConfig},
+	} {
+		name := prefix + f.ext
+		fd, err := DiffFiles(filepath.Join(baseDir, name), filepath.Join(newDir, name), DiffBlockSize)
+		if err != nil {
+			return nil, err
+		}
+		fd.Name, fd.Kind = name, f.kind
+		d.Files = append(d.Files, fd)
+	}
+
+	baseConfig := filepath.Join(baseDir, prefix+".config")
+	newConfig := filepath.Join(newDir, prefix+".config")
+	if changes, err := diffConfigFiles(baseConfig, newConfig); err == nil {
+		d.Config = changes
+	}
+
+	baseRootfs, newRootfs := configRootfs(baseConfig, baseDir), configRootfs(newConfig, newDir)
+	if baseRootfs != "" && newRootfs != "" {
+		bi, berr := os.Stat(baseRootfs)
+		ni, nerr := os.Stat(newRootfs)
+		if berr == nil && nerr == nil && !os.SameFile(bi, ni) {
+			fd, err := DiffFiles(baseRootfs, newRootfs, DiffBlockSize)
+			if err != nil {
+				return nil, err
+			}
+			fd.Name, fd.Kind = filepath.Base(newRootfs), FileRootfs
+			d.Files = append(d.Files, fd)
+		}
+	}
+
+	for _, f := range d.Files {
+		d.ChangedBytes += f.ChangedBytes()
+		d.DifferingBytes += f.DifferingBytes
+	}
+	return d, nil
+}
+
+// CompareSnapshotDirs compares snapshot files in baseDir and newDir using the
+// provided snapshot prefix. It returns a slice of file names that differ.
+// DiffSnapshotDirs tells what differs.
+func CompareSnapshotDirs(baseDir, newDir, prefix string) ([]string, error) {
+	d, err := DiffSnapshotDirs(baseDir, newDir, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return d.Changed(), nil
+}
+
+// DiffFiles compares the file at newPath against the one at basePath in
+// blocks of blockSize bytes and returns the runs of blocks that differ.
+// Holes are compared as zeros without being read.
+func DiffFiles(basePath, newPath string, blockSize int64) (FileDiff, error) {
+	d := FileDiff{Name: filepath.Base(newPath), BlockSize: blockSize}
+	if blockSize <= 0 {
+		return d, fmt.Errorf("invalid block size %d", blockSize)
+	}
+	base, baseSize, err := openSparse(basePath)
+	if err != nil {
+		return d, err
+	}
+	defer base.Close()
+	next, size, err := openSparse(newPath)
+	if err != nil {
+		return d, err
+	}
+	defer next.Close()
+	d.BaseSize, d.Size = baseSize, size
+	total := max(baseSize, size)
+	d.Blocks = (total + blockSize - 1) / blockSize
+
+	bufSize := max(1, (1<<20)/blockSize) * blockSize
+	bbuf, nbuf := make([]byte, bufSize), make([]byte, bufSize)
+	var run *ChangedRange
+	for off := int64(0); off < total; off += bufSize {
+		n := min(bufSize, total-off)
+		if err := readPadded(base, bbuf[:n]); err != nil {
+			return d, fmt.Errorf("failed to read %s: %w", basePath, err)
+		}
+		if err := readPadded(next, nbuf[:n]); err != nil {
+			return d, fmt.Errorf("failed to read %s: %w", newPath, err)
+		}
+		for b := int64(0); b < n; b += blockSize {
+			end := min(b+blockSize, n)
+			if bytes.Equal(bbuf[b:end], nbuf[b:end]) {
+				run = nil
+				continue
+			}
+			differing := differingBytes(bbuf[b:end], nbuf[b:end])
+			d.ChangedBlocks++
+			d.DifferingBytes += differing
+			if run == nil {
+				d.Ranges = append(d.Ranges, ChangedRange{Offset: off + b})
+				run = &d.Ranges[len(d.Ranges)-1]
+			}
+			run.Length += end - b
+			run.DifferingBytes += differing
+		}
+	}
+	return d, nil
+}
+
+// DiffConfig compares two snapshot configs setting by setting and returns the
+// changes ordered by path.
+func DiffConfig(base, next []byte) ([]ConfigChange, error) {
+	var a, b any
+	if err := json.Unmarshal(base, &a); err != nil {
+		return nil, fmt.Errorf("failed to parse base config: %w", err)
+	}
+	if err := json.Unmarshal(next, &b); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	var changes []ConfigChange
+	diffJSON("", a, b, true, true, &changes)
+	return changes, nil
+}
+
+// WriteSummary prints the diff for people: the changed ranges of each file,
+// at most maxRanges of them per file, the changed config settings and the
+// total size of the changes.
+func (d *SnapshotDiff) WriteSummary(w io.Writer, maxRanges int) error {
+	var buf bytes.Buffer
+	for _, f := range d.Files {
+		unit := "blocks"
+		if f.Kind == FileMemory {
+			unit = "pages"
+		}
+		if !f.Changed() {
+			fmt.Fprintf(&buf, "%s: unchanged\n", f.Name)
+		} else {
+			fmt.Fprintf(&buf, "%s: %d of %d %s changed, %s (%s differing)\n", f.Name, f.ChangedBlocks, f.Blocks, unit,
+				formatSize(f.ChangedBytes()), formatSize(f.DifferingBytes))
+		}
+		if f.Size != f.BaseSize {
+			fmt.Fprintf(&buf, "  size %s -> %s\n", formatSize(f.BaseSize), formatSize(f.Size))
+		}
+		ranges := f.Ranges
+		if f.Kind == FileConfig && len(d.Config) > 0 {
+			// the settings tell more than the bytes
+			ranges = nil
+		}
+		for i, r := range ranges {
+			if i == maxRanges {
+				fmt.Fprintf(&buf, "  ... %d more ranges\n", len(ranges)-i)
+				break
+			}
+			fmt.Fprintf(&buf, "  0x%08x-0x%08x  %d %s, %s differing\n", r.Offset, r.Offset+r.Length,
+				(r.Length+f.BlockSize-1)/f.BlockSize, unit, formatSize(r.DifferingBytes))
+		}
+		if f.Kind == FileConfig {
+			for _, c := range d.Config {
+				path := c.Path
+				if path == "" {
+					path = "(config)"
+				}
+				switch {
+				case c.Old == nil:
+					fmt.Fprintf(&buf, "  + %s: %s\n", path, c.New)
+				case c.New == nil:
+					fmt.Fprintf(&buf, "  - %s: %s\n", path, c.Old)
+				default:
+					fmt.Fprintf(&buf, "  ~ %s: %s -> %s\n", path, c.Old, c.New)
+				}
+			}
+		}
+	}
+	changed := d.Changed()
+	if len(changed) == 0 {
+		fmt.Fprintln(&buf, "no layer changes detected")
+	} else {
+		fmt.Fprintf(&buf, "%d of %d files changed: %s in changed blocks, %s differing\n", len(changed), len(d.Files),
+			formatSize(d.ChangedBytes), formatSize(d.DifferingBytes))
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// diffConfigFiles compares the snapshot configs at the given paths.
+func diffConfigFiles(basePath, newPath string) ([]ConfigChange, error) {
+	base, err := os.ReadFile(basePath)
+	if err != nil {
+		return nil, err
+	}
+	next, err := os.ReadFile(newPath)
+	if err != nil {
+		return nil, err
+	}
+	return DiffConfig(base, next)
+}
+
+// configRootfs returns the rootfs the snapshot config at path records,
+// relocated next to the snapshot files in dir, or an empty string if it
+// records none.
+func configRootfs(path, dir string) string {
+	rootfs, err := snapshotRootfs(path)
+	if err != nil || rootfs == "" {
+		return ""
+	}
+	return relocate(rootfs, dir)
+}
+
+// diffJSON appends the differences between the JSON values a and b at path
+// to changes. inA and inB report whether the values are present at all.
+func diffJSON(path string, a, b any, inA, inB bool, changes *[]ConfigChange) {
+	am, aObj := a.(map[string]any)
+	bm, bObj := b.(map[string]any)
+	if inA && inB && aObj && bObj {
+		keys := map[string]bool{}
+		for k := range am {
+			keys[k] = true
+		}
+		for k := range bm {
+			keys[k] = true
+		}
+		for _, k := range sortedSet(keys) {
+			av, ina := am[k]
+			bv, inb := bm[k]
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			diffJSON(p, av, bv, ina, inb, changes)
+		}
+		return
+	}
+	as, aArr := a.([]any)
+	bs, bArr := b.([]any)
+	if inA && inB && aArr && bArr {
+		for i := 0; i < max(len(as), len(bs)); i++ {
+			var av, bv any
+			if i < len(as) {
+				av = as[i]
+			}
+			if i < len(bs) {
+				bv = bs[i]
+			}
+			diffJSON(fmt.Sprintf("%s[%d]", path, i), av, bv, i < len(as), i < len(bs), changes)
+		}
+		return
+	}
+	if inA && inB && reflect.DeepEqual(a, b) {
+		return
+	}
+	c := ConfigChange{Path: path}
+	if inA {
+		c.Old, _ = json.Marshal(a)
+	}
+	if inB {
+		c.New, _ = json.Marshal(b)
+	}
+	*changes = append(*changes, c)
+}
+
+// sortedSet returns the members of a set of strings in order.
+func sortedSet(set map[string]bool) []string {
+	out := make([]string, 0, len(set))
+	for k := range set {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// sparseFile reads a file with its holes as zeros.
+type sparseFile struct {
+	r io.Reader
+	f *os.File
+}
+
+// openSparse opens the file at path for reading with holes as zeros and
+// returns it with its size.
+func openSparse(path string) (*sparseFile, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	r, err := sparse.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("failed to find data in %s: %w", path, err)
+	}
+	return &sparseFile{r: r, f: f}, info.Size(), nil
+}
+
+func (f *sparseFile) Read(p []byte) (int, error) {
+	return f.r.Read(p)
+}
+
+func (f *sparseFile) Close() error {
+	return f.f.Close()
+}
+
+// readPadded fills b from r, with zeros past the end of r.
+func readPadded(r io.Reader, b []byte) error {
+	n, err := io.ReadFull(r, b)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		clear(b[n:])
+		return nil
+	}
+	return err
+}
+
+// differingBytes returns the number of positions at which a and b differ.
+func differingBytes(a, b []byte) int64 {
+	var n int64
+	for i := range a {
+		if a[i] != b[i] {
+			n++
+		}
+	}
+	return n
+}
+
+// formatSize formats a byte count with a binary unit.
+func formatSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	f, unit := float64(n)/1024, 0
+	for f >= 1024 && unit < 3 {
+		f /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f%c", f, "KMGT"[unit])
+}
@@ -0,0 +1,128 @@
+package fc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeDiffSnapshot writes snapshot files with the given memory, config and
+// rootfs content to dir. The config records the rootfs by its build path,
+// which the diff relocates next to the snapshot files.
+func writeDiffSnapshot(t *testing.T, dir string, mem, rootfs []byte, memMiB int) {
+	t.Helper()
+	cfg := fmt.Sprintf(`{"firecracker-version":"1.7.0","machine-config":{"vcpu_count":1,"mem_size_mib":%d},`+
+		`"rootfs":{"path_on_host":"/build/rootfs.ext4"}}`, memMiB)
+	for name, data := range map[string][]byte{
+		"snapshot.mem":     mem,
+		"snapshot.vmstate": []byte("vmstate"),
+		"snapshot.config":  []byte(cfg),
+		"rootfs.ext4":      rootfs,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDiffSnapshotDirs(t *testing.T) {
+	mem := make([]byte, 8*DiffBlockSize)
+	for i := range mem[2*DiffBlockSize : 3*DiffBlockSize] {
+		mem[2*DiffBlockSize+i] = 1
+	}
+	rootfs := bytes.Repeat([]byte{7}, 4*DiffBlockSize)
+	base, next := t.TempDir(), t.TempDir()
+	writeDiffSnapshot(t, base, mem, rootfs, 128)
+
+	// pages 2 to 4 and 6 change, page 2 in a single byte; the rootfs grows
+	// by a block
+	changed := bytes.Clone(mem)
+	changed[2*DiffBlockSize+10] = 2
+	for i := 3 * DiffBlockSize; i < 5*DiffBlockSize; i++ {
+		changed[i] = 3
+	}
+	changed[6*DiffBlockSize] = 4
+	writeDiffSnapshot(t, next, changed, append(bytes.Clone(rootfs), bytes.Repeat([]byte{8}, DiffBlockSize)...), 256)
+
+	d, err := DiffSnapshotDirs(base, next, "snapshot")
+	if err != nil {
+		t.Fatalf("DiffSnapshotDirs: %v", err)
+	}
+	if want := []string{"snapshot.mem", "snapshot.config", "rootfs.ext4"}; !reflect.DeepEqual(d.Changed(), want) {
+		t.Errorf("changed = %v, want %v", d.Changed(), want)
+	}
+
+	m := d.Files[0]
+	if m.Kind != FileMemory || m.Blocks != 8 || m.ChangedBlocks != 4 || m.DifferingBytes != 1+2*DiffBlockSize+1 {
+		t.Errorf("memory diff = %+v", m)
+	}
+	want := []ChangedRange{
+		{Offset: 2 * DiffBlockSize, Length: 3 * DiffBlockSize, DifferingBytes: 1 + 2*DiffBlockSize},
+		{Offset: 6 * DiffBlockSize, Length: DiffBlockSize, DifferingBytes: 1},
+	}
+	if !reflect.DeepEqual(m.Ranges, want) {
+		t.Errorf("memory ranges = %+v, want %+v", m.Ranges, want)
+	}
+
+	r := d.Files[3]
+	if r.Kind != FileRootfs || r.BaseSize != 4*DiffBlockSize || r.Size != 5*DiffBlockSize || r.ChangedBlocks != 1 {
+		t.Errorf("rootfs diff = %+v", r)
+	}
+	if len(d.Config) != 1 || d.Config[0].Path != "machine-config.mem_size_mib" ||
+		string(d.Config[0].Old) != "128" || string(d.Config[0].New) != "256" {
+		t.Errorf("config changes = %+v", d.Config)
+	}
+	if d.ChangedBytes != 5*DiffBlockSize+d.Files[2].ChangedBytes() {
+		t.Errorf("changed bytes = %d", d.ChangedBytes)
+	}
+
+	var out strings.Builder
+	if err := d.WriteSummary(&out, 1); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"snapshot.mem: 4 of 8 pages changed, 16.0K",
+		"0x00002000-0x00005000  3 pages",
+		"... 1 more ranges",
+		"snapshot.vmstate: unchanged",
+		"~ machine-config.mem_size_mib: 128 -> 256",
+		"size 16.0K -> 20.0K",
+		"3 of 4 files changed",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("summary missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestDiffConfig(t *testing.T) {
+	changes, err := DiffConfig(
+		[]byte(`{"a":1,"drives":[{"id":"rootfs"}],"gone":true}`),
+		[]byte(`{"a":1,"drives":[{"id":"rootfs"},{"id":"data"}],"new":"x"}`),
+	)
+	if err != nil {
+		t.Fatalf("DiffConfig: %v", err)
+	}
+	want := []ConfigChange{
+		{Path: "drives[1]", New: json.RawMessage(`{"id":"data"}`)},
+		{Path: "gone", Old: json.RawMessage(`true`)},
+		{Path: "new", New: json.RawMessage(`"x"`)},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes = %+v, want %+v", changes, want)
+	}
+	if _, err := DiffConfig([]byte("{}"), []byte("not json")); err == nil {
+		t.Error("expected error for invalid config")
+	}
+}
+
+func TestCompareSnapshotDirsMissingFile(t *testing.T) {
+	if _, err := CompareSnapshotDirs(t.TempDir(), t.TempDir(), "snapshot"); err == nil {
+		t.Error("expected error for missing snapshot files")
+	}
+}
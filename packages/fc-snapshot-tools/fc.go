@@ -4,15 +4,22 @@ package fc
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/firecracker"
 	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/oci"
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/sparse"
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/uffd"
 )
 
 // NetConfig defines the network configuration for a Firecracker VM
@@ -36,11 +43,24 @@ type SnapshotSpec struct {
 	FCBin      string    // Path to the firecracker binary (default: "firecracker")
 	SocketPath string    // Path to the Firecracker socket (default: auto-generated)
 	ID         string    // VM ID (default: auto-generated)
+	// CPUTemplate is the Firecracker CPU template to run the VM with. It
+	// becomes the platform variant of the snapshot in an image index.
+	CPUTemplate string
+	// KeepZeroPages leaves the zero pages of the memory file allocated
+	// instead of punching them out
+	KeepZeroPages bool
+	ComposeFile   string // Compose file preheated in the guest, recorded in the provenance
+	GuestAgent    string // Guest agent binary in the rootfs, recorded in the provenance
 }
 
 // StartAndSnapshot launches a Firecracker VM with the given configuration,
 // waits for it to be ready, and then creates a snapshot.
 // The snapshot files (.mem, .vmstate, .config) are written to the outDir.
+// Zero pages of the memory file are punched out so that it only takes up
+// disk space for the memory the guest actually uses, and an integrity
+// manifest of the files is written next to them for Restore to verify. The
+// provenance of the build, with the digests of its inputs and the tool
+// versions, is written next to them too, see WriteProvenance.
 func StartAndSnapshot(ctx context.Context, s SnapshotSpec, outDir string) error {
 	// Set defaults
 	if s.MemSizeMB == 0 {
@@ -56,7 +76,31 @@ func StartAndSnapshot(ctx context.Context, s SnapshotSpec, outDir string) error
 		s.FCBin = "firecracker"
 	}
 	if s.ID == "" {
-		s.ID = fmt.Sprintf("sporelet-%d", time.Now().Unix())
+		id, err := defaultID()
+		if err != nil {
+			return err
+		}
+		s.ID = id
+	}
+
+	// the inputs are digested before the VM boots and writes to the rootfs
+	provenance, err := NewProvenance(BuildInputs{
+		Kernel:       s.Kernel,
+		Rootfs:       s.Rootfs,
+		ComposeFile:  s.ComposeFile,
+		GuestAgent:   s.GuestAgent,
+		FCBin:        s.FCBin,
+		JailerBin:    s.JailerBin,
+		InvocationID: s.ID,
+		Parameters: map[string]any{
+			"cmdline":     s.Cmdline,
+			"memSizeMib":  s.MemSizeMB,
+			"vcpuCount":   s.VCPUCount,
+			"cpuTemplate": s.CPUTemplate,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record build inputs: %w", err)
 	}
 
 	// Create output directory if it doesn't exist
@@ -78,9 +122,10 @@ func StartAndSnapshot(ctx context.Context, s SnapshotSpec, outDir string) error
 			IsReadOnly:   false,
 			IsRootDevice: true,
 		},
-		KernelArgs: s.Cmdline,
-		MemSizeMB:  s.MemSizeMB,
-		VCPUCount:  s.VCPUCount,
+		KernelArgs:  s.Cmdline,
+		MemSizeMB:   s.MemSizeMB,
+		VCPUCount:   s.VCPUCount,
+		CPUTemplate: s.CPUTemplate,
 		NetworkInterfaces: []firecracker.NetworkInterface{
 			{
 				HostDevName: s.Net.HostDevName,
@@ -112,33 +157,108 @@ func StartAndSnapshot(ctx context.Context, s SnapshotSpec, outDir string) error
 		return fmt.Errorf("failed to create snapshot: %w", err)
 	}
 
+	if !s.KeepZeroPages {
+		if _, err := sparse.PunchZeroPages(snapshotConfig.MemFilePath); err != nil && !errors.Is(err, errors.ErrUnsupported) {
+			return fmt.Errorf("failed to punch zero pages: %w", err)
+		}
+	}
+
+	if err := WriteIntegrity(snapshotConfig.MemFilePath, snapshotConfig.VMStateFilePath, snapshotConfig.ConfigFilePath); err != nil {
+		return fmt.Errorf("failed to write integrity manifest: %w", err)
+	}
+
+	if err := WriteProvenance(provenance, snapshotConfig.MemFilePath, snapshotConfig.ConfigFilePath); err != nil {
+		return err
+	}
+
 	return nil
 }
 
-// PushSnapshot pushes a snapshot to an OCI registry
-func PushSnapshot(ctx context.Context, ociRef, memFile, vmstateFile, configFile string) error {
+// PushSnapshot pushes a snapshot to an OCI registry and returns the digest of
+// the pushed manifest. Options such as oci.WithRootfs bundle additional files
+// into the artifact. The integrity manifest of the snapshot is bundled if it
+// exists, the provenance written by StartAndSnapshot is attached to it, and
+// the snapshot a diff layer was taken against, recorded by RecordParent,
+// becomes its parent. memFile may be a memory delta written by
+// WriteMemoryDelta, which is pushed in place of the memory file.
+func PushSnapshot(ctx context.Context, ociRef, memFile, vmstateFile, configFile string, opts ...oci.Option) (string, error) {
 	// Check if files exist
 	for _, file := range []string{memFile, vmstateFile, configFile} {
 		if _, err := os.Stat(file); err != nil {
-			return fmt.Errorf("snapshot file not found: %s: %w", file, err)
+			return "", fmt.Errorf("snapshot file not found: %s: %w", file, err)
 		}
 	}
 
+	if path := IntegrityPath(memoryFileOf(memFile)); fileExists(path) {
+		opts = append([]oci.Option{oci.WithIntegrity(path)}, opts...)
+	}
+	if path := ProvenancePath(memoryFileOf(memFile)); fileExists(path) {
+		opts = append([]oci.Option{oci.WithProvenance(path)}, opts...)
+	}
+	if data, err := os.ReadFile(filepath.Join(filepath.Dir(memFile), oci.ParentRefFile)); err == nil {
+		opts = append([]oci.Option{oci.WithParent(strings.TrimSpace(string(data)))}, opts...)
+	}
+
 	// Push to OCI registry
-	return oci.PushSnapshot(ctx, ociRef, memFile, vmstateFile, configFile)
+	return oci.PushSnapshot(ctx, ociRef, memFile, vmstateFile, configFile, opts...)
 }
 
 // RestoreSpec defines the configuration for restoring a VM from a snapshot
 // directory. MemFile, VMStateFile and ConfigFile must point to the snapshot
 // files produced by StartAndSnapshot.
+//
+// Every restored VM gets its own copy-on-write clone of the snapshot rootfs so
+// that clones of the same snapshot never write to a shared disk image. When
+// the rootfs recorded in the snapshot does not exist on this host, a file with
+// the same name in the snapshot directory is used instead, which is where
+// PullSnapshot places a bundled rootfs. Firecracker opens the recorded path
+// while loading the snapshot, so until the load is done that path is a
+// symlink to the clone; its directory must exist on this host.
+//
+// With LazyMemory, guest memory is loaded on demand through userfaultfd
+// instead of being read from MemFile up front, and pages that have not
+// faulted yet are prefetched in the background. Pages are served by the
+// calling process, so Restore only returns once Firecracker exits or ctx is
+// cancelled.
+//
+// A working set recorded with RecordWorkingSet lists the pages the guest
+// touched first after resuming. Restores given that working set prefetch
+// those pages ahead of execution: copied in through userfaultfd with
+// LazyMemory, or read into the page cache before the snapshot is loaded
+// otherwise.
+//
+// When the snapshot has an integrity manifest, written by StartAndSnapshot,
+// the files are checked against it before anything is loaded, and Restore
+// fails with an error wrapping ErrIntegrity if they do not match. Memory
+// served from MemSource is checked as it is read instead, every manifest
+// block before any of it reaches the guest.
 type RestoreSpec struct {
 	MemFile     string
 	VMStateFile string
 	ConfigFile  string
-	JailerBin   string // Path to jailer binary (default "jailer")
-	FCBin       string // Path to firecracker binary (default "firecracker")
-	SocketPath  string // Optional socket path
-	ID          string // Optional VM ID
+	JailerBin   string      // Path to jailer binary (default "jailer")
+	FCBin       string      // Path to firecracker binary (default "firecracker")
+	SocketPath  string      // Optional socket path
+	ID          string      // Optional VM ID
+	Rootfs      string      // Rootfs image to clone (default: the one recorded in ConfigFile)
+	CloneDir    string      // Directory for the rootfs clone and uffd socket (default: directory of MemFile)
+	KeepRootfs  bool        // Keep the rootfs clone on disk after the VM exits
+	LazyMemory  bool        // Load guest memory on demand through userfaultfd
+	MemSource   io.ReaderAt // Memory served with LazyMemory (default: MemFile), e.g. an oci.LayerReader
+	WorkingSet  string      // Working set to prefetch (default: snapshot.workingset next to MemFile, if present)
+	Verify      VerifyMode  // Integrity check of the files before loading (default: VerifySampled)
+	// RecordWorkingSet restores with LazyMemory and no prefetching, and
+	// writes the order in which the guest touched its pages to this path
+	// when the VM exits or ctx is cancelled
+	RecordWorkingSet string
+}
+
+// WorkingSetFile is the name of a working set file in a snapshot directory.
+const WorkingSetFile = "snapshot.workingset"
+
+// newFirecrackerClient creates the Firecracker client of a restore.
+var newFirecrackerClient = func(fcBin, jailerBin, vmID, socketPath string) (*firecracker.Client, error) {
+	return firecracker.NewClient(fcBin, jailerBin, vmID, socketPath)
 }
 
 // Restore launches Firecracker and loads the given snapshot to resume the VM.
@@ -150,16 +270,68 @@ func Restore(ctx context.Context, s RestoreSpec) error {
 		s.FCBin = "firecracker"
 	}
 	if s.ID == "" {
-		s.ID = fmt.Sprintf("sporelet-%d", time.Now().Unix())
+		id, err := defaultID()
+		if err != nil {
+			return err
+		}
+		s.ID = id
 	}
 
-	for _, f := range []string{s.MemFile, s.VMStateFile, s.ConfigFile} {
+	var err error
+	files := []string{s.VMStateFile, s.ConfigFile}
+	if s.MemSource == nil {
+		files = append(files, s.MemFile)
+	}
+	for _, f := range files {
 		if _, err := os.Stat(f); err != nil {
 			return fmt.Errorf("snapshot file not found: %s: %w", f, err)
 		}
 	}
 
-	client, err := firecracker.NewClient(s.FCBin, s.JailerBin, s.ID, s.SocketPath)
+	// memory served from elsewhere is verified block by block as it is read
+	mem := s.MemFile
+	if s.MemSource != nil {
+		mem = ""
+	}
+	roles := map[string]string{"mem": mem, "vmstate": s.VMStateFile, "config": s.ConfigFile}
+	if err := verifyIntegrity(IntegrityPath(s.MemFile), roles, s.Verify); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if s.MemSource != nil && s.Verify != VerifyNone {
+		src, err := newVerifiedReader(IntegrityPath(s.MemFile), s.MemSource)
+		if err == nil {
+			s.MemSource = src
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	recorded, err := snapshotRootfs(s.ConfigFile)
+	if err != nil {
+		return err
+	}
+	if s.Rootfs == "" {
+		s.Rootfs = relocate(recorded, filepath.Dir(s.MemFile))
+	}
+	if s.CloneDir == "" {
+		s.CloneDir = filepath.Dir(s.MemFile)
+	}
+	if s.RecordWorkingSet != "" {
+		s.LazyMemory = true
+		s.WorkingSet = ""
+	} else if s.WorkingSet == "" {
+		if path := filepath.Join(filepath.Dir(s.MemFile), WorkingSetFile); fileExists(path) {
+			s.WorkingSet = path
+		}
+	}
+	var ws uffd.WorkingSet
+	if s.WorkingSet != "" {
+		if ws, err = uffd.LoadWorkingSet(s.WorkingSet); err != nil {
+			return err
+		}
+	}
+
+	client, err := newFirecrackerClient(s.FCBin, s.JailerBin, s.ID, s.SocketPath)
 	if err != nil {
 		return fmt.Errorf("failed to create Firecracker client: %w", err)
 	}
@@ -169,49 +341,186 @@ func Restore(ctx context.Context, s RestoreSpec) error {
 		VMStateFilePath: s.VMStateFile,
 		ConfigFilePath:  s.ConfigFile,
 	}
-	if err := client.RestoreSnapshot(ctx, rcfg); err != nil {
+
+	var serveErr chan error
+	if s.LazyMemory {
+		ln, err := uffd.Listen(filepath.Join(s.CloneDir, s.ID+".uffd.sock"))
+		if err != nil {
+			return err
+		}
+		defer ln.Close()
+
+		src := s.MemSource
+		if src == nil {
+			f, err := os.Open(s.MemFile)
+			if err != nil {
+				return fmt.Errorf("failed to open memory file: %w", err)
+			}
+			defer f.Close()
+			src = f
+		}
+
+		opts := []uffd.Option{uffd.WithWorkingSet(ws)}
+		var handler *uffd.Handler
+		if s.RecordWorkingSet != "" {
+			opts = append(opts, uffd.WithPrefetch(false), uffd.WithHandler(func(h *uffd.Handler) { handler = h }))
+		}
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		serveErr = make(chan error, 1)
+		go func() {
+			err := ln.Serve(ctx, src, opts...)
+			if err == nil && handler != nil {
+				err = handler.WorkingSet().Save(s.RecordWorkingSet)
+			}
+			serveErr <- err
+		}()
+		rcfg.UffdSocket = ln.Path()
+	} else if len(ws.Offsets) > 0 {
+		go prefetchFile(s.MemFile, ws)
+	}
+
+	var clone string
+	if s.Rootfs != "" {
+		clone = filepath.Join(s.CloneDir, s.ID+".rootfs")
+		if err := cloneFile(s.Rootfs, clone); err != nil {
+			return fmt.Errorf("failed to clone rootfs: %w", err)
+		}
+		rcfg.DrivePaths = map[string]string{"rootfs": clone}
+	}
+
+	unlink := func() {}
+	if clone != "" {
+		if unlink, err = linkRecordedPath(recorded, clone); err != nil {
+			os.Remove(clone)
+			return err
+		}
+	}
+	err = client.RestoreSnapshot(ctx, rcfg)
+	unlink()
+	if err != nil {
+		if clone != "" {
+			os.Remove(clone)
+		}
 		return fmt.Errorf("failed to restore snapshot: %w", err)
 	}
 
+	// Firecracker holds the clone open once the drive is attached, so
+	// unlinking it frees the space as soon as the VM exits.
+	if clone != "" && !s.KeepRootfs {
+		if err := os.Remove(clone); err != nil {
+			return fmt.Errorf("failed to discard rootfs clone: %w", err)
+		}
+	}
+
 	// Wait for guest agent readiness
 	if err := client.WaitForVSockHandshake(ctx); err != nil {
 		return fmt.Errorf("vsock handshake failed: %w", err)
 	}
 
+	if serveErr != nil {
+		if err := <-serveErr; err != nil {
+			return fmt.Errorf("failed to serve guest memory: %w", err)
+		}
+	}
 	return nil
 }
 
-// CompareSnapshotDirs compares snapshot files in baseDir and newDir using the
-// provided snapshot prefix. It returns a slice of file names that differ.
-func CompareSnapshotDirs(baseDir, newDir, prefix string) ([]string, error) {
-	files := []string{
-		fmt.Sprintf("%s.mem", prefix),
-		fmt.Sprintf("%s.vmstate", prefix),
-		fmt.Sprintf("%s.config", prefix),
+// prefetchFile reads the pages of a working set into the page cache in the
+// order they were first touched, so that the faults of a VM restored from
+// the memory file hit the cache.
+func prefetchFile(path string, ws uffd.WorkingSet) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
 	}
+	defer f.Close()
 
-	var changed []string
-	for _, f := range files {
-		basePath := filepath.Join(baseDir, f)
-		newPath := filepath.Join(newDir, f)
-
-		bHash, err := fileHash(basePath)
-		if err != nil {
-			return nil, err
-		}
-		nHash, err := fileHash(newPath)
-		if err != nil {
-			return nil, err
+	var buf []byte
+	for _, run := range ws.Runs() {
+		if int64(len(buf)) < run[1] {
+			buf = make([]byte, run[1])
 		}
+		f.ReadAt(buf[:run[1]], run[0])
+	}
+}
 
-		if bHash != nHash {
-			changed = append(changed, f)
-		}
+// defaultID returns a VM ID for a spec without one. The random suffix keeps
+// the IDs of VMs started in the same second apart, and with them the names
+// of their rootfs clones and uffd sockets.
+func defaultID() (string, error) {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate VM ID: %w", err)
 	}
+	return fmt.Sprintf("sporelet-%d-%s", time.Now().Unix(), hex.EncodeToString(b[:])), nil
+}
 
-	return changed, nil
+// fileExists reports whether path exists.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// snapshotRootfs returns the rootfs path recorded in a snapshot config file,
+// or an empty string if the config does not record one.
+func snapshotRootfs(configFile string) (string, error) {
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read snapshot config: %w", err)
+	}
+	var cfg struct {
+		Rootfs struct {
+			PathOnHost string `json:"path_on_host"`
+		} `json:"rootfs"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return "", fmt.Errorf("failed to parse snapshot config: %w", err)
+	}
+	return cfg.Rootfs.PathOnHost, nil
 }
 
+// relocate returns path if it exists, otherwise the file with the same base
+// name in dir if that exists. Snapshots record absolute host paths from the
+// build machine, while pulled artifacts place bundled files next to the
+// snapshot files.
+func relocate(path, dir string) string {
+	if path == "" {
+		return ""
+	}
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	local := filepath.Join(dir, filepath.Base(path))
+	if _, err := os.Stat(local); err == nil {
+		return local
+	}
+	return path
+}
+
+// RecordParent records the snapshot pulled to baseDir as the parent of the
+// diff layer in outDir, so that PushSnapshot of the layer names it and
+// refuses another parent. It returns the pinned reference of the parent, or
+// an empty string if baseDir was not pulled from a registry.
+func RecordParent(baseDir, outDir string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(baseDir, oci.SnapshotRefFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read base snapshot reference: %w", err)
+	}
+	ref := strings.TrimSpace(string(data))
+	if err := os.WriteFile(filepath.Join(outDir, oci.ParentRefFile), []byte(ref+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("failed to record parent: %w", err)
+	}
+	return ref, nil
+}
+
+// fileHash hashes the content of a file. Holes are hashed as zeros without
+// being read, so punched memory files hash like their unpunched originals.
 func fileHash(path string) (string, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -219,8 +528,12 @@ func fileHash(path string) (string, error) {
 	}
 	defer f.Close()
 
+	r, err := sparse.NewReader(f)
+	if err != nil {
+		return "", err
+	}
 	h := sha256.New()
-	if _, err := io.Copy(h, f); err != nil {
+	if _, err := io.Copy(h, r); err != nil {
 		return "", err
 	}
 	return fmt.Sprintf("%x", h.Sum(nil)), nil
@@ -2,9 +2,15 @@ package fc
 
 import (
 	"context"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/firecracker"
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/oci"
 )
 
 func TestPushSnapshot_MissingFile(t *testing.T) {
@@ -15,7 +21,7 @@ func TestPushSnapshot_MissingFile(t *testing.T) {
 	vm := filepath.Join(dir, "snapshot.vmstate")
 	cfg := filepath.Join(dir, "snapshot.config")
 
-	if err := PushSnapshot(context.Background(), "ref", mem, vm, cfg); err == nil {
+	if _, err := PushSnapshot(context.Background(), "ref", mem, vm, cfg); err == nil {
 		t.Fatal("expected error when files are missing")
 	}
 }
@@ -31,3 +37,127 @@ func TestRestore_MissingFiles(t *testing.T) {
 		t.Fatal("expected error when files are missing")
 	}
 }
+
+func TestRestore_InvalidWorkingSet(t *testing.T) {
+	dir := t.TempDir()
+	spec := RestoreSpec{
+		MemFile:     filepath.Join(dir, "snapshot.mem"),
+		VMStateFile: filepath.Join(dir, "snapshot.vmstate"),
+		ConfigFile:  filepath.Join(dir, "snapshot.config"),
+	}
+	for _, f := range []string{spec.MemFile, spec.VMStateFile} {
+		os.WriteFile(f, []byte("dummy"), 0644)
+	}
+	os.WriteFile(spec.ConfigFile, []byte("{}"), 0644)
+
+	// a working set next to the memory file is picked up by default
+	os.WriteFile(filepath.Join(dir, WorkingSetFile), []byte(`{"pageSize":4096,"offsets":[100]}`), 0644)
+	if err := Restore(context.Background(), spec); err == nil {
+		t.Fatal("expected error for unaligned working set")
+	}
+}
+
+func TestRestore_RecordedRootfsMissing(t *testing.T) {
+	dir := t.TempDir()
+	spec := RestoreSpec{
+		MemFile:     filepath.Join(dir, "snapshot.mem"),
+		VMStateFile: filepath.Join(dir, "snapshot.vmstate"),
+		ConfigFile:  filepath.Join(dir, "snapshot.config"),
+	}
+	for _, f := range []string{spec.MemFile, spec.VMStateFile} {
+		os.WriteFile(f, []byte("dummy"), 0644)
+	}
+	// built on another host, with the rootfs bundled next to the snapshot
+	recorded := filepath.Join(t.TempDir(), "build", "rootfs.ext4")
+	os.WriteFile(spec.ConfigFile, []byte(`{"rootfs":{"path_on_host":"`+recorded+`"}}`), 0644)
+	os.WriteFile(filepath.Join(dir, "rootfs.ext4"), []byte("bundled"), 0644)
+
+	var loaded string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/snapshot/load" {
+			// Firecracker opens the recorded drive path during the load
+			data, err := os.ReadFile(recorded)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			loaded = string(data)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	orig := newFirecrackerClient
+	newFirecrackerClient = func(fcBin, jailerBin, vmID, socketPath string) (*firecracker.Client, error) {
+		nop := func(context.Context) error { return nil }
+		return firecracker.NewClient(fcBin, jailerBin, vmID, socketPath, firecracker.WithHTTPClient(srv.Client()),
+			firecracker.WithBaseURL(srv.URL), firecracker.WithStartFunc(nop), firecracker.WithHandshakeFunc(nop))
+	}
+	defer func() { newFirecrackerClient = orig }()
+
+	os.MkdirAll(filepath.Dir(recorded), 0755)
+
+	if err := Restore(context.Background(), spec); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if loaded != "bundled" {
+		t.Errorf("recorded rootfs read %q during the load", loaded)
+	}
+	if _, err := os.Lstat(recorded); !os.IsNotExist(err) {
+		t.Errorf("recorded rootfs link left behind: %v", err)
+	}
+}
+
+func TestLinkRecordedPath(t *testing.T) {
+	dir := t.TempDir()
+	clone := filepath.Join(dir, "clone.rootfs")
+	os.WriteFile(clone, []byte("clone"), 0644)
+
+	// an existing entry, even a dangling link, is left alone
+	recorded := filepath.Join(dir, "recorded.rootfs")
+	os.Symlink(filepath.Join(dir, "gone.rootfs"), recorded)
+	unlink, err := linkRecordedPath(recorded, clone)
+	if err != nil {
+		t.Fatalf("linkRecordedPath(existing): %v", err)
+	}
+	unlink()
+	if target, _ := os.Readlink(recorded); target != filepath.Join(dir, "gone.rootfs") {
+		t.Errorf("existing link changed to %q", target)
+	}
+
+	// the directory of the recorded path is not created
+	missing := filepath.Join(dir, "build", "rootfs.ext4")
+	if _, err := linkRecordedPath(missing, clone); err == nil {
+		t.Error("linkRecordedPath succeeded without the recorded directory")
+	}
+	if _, err := os.Stat(filepath.Dir(missing)); !os.IsNotExist(err) {
+		t.Errorf("recorded directory created: %v", err)
+	}
+}
+
+func TestDefaultIDUnique(t *testing.T) {
+	// restores in the same second must not share a clone or uffd socket
+	a, err := defaultID()
+	if err != nil {
+		t.Fatalf("defaultID: %v", err)
+	}
+	if b, _ := defaultID(); a == b {
+		t.Errorf("defaultID returned %q twice", a)
+	}
+}
+
+func TestRecordParent(t *testing.T) {
+	base, out := t.TempDir(), t.TempDir()
+	if ref, err := RecordParent(base, out); err != nil || ref != "" {
+		t.Fatalf("RecordParent(unpulled) = %q, %v", ref, err)
+	}
+
+	pinned := "ghcr.io/sporelet/layer1@sha256:" + strings.Repeat("a", 64)
+	os.WriteFile(filepath.Join(base, oci.SnapshotRefFile), []byte(pinned+"\n"), 0644)
+	ref, err := RecordParent(base, out)
+	if err != nil || ref != pinned {
+		t.Fatalf("RecordParent = %q, %v; want %q", ref, err, pinned)
+	}
+	if data, _ := os.ReadFile(filepath.Join(out, oci.ParentRefFile)); strings.TrimSpace(string(data)) != pinned {
+		t.Errorf("%s = %q", oci.ParentRefFile, data)
+	}
+}
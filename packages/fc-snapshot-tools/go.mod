@@ -1,5 +1,5 @@
 module github.com/quinnovator/sporelet/packages/fc-snapshot-tools
 
-go 1.21
+go 1.22
 
-// No external dependencies required
+require github.com/klauspost/compress v1.18.0
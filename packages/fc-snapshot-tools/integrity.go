@@ -0,0 +1,373 @@
+package fc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/sparse"
+)
+
+const (
+	// integrityBlockSize is the size of the blocks digested separately so
+	// that sampled verification can check parts of a file
+	integrityBlockSize = 4 << 20
+	// integritySamples is the number of random blocks checked per file by
+	// sampled verification, in addition to the first and last block
+	integritySamples = 16
+)
+
+// ErrIntegrity is returned when snapshot files do not match their integrity
+// manifest.
+var ErrIntegrity = errors.New("snapshot integrity check failed")
+
+// VerifyMode selects how thoroughly snapshot files are checked against their
+// integrity manifest before a restore.
+type VerifyMode int
+
+const (
+	// VerifySampled checks the size of every file, the vmstate and config
+	// in full and a random sample of memory file blocks
+	VerifySampled VerifyMode = iota
+	// VerifyFull checks the digest of every byte
+	VerifyFull
+	// VerifyNone skips verification
+	VerifyNone
+)
+
+// ParseVerifyMode parses "sampled", "full" or "none".
+func ParseVerifyMode(s string) (VerifyMode, error) {
+	switch s {
+	case "sampled", "":
+		return VerifySampled, nil
+	case "full":
+		return VerifyFull, nil
+	case "none":
+		return VerifyNone, nil
+	}
+	return VerifySampled, fmt.Errorf("unknown verify mode %q", s)
+}
+
+// Integrity is the integrity manifest of a snapshot. It records the size and
+// sha256 digest of each snapshot file, keyed by "mem", "vmstate" and
+// "config", along with the digests of each block of the file.
+type Integrity struct {
+	BlockSize int64                 `json:"blockSize"`
+	Files     map[string]FileDigest `json:"files"`
+}
+
+// FileDigest records the content of a snapshot file.
+type FileDigest struct {
+	Size   int64    `json:"size"`
+	Digest string   `json:"digest"`
+	Blocks []string `json:"blocks"`
+}
+
+// IntegrityPath returns where the integrity manifest of the snapshot with
+// the given memory file is stored: next to it, with an .integrity extension.
+func IntegrityPath(memFile string) string {
+	return strings.TrimSuffix(memFile, ".mem") + ".integrity"
+}
+
+// WriteIntegrity digests the snapshot files and writes their integrity
+// manifest to IntegrityPath(memFile). Holes are digested as zeros without
+// being read.
+func WriteIntegrity(memFile, vmstateFile, configFile string) error {
+	m := Integrity{BlockSize: integrityBlockSize, Files: map[string]FileDigest{}}
+	for role, path := range map[string]string{"mem": memFile, "vmstate": vmstateFile, "config": configFile} {
+		d, err := digestBlocks(path, integrityBlockSize)
+		if err != nil {
+			return fmt.Errorf("failed to digest %s: %w", path, err)
+		}
+		m.Files[role] = d
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(IntegrityPath(memFile), data, 0644)
+}
+
+// VerifyIntegrity checks the snapshot files against the integrity manifest at
+// IntegrityPath(memFile). It returns an error wrapping ErrIntegrity if a file
+// does not match, and one matching os.ErrNotExist if the snapshot has no
+// integrity manifest.
+func VerifyIntegrity(memFile, vmstateFile, configFile string, mode VerifyMode) error {
+	return verifyIntegrity(IntegrityPath(memFile), map[string]string{"mem": memFile, "vmstate": vmstateFile, "config": configFile}, mode)
+}
+
+// verifyIntegrity checks files, keyed by role, against a manifest. Files
+// with an empty path are skipped.
+func verifyIntegrity(manifest string, files map[string]string, mode VerifyMode) error {
+	if mode == VerifyNone {
+		return nil
+	}
+	m, err := readIntegrity(manifest)
+	if err != nil {
+		return err
+	}
+
+	for role, path := range files {
+		if path == "" {
+			continue
+		}
+		want, ok := m.Files[role]
+		if !ok {
+			return fmt.Errorf("%w: %s is not listed in %s", ErrIntegrity, role, manifest)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if info.Size() != want.Size {
+			return fmt.Errorf("%w: %s has %d bytes, expected %d", ErrIntegrity, path, info.Size(), want.Size)
+		}
+		if mode == VerifySampled && role == "mem" {
+			err = verifySampled(path, want, m.BlockSize)
+		} else {
+			err = verifyFull(path, want, m.BlockSize)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readIntegrity reads and checks an integrity manifest.
+func readIntegrity(manifest string) (Integrity, error) {
+	var m Integrity
+	data, err := os.ReadFile(manifest)
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("failed to parse integrity manifest %s: %w", manifest, err)
+	}
+	if m.BlockSize <= 0 || m.BlockSize > 1<<30 {
+		return m, fmt.Errorf("invalid block size %d in integrity manifest %s", m.BlockSize, manifest)
+	}
+	return m, nil
+}
+
+// verifyFull digests the whole file, reporting the first block that differs.
+func verifyFull(path string, want FileDigest, blockSize int64) error {
+	got, err := digestBlocks(path, blockSize)
+	if err != nil {
+		return fmt.Errorf("failed to digest %s: %w", path, err)
+	}
+	for i := range got.Blocks {
+		if i >= len(want.Blocks) || got.Blocks[i] != want.Blocks[i] {
+			return fmt.Errorf("%w: %s differs in the block at offset %d", ErrIntegrity, path, int64(i)*blockSize)
+		}
+	}
+	if got.Digest != want.Digest {
+		return fmt.Errorf("%w: %s has digest %s, expected %s", ErrIntegrity, path, got.Digest, want.Digest)
+	}
+	return nil
+}
+
+// verifySampled checks the first and last block and a random sample of the
+// others.
+func verifySampled(path string, want FileDigest, blockSize int64) error {
+	n := len(want.Blocks)
+	if int64(n) != (want.Size+blockSize-1)/blockSize {
+		return fmt.Errorf("%w: integrity manifest lists %d blocks for %s", ErrIntegrity, n, path)
+	}
+	if n <= integritySamples+2 {
+		return verifyFull(path, want, blockSize)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	blocks := append([]int{0, n - 1}, rand.Perm(n - 2)[:integritySamples]...)
+	buf := make([]byte, blockSize)
+	for i, b := range blocks {
+		if i >= 2 {
+			b++ // sampled from the blocks between the first and the last
+		}
+		off := int64(b) * blockSize
+		m, err := f.ReadAt(buf, off)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		sum := sha256.Sum256(buf[:m])
+		if hex.EncodeToString(sum[:]) != want.Blocks[b] {
+			return fmt.Errorf("%w: %s differs in the block at offset %d", ErrIntegrity, path, off)
+		}
+	}
+	return nil
+}
+
+// digestBlocks returns the size, digest and block digests of a file.
+func digestBlocks(path string, blockSize int64) (FileDigest, error) {
+	var d FileDigest
+	f, err := os.Open(path)
+	if err != nil {
+		return d, err
+	}
+	defer f.Close()
+	r, err := sparse.NewReader(f)
+	if err != nil {
+		return d, err
+	}
+
+	h := sha256.New()
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			h.Write(buf[:n])
+			sum := sha256.Sum256(buf[:n])
+			d.Blocks = append(d.Blocks, hex.EncodeToString(sum[:]))
+			d.Size += int64(n)
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return d, err
+		}
+	}
+	d.Digest = fmt.Sprintf("sha256:%x", h.Sum(nil))
+	return d, nil
+}
+
+// verifiedBlocks is the number of verified blocks a verifiedReader keeps in
+// memory
+const verifiedBlocks = 4
+
+// verifiedReader reads memory from another source, such as an
+// oci.LayerReader, one integrity manifest block at a time, and returns
+// nothing of a block before it matched its digest. Recently read blocks are
+// kept in memory; the lock is only held to look them up and insert them, and
+// concurrent reads of a block being verified wait for that read.
+type verifiedReader struct {
+	src       io.ReaderAt
+	want      FileDigest
+	blockSize int64
+
+	mu      sync.Mutex
+	cache   []verifiedBlock // most recently used first
+	loading map[int64]*verifiedLoad
+}
+
+type verifiedBlock struct {
+	index int64
+	data  []byte
+}
+
+// verifiedLoad is a block being read and verified, done once it is.
+type verifiedLoad struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// newVerifiedReader returns a reader of the memory in src checked against
+// the integrity manifest. A source with a Size method, such as an
+// oci.LayerReader, must have the size of the memory file.
+func newVerifiedReader(manifest string, src io.ReaderAt) (*verifiedReader, error) {
+	m, err := readIntegrity(manifest)
+	if err != nil {
+		return nil, err
+	}
+	want, ok := m.Files["mem"]
+	if !ok {
+		return nil, fmt.Errorf("%w: mem is not listed in %s", ErrIntegrity, manifest)
+	}
+	if int64(len(want.Blocks)) != (want.Size+m.BlockSize-1)/m.BlockSize {
+		return nil, fmt.Errorf("%w: integrity manifest lists %d blocks for mem", ErrIntegrity, len(want.Blocks))
+	}
+	if s, ok := src.(interface{ Size() int64 }); ok && s.Size() != want.Size {
+		return nil, fmt.Errorf("%w: memory has %d bytes, expected %d", ErrIntegrity, s.Size(), want.Size)
+	}
+	return &verifiedReader{src: src, want: want, blockSize: m.BlockSize}, nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *verifiedReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	n := 0
+	for n < len(p) {
+		if off >= r.want.Size {
+			return n, io.EOF
+		}
+		data, err := r.block(off / r.blockSize)
+		if err != nil {
+			return n, err
+		}
+		c := copy(p[n:], data[off%r.blockSize:])
+		n += c
+		off += int64(c)
+	}
+	return n, nil
+}
+
+// block returns the verified content of block i.
+func (r *verifiedReader) block(i int64) ([]byte, error) {
+	r.mu.Lock()
+	for j, b := range r.cache {
+		if b.index == i {
+			copy(r.cache[1:j+1], r.cache[:j])
+			r.cache[0] = b
+			r.mu.Unlock()
+			return b.data, nil
+		}
+	}
+	if l, ok := r.loading[i]; ok {
+		r.mu.Unlock()
+		<-l.done
+		return l.data, l.err
+	}
+	if r.loading == nil {
+		r.loading = map[int64]*verifiedLoad{}
+	}
+	l := &verifiedLoad{done: make(chan struct{})}
+	r.loading[i] = l
+	r.mu.Unlock()
+
+	l.data, l.err = r.verify(i)
+
+	r.mu.Lock()
+	delete(r.loading, i)
+	if l.err == nil {
+		r.cache = append([]verifiedBlock{{index: i, data: l.data}}, r.cache...)
+		if len(r.cache) > verifiedBlocks {
+			r.cache = r.cache[:verifiedBlocks]
+		}
+	}
+	r.mu.Unlock()
+	close(l.done)
+	return l.data, l.err
+}
+
+// verify reads block i from the source and checks it against its digest.
+func (r *verifiedReader) verify(i int64) ([]byte, error) {
+	off := i * r.blockSize
+	data := make([]byte, min(r.blockSize, r.want.Size-off))
+	n, err := r.src.ReadAt(data, off)
+	if n < len(data) {
+		if err == nil || errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%w: memory ends at %d, expected %d bytes", ErrIntegrity, off+int64(n), r.want.Size)
+		}
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != r.want.Blocks[i] {
+		return nil, fmt.Errorf("%w: memory differs in the block at offset %d", ErrIntegrity, off)
+	}
+	return data, nil
+}
@@ -0,0 +1,146 @@
+package fc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeSnapshotFiles(t *testing.T, dir string) (mem, vm, cfg string) {
+	t.Helper()
+	mem = filepath.Join(dir, "snapshot.mem")
+	vm = filepath.Join(dir, "snapshot.vmstate")
+	cfg = filepath.Join(dir, "snapshot.config")
+	data := make([]byte, 3*4096)
+	for i := range data {
+		data[i] = byte(i / 4096)
+	}
+	os.WriteFile(mem, data, 0644)
+	os.WriteFile(vm, []byte("vmstate"), 0644)
+	os.WriteFile(cfg, []byte("{}"), 0644)
+	return mem, vm, cfg
+}
+
+func TestIntegrity(t *testing.T) {
+	mem, vm, cfg := writeSnapshotFiles(t, t.TempDir())
+	if err := WriteIntegrity(mem, vm, cfg); err != nil {
+		t.Fatalf("WriteIntegrity: %v", err)
+	}
+	for _, mode := range []VerifyMode{VerifySampled, VerifyFull} {
+		if err := VerifyIntegrity(mem, vm, cfg, mode); err != nil {
+			t.Fatalf("VerifyIntegrity(%d): %v", mode, err)
+		}
+	}
+
+	// a tampered vmstate of the same size is caught even when sampling
+	os.WriteFile(vm, []byte("VMSTATE"), 0644)
+	if err := VerifyIntegrity(mem, vm, cfg, VerifySampled); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("expected integrity error for tampered vmstate, got %v", err)
+	}
+	if err := VerifyIntegrity(mem, vm, cfg, VerifyNone); err != nil {
+		t.Fatalf("VerifyNone: %v", err)
+	}
+	os.WriteFile(vm, []byte("vmstate"), 0644)
+
+	os.Truncate(mem, 4096)
+	if err := VerifyIntegrity(mem, vm, cfg, VerifySampled); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("expected integrity error for truncated memory file, got %v", err)
+	}
+
+	os.Remove(IntegrityPath(mem))
+	if err := VerifyIntegrity(mem, vm, cfg, VerifyFull); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected not exist error without manifest, got %v", err)
+	}
+}
+
+func TestVerifySampled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.mem")
+	data := make([]byte, 64*4096+100)
+	for i := range data {
+		data[i] = byte(i / 4096)
+	}
+	os.WriteFile(path, data, 0644)
+	want, err := digestBlocks(path, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want.Blocks) != 65 || want.Size != int64(len(data)) {
+		t.Fatalf("digested %d blocks and %d bytes", len(want.Blocks), want.Size)
+	}
+	if err := verifySampled(path, want, 4096); err != nil {
+		t.Fatalf("verifySampled: %v", err)
+	}
+
+	// the last block is always checked
+	f, _ := os.OpenFile(path, os.O_WRONLY, 0)
+	f.WriteAt([]byte{0xff}, int64(len(data))-1)
+	f.Close()
+	if err := verifySampled(path, want, 4096); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("expected integrity error, got %v", err)
+	}
+	if err := verifyFull(path, want, 4096); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("expected integrity error, got %v", err)
+	}
+}
+
+func TestRestore_IntegrityMismatch(t *testing.T) {
+	mem, vm, cfg := writeSnapshotFiles(t, t.TempDir())
+	if err := WriteIntegrity(mem, vm, cfg); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(cfg, []byte("[]"), 0644)
+
+	spec := RestoreSpec{MemFile: mem, VMStateFile: vm, ConfigFile: cfg}
+	if err := Restore(context.Background(), spec); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("expected integrity error, got %v", err)
+	}
+}
+
+func TestVerifiedReader(t *testing.T) {
+	mem, vm, cfg := writeSnapshotFiles(t, t.TempDir())
+	data := make([]byte, 2*integrityBlockSize+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	os.WriteFile(mem, data, 0644)
+	if err := WriteIntegrity(mem, vm, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// a registry layer served with one block tampered with
+	tampered := bytes.Clone(data)
+	tampered[integrityBlockSize+7] ^= 1
+	r, err := newVerifiedReader(IntegrityPath(mem), bytes.NewReader(tampered))
+	if err != nil {
+		t.Fatalf("newVerifiedReader: %v", err)
+	}
+	page := make([]byte, 4096)
+	for _, off := range []int64{0, 2 * integrityBlockSize} {
+		n, err := r.ReadAt(page, off)
+		if err != nil && !errors.Is(err, io.EOF) {
+			t.Fatalf("ReadAt(%d): %v", off, err)
+		}
+		if !bytes.Equal(page[:n], data[off:off+int64(n)]) {
+			t.Fatalf("ReadAt(%d) returned wrong content", off)
+		}
+	}
+	if _, err := r.ReadAt(page, integrityBlockSize); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("ReadAt(tampered block) = %v, want ErrIntegrity", err)
+	}
+
+	// truncated, found by its size or when the missing block is read
+	short := data[:len(data)-1]
+	if _, err := newVerifiedReader(IntegrityPath(mem), bytes.NewReader(short)); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("newVerifiedReader(truncated) = %v, want ErrIntegrity", err)
+	}
+	r, err = newVerifiedReader(IntegrityPath(mem), struct{ io.ReaderAt }{bytes.NewReader(short)})
+	if err != nil {
+		t.Fatalf("newVerifiedReader: %v", err)
+	}
+	if _, err := r.ReadAt(page, 2*integrityBlockSize); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("ReadAt(truncated) = %v, want ErrIntegrity", err)
+	}
+}
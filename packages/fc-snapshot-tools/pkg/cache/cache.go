@@ -0,0 +1,486 @@
+// Package cache keeps pulled snapshots in a node-local store addressed by
+// digest, so that every VM restoring the same snapshot shares one copy of
+// its files.
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/oci"
+)
+
+const (
+	indexFile = "index.json"
+	lockFile  = "lock"
+	blobsDir  = "blobs"
+	tmpDir    = "tmp"
+)
+
+// ErrNotFound is returned for snapshots that are not in the cache.
+var ErrNotFound = errors.New("snapshot not in cache")
+
+// Cache is a node-local snapshot store. Files are stored once per layer
+// digest, snapshots are indexed by manifest digest, and work directories
+// check snapshots out as reflinks or hard links. Each checkout holds a
+// reference on its snapshot; snapshots without references are evicted,
+// least recently used first, once the cache outgrows its size cap. The index
+// is guarded by a file lock, so several processes can share a cache.
+type Cache struct {
+	root    string
+	maxSize int64
+}
+
+// Option configures a Cache.
+type Option func(*Cache)
+
+// WithMaxSize caps the disk space used by the cache. Unreferenced snapshots
+// are evicted after pulls and releases while the cache is larger. Zero, the
+// default, disables the cap.
+func WithMaxSize(bytes int64) Option {
+	return func(c *Cache) { c.maxSize = bytes }
+}
+
+// Snapshot is a cached snapshot.
+type Snapshot struct {
+	Digest   string            `json:"digest"`
+	Refs     []string          `json:"refs"`               // references it was pulled by
+	Files    map[string]string `json:"files"`              // file name -> layer digest
+	Writable []string          `json:"writable,omitempty"` // files the VM writes to
+	Users    []string          `json:"users"`              // directories it is checked out to
+	Pulled   time.Time         `json:"pulled"`
+	LastUsed time.Time         `json:"lastUsed"`
+	Size     int64             `json:"-"` // disk usage of its files, set by List
+}
+
+type index struct {
+	Snapshots map[string]*Snapshot `json:"snapshots"`
+}
+
+// Open opens the cache at root, creating it if needed.
+func Open(root string, opts ...Option) (*Cache, error) {
+	c := &Cache{root: root}
+	for _, opt := range opts {
+		opt(c)
+	}
+	for _, dir := range []string{filepath.Join(root, blobsDir, "sha256"), filepath.Join(root, tmpDir)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create cache: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// Pull makes sure the snapshot ociRef points at is in the cache and returns
+// it. Only files that no cached snapshot already holds are downloaded. opts
+// configure the registry client and the pull; for an image index the
+// snapshot of the platform set with oci.WithPlatform is cached.
+//
+// The snapshot may be evicted again before it is checked out; use PullTo to
+// pull a snapshot for a VM.
+func (c *Cache) Pull(ctx context.Context, ociRef string, opts ...oci.Option) (Snapshot, error) {
+	return c.pull(ctx, ociRef, "", opts...)
+}
+
+// PullTo pulls like Pull and checks the snapshot out in dir like Checkout,
+// in the same locked step, so that the snapshot cannot be evicted in
+// between.
+func (c *Cache) PullTo(ctx context.Context, ociRef, dir string, opts ...oci.Option) (Snapshot, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return Snapshot{}, err
+	}
+	return c.pull(ctx, ociRef, dir, opts...)
+}
+
+// pull implements Pull and, when dir is set, PullTo.
+func (c *Cache) pull(ctx context.Context, ociRef, dir string, opts ...oci.Option) (Snapshot, error) {
+	ref, err := oci.ParseReference(ociRef)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	desc, m, err := oci.NewClient(opts...).ResolveSnapshot(ctx, ref)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	var s Snapshot
+	err = c.update(func(idx *index) error {
+		if cached := idx.Snapshots[desc.Digest]; cached != nil {
+			cached.LastUsed = time.Now()
+			cached.Refs = addString(cached.Refs, ociRef)
+			if dir != "" {
+				if err := c.checkout(idx, cached, dir); err != nil {
+					return err
+				}
+			}
+			s = *cached
+		}
+		return nil
+	})
+	if err != nil || s.Digest != "" {
+		return s, err
+	}
+
+	files := map[string]string{}
+	var writable []string
+	for _, l := range m.Layers {
+		title := l.Annotations[oci.AnnotationTitle]
+		if title == "" {
+			continue
+		}
+		files[title] = l.Digest
+		if strings.HasPrefix(l.MediaType, oci.MediaTypeRootfs) || strings.HasPrefix(l.Annotations[oci.AnnotationChunkedMediaType], oci.MediaTypeRootfs) {
+			writable = append(writable, title)
+		}
+	}
+	tmp, err := os.MkdirTemp(filepath.Join(c.root, tmpDir), "pull-")
+	if err != nil {
+		return Snapshot{}, err
+	}
+	defer os.RemoveAll(tmp)
+	keep := func(l oci.Descriptor) bool { return !fileExists(c.blobPath(l.Digest)) }
+	pinned := ref.WithDigest(desc.Digest).String()
+	if err := oci.PullSnapshot(ctx, pinned, tmp, append(opts, oci.WithLayerFilter(keep))...); err != nil {
+		return Snapshot{}, err
+	}
+	return c.add(desc.Digest, ociRef, tmp, files, writable, dir)
+}
+
+// add moves the pulled files in dir into the store and indexes the snapshot,
+// adding ref to the entry when another pull already indexed it. When work is
+// set, the snapshot is also checked out there.
+func (c *Cache) add(digest, ref, dir string, files map[string]string, writable []string, work string) (Snapshot, error) {
+	var s Snapshot
+	err := c.update(func(idx *index) error {
+		for title, d := range files {
+			blob := c.blobPath(d)
+			pulled := filepath.Join(dir, title)
+			if fileExists(blob) {
+				continue
+			}
+			if !fileExists(pulled) {
+				return fmt.Errorf("%s of snapshot %s was neither pulled nor cached", title, digest)
+			}
+			// checkouts may be hard links, so the store is read-only
+			if err := os.Chmod(pulled, 0444); err != nil {
+				return err
+			}
+			if err := os.Rename(pulled, blob); err != nil {
+				return fmt.Errorf("failed to store %s: %w", title, err)
+			}
+		}
+		now := time.Now()
+		added := idx.Snapshots[digest]
+		if added == nil {
+			added = &Snapshot{Digest: digest, Files: files, Writable: writable, Pulled: now}
+			idx.Snapshots[digest] = added
+		}
+		added.Refs = addString(added.Refs, ref)
+		added.LastUsed = now
+		if work != "" {
+			if err := c.checkout(idx, added, work); err != nil {
+				return err
+			}
+		}
+		s = *added
+		if c.maxSize > 0 {
+			c.gc(idx, c.maxSize, digest)
+		}
+		return nil
+	})
+	return s, err
+}
+
+// Checkout places the files of a cached snapshot in dir and records dir as a
+// user of the snapshot until Release. Files the VM writes to, such as the
+// rootfs, are reflinked or copied; the others may be read-only hard links. A directory holds one checkout at a
+// time: checking out another snapshot releases the previous one.
+func (c *Cache) Checkout(digest, dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return c.update(func(idx *index) error {
+		s := idx.Snapshots[digest]
+		if s == nil {
+			return fmt.Errorf("%s: %w", digest, ErrNotFound)
+		}
+		return c.checkout(idx, s, dir)
+	})
+}
+
+// checkout places the files of s in dir and moves the user dir to s.
+func (c *Cache) checkout(idx *index, s *Snapshot, dir string) error {
+	for title, d := range s.Files {
+		dst := filepath.Join(dir, title)
+		if err := os.Remove(dst); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := link(c.blobPath(d), dst, containsString(s.Writable, title)); err != nil {
+			return fmt.Errorf("failed to check out %s: %w", title, err)
+		}
+	}
+	for _, other := range idx.Snapshots {
+		other.Users = removeString(other.Users, dir)
+	}
+	s.Users = append(s.Users, dir)
+	s.LastUsed = time.Now()
+	return nil
+}
+
+// Release drops the reference the checkout in dir holds. The files in dir
+// are left for the caller to remove.
+func (c *Cache) Release(dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	return c.update(func(idx *index) error {
+		for _, s := range idx.Snapshots {
+			if containsString(s.Users, dir) {
+				s.Users = removeString(s.Users, dir)
+				s.LastUsed = time.Now()
+			}
+		}
+		if c.maxSize > 0 {
+			c.gc(idx, c.maxSize, "")
+		}
+		return nil
+	})
+}
+
+// Move renames the checkout in dir to newDir, which must not exist, and moves
+// the reference it holds along with it.
+func (c *Cache) Move(dir, newDir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if newDir, err = filepath.Abs(newDir); err != nil {
+		return err
+	}
+	return c.update(func(idx *index) error {
+		if err := os.Rename(dir, newDir); err != nil {
+			return err
+		}
+		for _, s := range idx.Snapshots {
+			if containsString(s.Users, dir) {
+				s.Users = addString(removeString(s.Users, dir), newDir)
+			}
+		}
+		return nil
+	})
+}
+
+// Prune evicts unreferenced snapshots, least recently used first, until the
+// cache uses at most maxSize bytes, and removes stored files no snapshot
+// lists. A maxSize of zero evicts every unreferenced snapshot. It returns the
+// evicted snapshots.
+func (c *Cache) Prune(maxSize int64) ([]Snapshot, error) {
+	var evicted []Snapshot
+	err := c.update(func(idx *index) error {
+		evicted = c.gc(idx, maxSize, "")
+
+		listed := map[string]bool{}
+		for _, s := range idx.Snapshots {
+			for _, d := range s.Files {
+				listed[c.blobPath(d)] = true
+			}
+		}
+		blobs, err := filepath.Glob(filepath.Join(c.root, blobsDir, "*", "*"))
+		if err != nil {
+			return err
+		}
+		for _, blob := range blobs {
+			if !listed[blob] {
+				os.Remove(blob)
+			}
+		}
+		return nil
+	})
+	return evicted, err
+}
+
+// List returns the cached snapshots, most recently used first.
+func (c *Cache) List() ([]Snapshot, error) {
+	var list []Snapshot
+	err := c.update(func(idx *index) error {
+		for _, s := range idx.Snapshots {
+			for _, d := range s.Files {
+				s.Size += diskUsage(c.blobPath(d))
+			}
+			list = append(list, *s)
+			s.Size = 0
+		}
+		return nil
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].LastUsed.After(list[j].LastUsed) })
+	return list, err
+}
+
+// gc drops users whose directory is gone and then evicts unreferenced
+// snapshots, least recently used first, while the stored files take more
+// than maxSize bytes. The snapshot keep is never evicted, so a snapshot that
+// was just pulled survives the pull.
+func (c *Cache) gc(idx *index, maxSize int64, keep string) []Snapshot {
+	refs := map[string]int{}
+	var unused []*Snapshot
+	for _, s := range idx.Snapshots {
+		var users []string
+		for _, u := range s.Users {
+			if _, err := os.Stat(u); err == nil {
+				users = append(users, u)
+			}
+		}
+		s.Users = users
+		if len(users) == 0 && s.Digest != keep {
+			unused = append(unused, s)
+		}
+		for _, d := range s.Files {
+			refs[d]++
+		}
+	}
+	var total int64
+	for d := range refs {
+		total += diskUsage(c.blobPath(d))
+	}
+	sort.Slice(unused, func(i, j int) bool { return unused[i].LastUsed.Before(unused[j].LastUsed) })
+
+	var evicted []Snapshot
+	for _, s := range unused {
+		if total <= maxSize {
+			break
+		}
+		delete(idx.Snapshots, s.Digest)
+		evicted = append(evicted, *s)
+		for _, d := range s.Files {
+			if refs[d]--; refs[d] == 0 {
+				total -= diskUsage(c.blobPath(d))
+				os.Remove(c.blobPath(d))
+			}
+		}
+	}
+	return evicted
+}
+
+// update runs fn on the index with the cache locked and saves the result.
+func (c *Cache) update(fn func(*index) error) error {
+	lock, err := os.OpenFile(filepath.Join(c.root, lockFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close() // releases the lock
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock cache: %w", err)
+	}
+
+	idx := &index{Snapshots: map[string]*Snapshot{}}
+	data, err := os.ReadFile(filepath.Join(c.root, indexFile))
+	if err == nil {
+		if err := json.Unmarshal(data, idx); err != nil {
+			return fmt.Errorf("failed to parse cache index: %w", err)
+		}
+		if idx.Snapshots == nil {
+			idx.Snapshots = map[string]*Snapshot{}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if err := fn(idx); err != nil {
+		return err
+	}
+	if data, err = json.Marshal(idx); err != nil {
+		return err
+	}
+	tmp := filepath.Join(c.root, indexFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(c.root, indexFile))
+}
+
+// ParseSize parses a size such as "512M" or "20G" into bytes. Suffixes are
+// binary multiples; a plain number is a count of bytes.
+func ParseSize(s string) (int64, error) {
+	num, shift := strings.TrimSuffix(strings.ToUpper(s), "B"), 0
+	for i, unit := range "KMGT" {
+		if strings.HasSuffix(num, string(unit)) {
+			num, shift = strings.TrimSuffix(num, string(unit)), 10*(i+1)
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n << shift, nil
+}
+
+// blobPath returns where the file of the layer with the given digest is
+// stored.
+func (c *Cache) blobPath(digest string) string {
+	algo, hex, _ := strings.Cut(digest, ":")
+	return filepath.Join(c.root, blobsDir, algo, hex)
+}
+
+// diskUsage returns the bytes allocated to a file, which is less than its
+// size for sparse memory files.
+func diskUsage(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int64(st.Blocks) * 512
+	}
+	return info.Size()
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func addString(slice []string, s string) []string {
+	if containsString(slice, s) {
+		return slice
+	}
+	return append(slice, s)
+}
+
+func containsString(slice []string, s string) bool {
+	for _, v := range slice {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(slice []string, s string) []string {
+	var out []string
+	for _, v := range slice {
+		if v != s {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,251 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/oci"
+)
+
+// addSnapshot indexes a snapshot made of the given files, keyed by fake
+// layer digests.
+func addSnapshot(t *testing.T, c *Cache, digest string, files map[string]string, writable ...string) {
+	t.Helper()
+	dir := t.TempDir()
+	layers := map[string]string{}
+	for name, content := range files {
+		layers[name] = "sha256:" + content
+		if err := os.WriteFile(filepath.Join(dir, name), bytes.Repeat([]byte(content), 4096), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.add(digest, "example.com/spore:"+digest, dir, layers, writable, ""); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+}
+
+func TestCheckoutRelease(t *testing.T) {
+	c, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	addSnapshot(t, c, "a", map[string]string{"snapshot.mem": "aa", "snapshot.vmstate": "cc", "rootfs.ext4": "ee"}, "rootfs.ext4")
+	addSnapshot(t, c, "b", map[string]string{"snapshot.mem": "bb", "snapshot.vmstate": "cc"})
+
+	work := t.TempDir()
+	if err := c.Checkout("a", work); err != nil {
+		t.Fatalf("Checkout: %v", err)
+	}
+	rootfs := filepath.Join(work, "rootfs.ext4")
+	if err := os.WriteFile(rootfs, []byte("written"), 0644); err != nil {
+		t.Fatalf("rootfs checkout is not writable: %v", err)
+	}
+	if data, _ := os.ReadFile(c.blobPath("sha256:ee")); !bytes.HasPrefix(data, []byte("ee")) {
+		t.Fatal("write to the checked out rootfs reached the store")
+	}
+	data, err := os.ReadFile(filepath.Join(work, "snapshot.mem"))
+	if err != nil || !bytes.HasPrefix(data, []byte("aa")) {
+		t.Fatalf("checked out memory = %.8q, %v", data, err)
+	}
+	if err := c.Checkout("b", work); err != nil {
+		t.Fatalf("Checkout: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(work, "snapshot.mem")); !bytes.HasPrefix(data, []byte("bb")) {
+		t.Fatalf("checked out memory = %.8q, want snapshot b", data)
+	}
+	if err := c.Checkout("missing", work); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Checkout of unknown snapshot: %v", err)
+	}
+
+	list, err := c.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := map[string]int{}
+	for _, s := range list {
+		users[s.Digest] = len(s.Users)
+		if s.Size == 0 {
+			t.Errorf("snapshot %s has no size", s.Digest)
+		}
+	}
+	if users["a"] != 0 || users["b"] != 1 {
+		t.Fatalf("users = %v, want only b checked out", users)
+	}
+
+	// a checkout staged elsewhere keeps its reference when moved into place
+	moved := filepath.Join(t.TempDir(), "work")
+	if err := c.Move(work, moved); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(moved, "snapshot.mem")); !bytes.HasPrefix(data, []byte("bb")) {
+		t.Fatalf("moved memory = %.8q", data)
+	}
+	list, _ = c.List()
+	for _, s := range list {
+		if s.Digest == "b" && (len(s.Users) != 1 || s.Users[0] != moved) {
+			t.Fatalf("users of b = %v, want %s", s.Users, moved)
+		}
+	}
+	work = moved
+
+	if err := c.Release(work); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	list, _ = c.List()
+	for _, s := range list {
+		if len(s.Users) != 0 {
+			t.Fatalf("snapshot %s still used by %v", s.Digest, s.Users)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	root := t.TempDir()
+	c, err := Open(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addSnapshot(t, c, "old", map[string]string{"snapshot.mem": "aa", "snapshot.vmstate": "cc"})
+	addSnapshot(t, c, "used", map[string]string{"snapshot.mem": "bb", "snapshot.vmstate": "cc"})
+	addSnapshot(t, c, "new", map[string]string{"snapshot.mem": "dd"})
+	if err := c.Checkout("used", t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(root, blobsDir, "sha256", "orphan"), []byte("x"), 0644)
+
+	list, _ := c.List()
+	var total int64
+	for _, s := range list {
+		if s.Digest == "new" {
+			total += s.Size
+		}
+	}
+	// evicting only the least recently used snapshot brings the cache under
+	// the cap
+	evicted, err := c.Prune(diskUsage(c.blobPath("sha256:bb")) + diskUsage(c.blobPath("sha256:cc")) + total)
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if len(evicted) != 1 || evicted[0].Digest != "old" {
+		t.Fatalf("evicted %v, want old", evicted)
+	}
+	if fileExists(c.blobPath("sha256:aa")) {
+		t.Error("memory of evicted snapshot still stored")
+	}
+	if !fileExists(c.blobPath("sha256:cc")) {
+		t.Error("vmstate shared with a kept snapshot was removed")
+	}
+	if fileExists(filepath.Join(root, blobsDir, "sha256", "orphan")) {
+		t.Error("orphan blob was not removed")
+	}
+
+	// checked out snapshots are never evicted
+	if evicted, err = c.Prune(0); err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if len(evicted) != 1 || evicted[0].Digest != "new" {
+		t.Fatalf("evicted %v, want new", evicted)
+	}
+}
+
+func TestReleaseEnforcesMaxSize(t *testing.T) {
+	c, err := Open(t.TempDir(), WithMaxSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addSnapshot(t, c, "a", map[string]string{"snapshot.mem": "aa"})
+	work := t.TempDir()
+	if err := c.Checkout("a", work); err != nil {
+		t.Fatalf("Checkout of a just pulled snapshot: %v", err)
+	}
+	addSnapshot(t, c, "b", map[string]string{"snapshot.mem": "bb"})
+	if list, _ := c.List(); len(list) != 2 {
+		t.Fatalf("cached %d snapshots, want the used and the just pulled one", len(list))
+	}
+
+	if err := c.Release(work); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if list, _ := c.List(); len(list) != 0 {
+		t.Fatalf("unused snapshots over the cap were kept: %v", list)
+	}
+}
+
+func TestPullToConcurrent(t *testing.T) {
+	ctx := context.Background()
+	c, err := Open(t.TempDir(), WithMaxSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := t.TempDir()
+	for name, content := range map[string]string{"snapshot.mem": "mem", "snapshot.vmstate": "vmstate", "snapshot.config": "{}"} {
+		os.WriteFile(filepath.Join(src, name), []byte(content), 0644)
+	}
+	ref := oci.LayoutScheme + filepath.Join(t.TempDir(), "layout") + ":v1"
+	digest, err := oci.PushSnapshot(ctx, ref, filepath.Join(src, "snapshot.mem"), filepath.Join(src, "snapshot.vmstate"), filepath.Join(src, "snapshot.config"))
+	if err != nil {
+		t.Fatalf("PushSnapshot: %v", err)
+	}
+	addSnapshot(t, c, "other", map[string]string{"snapshot.mem": "aa"})
+
+	works := []string{t.TempDir(), t.TempDir()}
+	errs := make(chan error, len(works)+1)
+	var wg sync.WaitGroup
+	for _, work := range works {
+		wg.Add(1)
+		go func(work string) {
+			defer wg.Done()
+			_, err := c.PullTo(ctx, ref, work)
+			errs <- err
+		}(work)
+	}
+	// a checkout released alongside the pulls evicts whatever is unused
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		other := t.TempDir()
+		err := c.Checkout("other", other)
+		if err == nil {
+			err = c.Release(other)
+		}
+		errs <- err
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list, _ := c.List()
+	if len(list) != 1 || list[0].Digest != digest {
+		t.Fatalf("cached %v, want only %s", list, digest)
+	}
+	for _, work := range works {
+		if !containsString(list[0].Users, work) {
+			t.Errorf("checkout in %s dropped from users %v", work, list[0].Users)
+		}
+		if data, _ := os.ReadFile(filepath.Join(work, "snapshot.mem")); string(data) != "mem" {
+			t.Errorf("checked out memory in %s = %q", work, data)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for in, want := range map[string]int64{"0": 0, "4096": 4096, "512M": 512 << 20, "20G": 20 << 30, "1tb": 1 << 40} {
+		if got, err := ParseSize(in); err != nil || got != want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "G", "-1G", "1.5G", "10X"} {
+		if _, err := ParseSize(in); err == nil {
+			t.Errorf("ParseSize(%q) succeeded", in)
+		}
+	}
+}
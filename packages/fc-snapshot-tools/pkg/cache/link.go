@@ -0,0 +1,54 @@
+package cache
+
+import (
+	"os"
+
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/sparse"
+)
+
+// link places the stored file src at dst without copying its data: as a
+// reflink when the filesystem supports them, else as a hard link. Across
+// filesystems it falls back to a sparse copy. Writable files are never hard
+// linked, so that writes to them cannot reach the store.
+func link(src, dst string, writable bool) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	perm := info.Mode().Perm()
+	if writable {
+		perm = 0644
+	}
+
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if err := sparse.Reflink(out, in); err == nil {
+		return out.Close()
+	}
+	out.Close()
+	os.Remove(dst)
+
+	if !writable {
+		if err := os.Link(src, dst); err == nil {
+			return nil
+		}
+	}
+
+	if out, err = os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm); err != nil {
+		return err
+	}
+	if err := sparse.Copy(out, in, info.Size()); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,555 @@
+// Package delta encodes a snapshot memory file as page-granular operations
+// against the memory file of a related base snapshot, and applies such a
+// delta to the base to rebuild the full file.
+//
+// Pages equal to the base page at the same offset are left out of the delta.
+// Other pages are recorded as zero, as a copy of another base page, as the
+// XOR with the base page at the same offset when that leaves more zero bytes
+// than the page itself, or as data. The operations are zstd compressed, so
+// XOR pages of mostly unchanged memory take little room. The header records
+// the digests of the base and of the rebuilt file, which Apply checks.
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/sparse"
+)
+
+// PageSize is the granularity of delta operations.
+const PageSize = sparse.PageSize
+
+// ErrBaseMismatch is returned when a delta is applied to another base than
+// the one it was encoded against.
+var ErrBaseMismatch = errors.New("delta base mismatch")
+
+const (
+	magic      = "SPDELTA1"
+	headerSize = len(magic) + 4 + 8 + 8 + sha256.Size + sha256.Size
+
+	// maxRun bounds the pages of one operation, and so its payload
+	maxRun = 256
+	// ioPages is the number of pages read at once when scanning files
+	ioPages = 256
+)
+
+// Operations of the delta stream.
+const (
+	opEnd  = iota
+	opZero // the pages are zero
+	opCopy // the pages are base pages at another offset
+	opXOR  // the payload is the XOR of the pages with the base pages
+	opData // the payload is the pages
+)
+
+// Header describes a delta file.
+type Header struct {
+	PageSize   int64
+	BaseSize   int64  // size of the base file
+	Size       int64  // size of the rebuilt file
+	BaseDigest string // sha256 digest of the base file content
+	Digest     string // sha256 digest of the rebuilt file content
+}
+
+// Stats counts the pages of a file by how its delta records them.
+type Stats struct {
+	Pages     int64 `json:"pages"`
+	Unchanged int64 `json:"unchanged"` // equal to the base page at the same offset
+	Zero      int64 `json:"zero"`
+	Copied    int64 `json:"copied"` // equal to a base page at another offset
+	XOR       int64 `json:"xor"`
+	Data      int64 `json:"data"`
+	// DeltaSize is the size of the delta file
+	DeltaSize int64 `json:"deltaSize"`
+}
+
+// ReadHeader reads the header of the delta file at path. It fails for files
+// that are not deltas.
+func ReadHeader(path string) (Header, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Header{}, err
+	}
+	defer f.Close()
+	return readHeader(f)
+}
+
+// Encode writes to deltaPath the delta that rebuilds the file at target from
+// the file at base.
+func Encode(base, target, deltaPath string) (Stats, error) {
+	var st Stats
+	bf, err := os.Open(base)
+	if err != nil {
+		return st, err
+	}
+	defer bf.Close()
+	tf, err := os.Open(target)
+	if err != nil {
+		return st, err
+	}
+	defer tf.Close()
+	binfo, err := bf.Stat()
+	if err != nil {
+		return st, err
+	}
+	tinfo, err := tf.Stat()
+	if err != nil {
+		return st, err
+	}
+	h := Header{PageSize: PageSize, BaseSize: binfo.Size(), Size: tinfo.Size()}
+
+	// the base pages by content, to find pages that moved
+	pages := map[[16]byte]int64{}
+	baseHash := sha256.New()
+	err = scan(bf, h.BaseSize, baseHash, func(p int64, page []byte) error {
+		if sparse.IsZero(page) {
+			return nil
+		}
+		key := pageKey(page)
+		if _, ok := pages[key]; !ok {
+			pages[key] = p
+		}
+		return nil
+	})
+	if err != nil {
+		return st, fmt.Errorf("failed to read base: %w", err)
+	}
+	h.BaseDigest = digest(baseHash)
+
+	out, err := os.CreateTemp(filepath.Dir(deltaPath), "."+filepath.Base(deltaPath)+".*")
+	if err != nil {
+		return st, err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	if _, err := out.Write(make([]byte, headerSize)); err != nil {
+		return st, err
+	}
+	bw := bufio.NewWriter(out)
+	zw, err := zstd.NewWriter(bw)
+	if err != nil {
+		return st, err
+	}
+	enc := &encoder{w: zw}
+
+	// pages past the end of the base are compared with zeros
+	basePage := make([]byte, PageSize)
+	baseBuf := make([]byte, ioPages*PageSize)
+	var baseBufStart int64 = -1
+	readBase := func(p int64, b []byte) error {
+		if start := p / ioPages * ioPages; start != baseBufStart {
+			if err := readPadded(bf, baseBuf, start*PageSize, h.BaseSize); err != nil {
+				return err
+			}
+			baseBufStart = start
+		}
+		copy(b, baseBuf[(p-baseBufStart)*PageSize:])
+		return nil
+	}
+	moved := make([]byte, PageSize)
+	xor := make([]byte, PageSize)
+
+	targetHash := sha256.New()
+	err = scan(tf, h.Size, targetHash, func(p int64, page []byte) error {
+		st.Pages++
+		if err := readBase(p, basePage); err != nil {
+			return fmt.Errorf("failed to read base: %w", err)
+		}
+		if bytes.Equal(page, basePage) {
+			st.Unchanged++
+			return enc.skip()
+		}
+		if sparse.IsZero(page) {
+			st.Zero++
+			return enc.add(opZero, p, 0, nil)
+		}
+		if src, ok := pages[pageKey(page)]; ok {
+			if err := readPadded(bf, moved, src*PageSize, h.BaseSize); err != nil {
+				return fmt.Errorf("failed to read base: %w", err)
+			}
+			if bytes.Equal(moved, page) {
+				st.Copied++
+				return enc.add(opCopy, p, src, nil)
+			}
+		}
+		for i := range xor {
+			xor[i] = page[i] ^ basePage[i]
+		}
+		if zeroBytes(xor) > zeroBytes(page) {
+			st.XOR++
+			return enc.add(opXOR, p, 0, xor)
+		}
+		st.Data++
+		return enc.add(opData, p, 0, page)
+	})
+	if err != nil {
+		return st, err
+	}
+	h.Digest = digest(targetHash)
+
+	if err := enc.finish(); err != nil {
+		return st, err
+	}
+	if err := zw.Close(); err != nil {
+		return st, err
+	}
+	if err := bw.Flush(); err != nil {
+		return st, err
+	}
+	if _, err := out.WriteAt(h.encode(), 0); err != nil {
+		return st, err
+	}
+	info, err := out.Stat()
+	if err != nil {
+		return st, err
+	}
+	st.DeltaSize = info.Size()
+	if err := out.Close(); err != nil {
+		return st, err
+	}
+	if err := os.Rename(out.Name(), deltaPath); err != nil {
+		return st, err
+	}
+	return st, nil
+}
+
+// Apply rebuilds the file the delta at deltaPath was encoded from, using the
+// file at base, and writes it to outPath with zero pages as holes. The base
+// and the rebuilt file are checked against the digests in the delta; a base
+// that does not match fails with ErrBaseMismatch.
+func Apply(base, deltaPath, outPath string) error {
+	df, err := os.Open(deltaPath)
+	if err != nil {
+		return err
+	}
+	defer df.Close()
+	h, err := readHeader(df)
+	if err != nil {
+		return err
+	}
+
+	bf, err := os.Open(base)
+	if err != nil {
+		return err
+	}
+	defer bf.Close()
+	info, err := bf.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != h.BaseSize {
+		return fmt.Errorf("%w: base is %d bytes, delta expects %d", ErrBaseMismatch, info.Size(), h.BaseSize)
+	}
+	baseHash := sha256.New()
+	if err := scan(bf, h.BaseSize, baseHash, func(int64, []byte) error { return nil }); err != nil {
+		return fmt.Errorf("failed to read base: %w", err)
+	}
+	if d := digest(baseHash); d != h.BaseDigest {
+		return fmt.Errorf("%w: base is %s, delta expects %s", ErrBaseMismatch, d, h.BaseDigest)
+	}
+
+	zr, err := zstd.NewReader(bufio.NewReader(io.NewSectionReader(df, int64(headerSize), 1<<62)))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	out, err := os.CreateTemp(filepath.Dir(outPath), "."+filepath.Base(outPath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	sw := sparse.NewWriter(out)
+	targetHash := sha256.New()
+	w := io.MultiWriter(targetHash, sw)
+
+	pages := (h.Size + PageSize - 1) / PageSize
+	// emit writes page p of the rebuilt file, cut at its size
+	emit := func(p int64, page []byte) error {
+		_, err := w.Write(page[:min(PageSize, h.Size-p*PageSize)])
+		return err
+	}
+	buf := make([]byte, ioPages*PageSize)
+	// copyBase emits base pages [from, to) at the same offsets
+	copyBase := func(from, to int64) error {
+		for p := from; p < to; p += ioPages {
+			n := min(ioPages, to-p)
+			b := buf[:n*PageSize]
+			if err := readPadded(bf, b, p*PageSize, h.BaseSize); err != nil {
+				return fmt.Errorf("failed to read base: %w", err)
+			}
+			for i := int64(0); i < n; i++ {
+				if err := emit(p+i, b[i*PageSize:(i+1)*PageSize]); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	page := make([]byte, PageSize)
+	basePage := make([]byte, PageSize)
+	var next int64 // first page not emitted yet
+	for {
+		op, dst, count, src, err := readOp(zr)
+		if err != nil {
+			return fmt.Errorf("invalid delta: %w", err)
+		}
+		if op == opEnd {
+			break
+		}
+		if dst < next || count == 0 || dst+count > pages {
+			return fmt.Errorf("invalid delta: operation on pages %d to %d", dst, dst+count)
+		}
+		if err := copyBase(next, dst); err != nil {
+			return err
+		}
+		for i := int64(0); i < count; i++ {
+			p := dst + i
+			switch op {
+			case opZero:
+				clear(page)
+			case opCopy:
+				if err := readPadded(bf, page, (src+i)*PageSize, h.BaseSize); err != nil {
+					return fmt.Errorf("failed to read base: %w", err)
+				}
+			case opXOR, opData:
+				if _, err := io.ReadFull(zr, page); err != nil {
+					return fmt.Errorf("invalid delta: %w", err)
+				}
+				if op == opXOR {
+					if err := readPadded(bf, basePage, p*PageSize, h.BaseSize); err != nil {
+						return fmt.Errorf("failed to read base: %w", err)
+					}
+					for j := range page {
+						page[j] ^= basePage[j]
+					}
+				}
+			default:
+				return fmt.Errorf("invalid delta: unknown operation %d", op)
+			}
+			if err := emit(p, page); err != nil {
+				return err
+			}
+		}
+		next = dst + count
+	}
+	if err := copyBase(next, pages); err != nil {
+		return err
+	}
+	if err := sw.Finish(); err != nil {
+		return err
+	}
+	if d := digest(targetHash); d != h.Digest {
+		return fmt.Errorf("rebuilt file is %s, delta expects %s", d, h.Digest)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), outPath)
+}
+
+// encoder merges consecutive pages with the same operation into runs.
+type encoder struct {
+	w       io.Writer
+	op      int
+	dst     int64
+	src     int64
+	count   int64
+	payload []byte
+}
+
+// add records page dst, copied from base page src for opCopy.
+func (e *encoder) add(op int, dst, src int64, page []byte) error {
+	if e.count > 0 && (op != e.op || dst != e.dst+e.count || (op == opCopy && src != e.src+e.count) || e.count == maxRun) {
+		if err := e.flush(); err != nil {
+			return err
+		}
+	}
+	if e.count == 0 {
+		e.op, e.dst, e.src = op, dst, src
+	}
+	e.count++
+	e.payload = append(e.payload, page...)
+	return nil
+}
+
+// skip ends the current run at an unchanged page.
+func (e *encoder) skip() error {
+	if e.count == 0 {
+		return nil
+	}
+	return e.flush()
+}
+
+func (e *encoder) flush() error {
+	var rec [1 + 8 + 4 + 8]byte
+	rec[0] = byte(e.op)
+	binary.LittleEndian.PutUint64(rec[1:], uint64(e.dst))
+	binary.LittleEndian.PutUint32(rec[9:], uint32(e.count))
+	n := 13
+	if e.op == opCopy {
+		binary.LittleEndian.PutUint64(rec[13:], uint64(e.src))
+		n = len(rec)
+	}
+	if _, err := e.w.Write(rec[:n]); err != nil {
+		return err
+	}
+	if _, err := e.w.Write(e.payload); err != nil {
+		return err
+	}
+	e.count, e.payload = 0, e.payload[:0]
+	return nil
+}
+
+// finish flushes the current run and ends the stream.
+func (e *encoder) finish() error {
+	if err := e.skip(); err != nil {
+		return err
+	}
+	_, err := e.w.Write([]byte{opEnd})
+	return err
+}
+
+// readOp reads the next operation header from r.
+func readOp(r io.Reader) (op int, dst, count, src int64, err error) {
+	var rec [8 + 4 + 8]byte
+	if _, err = io.ReadFull(r, rec[:1]); err != nil {
+		return 0, 0, 0, 0, err
+	}
+	op = int(rec[0])
+	if op == opEnd {
+		return op, 0, 0, 0, nil
+	}
+	n := 12
+	if op == opCopy {
+		n = len(rec)
+	}
+	if _, err = io.ReadFull(r, rec[:n]); err != nil {
+		return 0, 0, 0, 0, err
+	}
+	dst = int64(binary.LittleEndian.Uint64(rec[0:]))
+	count = int64(binary.LittleEndian.Uint32(rec[8:]))
+	if op == opCopy {
+		src = int64(binary.LittleEndian.Uint64(rec[12:]))
+	}
+	if dst < 0 || src < 0 {
+		return 0, 0, 0, 0, fmt.Errorf("page offset out of range")
+	}
+	return op, dst, count, src, nil
+}
+
+func (h Header) encode() []byte {
+	b := make([]byte, 0, headerSize)
+	b = append(b, magic...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(h.PageSize))
+	b = binary.LittleEndian.AppendUint64(b, uint64(h.BaseSize))
+	b = binary.LittleEndian.AppendUint64(b, uint64(h.Size))
+	for _, d := range []string{h.BaseDigest, h.Digest} {
+		sum, _ := hex.DecodeString(d[len("sha256:"):])
+		b = append(b, sum...)
+	}
+	return b
+}
+
+func readHeader(r io.Reader) (Header, error) {
+	b := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, b); err != nil || string(b[:len(magic)]) != magic {
+		return Header{}, fmt.Errorf("not a memory delta")
+	}
+	b = b[len(magic):]
+	h := Header{
+		PageSize:   int64(binary.LittleEndian.Uint32(b)),
+		BaseSize:   int64(binary.LittleEndian.Uint64(b[4:])),
+		Size:       int64(binary.LittleEndian.Uint64(b[12:])),
+		BaseDigest: "sha256:" + hex.EncodeToString(b[20:52]),
+		Digest:     "sha256:" + hex.EncodeToString(b[52:84]),
+	}
+	if h.PageSize != PageSize {
+		return Header{}, fmt.Errorf("unsupported delta page size %d", h.PageSize)
+	}
+	if h.BaseSize < 0 || h.Size < 0 {
+		return Header{}, fmt.Errorf("invalid delta sizes")
+	}
+	return h, nil
+}
+
+// scan reads the first size bytes of f in order, hashing them into h, and
+// calls fn with each page, the last one padded with zeros. Holes are read as
+// zeros without touching the disk.
+func scan(f *os.File, size int64, h hash.Hash, fn func(p int64, page []byte) error) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r, err := sparse.NewReader(f)
+	if err != nil {
+		return err
+	}
+	r = io.LimitReader(r, size)
+	buf := make([]byte, ioPages*PageSize)
+	var p int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			h.Write(buf[:n])
+			// pad the last page
+			end := (n + PageSize - 1) / PageSize * PageSize
+			clear(buf[n:end])
+			for off := 0; off < end; off += PageSize {
+				if err := fn(p, buf[off:off+PageSize]); err != nil {
+					return err
+				}
+				p++
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readPadded reads len(b) bytes of f at off, with zeros past size.
+func readPadded(f *os.File, b []byte, off, size int64) error {
+	n := max(0, min(int64(len(b)), size-off))
+	if n > 0 {
+		if _, err := f.ReadAt(b[:n], off); err != nil && err != io.EOF {
+			return err
+		}
+	}
+	clear(b[n:])
+	return nil
+}
+
+func pageKey(page []byte) [16]byte {
+	sum := sha256.Sum256(page)
+	return [16]byte(sum[:16])
+}
+
+func zeroBytes(b []byte) int {
+	n := 0
+	for _, c := range b {
+		if c == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func digest(h hash.Hash) string {
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,112 @@
+package delta
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/sparse"
+)
+
+func writeFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEncodeApply(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	base := make([]byte, 64*PageSize)
+	rng.Read(base[:48*PageSize])
+
+	target := bytes.Clone(base)
+	// a few bytes change in page 3
+	target[3*PageSize+100] ^= 0xff
+	target[3*PageSize+200] ^= 0xff
+	// pages 10 and 11 are zeroed
+	clear(target[10*PageSize : 12*PageSize])
+	// pages 20 to 22 move to 40 to 42
+	copy(target[40*PageSize:43*PageSize], base[20*PageSize:23*PageSize])
+	// page 50, zero in the base, gets new data, and the file grows by half
+	// a page of data
+	rng.Read(target[50*PageSize : 51*PageSize])
+	target = append(target, bytes.Repeat([]byte{7}, PageSize/2)...)
+
+	dir := t.TempDir()
+	basePath := writeFile(t, dir, "base.mem", base)
+	targetPath := writeFile(t, dir, "snapshot.mem", target)
+	deltaPath := filepath.Join(dir, "snapshot.mem.delta")
+
+	st, err := Encode(basePath, targetPath, deltaPath)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	want := Stats{Pages: 65, Unchanged: 57, Zero: 2, Copied: 3, XOR: 1, Data: 2, DeltaSize: st.DeltaSize}
+	if st != want {
+		t.Errorf("stats = %+v, want %+v", st, want)
+	}
+	if st.DeltaSize > 4*PageSize {
+		t.Errorf("delta is %d bytes", st.DeltaSize)
+	}
+
+	h, err := ReadHeader(deltaPath)
+	if err != nil {
+		t.Fatalf("ReadHeader: %v", err)
+	}
+	if h.BaseSize != int64(len(base)) || h.Size != int64(len(target)) {
+		t.Errorf("header = %+v", h)
+	}
+
+	out := filepath.Join(dir, "rebuilt.mem")
+	if err := Apply(basePath, deltaPath, out); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	got, _ := os.ReadFile(out)
+	if !bytes.Equal(got, target) {
+		t.Fatal("rebuilt file differs from the target")
+	}
+
+	// the base must be the one the delta was encoded against
+	other := bytes.Clone(base)
+	other[0] ^= 1
+	if err := Apply(writeFile(t, dir, "other.mem", other), deltaPath, out); !errors.Is(err, ErrBaseMismatch) {
+		t.Errorf("Apply(other base) = %v, want ErrBaseMismatch", err)
+	}
+}
+
+func TestEncodeSparseBase(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 16*PageSize)
+	copy(data[5*PageSize:], bytes.Repeat([]byte{1}, PageSize))
+	basePath := writeFile(t, dir, "base.mem", data)
+	// punched or not, the base holds the same content
+	sparse.PunchZeroPages(basePath)
+
+	target := bytes.Clone(data)
+	target[0] = 1
+	targetPath := writeFile(t, dir, "snapshot.mem", target)
+	deltaPath := filepath.Join(dir, "snapshot.mem.delta")
+	if _, err := Encode(basePath, targetPath, deltaPath); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	out := filepath.Join(dir, "rebuilt.mem")
+	if err := Apply(basePath, deltaPath, out); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, target) {
+		t.Fatal("rebuilt file differs from the target")
+	}
+}
+
+func TestReadHeaderNotDelta(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "snapshot.mem", make([]byte, PageSize))
+	if _, err := ReadHeader(path); err == nil {
+		t.Error("expected error for a memory file")
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"syscall"
 	"time"
 	"unsafe"
@@ -64,6 +65,7 @@ type VMConfig struct {
 	KernelArgs        string
 	MemSizeMB         int
 	VCPUCount         int
+	CPUTemplate       string // Firecracker CPU template, e.g. T2; empty for none
 	NetworkInterfaces []NetworkInterface
 }
 
@@ -95,6 +97,14 @@ type RestoreConfig struct {
 	MemFilePath     string
 	VMStateFilePath string
 	ConfigFilePath  string
+	// DrivePaths maps drive IDs to host paths that replace the ones recorded
+	// in the snapshot. Overrides are applied before the VM is resumed, after
+	// the load, which still opens the recorded paths.
+	DrivePaths map[string]string
+	// UffdSocket, if set, loads guest memory through the Uffd memory backend
+	// from the page fault handler listening on this socket instead of from
+	// MemFilePath.
+	UffdSocket string
 }
 
 // NewClient creates a new Firecracker client
@@ -210,6 +220,9 @@ func (c *Client) configureVM(ctx context.Context, config VMConfig) error {
 		"vcpu_count":   config.VCPUCount,
 		"mem_size_mib": config.MemSizeMB,
 	}
+	if config.CPUTemplate != "" {
+		machine["cpu_template"] = config.CPUTemplate
+	}
 	if err := c.apiPut(ctx, "/machine-config", machine); err != nil {
 		return fmt.Errorf("failed to configure machine: %w", err)
 	}
@@ -355,16 +368,48 @@ func (c *Client) RestoreSnapshot(ctx context.Context, config RestoreConfig) erro
 		return fmt.Errorf("failed to start Firecracker: %w", err)
 	}
 
+	// Drive overrides can only be applied while the VM is paused, so the
+	// snapshot is loaded without resuming when any are requested.
 	load := map[string]any{
 		"snapshot_path": config.VMStateFilePath,
-		"mem_file_path": config.MemFilePath,
-		"resume_vm":     true,
+		"resume_vm":     len(config.DrivePaths) == 0,
+	}
+	if config.UffdSocket != "" {
+		load["mem_backend"] = map[string]any{
+			"backend_type": "Uffd",
+			"backend_path": config.UffdSocket,
+		}
+	} else {
+		load["mem_file_path"] = config.MemFilePath
 	}
 
 	if err := c.apiPut(ctx, "/snapshot/load", load); err != nil {
 		return fmt.Errorf("failed to load snapshot: %w", err)
 	}
 
+	if len(config.DrivePaths) == 0 {
+		return nil
+	}
+
+	ids := make([]string, 0, len(config.DrivePaths))
+	for id := range config.DrivePaths {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		drive := map[string]any{
+			"drive_id":     id,
+			"path_on_host": config.DrivePaths[id],
+		}
+		if err := c.apiPatch(ctx, fmt.Sprintf("/drives/%s", id), drive); err != nil {
+			return fmt.Errorf("failed to override drive %s: %w", id, err)
+		}
+	}
+
+	if err := c.apiPatch(ctx, "/vm", map[string]any{"state": "Resumed"}); err != nil {
+		return fmt.Errorf("failed to resume VM: %w", err)
+	}
+
 	return nil
 }
 
@@ -391,11 +436,30 @@ func (c *Client) getVMConfig(ctx context.Context) ([]byte, error) {
 		"rootfs":         rootfs,
 	}
 
+	// The version is informational, so older API servers without the
+	// endpoint are tolerated.
+	var version struct {
+		FirecrackerVersion string `json:"firecracker_version"`
+	}
+	if err := c.apiGetJSON(ctx, "/version", &version); err == nil && version.FirecrackerVersion != "" {
+		cfg["firecracker-version"] = version.FirecrackerVersion
+	}
+
 	return json.Marshal(cfg)
 }
 
 // apiPut sends a PUT request to the Firecracker API
 func (c *Client) apiPut(ctx context.Context, path string, data any) error {
+	return c.apiSend(ctx, http.MethodPut, path, data)
+}
+
+// apiPatch sends a PATCH request to the Firecracker API
+func (c *Client) apiPatch(ctx context.Context, path string, data any) error {
+	return c.apiSend(ctx, http.MethodPatch, path, data)
+}
+
+// apiSend sends a JSON request with the given method to the Firecracker API
+func (c *Client) apiSend(ctx context.Context, method, path string, data any) error {
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		return fmt.Errorf("failed to marshal JSON: %w", err)
@@ -403,7 +467,7 @@ func (c *Client) apiPut(ctx context.Context, path string, data any) error {
 
 	req, err := http.NewRequestWithContext(
 		ctx,
-		http.MethodPut,
+		method,
 		fmt.Sprintf("%s%s", c.baseURL, path),
 		bytes.NewReader(jsonData),
 	)
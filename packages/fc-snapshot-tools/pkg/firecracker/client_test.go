@@ -2,6 +2,7 @@ package firecracker
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -166,3 +167,70 @@ func TestRestoreSnapshot(t *testing.T) {
 		}
 	}
 }
+
+// Test that drive overrides load the snapshot paused, patch drives and resume
+func TestRestoreSnapshotDriveOverrides(t *testing.T) {
+	var calls []string
+	var load map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		if r.URL.Path == "/snapshot/load" {
+			json.NewDecoder(r.Body).Decode(&load)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	c, err := NewClient("fc", "jailer", "vm", "", WithHTTPClient(srv.Client()), WithBaseURL(srv.URL), WithStartFunc(func(context.Context) error { return nil }))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	rcfg := RestoreConfig{
+		MemFilePath:     "mem",
+		VMStateFilePath: "vm",
+		ConfigFilePath:  "cfg",
+		DrivePaths:      map[string]string{"rootfs": "/clones/vm.rootfs"},
+	}
+	if err := c.RestoreSnapshot(context.Background(), rcfg); err != nil {
+		t.Fatalf("RestoreSnapshot: %v", err)
+	}
+
+	if load["resume_vm"] != false {
+		t.Errorf("expected snapshot to be loaded paused, got resume_vm=%v", load["resume_vm"])
+	}
+	expected := []string{"PUT /snapshot/load", "PATCH /drives/rootfs", "PATCH /vm"}
+	if fmt.Sprint(calls) != fmt.Sprint(expected) {
+		t.Errorf("calls = %v, want %v", calls, expected)
+	}
+}
+
+// Test that a uffd socket selects the Uffd memory backend
+func TestRestoreSnapshotUffd(t *testing.T) {
+	var load struct {
+		MemFilePath string `json:"mem_file_path"`
+		MemBackend  struct {
+			BackendType string `json:"backend_type"`
+			BackendPath string `json:"backend_path"`
+		} `json:"mem_backend"`
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/snapshot/load" {
+			json.NewDecoder(r.Body).Decode(&load)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	c, err := NewClient("fc", "jailer", "vm", "", WithHTTPClient(srv.Client()), WithBaseURL(srv.URL), WithStartFunc(func(context.Context) error { return nil }))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	rcfg := RestoreConfig{MemFilePath: "mem", VMStateFilePath: "vm", ConfigFilePath: "cfg", UffdSocket: "/run/vm.uffd.sock"}
+	if err := c.RestoreSnapshot(context.Background(), rcfg); err != nil {
+		t.Fatalf("RestoreSnapshot: %v", err)
+	}
+	if load.MemFilePath != "" || load.MemBackend.BackendType != "Uffd" || load.MemBackend.BackendPath != "/run/vm.uffd.sock" {
+		t.Fatalf("unexpected snapshot load request %+v", load)
+	}
+}
@@ -0,0 +1,192 @@
+// Package ksm predicts how much guest memory kernel same-page merging can
+// share between VMs restored from snapshots, by hashing every page of their
+// memory files.
+package ksm
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/sparse"
+)
+
+// PageSize is the size of the pages compared, the page size KSM merges.
+const PageSize = sparse.PageSize
+
+// Report is the page sharing analysis of a set of memory files.
+type Report struct {
+	PageSize  int64      `json:"pageSize"`
+	Clones    int        `json:"clones"` // VMs restored from each snapshot in the estimates
+	Snapshots []Snapshot `json:"snapshots"`
+	// Pairs counts the page contents each pair of snapshots has in common
+	Pairs []Pair `json:"pairs,omitempty"`
+
+	Pages     int64 `json:"pages"`
+	ZeroPages int64 `json:"zeroPages"`
+	// DistinctPages is the number of different non-zero page contents
+	// across all snapshots
+	DistinctPages int64 `json:"distinctPages"`
+	// SharedPages is the number of non-zero page contents found in more
+	// than one snapshot
+	SharedPages int64 `json:"sharedPages"`
+
+	// Memory is the estimated node memory of Clones VMs of every snapshot
+	// without KSM, MemoryKSM with KSM merging identical pages across them
+	Memory    int64 `json:"memoryBytes"`
+	MemoryKSM int64 `json:"memoryKsmBytes"`
+}
+
+// Snapshot is the analysis of one memory file. Its pages are either zero,
+// unique to the snapshot or shared with another snapshot.
+type Snapshot struct {
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	Pages     int64  `json:"pages"`
+	ZeroPages int64  `json:"zeroPages"`
+	// UniquePages have contents no other snapshot has, SharedPages contents
+	// at least one other snapshot has too
+	UniquePages int64 `json:"uniquePages"`
+	SharedPages int64 `json:"sharedPages"`
+	// DistinctPages is the number of different non-zero page contents, less
+	// than the non-zero pages when the snapshot repeats pages itself
+	DistinctPages int64 `json:"distinctPages"`
+
+	// Memory is the estimated node memory of the clones of this snapshot
+	// alone without KSM, MemoryKSM with KSM
+	Memory    int64 `json:"memoryBytes"`
+	MemoryKSM int64 `json:"memoryKsmBytes"`
+}
+
+// Pair is the overlap of two snapshots.
+type Pair struct {
+	A           string `json:"a"`
+	B           string `json:"b"`
+	SharedPages int64  `json:"sharedPages"` // page contents both have
+}
+
+// pageKey identifies page contents by a truncated sha256 digest.
+type pageKey [16]byte
+
+// Analyze hashes every page of the memory files at paths and reports which
+// pages are zero, unique to a snapshot or shared between snapshots, and the
+// node memory clones VMs of each snapshot would take with and without KSM.
+//
+// The estimates assume restored VMs touch all of their non-zero pages, that
+// zero pages map the shared zero page, and that KSM has merged every
+// identical page; its own bookkeeping is left out.
+func Analyze(paths []string, clones int) (*Report, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no memory files")
+	}
+	if clones < 1 {
+		return nil, fmt.Errorf("invalid clone count %d", clones)
+	}
+
+	r := &Report{PageSize: PageSize, Clones: clones}
+	contents := make([]map[pageKey]int64, len(paths))
+	owners := map[pageKey]int{}
+	for i, path := range paths {
+		s, pages, err := hashPages(path)
+		if err != nil {
+			return nil, err
+		}
+		r.Snapshots = append(r.Snapshots, s)
+		contents[i] = pages
+		for k := range pages {
+			owners[k]++
+		}
+	}
+
+	for i := range r.Snapshots {
+		s := &r.Snapshots[i]
+		for k, n := range contents[i] {
+			if owners[k] > 1 {
+				s.SharedPages += n
+			} else {
+				s.UniquePages += n
+			}
+		}
+		s.DistinctPages = int64(len(contents[i]))
+		s.Memory = int64(clones) * (s.Pages - s.ZeroPages) * PageSize
+		s.MemoryKSM = s.DistinctPages * PageSize
+
+		r.Pages += s.Pages
+		r.ZeroPages += s.ZeroPages
+		r.Memory += s.Memory
+		for j := i + 1; j < len(paths); j++ {
+			p := Pair{A: s.Path, B: paths[j]}
+			small, large := contents[i], contents[j]
+			if len(small) > len(large) {
+				small, large = large, small
+			}
+			for k := range small {
+				if _, ok := large[k]; ok {
+					p.SharedPages++
+				}
+			}
+			r.Pairs = append(r.Pairs, p)
+		}
+	}
+	r.DistinctPages = int64(len(owners))
+	for _, n := range owners {
+		if n > 1 {
+			r.SharedPages++
+		}
+	}
+	r.MemoryKSM = r.DistinctPages * PageSize
+	return r, nil
+}
+
+// hashPages counts the zero pages of the memory file at path and the
+// occurrences of each non-zero page content. Holes are counted as zero pages
+// without being read.
+func hashPages(path string) (Snapshot, map[pageKey]int64, error) {
+	s := Snapshot{Path: path}
+	f, err := os.Open(path)
+	if err != nil {
+		return s, nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return s, nil, err
+	}
+	s.Size = info.Size()
+	s.Pages = (s.Size + PageSize - 1) / PageSize
+
+	extents, err := sparse.DataExtents(f, s.Size)
+	if err != nil {
+		return s, nil, fmt.Errorf("failed to find data in %s: %w", path, err)
+	}
+	pages := map[pageKey]int64{}
+	buf := make([]byte, 1<<20)
+	var read int64    // end of the pages hashed, in pages
+	var nonZero int64 // non-zero pages hashed
+	for _, e := range extents {
+		// extents are widened to whole pages; pages straddling two extents
+		// are hashed with the first
+		start := max(e.Offset/PageSize*PageSize, read*PageSize)
+		end := min((e.End()+PageSize-1)/PageSize*PageSize, s.Size)
+		for off := start; off < end; {
+			n := min(int64(len(buf)), end-off)
+			if _, err := f.ReadAt(buf[:n], off); err != nil && err != io.EOF {
+				return s, nil, fmt.Errorf("failed to read %s: %w", path, err)
+			}
+			for p := int64(0); p < n; p += PageSize {
+				page := buf[p:min(p+PageSize, n)]
+				if sparse.IsZero(page) {
+					continue
+				}
+				nonZero++
+				sum := sha256.Sum256(page)
+				pages[pageKey(sum[:16])]++
+			}
+			off += n
+		}
+		read = (end + PageSize - 1) / PageSize
+	}
+	s.ZeroPages = s.Pages - nonZero
+	return s, pages, nil
+}
@@ -0,0 +1,83 @@
+package ksm
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/sparse"
+)
+
+// writeMem writes a memory file of pages filled with the given bytes, 0
+// being a zero page.
+func writeMem(t *testing.T, fills ...byte) string {
+	t.Helper()
+	var data []byte
+	for _, b := range fills {
+		data = append(data, bytes.Repeat([]byte{b}, PageSize)...)
+	}
+	path := filepath.Join(t.TempDir(), "snapshot.mem")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAnalyze(t *testing.T) {
+	a := writeMem(t, 'a', 'b', 0, 'a', 'c')
+	b := writeMem(t, 'a', 'd', 0, 0)
+	// holes count as zero pages, whether or not the filesystem punches them
+	sparse.PunchZeroPages(b)
+
+	r, err := Analyze([]string{a, b}, 10)
+	if err != nil {
+		t.Fatalf("Analyze: %v", err)
+	}
+
+	for i, want := range []Snapshot{
+		{Path: a, Size: 5 * PageSize, Pages: 5, ZeroPages: 1, UniquePages: 2, SharedPages: 2, DistinctPages: 3,
+			Memory: 10 * 4 * PageSize, MemoryKSM: 3 * PageSize},
+		{Path: b, Size: 4 * PageSize, Pages: 4, ZeroPages: 2, UniquePages: 1, SharedPages: 1, DistinctPages: 2,
+			Memory: 10 * 2 * PageSize, MemoryKSM: 2 * PageSize},
+	} {
+		if r.Snapshots[i] != want {
+			t.Errorf("snapshot %d = %+v, want %+v", i, r.Snapshots[i], want)
+		}
+	}
+	if len(r.Pairs) != 1 || r.Pairs[0] != (Pair{A: a, B: b, SharedPages: 1}) {
+		t.Errorf("pairs = %+v", r.Pairs)
+	}
+	if r.Pages != 9 || r.ZeroPages != 3 || r.DistinctPages != 4 || r.SharedPages != 1 {
+		t.Errorf("totals = %d pages, %d zero, %d distinct, %d shared", r.Pages, r.ZeroPages, r.DistinctPages, r.SharedPages)
+	}
+	if r.Memory != 10*6*PageSize || r.MemoryKSM != 4*PageSize {
+		t.Errorf("memory = %d, with KSM %d", r.Memory, r.MemoryKSM)
+	}
+}
+
+func TestAnalyzePartialPage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.mem")
+	if err := os.WriteFile(path, append(make([]byte, PageSize), 'x'), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Analyze([]string{path}, 1)
+	if err != nil {
+		t.Fatalf("Analyze: %v", err)
+	}
+	if s := r.Snapshots[0]; s.Pages != 2 || s.ZeroPages != 1 || s.UniquePages != 1 {
+		t.Errorf("snapshot = %+v", s)
+	}
+}
+
+func TestAnalyzeErrors(t *testing.T) {
+	if _, err := Analyze(nil, 1); err == nil {
+		t.Error("expected error without memory files")
+	}
+	if _, err := Analyze([]string{writeMem(t, 'a')}, 0); err == nil {
+		t.Error("expected error for zero clones")
+	}
+	if _, err := Analyze([]string{filepath.Join(t.TempDir(), "missing.mem")}, 1); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
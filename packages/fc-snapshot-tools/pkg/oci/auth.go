@@ -0,0 +1,389 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Credential holds the secret used to authenticate to a registry. An
+// IdentityToken is an OAuth2 refresh token exchanged for access tokens; a
+// RegistryToken is sent as a bearer token as is.
+type Credential struct {
+	Username      string
+	Password      string
+	IdentityToken string
+	RegistryToken string
+}
+
+// IsEmpty reports whether c holds no secret, i.e. anonymous access.
+func (c Credential) IsEmpty() bool {
+	return c == Credential{}
+}
+
+// CredentialStore looks up the credential for a registry host such as
+// "ghcr.io" or "docker.io". Stores return an empty credential, not an error,
+// when they have nothing for the host.
+type CredentialStore interface {
+	Credential(ctx context.Context, registry string) (Credential, error)
+}
+
+// StaticCredentials is a CredentialStore backed by a map of registry host to
+// credential.
+type StaticCredentials map[string]Credential
+
+// Credential implements CredentialStore.
+func (s StaticCredentials) Credential(_ context.Context, registry string) (Credential, error) {
+	return s[normalizeRegistry(registry)], nil
+}
+
+// CredentialStores tries each store in order and returns the first non-empty
+// credential.
+type CredentialStores []CredentialStore
+
+// Credential implements CredentialStore.
+func (s CredentialStores) Credential(ctx context.Context, registry string) (Credential, error) {
+	for _, store := range s {
+		cred, err := store.Credential(ctx, registry)
+		if err != nil {
+			return Credential{}, err
+		}
+		if !cred.IsEmpty() {
+			return cred, nil
+		}
+	}
+	return Credential{}, nil
+}
+
+// DockerConfig is the credential section of a Docker config.json, also used
+// by Kubernetes image pull secrets.
+type DockerConfig struct {
+	Auths       map[string]DockerAuth `json:"auths"`
+	CredsStore  string                `json:"credsStore,omitempty"`
+	CredHelpers map[string]string     `json:"credHelpers,omitempty"`
+}
+
+// DockerAuth is a single entry of the auths section of a Docker config.
+type DockerAuth struct {
+	Auth          string `json:"auth,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+	RegistryToken string `json:"registrytoken,omitempty"`
+}
+
+// ParseDockerConfig parses a Docker config.json or the content of a
+// kubernetes.io/dockerconfigjson secret. The legacy .dockercfg format, which
+// holds the auths map at the top level, is accepted as well.
+func ParseDockerConfig(data []byte) (*DockerConfig, error) {
+	var cfg DockerConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse docker config: %w", err)
+	}
+	if cfg.Auths == nil && cfg.CredsStore == "" && cfg.CredHelpers == nil {
+		if err := json.Unmarshal(data, &cfg.Auths); err != nil {
+			return nil, fmt.Errorf("failed to parse docker config: %w", err)
+		}
+	}
+
+	auths := make(map[string]DockerAuth, len(cfg.Auths))
+	for host, a := range cfg.Auths {
+		auths[normalizeRegistry(host)] = a
+	}
+	cfg.Auths = auths
+	helpers := make(map[string]string, len(cfg.CredHelpers))
+	for host, h := range cfg.CredHelpers {
+		helpers[normalizeRegistry(host)] = h
+	}
+	cfg.CredHelpers = helpers
+	return &cfg, nil
+}
+
+// LoadDockerConfig reads config.json from $DOCKER_CONFIG or ~/.docker. A
+// missing file yields an empty config.
+func LoadDockerConfig() (*DockerConfig, error) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return &DockerConfig{}, nil
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return &DockerConfig{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseDockerConfig(data)
+}
+
+// Credential implements CredentialStore. Per-registry credential helpers take
+// precedence over inline auths, which take precedence over the default
+// credential store.
+func (c *DockerConfig) Credential(ctx context.Context, registry string) (Credential, error) {
+	registry = normalizeRegistry(registry)
+	if helper, ok := c.CredHelpers[registry]; ok {
+		return credentialFromHelper(ctx, helper, registry)
+	}
+	if a, ok := c.Auths[registry]; ok {
+		return a.credential()
+	}
+	if c.CredsStore != "" {
+		return credentialFromHelper(ctx, c.CredsStore, registry)
+	}
+	return Credential{}, nil
+}
+
+func (a DockerAuth) credential() (Credential, error) {
+	cred := Credential{
+		Username:      a.Username,
+		Password:      a.Password,
+		IdentityToken: a.IdentityToken,
+		RegistryToken: a.RegistryToken,
+	}
+	if a.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+		if err != nil {
+			return Credential{}, fmt.Errorf("invalid auth in docker config: %w", err)
+		}
+		user, pass, ok := strings.Cut(string(decoded), ":")
+		if !ok {
+			return Credential{}, fmt.Errorf("invalid auth in docker config: missing ':'")
+		}
+		cred.Username, cred.Password = user, pass
+	}
+	return cred, nil
+}
+
+// credentialFromHelper runs docker-credential-<helper> get for registry.
+func credentialFromHelper(ctx context.Context, helper, registry string) (Credential, error) {
+	server := registry
+	if registry == dockerHubRegistry {
+		server = "https://index.docker.io/v1/"
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// helpers report unknown registries on stdout and exit non-zero
+		if strings.Contains(stdout.String(), "credentials not found") {
+			return Credential{}, nil
+		}
+		return Credential{}, fmt.Errorf("credential helper %s: %s: %w", helper, strings.TrimSpace(stdout.String()+stderr.String()), err)
+	}
+
+	var out struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return Credential{}, fmt.Errorf("credential helper %s: invalid output: %w", helper, err)
+	}
+	if out.Username == "<token>" {
+		return Credential{IdentityToken: out.Secret}, nil
+	}
+	return Credential{Username: out.Username, Password: out.Secret}, nil
+}
+
+// dockerConfigCredentials is the default CredentialStore. It loads the
+// Docker config of the current user on first use.
+type dockerConfigCredentials struct {
+	once sync.Once
+	cfg  *DockerConfig
+	err  error
+}
+
+// Credential implements CredentialStore.
+func (d *dockerConfigCredentials) Credential(ctx context.Context, registry string) (Credential, error) {
+	d.once.Do(func() { d.cfg, d.err = LoadDockerConfig() })
+	if d.err != nil {
+		return Credential{}, fmt.Errorf("failed to load docker config: %w", d.err)
+	}
+	return d.cfg.Credential(ctx, registry)
+}
+
+// normalizeRegistry maps the various spellings of a registry in Docker
+// configs and API URLs to the host used in references.
+func normalizeRegistry(s string) string {
+	if u, err := url.Parse(s); err == nil && u.Host != "" {
+		s = u.Host
+	}
+	s = strings.TrimSuffix(s, "/")
+	switch s {
+	case "index.docker.io", dockerHubEndpoint:
+		return dockerHubRegistry
+	}
+	return s
+}
+
+// authorizer obtains and caches Authorization headers per repository.
+type authorizer struct {
+	store      CredentialStore
+	httpClient *http.Client
+
+	mu      sync.Mutex
+	headers map[string]string
+}
+
+func newAuthorizer(store CredentialStore, hc *http.Client) *authorizer {
+	return &authorizer{store: store, httpClient: hc, headers: map[string]string{}}
+}
+
+// cached returns the Authorization header last used for key.
+func (a *authorizer) cached(key string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.headers[key]
+}
+
+// authorize answers the challenge in a 401 response and caches the resulting
+// Authorization header for key.
+func (a *authorizer) authorize(ctx context.Context, key, registry string, resp *http.Response) (string, error) {
+	scheme, params := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+
+	cred, err := a.store.Credential(ctx, registry)
+	if err != nil {
+		return "", err
+	}
+
+	var header string
+	switch scheme {
+	case "basic":
+		if cred.Username == "" {
+			return "", fmt.Errorf("registry %s requires basic auth: %w", registry, ErrUnauthorized)
+		}
+		header = "Basic " + base64.StdEncoding.EncodeToString([]byte(cred.Username+":"+cred.Password))
+	case "bearer":
+		token := cred.RegistryToken
+		if token == "" {
+			token, err = a.fetchToken(ctx, params, cred)
+			if err != nil {
+				return "", err
+			}
+		}
+		header = "Bearer " + token
+	default:
+		return "", fmt.Errorf("unsupported auth challenge %q: %w", scheme, ErrUnauthorized)
+	}
+
+	a.mu.Lock()
+	a.headers[key] = header
+	a.mu.Unlock()
+	return header, nil
+}
+
+// fetchToken performs the token exchange described by a bearer challenge.
+// Identity tokens use the OAuth2 refresh token grant; other credentials use
+// basic auth against the token endpoint.
+func (a *authorizer) fetchToken(ctx context.Context, params map[string]string, cred Credential) (string, error) {
+	realm := params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("bearer challenge without realm: %w", ErrUnauthorized)
+	}
+
+	var req *http.Request
+	var err error
+	if cred.IdentityToken != "" {
+		form := url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {cred.IdentityToken},
+			"service":       {params["service"]},
+			"client_id":     {"sporelet"},
+		}
+		if params["scope"] != "" {
+			form.Set("scope", params["scope"])
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, realm, strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		u, err := url.Parse(realm)
+		if err != nil {
+			return "", fmt.Errorf("invalid token realm %q: %w", realm, err)
+		}
+		q := u.Query()
+		if params["service"] != "" {
+			q.Set("service", params["service"])
+		}
+		if params["scope"] != "" {
+			q.Set("scope", params["scope"])
+		}
+		u.RawQuery = q.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return "", err
+		}
+		if cred.Username != "" {
+			req.SetBasicAuth(cred.Username, cred.Password)
+		}
+	}
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request: %w", newRegistryError(req, resp))
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("invalid token response: %w", err)
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	if body.AccessToken != "" {
+		return body.AccessToken, nil
+	}
+	return "", fmt.Errorf("token response without token: %w", ErrUnauthorized)
+}
+
+// parseChallenge parses a WWW-Authenticate header into its lower-cased scheme
+// and parameters.
+func parseChallenge(h string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(h), " ")
+	params := map[string]string{}
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		key, after, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		var value string
+		if strings.HasPrefix(after, `"`) {
+			end := strings.Index(after[1:], `"`)
+			if end < 0 {
+				value, rest = after[1:], ""
+			} else {
+				value, rest = after[1:end+1], after[end+2:]
+			}
+		} else {
+			value, rest, _ = strings.Cut(after, ",")
+		}
+		params[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+	return strings.ToLower(scheme), params
+}
@@ -0,0 +1,123 @@
+package oci
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// requireBearer makes reg demand a token issued by a token server that only
+// accepts user:secret.
+func requireBearer(t *testing.T, reg *testRegistry) {
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "user" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"token":"token-for-%s"}`, r.URL.Query().Get("scope"))
+	}))
+	t.Cleanup(tokenSrv.Close)
+
+	reg.authorize = func(w http.ResponseWriter, req *http.Request) bool {
+		if req.Header.Get("Authorization") == "Bearer token-for-repository:sporelet/layer1:pull,push" {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:sporelet/layer1:pull,push"`, tokenSrv.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+}
+
+func TestBearerAuth(t *testing.T) {
+	reg := newTestRegistry(t)
+	requireBearer(t, reg)
+	mem, vm, cfg := writeSnapshot(t, t.TempDir())
+	ref := reg.host() + "/sporelet/layer1:dev"
+	ctx := context.Background()
+
+	creds := StaticCredentials{reg.host(): {Username: "user", Password: "secret"}}
+	if _, err := PushSnapshot(ctx, ref, mem, vm, cfg, WithPlainHTTP(true), WithCredentialStore(creds)); err != nil {
+		t.Fatalf("PushSnapshot: %v", err)
+	}
+	if err := PullSnapshot(ctx, ref, t.TempDir(), WithPlainHTTP(true), WithCredentialStore(creds)); err != nil {
+		t.Fatalf("PullSnapshot: %v", err)
+	}
+
+	wrong := StaticCredentials{reg.host(): {Username: "user", Password: "wrong"}}
+	err := PullSnapshot(ctx, ref, t.TempDir(), WithPlainHTTP(true), WithCredentialStore(wrong))
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected ErrUnauthorized, got %v", err)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	reg := newTestRegistry(t)
+	reg.authorize = func(w http.ResponseWriter, req *http.Request) bool {
+		if user, pass, ok := req.BasicAuth(); ok && user == "user" && pass == "secret" {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	mem, vm, cfg := writeSnapshot(t, t.TempDir())
+
+	creds := StaticCredentials{reg.host(): {Username: "user", Password: "secret"}}
+	if _, err := PushSnapshot(context.Background(), reg.host()+"/snap:dev", mem, vm, cfg, WithPlainHTTP(true), WithCredentialStore(creds)); err != nil {
+		t.Fatalf("PushSnapshot: %v", err)
+	}
+}
+
+func TestDockerConfigCredentials(t *testing.T) {
+	dir := t.TempDir()
+	auth := base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	config := fmt.Sprintf(`{
+		"auths": {
+			"https://index.docker.io/v1/": {"auth": %q},
+			"ghcr.io": {"identitytoken": "refresh"}
+		},
+		"credHelpers": {"helper.example": "fake"}
+	}`, auth)
+	os.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600)
+	t.Setenv("DOCKER_CONFIG", dir)
+
+	// a fake docker-credential-fake helper on PATH
+	helper := "#!/bin/sh\nread server\necho '{\"ServerURL\":\"'$server'\",\"Username\":\"bot\",\"Secret\":\"helper-secret\"}'\n"
+	os.WriteFile(filepath.Join(dir, "docker-credential-fake"), []byte(helper), 0755)
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	cfg, err := LoadDockerConfig()
+	if err != nil {
+		t.Fatalf("LoadDockerConfig: %v", err)
+	}
+	ctx := context.Background()
+	tests := map[string]Credential{
+		"docker.io":      {Username: "user", Password: "secret"},
+		"ghcr.io":        {IdentityToken: "refresh"},
+		"helper.example": {Username: "bot", Password: "helper-secret"},
+		"other.example":  {},
+	}
+	for registry, want := range tests {
+		got, err := cfg.Credential(ctx, registry)
+		if err != nil {
+			t.Fatalf("Credential(%s): %v", registry, err)
+		}
+		if got != want {
+			t.Errorf("Credential(%s) = %+v, want %+v", registry, got, want)
+		}
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.example/token",service="registry.example",scope="repository:a/b:pull,push"`)
+	if scheme != "bearer" || params["realm"] != "https://auth.example/token" || params["service"] != "registry.example" || params["scope"] != "repository:a/b:pull,push" {
+		t.Fatalf("parseChallenge = %s %v", scheme, params)
+	}
+}
@@ -0,0 +1,375 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/sparse"
+)
+
+const (
+	// MediaTypeChunkIndex is the media type of a layer listing the chunks a
+	// file was split into. Its AnnotationChunkedMediaType annotation holds
+	// the media type of the reassembled file.
+	MediaTypeChunkIndex = "application/vnd.sporelet.chunk-index.v1+json"
+	// MediaTypeChunk is the media type of a single content-defined chunk
+	MediaTypeChunk = "application/vnd.sporelet.chunk.v1"
+
+	// AnnotationChunkedMediaType records the media type of a chunked file
+	AnnotationChunkedMediaType = "ai.sporelet.chunked.media-type"
+
+	// maxChunkIndexSize bounds the size of a chunk index read into memory
+	maxChunkIndexSize = 16 << 20
+)
+
+// ChunkIndex lists the chunks of a file in order.
+type ChunkIndex struct {
+	MediaType string  `json:"mediaType"` // media type of the reassembled file
+	Digest    string  `json:"digest"`    // digest of the reassembled file
+	Size      int64   `json:"size"`
+	Chunks    []Chunk `json:"chunks"`
+}
+
+// Chunk is a slice of a file stored as its own blob.
+type Chunk struct {
+	Digest string `json:"digest"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+// validate checks that the chunks are well-formed and cover the file exactly.
+func (idx ChunkIndex) validate() error {
+	if err := validateDigest(idx.Digest); err != nil {
+		return err
+	}
+	var off int64
+	for _, c := range idx.Chunks {
+		if err := validateDigest(c.Digest); err != nil {
+			return fmt.Errorf("chunk at offset %d: %w", c.Offset, err)
+		}
+		if c.Offset != off || c.Size <= 0 {
+			return fmt.Errorf("chunk at offset %d does not follow previous chunk", c.Offset)
+		}
+		off += c.Size
+	}
+	if off != idx.Size {
+		return fmt.Errorf("chunks cover %d bytes, file has %d", off, idx.Size)
+	}
+	return nil
+}
+
+// chunkerParams bound the size of content-defined chunks.
+type chunkerParams struct {
+	min, avg, max int
+}
+
+// defaultChunkerParams give 2 MiB chunks on average, large enough to keep
+// the manifest of a multi-GiB memory file small and small enough that a
+// change to a few pages only invalidates a few chunks.
+var defaultChunkerParams = chunkerParams{min: 512 << 10, avg: 2 << 20, max: 8 << 20}
+
+// gear is the random table of the gear rolling hash.
+var gear = func() (t [256]uint64) {
+	// splitmix64 keeps the table, and therefore chunk boundaries, stable
+	// across builds
+	x := uint64(0x5370_6f72_656c_6574)
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		t[i] = z ^ z>>31
+	}
+	return t
+}()
+
+// cutPoint returns the length of the first chunk in data using FastCDC: no
+// cut before min, a harder cut condition until avg and an easier one after,
+// and a forced cut at max.
+func (p chunkerParams) cutPoint(data []byte) int {
+	n := len(data)
+	if n <= p.min {
+		return n
+	}
+	if n > p.max {
+		n = p.max
+	}
+	normal := p.avg
+	if normal > n {
+		normal = n
+	}
+
+	// the hash shifts left, so the top bits depend on the most bytes
+	b := bits.Len(uint(p.avg)) - 1
+	maskS := ^uint64(0) << (64 - (b + 2))
+	maskL := ^uint64(0) << (64 - (b - 2))
+
+	var h uint64
+	i := p.min
+	for ; i < normal; i++ {
+		h = h<<1 + gear[data[i]]
+		if h&maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = h<<1 + gear[data[i]]
+		if h&maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// split reads r to the end and calls fn with each chunk. data is only valid
+// until fn returns.
+func (p chunkerParams) split(r io.Reader, fn func(offset int64, data []byte) error) error {
+	buf := make([]byte, p.max)
+	var n int
+	var off int64
+	eof := false
+	for {
+		if !eof {
+			m, err := io.ReadFull(r, buf[n:])
+			n += m
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if n == 0 {
+			return nil
+		}
+		cut := p.cutPoint(buf[:n])
+		if err := fn(off, buf[:cut]); err != nil {
+			return err
+		}
+		off += int64(cut)
+		n = copy(buf, buf[cut:n])
+	}
+}
+
+// pushChunked splits a file into chunks, uploads the chunks the repository
+// does not have yet and then the chunk index. It returns the index layer and
+// the distinct chunk layers.
+func (c *Client) pushChunked(ctx context.Context, ref Reference, file snapshotFile, p chunkerParams) (Descriptor, []Descriptor, error) {
+	f, err := os.Open(file.path)
+	if err != nil {
+		return Descriptor{}, nil, err
+	}
+	defer f.Close()
+	// holes are chunked as zeros without reading them
+	r, err := sparse.NewReader(f)
+	if err != nil {
+		return Descriptor{}, nil, err
+	}
+
+	idx := ChunkIndex{MediaType: file.mediaType}
+	var layers []Descriptor
+	seen := map[string]bool{}
+	h := sha256.New()
+	err = p.split(r, func(off int64, data []byte) error {
+		h.Write(data)
+		chunk := Descriptor{MediaType: MediaTypeChunk, Digest: digestBytes(data), Size: int64(len(data))}
+		idx.Chunks = append(idx.Chunks, Chunk{Digest: chunk.Digest, Offset: off, Size: chunk.Size})
+		idx.Size = off + chunk.Size
+		if seen[chunk.Digest] {
+			return nil
+		}
+		seen[chunk.Digest] = true
+		layers = append(layers, chunk)
+		return c.pushBlobIfMissing(ctx, ref, chunk, func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		})
+	})
+	if err != nil {
+		return Descriptor{}, nil, err
+	}
+	idx.Digest = fmt.Sprintf("sha256:%x", h.Sum(nil))
+
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return Descriptor{}, nil, err
+	}
+	layer := Descriptor{
+		MediaType: MediaTypeChunkIndex,
+		Digest:    digestBytes(data),
+		Size:      int64(len(data)),
+		Annotations: map[string]string{
+			AnnotationTitle:            filepath.Base(file.path),
+			AnnotationChunkedMediaType: file.mediaType,
+		},
+	}
+	if err := c.pushBlobIfMissing(ctx, ref, layer, func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}); err != nil {
+		return Descriptor{}, nil, err
+	}
+	return layer, layers, nil
+}
+
+// fetchChunked reassembles a chunked file at path. Chunks found in store are
+// copied from there; missing chunks are downloaded and added to the store.
+// An empty store downloads every chunk.
+func (c *Client) fetchChunked(ctx context.Context, ref Reference, layer Descriptor, manifest Manifest, path, store string) error {
+	idx, err := c.fetchChunkIndex(ctx, ref, layer, manifest)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if store != "" {
+		if err := c.prefetchChunks(ctx, ref, idx, store); err != nil {
+			return err
+		}
+	} else {
+		for _, chunk := range idx.Chunks {
+			c.progress.add(chunk.Size)
+		}
+	}
+
+	h := sha256.New()
+	sw := sparse.NewWriter(tmp)
+	w := io.MultiWriter(sw, h)
+	for _, chunk := range idx.Chunks {
+		if err := c.copyChunk(ctx, ref, chunk, w, store); err != nil {
+			return fmt.Errorf("failed to fetch chunk %s: %w", chunk.Digest, err)
+		}
+	}
+	if err := sw.Finish(); err != nil {
+		return err
+	}
+	if got := fmt.Sprintf("sha256:%x", h.Sum(nil)); got != idx.Digest {
+		return fmt.Errorf("%w: reassembled file has digest %s, expected %s", ErrDigestMismatch, got, idx.Digest)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// prefetchChunks downloads the chunks of idx missing from store in parallel.
+func (c *Client) prefetchChunks(ctx context.Context, ref Reference, idx ChunkIndex, store string) error {
+	var missing []Chunk
+	queued := map[string]bool{}
+	for _, chunk := range idx.Chunks {
+		if queued[chunk.Digest] {
+			continue
+		}
+		queued[chunk.Digest] = true
+		if _, err := os.Stat(chunkPath(store, chunk.Digest)); errors.Is(err, os.ErrNotExist) {
+			missing = append(missing, chunk)
+			c.progress.add(chunk.Size)
+		}
+	}
+	return parallel(ctx, c.concurrency, len(missing), func(ctx context.Context, i int) error {
+		chunk := missing[i]
+		path := chunkPath(store, chunk.Digest)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		desc := Descriptor{MediaType: MediaTypeChunk, Digest: chunk.Digest, Size: chunk.Size}
+		if err := c.fetchBlobToFile(ctx, ref, desc, path); err != nil {
+			return fmt.Errorf("failed to fetch chunk %s: %w", chunk.Digest, err)
+		}
+		return nil
+	})
+}
+
+// fetchChunkIndex downloads and validates the chunk index of a layer.
+func (c *Client) fetchChunkIndex(ctx context.Context, ref Reference, layer Descriptor, manifest Manifest) (ChunkIndex, error) {
+	var idx ChunkIndex
+	rc, err := c.FetchBlob(ctx, ref, layer)
+	if err != nil {
+		return idx, err
+	}
+	data, err := io.ReadAll(io.LimitReader(rc, maxChunkIndexSize))
+	rc.Close()
+	if err != nil {
+		return idx, fmt.Errorf("failed to read chunk index: %w", err)
+	}
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return idx, fmt.Errorf("failed to decode chunk index: %w", err)
+	}
+	if err := idx.validate(); err != nil {
+		return idx, fmt.Errorf("invalid chunk index: %w", err)
+	}
+
+	// only chunks the manifest references are protected from registry
+	// garbage collection, so refuse indexes pointing anywhere else
+	listed := map[string]bool{}
+	for _, l := range manifest.Layers {
+		if l.MediaType == MediaTypeChunk {
+			listed[l.Digest] = true
+		}
+	}
+	for _, chunk := range idx.Chunks {
+		if !listed[chunk.Digest] {
+			return idx, fmt.Errorf("chunk %s is not listed in the manifest", chunk.Digest)
+		}
+	}
+	return idx, nil
+}
+
+// copyChunk writes a chunk to w, from the local store if it has the chunk.
+func (c *Client) copyChunk(ctx context.Context, ref Reference, chunk Chunk, w io.Writer, store string) error {
+	if store != "" {
+		f, err := os.Open(chunkPath(store, chunk.Digest))
+		if err == nil {
+			defer f.Close()
+			_, err = io.Copy(w, io.LimitReader(f, chunk.Size))
+			return err
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	desc := Descriptor{MediaType: MediaTypeChunk, Digest: chunk.Digest, Size: chunk.Size}
+	if store == "" {
+		rc, err := c.FetchBlob(ctx, ref, desc)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		_, err = io.Copy(w, c.progress.reader(rc))
+		return err
+	}
+
+	path := chunkPath(store, chunk.Digest)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := c.fetchBlobToFile(ctx, ref, desc, path); err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// chunkPath returns where a chunk is kept in a local chunk store.
+func chunkPath(store, digest string) string {
+	algo, hex, _ := strings.Cut(digest, ":")
+	return filepath.Join(store, algo, hex)
+}
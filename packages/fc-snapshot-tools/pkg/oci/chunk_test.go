@@ -0,0 +1,142 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testChunkerParams = chunkerParams{min: 256, avg: 1024, max: 4096}
+
+// withTestChunking enables chunking with small chunks.
+func withTestChunking() Option {
+	return func(o *options) {
+		p := testChunkerParams
+		o.chunking = &p
+	}
+}
+
+func splitDigests(t *testing.T, p chunkerParams, data []byte) []string {
+	t.Helper()
+	var digests []string
+	var joined []byte
+	err := p.split(bytes.NewReader(data), func(off int64, chunk []byte) error {
+		if int(off) != len(joined) {
+			t.Fatalf("chunk at offset %d, expected %d", off, len(joined))
+		}
+		if len(chunk) > p.max || (len(chunk) < p.min && int(off)+len(chunk) != len(data)) {
+			t.Fatalf("chunk of %d bytes outside [%d, %d]", len(chunk), p.min, p.max)
+		}
+		joined = append(joined, chunk...)
+		digests = append(digests, digestBytes(chunk))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(joined, data) {
+		t.Fatal("chunks do not reassemble to the input")
+	}
+	return digests
+}
+
+func TestChunkerBoundaries(t *testing.T) {
+	data := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+	before := splitDigests(t, testChunkerParams, data)
+
+	// an insertion only changes the chunks around it
+	edited := append(append(append([]byte{}, data[:100000]...), "inserted"...), data[100000:]...)
+	after := splitDigests(t, testChunkerParams, edited)
+
+	known := map[string]bool{}
+	for _, d := range before {
+		known[d] = true
+	}
+	changed := 0
+	for _, d := range after {
+		if !known[d] {
+			changed++
+		}
+	}
+	if changed > 3 {
+		t.Fatalf("%d of %d chunks changed after a small insertion", changed, len(after))
+	}
+}
+
+func TestPushPullChunked(t *testing.T) {
+	reg := newTestRegistry(t)
+	src := t.TempDir()
+	mem, vm, cfg := writeSnapshot(t, src)
+	data := make([]byte, 128<<10)
+	rand.New(rand.NewSource(2)).Read(data)
+	os.WriteFile(mem, data, 0644)
+
+	ctx := context.Background()
+	repo := reg.host() + "/sporelet/layer1"
+	if _, err := PushSnapshot(ctx, repo+":v1", mem, vm, cfg, WithPlainHTTP(true), withTestChunking()); err != nil {
+		t.Fatalf("PushSnapshot: %v", err)
+	}
+
+	// change a few bytes and push again: only the affected chunks are uploaded
+	copy(data[50000:], "changed")
+	os.WriteFile(mem, data, 0644)
+	uploads := reg.count(http.MethodPost, "/v2/sporelet/layer1/blobs/uploads/")
+	if _, err := PushSnapshot(ctx, repo+":v2", mem, vm, cfg, WithPlainHTTP(true), withTestChunking()); err != nil {
+		t.Fatalf("second PushSnapshot: %v", err)
+	}
+	// at most two changed chunks and the new chunk index
+	if n := reg.count(http.MethodPost, "/v2/sporelet/layer1/blobs/uploads/") - uploads; n > 3 {
+		t.Fatalf("expected only changed chunks to be uploaded, got %d uploads", n)
+	}
+
+	store := t.TempDir()
+	out := t.TempDir()
+	if err := PullSnapshot(ctx, repo+":v1", out, WithPlainHTTP(true), WithChunkStore(store)); err != nil {
+		t.Fatalf("PullSnapshot: %v", err)
+	}
+
+	// pulling v2 only downloads the chunks missing from the store
+	gets := reg.count(http.MethodGet, "/v2/sporelet/layer1/blobs/")
+	if err := PullSnapshot(ctx, repo+":v2", out, WithPlainHTTP(true), WithChunkStore(store)); err != nil {
+		t.Fatalf("PullSnapshot v2: %v", err)
+	}
+	// the chunk index, vmstate, config and at most two changed chunks
+	if n := reg.count(http.MethodGet, "/v2/sporelet/layer1/blobs/") - gets; n > 5 {
+		t.Fatalf("expected only missing chunks to be downloaded, got %d downloads", n)
+	}
+	got, err := os.ReadFile(filepath.Join(out, "snapshot.mem"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("reassembled memory file differs: %v", err)
+	}
+
+	// pulling without a store fetches the chunks directly
+	out = t.TempDir()
+	if err := PullSnapshot(ctx, repo+":v2", out, WithPlainHTTP(true)); err != nil {
+		t.Fatalf("PullSnapshot without store: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(out, "snapshot.mem")); !bytes.Equal(got, data) {
+		t.Fatal("reassembled memory file differs")
+	}
+}
+
+func TestChunkIndexValidate(t *testing.T) {
+	d := digestBytes([]byte("x"))
+	idx := ChunkIndex{Digest: d, Size: 3, Chunks: []Chunk{{d, 0, 1}, {d, 1, 2}}}
+	if err := idx.validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	for _, bad := range []ChunkIndex{
+		{Digest: d, Size: 3, Chunks: []Chunk{{d, 0, 1}, {d, 2, 1}}},
+		{Digest: d, Size: 4, Chunks: []Chunk{{d, 0, 1}, {d, 1, 2}}},
+		{Digest: d, Size: 1, Chunks: []Chunk{{"sha256:bad", 0, 1}}},
+	} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("validate(%+v): expected error", bad)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package oci
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression selects how file layers are compressed on push.
+type Compression int
+
+const (
+	// CompressionAuto compresses the memory file and rootfs with zstd when
+	// that saves at least a tenth of their size
+	CompressionAuto Compression = iota
+	// CompressionNone pushes every file uncompressed
+	CompressionNone
+	// CompressionZstd always compresses the memory file and rootfs
+	CompressionZstd
+)
+
+const (
+	// SuffixZstd is appended to the media type of zstd compressed layers
+	SuffixZstd = "+zstd"
+
+	// seekableFrameSize is the uncompressed size of each zstd frame, so
+	// that a range read of one frame serves a lazy read block
+	seekableFrameSize = lazyBlockSize
+	// minCompressionSaving is the fraction of the size that compression
+	// must save for CompressionAuto to keep it
+	minCompressionSaving = 0.1
+
+	// seek table framing of the zstd seekable format
+	skippableMagic   = 0x184D2A5E
+	seekableMagic    = 0x8F92EAB1
+	seekFooterSize   = 9
+	seekEntrySize    = 8
+	maxSeekTableSize = 16 << 20
+)
+
+// WithCompression sets how the memory file and rootfs are compressed on
+// push. The default, CompressionAuto, measures the compressed size of each
+// file and only keeps the compression if it pays off.
+func WithCompression(c Compression) Option {
+	return func(o *options) { o.compression = c }
+}
+
+// ParseCompression parses "auto", "none" or "zstd".
+func ParseCompression(s string) (Compression, error) {
+	switch s {
+	case "auto", "":
+		return CompressionAuto, nil
+	case "none":
+		return CompressionNone, nil
+	case "zstd":
+		return CompressionZstd, nil
+	}
+	return CompressionAuto, fmt.Errorf("unknown compression %q", s)
+}
+
+// compressible reports whether layers of the given media type may be
+// compressed.
+func compressible(mediaType string) bool {
+	return mediaType == MediaTypeMemory || mediaType == MediaTypeRootfs
+}
+
+// baseMediaType returns the media type of the plain file and whether
+// mediaType is a compressed variant of it. Encrypted variants, checked with
+// isEncrypted, have the same base media type.
+func baseMediaType(mediaType string) (string, bool) {
+	mt, encrypted := strings.CutSuffix(mediaType, SuffixEncrypted)
+	base, compressed := strings.CutSuffix(mt, SuffixZstd)
+	if (compressed && !compressible(base)) || (encrypted && !encryptable(base)) {
+		return mediaType, false
+	}
+	return base, compressed
+}
+
+// zstdDecoder decodes whole frames for lazy reads.
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+// writeSeekable compresses r into w in the zstd seekable format: independent
+// frames of seekableFrameSize uncompressed bytes followed by a skippable
+// frame holding the seek table. Any zstd decoder can decompress the result
+// as a stream. It returns the uncompressed and compressed sizes.
+func writeSeekable(w io.Writer, r io.Reader) (int64, int64, error) {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer enc.Close()
+
+	var in, out int64
+	var table []byte
+	buf := make([]byte, seekableFrameSize)
+	var frame []byte
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			frame = enc.EncodeAll(buf[:n], frame[:0])
+			if _, err := w.Write(frame); err != nil {
+				return in, out, err
+			}
+			table = binary.LittleEndian.AppendUint32(table, uint32(len(frame)))
+			table = binary.LittleEndian.AppendUint32(table, uint32(n))
+			in += int64(n)
+			out += int64(len(frame))
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return in, out, err
+		}
+	}
+
+	frames := len(table) / seekEntrySize
+	trailer := binary.LittleEndian.AppendUint32(nil, skippableMagic)
+	trailer = binary.LittleEndian.AppendUint32(trailer, uint32(len(table)+seekFooterSize))
+	trailer = append(trailer, table...)
+	trailer = binary.LittleEndian.AppendUint32(trailer, uint32(frames))
+	trailer = append(trailer, 0) // no checksums
+	trailer = binary.LittleEndian.AppendUint32(trailer, seekableMagic)
+	if _, err := w.Write(trailer); err != nil {
+		return in, out, err
+	}
+	return in, out + int64(len(trailer)), nil
+}
+
+// compressFile compresses src, read through open, into a temporary file in
+// the seekable format. With CompressionAuto it returns an empty path if
+// compression does not save enough. The caller removes the returned file.
+func compressFile(open func() (io.ReadCloser, error), c Compression) (string, error) {
+	r, err := open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	tmp, err := os.CreateTemp("", "sporelet-layer-*.zst")
+	if err != nil {
+		return "", err
+	}
+	in, out, err := writeSeekable(tmp, r)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if c == CompressionAuto && float64(out) > float64(in)*(1-minCompressionSaving) {
+		os.Remove(tmp.Name())
+		return "", nil
+	}
+	return tmp.Name(), nil
+}
+
+// seekFrame locates a frame of a seekable blob.
+type seekFrame struct {
+	offset, size int64 // compressed
+	start, n     int64 // uncompressed
+}
+
+// seekTable lists the frames of a seekable blob in order.
+type seekTable struct {
+	frames []seekFrame
+	size   int64 // uncompressed size
+}
+
+// parseSeekTable decodes the seek table at the end of a seekable blob of
+// size blobSize. tail must hold at least the last seekFooterSize bytes of the
+// blob; if it is too short to hold the whole table, the returned length is
+// the number of tail bytes needed.
+func parseSeekTable(tail []byte, blobSize int64) (*seekTable, int, error) {
+	if len(tail) < seekFooterSize {
+		return nil, seekFooterSize, nil
+	}
+	footer := tail[len(tail)-seekFooterSize:]
+	if binary.LittleEndian.Uint32(footer[5:]) != seekableMagic {
+		return nil, 0, fmt.Errorf("blob is not in the zstd seekable format")
+	}
+	if footer[4]&0x80 != 0 {
+		return nil, 0, fmt.Errorf("seek table checksums are not supported")
+	}
+	frames := int64(binary.LittleEndian.Uint32(footer))
+	need := 8 + frames*seekEntrySize + seekFooterSize
+	if need > maxSeekTableSize || need > blobSize {
+		return nil, 0, fmt.Errorf("seek table of %d frames does not fit the blob", frames)
+	}
+	if int64(len(tail)) < need {
+		return nil, int(need), nil
+	}
+
+	skippable := tail[int64(len(tail))-need:]
+	if binary.LittleEndian.Uint32(skippable) != skippableMagic || int64(binary.LittleEndian.Uint32(skippable[4:])) != need-8 {
+		return nil, 0, fmt.Errorf("malformed seek table frame")
+	}
+	t := &seekTable{frames: make([]seekFrame, frames)}
+	var off int64
+	for i := range t.frames {
+		e := skippable[8+i*seekEntrySize:]
+		f := seekFrame{
+			offset: off,
+			size:   int64(binary.LittleEndian.Uint32(e)),
+			start:  t.size,
+			n:      int64(binary.LittleEndian.Uint32(e[4:])),
+		}
+		t.frames[i] = f
+		off += f.size
+		t.size += f.n
+	}
+	if off+need != blobSize {
+		return nil, 0, fmt.Errorf("seek table covers %d bytes, blob has %d", off+need, blobSize)
+	}
+	return t, 0, nil
+}
+
+// find returns the frame holding uncompressed offset off.
+func (t *seekTable) find(off int64) seekFrame {
+	i := sort.Search(len(t.frames), func(i int) bool {
+		return t.frames[i].start+t.frames[i].n > off
+	})
+	return t.frames[i]
+}
+
+// readSeekTable reads the seek table from the end of a seekable blob of the
+// given size with ranged reads.
+func readSeekTable(size int64, read func(off, n int64) ([]byte, error)) (*seekTable, error) {
+	need := 4096
+	for {
+		n := min(int64(need), size)
+		tail, err := read(size-n, n)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch seek table: %w", err)
+		}
+		t, more, err := parseSeekTable(tail, size)
+		if err != nil || t != nil {
+			return t, err
+		}
+		if int64(more) <= n {
+			return nil, fmt.Errorf("malformed seek table")
+		}
+		need = more
+	}
+}
@@ -0,0 +1,136 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressibleData returns text-like data spanning several seekable frames.
+func compressibleData(n int) []byte {
+	rng := rand.New(rand.NewSource(5))
+	words := []string{"spore", "let ", "fire", "cracker ", "page\n", "zero "}
+	var b bytes.Buffer
+	for b.Len() < n {
+		b.WriteString(words[rng.Intn(len(words))])
+	}
+	return b.Bytes()[:n]
+}
+
+func TestWriteSeekable(t *testing.T) {
+	data := compressibleData(2*seekableFrameSize + 12345)
+	var buf bytes.Buffer
+	in, out, err := writeSeekable(&buf, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in != int64(len(data)) || out != int64(buf.Len()) || out >= in/2 {
+		t.Fatalf("writeSeekable = %d, %d for %d bytes", in, out, len(data))
+	}
+
+	// any zstd decoder reads the frames and skips the seek table
+	zr, err := zstd.NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	got, err := io.ReadAll(zr)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("stream decode returned %d bytes, %v", len(got), err)
+	}
+
+	blob := buf.Bytes()
+	_, need, err := parseSeekTable(blob[len(blob)-seekFooterSize:], int64(len(blob)))
+	if err != nil || need <= seekFooterSize {
+		t.Fatalf("parseSeekTable with footer only = %d, %v", need, err)
+	}
+	table, _, err := parseSeekTable(blob[len(blob)-need:], int64(len(blob)))
+	if err != nil {
+		t.Fatalf("parseSeekTable: %v", err)
+	}
+	if len(table.frames) != 3 || table.size != int64(len(data)) {
+		t.Fatalf("seek table %+v", table)
+	}
+	f := table.find(seekableFrameSize + 10)
+	frame, err := zstdDecoder.DecodeAll(blob[f.offset:f.offset+f.size], nil)
+	if err != nil || !bytes.Equal(frame, data[f.start:f.start+f.n]) {
+		t.Fatalf("frame at %d decoded to %d bytes, %v", f.start, len(frame), err)
+	}
+
+	if _, _, err := parseSeekTable(data[len(data)-64:], int64(len(data))); err == nil {
+		t.Fatal("expected error for data without seek table")
+	}
+}
+
+func TestPushPullCompressed(t *testing.T) {
+	reg := newTestRegistry(t)
+	dir := t.TempDir()
+	mem, vm, cfg := writeSnapshot(t, dir)
+	data := compressibleData(lazyBlockSize + 300<<10)
+	os.WriteFile(mem, data, 0644)
+	rootfs := filepath.Join(dir, "rootfs.ext4")
+	noise := make([]byte, 256<<10)
+	rand.New(rand.NewSource(6)).Read(noise)
+	os.WriteFile(rootfs, noise, 0644)
+
+	ctx := context.Background()
+	ref := reg.host() + "/sporelet/layer1:dev"
+	if _, err := PushSnapshot(ctx, ref, mem, vm, cfg, WithPlainHTTP(true), WithRootfs(rootfs)); err != nil {
+		t.Fatalf("PushSnapshot: %v", err)
+	}
+
+	// only the layer that compresses well is compressed
+	var manifest Manifest
+	json.Unmarshal(reg.manifests["sporelet/layer1:dev"], &manifest)
+	types := map[string]string{}
+	for _, l := range manifest.Layers {
+		types[l.Annotations[AnnotationTitle]] = l.MediaType
+	}
+	if types["snapshot.mem"] != MediaTypeMemory+SuffixZstd || types["rootfs.ext4"] != MediaTypeRootfs || types["snapshot.vmstate"] != MediaTypeVMState {
+		t.Fatalf("layer media types %v", types)
+	}
+
+	out := t.TempDir()
+	if err := PullSnapshot(ctx, ref, out, WithPlainHTTP(true)); err != nil {
+		t.Fatalf("PullSnapshot: %v", err)
+	}
+	for _, f := range []string{mem, rootfs, vm} {
+		want, _ := os.ReadFile(f)
+		got, _ := os.ReadFile(filepath.Join(out, filepath.Base(f)))
+		if !bytes.Equal(got, want) {
+			t.Fatalf("pulled %s differs", filepath.Base(f))
+		}
+	}
+
+	r, err := OpenLayer(ctx, ref, MediaTypeMemory, WithPlainHTTP(true))
+	if err != nil {
+		t.Fatalf("OpenLayer: %v", err)
+	}
+	if r.Size() != int64(len(data)) {
+		t.Fatalf("size %d, want %d", r.Size(), len(data))
+	}
+	for _, off := range []int64{0, lazyBlockSize - 100, int64(len(data)) - 4096} {
+		page := make([]byte, 4096)
+		if _, err := r.ReadAt(page, off); err != nil || !bytes.Equal(page, data[off:off+4096]) {
+			t.Fatalf("ReadAt(%d) returned wrong content, %v", off, err)
+		}
+	}
+
+	// CompressionNone keeps every layer uncompressed
+	if _, err := PushSnapshot(ctx, ref, mem, vm, cfg, WithPlainHTTP(true), WithCompression(CompressionNone)); err != nil {
+		t.Fatal(err)
+	}
+	var plain Manifest
+	json.Unmarshal(reg.manifests["sporelet/layer1:dev"], &plain)
+	if strings.HasSuffix(plain.Layers[0].MediaType, SuffixZstd) {
+		t.Fatalf("memory layer compressed with CompressionNone: %s", plain.Layers[0].MediaType)
+	}
+}
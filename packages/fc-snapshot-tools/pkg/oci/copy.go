@@ -0,0 +1,255 @@
+package oci
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// referrersTagPattern matches the tags of the referrers tag schema.
+var referrersTagPattern = regexp.MustCompile(`^sha256-[0-9a-f]{64}$`)
+
+// CopySnapshot copies the manifest src points at to dst together with its
+// blobs and its referrers, such as signatures. An image index is copied with
+// the snapshots of every platform. Either reference may be a registry or an
+// image layout, so CopySnapshot exports snapshots to layouts and imports them
+// from there. A dst without tag or digest takes the tag of src. It returns
+// the manifest digest, which the copy preserves.
+func CopySnapshot(ctx context.Context, src, dst string, opts ...Option) (string, error) {
+	srcRef, err := ParseReference(src)
+	if err != nil {
+		return "", err
+	}
+	dstRef, err := ParseReference(dst)
+	if err != nil {
+		return "", err
+	}
+	if dstRef.Tag == "" && dstRef.Digest == "" {
+		dstRef.Tag = srcRef.Tag
+	}
+
+	c := newClient(newOptions(opts))
+	desc, data, err := c.FetchManifest(ctx, srcRef)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch manifest %s: %w", srcRef, err)
+	}
+	if dstRef.Digest != "" && dstRef.Digest != desc.Digest {
+		return "", fmt.Errorf("manifest %s: %w: got %s", dstRef, ErrDigestMismatch, desc.Digest)
+	}
+	if err := c.copyManifest(ctx, srcRef, dstRef, desc, data); err != nil {
+		return "", err
+	}
+	if dstRef.Tag != "" {
+		if _, err := c.PushManifest(ctx, dstRef.WithDigest("").withTag(dstRef.Tag), desc.MediaType, data); err != nil {
+			return "", fmt.Errorf("failed to push manifest: %w", err)
+		}
+	}
+	return desc.Digest, nil
+}
+
+// copyManifest copies the content of a manifest or image index and the
+// manifest itself by digest, followed by its referrers.
+func (c *Client) copyManifest(ctx context.Context, src, dst Reference, desc Descriptor, data []byte) error {
+	if desc.MediaType == MediaTypeImageIndex {
+		var index Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return fmt.Errorf("failed to decode index: %w", err)
+		}
+		for _, entry := range index.Manifests {
+			child, childData, err := c.FetchManifest(ctx, src.WithDigest(entry.Digest))
+			if err != nil {
+				return fmt.Errorf("failed to fetch manifest %s: %w", entry.Digest, err)
+			}
+			if err := c.copyManifest(ctx, src, dst, child, childData); err != nil {
+				return err
+			}
+		}
+		if _, err := c.PushManifest(ctx, dst.WithDigest(""), desc.MediaType, data); err != nil {
+			return fmt.Errorf("failed to push manifest %s: %w", desc.Digest, err)
+		}
+	} else {
+		var m Manifest
+		err := json.Unmarshal(data, &m)
+		if err != nil {
+			return fmt.Errorf("failed to decode manifest: %w", err)
+		}
+		if err := c.copyBlobs(ctx, src, dst, m); err != nil {
+			return err
+		}
+		// a snapshot with its parent in the same repository is a referrer
+		// of the parent
+		if m.Subject != nil {
+			_, err = c.pushReferrer(ctx, dst.WithDigest(""), m, data)
+		} else {
+			_, err = c.PushManifest(ctx, dst.WithDigest(""), desc.MediaType, data)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to push manifest %s: %w", desc.Digest, err)
+		}
+	}
+
+	referrers, err := c.Referrers(ctx, src, desc.Digest, "")
+	if err != nil {
+		return fmt.Errorf("failed to list referrers: %w", err)
+	}
+	for _, r := range referrers {
+		if lineageArtifact(r.ArtifactType) {
+			// child snapshots are copied on their own, not with their parent
+			continue
+		}
+		_, data, err := c.FetchManifest(ctx, src.WithDigest(r.Digest))
+		if err != nil {
+			return fmt.Errorf("failed to fetch referrer %s: %w", r.Digest, err)
+		}
+		var rm Manifest
+		if err := json.Unmarshal(data, &rm); err != nil || rm.Subject == nil {
+			return fmt.Errorf("referrer %s is not a manifest with a subject", r.Digest)
+		}
+		if err := c.copyBlobs(ctx, src, dst, rm); err != nil {
+			return err
+		}
+		if _, err := c.pushReferrer(ctx, dst, rm, data); err != nil {
+			return fmt.Errorf("failed to push referrer %s: %w", r.Digest, err)
+		}
+	}
+	return nil
+}
+
+// withTag returns a copy of r addressing the given tag.
+func (r Reference) withTag(tag string) Reference {
+	r.Tag = tag
+	return r
+}
+
+// copyBlobs copies the config and layers of m that dst does not hold yet.
+func (c *Client) copyBlobs(ctx context.Context, src, dst Reference, m Manifest) error {
+	for _, d := range append([]Descriptor{m.Config}, m.Layers...) {
+		exists, err := c.BlobExists(ctx, dst, d.Digest)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		rc, err := c.FetchBlob(ctx, src, d)
+		if err != nil {
+			return fmt.Errorf("failed to fetch blob %s: %w", d.Digest, err)
+		}
+		err = c.PushBlob(ctx, dst, d, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("failed to push blob %s: %w", d.Digest, err)
+		}
+	}
+	return nil
+}
+
+// LayoutTags returns the tags of the image layout in dir, leaving out the
+// tags of the referrers tag schema.
+func LayoutTags(dir string) ([]string, error) {
+	index, err := layout(dir).readIndex()
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	for _, d := range index.Manifests {
+		if tag := d.Annotations[AnnotationRefName]; tag != "" && !referrersTagPattern.MatchString(tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags, nil
+}
+
+// WriteLayoutTar writes the image layout in dir to w as a tar archive.
+func WriteLayoutTar(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil || name == "." {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(name)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to archive image layout: %w", err)
+	}
+	return tw.Close()
+}
+
+// ExtractLayoutTar extracts an image layout archive into dir. Entries other
+// than regular files and directories, and paths leaving dir, are rejected.
+func ExtractLayoutTar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read image layout archive: %w", err)
+		}
+		name := filepath.FromSlash(hdr.Name)
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("image layout archive entry %q leaves the layout", hdr.Name)
+		}
+		path := filepath.Join(dir, name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0755)
+		case tar.TypeReg:
+			err = extractFile(path, tr)
+		default:
+			return fmt.Errorf("image layout archive entry %q is not a regular file", hdr.Name)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to extract %s: %w", hdr.Name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, layoutFile)); err != nil {
+		return fmt.Errorf("archive is not an image layout: no %s", layoutFile)
+	}
+	return nil
+}
+
+func extractFile(path string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
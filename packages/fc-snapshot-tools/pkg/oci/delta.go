@@ -0,0 +1,168 @@
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/delta"
+)
+
+const (
+	// AnnotationDeltaBase holds the sha256 digest of the memory file content
+	// a memory delta layer applies to, that of the parent snapshot
+	AnnotationDeltaBase = "ai.sporelet.delta.base"
+	// AnnotationDeltaSize holds the size of the memory file a memory delta
+	// layer rebuilds
+	AnnotationDeltaSize = "ai.sporelet.delta.size"
+
+	// deltaSuffix ends the names of memory delta files, which are pushed
+	// under the name of the memory file they rebuild
+	deltaSuffix = ".delta"
+)
+
+// WithDeltaBase sets the memory file of the parent snapshot that a memory
+// delta layer is applied to on pull, such as one pulled earlier. Without it,
+// the parent's memory is pulled from the registry first.
+func WithDeltaBase(path string) Option {
+	return func(o *options) { o.deltaBase = path }
+}
+
+// isDelta reports whether the file at path is a memory delta.
+func isDelta(path string) bool {
+	_, err := delta.ReadHeader(path)
+	return err == nil
+}
+
+// annotateDelta records the base and the size of the memory file a delta
+// rebuilds in its layer annotations.
+func annotateDelta(path string, a map[string]string) error {
+	h, err := delta.ReadHeader(path)
+	if err != nil {
+		return err
+	}
+	a[AnnotationTitle] = strings.TrimSuffix(a[AnnotationTitle], deltaSuffix)
+	a[AnnotationDeltaBase] = h.BaseDigest
+	a[AnnotationDeltaSize] = strconv.FormatInt(h.Size, 10)
+	return nil
+}
+
+// checkDeltaBase checks that the memory delta memFile was encoded against
+// the memory of the parent snapshot with manifest m, whose digest is taken
+// from the parent's integrity layer.
+func (c *Client) checkDeltaBase(ctx context.Context, parent Reference, m Manifest, memFile string) error {
+	h, err := delta.ReadHeader(memFile)
+	if err != nil {
+		return fmt.Errorf("failed to read memory delta %s: %w", memFile, err)
+	}
+	var layer *Descriptor
+	for i, l := range m.Layers {
+		if l.MediaType == MediaTypeIntegrity {
+			layer = &m.Layers[i]
+			break
+		}
+	}
+	if layer == nil {
+		return fmt.Errorf("%w: parent %s has no integrity layer to check the delta base against", ErrParentMismatch, parent)
+	}
+	if layer.Size > maxManifestSize {
+		return fmt.Errorf("integrity of parent %s exceeds %d bytes", parent, maxManifestSize)
+	}
+	rc, err := c.direct().FetchBlob(ctx, parent, *layer)
+	if err != nil {
+		return fmt.Errorf("failed to fetch integrity of parent %s: %w", parent, err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return fmt.Errorf("failed to fetch integrity of parent %s: %w", parent, err)
+	}
+	var integrity struct {
+		Files map[string]struct {
+			Digest string `json:"digest"`
+		} `json:"files"`
+	}
+	if err := json.Unmarshal(data, &integrity); err != nil {
+		return fmt.Errorf("failed to decode integrity of parent %s: %w", parent, err)
+	}
+	if d := integrity.Files["mem"].Digest; d != h.BaseDigest {
+		return fmt.Errorf("%w: delta was encoded against memory %s, parent %s has %q", ErrParentMismatch, h.BaseDigest, parent, d)
+	}
+	return nil
+}
+
+// validateDelta checks the annotations of a memory delta layer.
+func validateDelta(l Descriptor) error {
+	if err := validateDigest(l.Annotations[AnnotationDeltaBase]); err != nil {
+		return fmt.Errorf("invalid annotation %s: %w", AnnotationDeltaBase, err)
+	}
+	if size, err := strconv.ParseInt(l.Annotations[AnnotationDeltaSize], 10, 64); err != nil || size < 0 {
+		return fmt.Errorf("invalid annotation %s: %q", AnnotationDeltaSize, l.Annotations[AnnotationDeltaSize])
+	}
+	return nil
+}
+
+// fetchDelta downloads the memory delta layer of the snapshot manifest m and
+// writes the memory file it rebuilds from the parent's memory to path.
+func (c *Client) fetchDelta(ctx context.Context, ref Reference, m Manifest, layer Descriptor, path string, o *options, opts []Option) error {
+	deltaPath := path + deltaSuffix
+	if err := c.fetchBlobToFile(ctx, ref, layer, deltaPath); err != nil {
+		return err
+	}
+	defer os.Remove(deltaPath)
+
+	base := o.deltaBase
+	if base == "" {
+		dir, err := os.MkdirTemp(filepath.Dir(path), ".delta-base-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		if base, err = c.pullParentMemory(ctx, ref, m, dir, opts); err != nil {
+			return err
+		}
+	}
+	if err := delta.Apply(base, deltaPath, path); err != nil {
+		return fmt.Errorf("failed to apply memory delta: %w", err)
+	}
+	return nil
+}
+
+// pullParentMemory pulls the memory file of the parent of the snapshot
+// manifest m to dir and returns its path. A parent whose memory is a delta
+// itself is rebuilt from its own parent.
+func (c *Client) pullParentMemory(ctx context.Context, ref Reference, m Manifest, dir string, opts []Option) (string, error) {
+	md, err := ParseSnapshotMetadata(m.Annotations)
+	if err != nil {
+		return "", err
+	}
+	parent, ok := parentOf(ref, SnapshotSummary{Parent: md.Parent, ParentRepository: md.ParentRepository})
+	if !ok {
+		return "", fmt.Errorf("memory delta of %s has no parent to apply to", ref)
+	}
+	_, pm, err := c.ResolveSnapshot(ctx, parent)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve parent %s: %w", parent, err)
+	}
+	memory := func(l Descriptor) bool {
+		mt, _ := baseMediaType(l.MediaType)
+		return mt == MediaTypeMemory || mt == MediaTypeMemoryDelta || l.Annotations[AnnotationChunkedMediaType] == MediaTypeMemory
+	}
+	var title string
+	for _, l := range pm.Layers {
+		if memory(l) {
+			title = l.Annotations[AnnotationTitle]
+		}
+	}
+
+	opts = append(opts[:len(opts):len(opts)], WithLayerFilter(memory), WithLazyMemory(false), WithDeltaBase(""))
+	if err := PullSnapshot(ctx, parent.String(), dir, opts...); err != nil {
+		return "", fmt.Errorf("failed to pull memory of parent %s: %w", parent, err)
+	}
+	return filepath.Join(dir, title), nil
+}
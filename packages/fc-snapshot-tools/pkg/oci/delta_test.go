@@ -0,0 +1,140 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/delta"
+)
+
+// writeMemIntegrity writes an integrity manifest recording the digest of
+// memory next to mem and returns an option bundling it.
+func writeMemIntegrity(t *testing.T, mem string, memory []byte) Option {
+	t.Helper()
+	path := filepath.Join(filepath.Dir(mem), "snapshot.integrity")
+	data := fmt.Sprintf(`{"blockSize":4194304,"files":{"mem":{"size":%d,"digest":"sha256:%x"}}}`, len(memory), sha256.Sum256(memory))
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return WithIntegrity(path)
+}
+
+func TestPushPullMemoryDelta(t *testing.T) {
+	reg := newTestRegistry(t)
+	ctx := context.Background()
+	repo := reg.host() + "/sporelet/layer"
+
+	rng := rand.New(rand.NewSource(3))
+	memory := make([]byte, 32*delta.PageSize)
+	rng.Read(memory[:24*delta.PageSize])
+
+	dir := t.TempDir()
+	mem, vm, cfg := writeSnapshot(t, dir)
+	os.WriteFile(mem, memory, 0644)
+	base, err := PushSnapshot(ctx, repo+":base", mem, vm, cfg, WithPlainHTTP(true), WithMetadata(SnapshotMetadata{Layer: Layer0}), writeMemIntegrity(t, mem, memory))
+	if err != nil {
+		t.Fatalf("PushSnapshot(base): %v", err)
+	}
+
+	// two layers on top, each a delta against the one below
+	var want []byte
+	parent := base
+	for i, tag := range []string{"app", "model"} {
+		next := bytes.Clone(memory)
+		next[i*delta.PageSize] ^= 0xff
+		rng.Read(next[(28+i)*delta.PageSize : (29+i)*delta.PageSize])
+		dir := t.TempDir()
+		mem2, vm2, cfg2 := writeSnapshot(t, dir)
+		os.WriteFile(mem2, next, 0644)
+		if _, err := delta.Encode(mem, mem2, mem2+".delta"); err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+		if _, err := PushSnapshot(ctx, repo+":orphan", mem2+".delta", vm2, cfg2, WithPlainHTTP(true), WithMetadata(SnapshotMetadata{Layer: Layer2})); err == nil {
+			t.Error("expected error for a delta without a parent")
+		}
+		md := WithMetadata(SnapshotMetadata{Layer: Layer1 + i, Parent: parent})
+		if parent, err = PushSnapshot(ctx, repo+":"+tag, mem2+".delta", vm2, cfg2, WithPlainHTTP(true), md, writeMemIntegrity(t, mem2, next)); err != nil {
+			t.Fatalf("PushSnapshot(%s): %v", tag, err)
+		}
+		mem, memory, want = mem2, next, next
+	}
+
+	_, m, err := NewClient(WithPlainHTTP(true)).ResolveSnapshot(ctx, mustParse(t, repo+":model"))
+	if err != nil {
+		t.Fatalf("ResolveSnapshot: %v", err)
+	}
+	l := m.Layers[0]
+	if l.MediaType != MediaTypeMemoryDelta || l.Annotations[AnnotationTitle] != "snapshot.mem" || l.Annotations[AnnotationDeltaBase] == "" {
+		t.Errorf("memory layer %+v", l)
+	}
+	if l.Size > 4*delta.PageSize {
+		t.Errorf("delta layer is %d bytes", l.Size)
+	}
+
+	// the model layer is a delta against app, itself a delta against base
+	out := t.TempDir()
+	if err := PullSnapshot(ctx, repo+":model", out, WithPlainHTTP(true)); err != nil {
+		t.Fatalf("PullSnapshot: %v", err)
+	}
+	got, _ := os.ReadFile(filepath.Join(out, "snapshot.mem"))
+	if !bytes.Equal(got, want) {
+		t.Fatal("pulled memory differs from the pushed snapshot")
+	}
+	entries, _ := os.ReadDir(out)
+	for _, e := range entries {
+		if e.Name() != "snapshot.mem" && e.Name() != "snapshot.vmstate" && e.Name() != "snapshot.config" && e.Name() != "snapshot.integrity" && e.Name() != SnapshotRefFile {
+			t.Errorf("left behind %s", e.Name())
+		}
+	}
+
+	info, err := InspectSnapshot(ctx, repo+":model", WithPlainHTTP(true))
+	if err != nil {
+		t.Fatalf("InspectSnapshot: %v", err)
+	}
+	if f := info.Files[0]; f.MediaType != MediaTypeMemoryDelta || f.FileSize != int64(len(want)) {
+		t.Errorf("inspected memory file %+v", f)
+	}
+}
+
+func TestPushMemoryDeltaParentMismatch(t *testing.T) {
+	reg := newTestRegistry(t)
+	ctx := context.Background()
+	repo := reg.host() + "/sporelet/layer"
+
+	memory := bytes.Repeat([]byte("base"), 4*delta.PageSize)
+	dir := t.TempDir()
+	mem, vm, cfg := writeSnapshot(t, dir)
+	os.WriteFile(mem, memory, 0644)
+	if _, err := PushSnapshot(ctx, repo+":plain", mem, vm, cfg, WithPlainHTTP(true), WithMetadata(SnapshotMetadata{Layer: Layer0})); err != nil {
+		t.Fatalf("PushSnapshot(plain): %v", err)
+	}
+	if _, err := PushSnapshot(ctx, repo+":base", mem, vm, cfg, WithPlainHTTP(true), WithMetadata(SnapshotMetadata{Layer: Layer0}), writeMemIntegrity(t, mem, memory)); err != nil {
+		t.Fatalf("PushSnapshot(base): %v", err)
+	}
+
+	// a delta against other memory than the parent's
+	other := filepath.Join(t.TempDir(), "other.mem")
+	os.WriteFile(other, bytes.Repeat([]byte("else"), 4*delta.PageSize), 0644)
+	mem2, vm2, cfg2 := writeSnapshot(t, t.TempDir())
+	os.WriteFile(mem2, bytes.Repeat([]byte("next"), 4*delta.PageSize), 0644)
+	if _, err := delta.Encode(other, mem2, mem2+".delta"); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	for _, parent := range []string{repo + ":base", repo + ":plain"} {
+		md := WithMetadata(SnapshotMetadata{Layer: Layer1, Parent: parent})
+		_, err := PushSnapshot(ctx, repo+":app", mem2+".delta", vm2, cfg2, WithPlainHTTP(true), md)
+		if !errors.Is(err, ErrParentMismatch) {
+			t.Errorf("push on %s: err = %v, want ErrParentMismatch", parent, err)
+		}
+	}
+	if n := reg.count("PUT", "/v2/sporelet/layer/manifests/app"); n != 0 {
+		t.Errorf("pushed %d manifests for a mismatched delta", n)
+	}
+}
@@ -0,0 +1,376 @@
+package oci
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	// SuffixEncrypted is appended to the media type of encrypted layers,
+	// after SuffixZstd if the layer is also compressed
+	SuffixEncrypted = "+encrypted"
+	// AnnotationEncryption holds the JSON encryption parameters of an
+	// encrypted layer, including its wrapped data key
+	AnnotationEncryption = "ai.sporelet.encryption"
+
+	// KeyProviderKeyfile names the keys wrapped by a KeyfileProvider
+	KeyProviderKeyfile = "keyfile"
+
+	// encryptBlockSize is the plaintext size of each sealed block, so that
+	// ranged reads decrypt little more than they need
+	encryptBlockSize = 64 << 10
+	// maxEncryptBlockSize bounds the block size read from annotations
+	maxEncryptBlockSize = 16 << 20
+	aesGCMTagSize       = 16
+	dataKeySize         = 32
+)
+
+// ErrNoKey is returned when an encrypted layer is read without a key
+// provider that can unwrap its data key.
+var ErrNoKey = errors.New("no key to decrypt layer")
+
+// KeyProvider wraps and unwraps the data keys that encrypt layers. Data keys
+// are random per layer; only their wrapped form is stored in the manifest. A
+// KMS can implement KeyProvider by sending the keys to its encrypt and
+// decrypt APIs.
+type KeyProvider interface {
+	// WrapKey encrypts a data key.
+	WrapKey(ctx context.Context, dataKey []byte) (WrappedKey, error)
+	// UnwrapKey decrypts a data key wrapped by WrapKey. It returns an
+	// error wrapping ErrNoKey if the key was wrapped by another provider
+	// or key.
+	UnwrapKey(ctx context.Context, key WrappedKey) ([]byte, error)
+}
+
+// WrappedKey is a data key encrypted by a KeyProvider.
+type WrappedKey struct {
+	Provider string `json:"provider"`
+	KeyID    string `json:"keyId"`
+	Key      []byte `json:"wrappedKey"`
+}
+
+// WithKeyProvider encrypts the memory and vmstate layers on push with data
+// keys wrapped by kp, and unwraps the data keys of encrypted layers on pull
+// and lazy reads.
+func WithKeyProvider(kp KeyProvider) Option {
+	return func(o *options) { o.keys = kp }
+}
+
+// encryptable reports whether layers of the given media type are encrypted
+// when a key provider is set.
+func encryptable(mediaType string) bool {
+	return mediaType == MediaTypeMemory || mediaType == MediaTypeMemoryDelta || mediaType == MediaTypeVMState
+}
+
+// KeyfileProvider wraps data keys with AES-256-GCM under a key read from a
+// local file.
+type KeyfileProvider struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// NewKeyfileProvider reads a 32 byte key, base64 encoded, from path. A key
+// can be generated with `openssl rand -base64 32`.
+func NewKeyfileProvider(path string) (*KeyfileProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != dataKeySize {
+		return nil, fmt.Errorf("keyfile %s must hold %d base64 encoded bytes", path, dataKeySize)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &KeyfileProvider{id: hex.EncodeToString(sum[:8]), aead: aead}, nil
+}
+
+// WrapKey implements KeyProvider.
+func (p *KeyfileProvider) WrapKey(ctx context.Context, dataKey []byte) (WrappedKey, error) {
+	nonce := make([]byte, p.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return WrappedKey{}, err
+	}
+	return WrappedKey{
+		Provider: KeyProviderKeyfile,
+		KeyID:    p.id,
+		Key:      p.aead.Seal(nonce, nonce, dataKey, nil),
+	}, nil
+}
+
+// UnwrapKey implements KeyProvider.
+func (p *KeyfileProvider) UnwrapKey(ctx context.Context, key WrappedKey) ([]byte, error) {
+	if key.Provider != KeyProviderKeyfile || key.KeyID != p.id {
+		return nil, fmt.Errorf("%w: data key is wrapped by %s key %s", ErrNoKey, key.Provider, key.KeyID)
+	}
+	n := p.aead.NonceSize()
+	if len(key.Key) < n {
+		return nil, fmt.Errorf("wrapped key is too short")
+	}
+	dataKey, err := p.aead.Open(nil, key.Key[:n], key.Key[n:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	return dataKey, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryption describes an encrypted layer. The content is sealed with
+// AES-256-GCM in blocks of BlockSize plaintext bytes, each followed by its
+// tag. Block i uses the big endian i as nonce, which is safe because every
+// layer has its own data key; the additional data binds the index and
+// whether the block is the last one, so blocks cannot be reordered or
+// dropped.
+type encryption struct {
+	WrappedKey
+	BlockSize int64 `json:"blockSize"`
+	Size      int64 `json:"size"` // plaintext size
+}
+
+// parseEncryption decodes the encryption parameters of a layer, or returns
+// nil if the layer is not encrypted.
+func parseEncryption(desc Descriptor) (*encryption, error) {
+	v, ok := desc.Annotations[AnnotationEncryption]
+	if !ok {
+		if isEncrypted(desc.MediaType) {
+			return nil, fmt.Errorf("encrypted layer has no annotation %s", AnnotationEncryption)
+		}
+		return nil, nil
+	}
+	if !isEncrypted(desc.MediaType) {
+		return nil, fmt.Errorf("annotation %s on unencrypted layer", AnnotationEncryption)
+	}
+	var e encryption
+	if err := json.Unmarshal([]byte(v), &e); err != nil {
+		return nil, fmt.Errorf("invalid annotation %s: %w", AnnotationEncryption, err)
+	}
+	if e.BlockSize <= 0 || e.BlockSize > maxEncryptBlockSize || e.Size < 0 {
+		return nil, fmt.Errorf("invalid annotation %s: block size %d, size %d", AnnotationEncryption, e.BlockSize, e.Size)
+	}
+	if e.sealedSize() != desc.Size {
+		return nil, fmt.Errorf("encrypted layer has %d bytes, expected %d", desc.Size, e.sealedSize())
+	}
+	return &e, nil
+}
+
+// isEncrypted reports whether mediaType is an encrypted variant of an
+// encryptable media type.
+func isEncrypted(mediaType string) bool {
+	base, _ := baseMediaType(mediaType)
+	return base != mediaType && strings.HasSuffix(mediaType, SuffixEncrypted)
+}
+
+// blocks returns the number of sealed blocks. Empty content is sealed as one
+// empty block.
+func (e *encryption) blocks() int64 {
+	return max(1, (e.Size+e.BlockSize-1)/e.BlockSize)
+}
+
+// sealedSize returns the size of the encrypted blob.
+func (e *encryption) sealedSize() int64 {
+	return e.Size + e.blocks()*aesGCMTagSize
+}
+
+// aead unwraps the data key with kp.
+func (e *encryption) aead(ctx context.Context, kp KeyProvider) (cipher.AEAD, error) {
+	if kp == nil {
+		return nil, fmt.Errorf("%w: layer is encrypted with %s key %s and no key provider is set", ErrNoKey, e.Provider, e.KeyID)
+	}
+	key, err := kp.UnwrapKey(ctx, e.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != dataKeySize {
+		return nil, fmt.Errorf("data key has %d bytes, expected %d", len(key), dataKeySize)
+	}
+	return newAEAD(key)
+}
+
+// blockNonce and blockAD return the nonce and additional data of block i.
+func (e *encryption) blockNonce(i int64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], uint64(i))
+	return nonce
+}
+
+func (e *encryption) blockAD(i int64) []byte {
+	ad := binary.BigEndian.AppendUint64(nil, uint64(i))
+	if i == e.blocks()-1 {
+		return append(ad, 1)
+	}
+	return append(ad, 0)
+}
+
+// openBlock decrypts sealed block i.
+func (e *encryption) openBlock(aead cipher.AEAD, i int64, sealed []byte) ([]byte, error) {
+	data, err := aead.Open(nil, e.blockNonce(i), sealed, e.blockAD(i))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt block %d: %w", i, err)
+	}
+	return data, nil
+}
+
+// encryptFile encrypts the content read through open into a temporary file
+// with a new data key wrapped by kp. The caller removes the returned file.
+func encryptFile(ctx context.Context, open func() (io.ReadCloser, error), kp KeyProvider) (string, *encryption, error) {
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", nil, err
+	}
+	wrapped, err := kp.WrapKey(ctx, key)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	r, err := open()
+	if err != nil {
+		return "", nil, err
+	}
+	defer func() { r.Close() }()
+	// the size is needed up front to mark the last block
+	var size int64
+	if s, ok := r.(io.Seeker); ok {
+		if size, err = s.Seek(0, io.SeekEnd); err == nil {
+			_, err = s.Seek(0, io.SeekStart)
+		}
+	} else {
+		size, err = io.Copy(io.Discard, r)
+		r.Close()
+		if err == nil {
+			r, err = open()
+		}
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	e := &encryption{WrappedKey: wrapped, BlockSize: encryptBlockSize, Size: size}
+
+	tmp, err := os.CreateTemp("", "sporelet-layer-*.enc")
+	if err != nil {
+		return "", nil, err
+	}
+	buf := make([]byte, e.BlockSize, e.BlockSize+aesGCMTagSize)
+	var n int64
+	for i := int64(0); i < e.blocks() && err == nil; i++ {
+		var m int
+		m, err = io.ReadFull(r, buf[:min(e.BlockSize, size-n)])
+		if err == nil {
+			n += int64(m)
+			_, err = tmp.Write(aead.Seal(buf[:0], e.blockNonce(i), buf[:m], e.blockAD(i)))
+		}
+	}
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", nil, err
+	}
+	return tmp.Name(), e, nil
+}
+
+// annotate records the encryption parameters in the annotations of a layer.
+func (e *encryption) annotate(a map[string]string) {
+	data, _ := json.Marshal(e)
+	a[AnnotationEncryption] = string(data)
+}
+
+// decryptReader decrypts an encrypted blob as it streams in.
+type decryptReader struct {
+	e    *encryption
+	aead cipher.AEAD
+	r    io.Reader
+	i    int64
+	buf  []byte
+	out  []byte
+}
+
+func newDecryptReader(e *encryption, aead cipher.AEAD, r io.Reader) *decryptReader {
+	return &decryptReader{e: e, aead: aead, r: r, buf: make([]byte, e.BlockSize+aesGCMTagSize)}
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.i == d.e.blocks() {
+			// reading to EOF lets a verifying reader check the digest
+			if n, err := io.Copy(io.Discard, d.r); err != nil {
+				return 0, err
+			} else if n > 0 {
+				return 0, fmt.Errorf("encrypted layer has %d unexpected trailing bytes", n)
+			}
+			return 0, io.EOF
+		}
+		n := min(d.e.BlockSize, d.e.Size-d.i*d.e.BlockSize) + aesGCMTagSize
+		if _, err := io.ReadFull(d.r, d.buf[:n]); err != nil {
+			return 0, fmt.Errorf("failed to read block %d: %w", d.i, err)
+		}
+		out, err := d.e.openBlock(d.aead, d.i, d.buf[:n])
+		if err != nil {
+			return 0, err
+		}
+		d.out = out
+		d.i++
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// readRange decrypts n plaintext bytes at off, fetching the sealed blocks
+// that hold them with fetch.
+func (e *encryption) readRange(aead cipher.AEAD, off, n int64, fetch func(off, n int64) ([]byte, error)) ([]byte, error) {
+	if off < 0 || n < 0 || off+n > e.Size {
+		return nil, fmt.Errorf("range %d+%d is outside the %d byte layer", off, n, e.Size)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	first, last := off/e.BlockSize, (off+n-1)/e.BlockSize
+	sealedBlock := e.BlockSize + aesGCMTagSize
+	start := first * sealedBlock
+	end := min((last+1)*sealedBlock, e.sealedSize())
+	sealed, err := fetch(start, end-start)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, (last-first+1)*e.BlockSize)
+	for i := first; i <= last; i++ {
+		b := sealed[(i-first)*sealedBlock : min((i-first+1)*sealedBlock, int64(len(sealed)))]
+		data, err := e.openBlock(aead, i, b)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, data...)
+	}
+	skip := off - first*e.BlockSize
+	return out[skip : skip+n], nil
+}
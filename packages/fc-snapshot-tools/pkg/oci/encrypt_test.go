@@ -0,0 +1,158 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeKeyfile(t *testing.T) *KeyfileProvider {
+	t.Helper()
+	key := make([]byte, 32)
+	rand.Read(key)
+	path := filepath.Join(t.TempDir(), "snapshot.key")
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	kp, err := NewKeyfileProvider(path)
+	if err != nil {
+		t.Fatalf("NewKeyfileProvider: %v", err)
+	}
+	return kp
+}
+
+func TestKeyfileProvider(t *testing.T) {
+	ctx := context.Background()
+	kp, other := writeKeyfile(t), writeKeyfile(t)
+	dataKey := bytes.Repeat([]byte{7}, dataKeySize)
+	wrapped, err := kp.WrapKey(ctx, dataKey)
+	if err != nil {
+		t.Fatalf("WrapKey: %v", err)
+	}
+	if bytes.Contains(wrapped.Key, dataKey) {
+		t.Fatal("wrapped key holds the data key")
+	}
+	got, err := kp.UnwrapKey(ctx, wrapped)
+	if err != nil || !bytes.Equal(got, dataKey) {
+		t.Fatalf("UnwrapKey = %x, %v", got, err)
+	}
+	if _, err := other.UnwrapKey(ctx, wrapped); !errors.Is(err, ErrNoKey) {
+		t.Fatalf("UnwrapKey with another keyfile: %v", err)
+	}
+}
+
+func TestEncryptRange(t *testing.T) {
+	ctx := context.Background()
+	kp := writeKeyfile(t)
+	data := compressibleData(3*encryptBlockSize + 100)
+	path, e, err := encryptFile(ctx, func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}, kp)
+	if err != nil {
+		t.Fatalf("encryptFile: %v", err)
+	}
+	defer os.Remove(path)
+	sealed, _ := os.ReadFile(path)
+	if int64(len(sealed)) != e.sealedSize() || bytes.Contains(sealed, data[:64]) {
+		t.Fatalf("sealed %d bytes, want %d of ciphertext", len(sealed), e.sealedSize())
+	}
+	aead, err := e.aead(ctx, kp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := io.ReadAll(newDecryptReader(e, aead, bytes.NewReader(sealed)))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("decrypted %d bytes, %v", len(got), err)
+	}
+	fetch := func(off, n int64) ([]byte, error) { return sealed[off : off+n], nil }
+	for _, r := range [][2]int64{{0, 10}, {encryptBlockSize - 5, 10}, {encryptBlockSize, 2 * encryptBlockSize}, {int64(len(data)) - 50, 50}} {
+		got, err := e.readRange(aead, r[0], r[1], fetch)
+		if err != nil || !bytes.Equal(got, data[r[0]:r[0]+r[1]]) {
+			t.Fatalf("readRange(%d, %d) returned wrong content, %v", r[0], r[1], err)
+		}
+	}
+
+	// dropping the last block is detected even with a matching size
+	truncated := *e
+	truncated.Size = 3 * encryptBlockSize
+	if _, err := io.ReadAll(newDecryptReader(&truncated, aead, bytes.NewReader(sealed[:truncated.sealedSize()]))); err == nil {
+		t.Fatal("expected error for truncated layer")
+	}
+	sealed[encryptBlockSize+aesGCMTagSize+1] ^= 1
+	if _, err := e.readRange(aead, encryptBlockSize, 10, fetch); err == nil {
+		t.Fatal("expected error for tampered block")
+	}
+}
+
+func TestPushPullEncrypted(t *testing.T) {
+	reg := newTestRegistry(t)
+	dir := t.TempDir()
+	mem, vm, cfg := writeSnapshot(t, dir)
+	data := compressibleData(lazyBlockSize + 300<<10)
+	os.WriteFile(mem, data, 0644)
+	kp := writeKeyfile(t)
+
+	ctx := context.Background()
+	ref := reg.host() + "/sporelet/layer1:dev"
+	if _, err := PushSnapshot(ctx, ref, mem, vm, cfg, WithPlainHTTP(true), WithKeyProvider(kp), WithChunking(true)); err == nil {
+		t.Fatal("expected error for encrypted chunked push")
+	}
+	if _, err := PushSnapshot(ctx, ref, mem, vm, cfg, WithPlainHTTP(true), WithKeyProvider(kp)); err != nil {
+		t.Fatalf("PushSnapshot: %v", err)
+	}
+
+	var manifest Manifest
+	json.Unmarshal(reg.manifests["sporelet/layer1:dev"], &manifest)
+	types := map[string]string{}
+	for _, l := range manifest.Layers {
+		types[l.Annotations[AnnotationTitle]] = l.MediaType
+	}
+	if types["snapshot.mem"] != MediaTypeMemory+SuffixZstd+SuffixEncrypted || types["snapshot.vmstate"] != MediaTypeVMState+SuffixEncrypted || types["snapshot.config"] != MediaTypeVMConfig {
+		t.Fatalf("layer media types %v", types)
+	}
+	for _, blob := range reg.blobs {
+		if bytes.Contains(blob, []byte("dummy snapshot.vmstate")) {
+			t.Fatal("registry holds the vmstate in plaintext")
+		}
+	}
+
+	out := t.TempDir()
+	if err := PullSnapshot(ctx, ref, out, WithPlainHTTP(true)); !errors.Is(err, ErrNoKey) {
+		t.Fatalf("PullSnapshot without key: %v", err)
+	}
+	if err := PullSnapshot(ctx, ref, out, WithPlainHTTP(true), WithKeyProvider(kp)); err != nil {
+		t.Fatalf("PullSnapshot: %v", err)
+	}
+	for _, f := range []string{mem, vm, cfg} {
+		want, _ := os.ReadFile(f)
+		got, _ := os.ReadFile(filepath.Join(out, filepath.Base(f)))
+		if !bytes.Equal(got, want) {
+			t.Fatalf("pulled %s differs", filepath.Base(f))
+		}
+	}
+
+	if _, err := OpenLayer(ctx, ref, MediaTypeMemory, WithPlainHTTP(true)); !errors.Is(err, ErrNoKey) {
+		t.Fatalf("OpenLayer without key: %v", err)
+	}
+	r, err := OpenLayer(ctx, ref, MediaTypeMemory, WithPlainHTTP(true), WithKeyProvider(kp))
+	if err != nil {
+		t.Fatalf("OpenLayer: %v", err)
+	}
+	if r.Size() != int64(len(data)) {
+		t.Fatalf("size %d, want %d", r.Size(), len(data))
+	}
+	for _, off := range []int64{0, lazyBlockSize - 100, int64(len(data)) - 4096} {
+		page := make([]byte, 4096)
+		if _, err := r.ReadAt(page, off); err != nil || !bytes.Equal(page, data[off:off+4096]) {
+			t.Fatalf("ReadAt(%d) returned wrong content, %v", off, err)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tagPageSize is the number of tags requested per page of a tag listing.
+var tagPageSize = 1000
+
+// SnapshotSummary describes a snapshot manifest in a repository.
+type SnapshotSummary struct {
+	Tag    string `json:"tag,omitempty"`
+	Digest string `json:"digest"`
+	// Reference pins the snapshot by digest; it is set for parents and
+	// children, which may live in other repositories
+	Reference string `json:"reference,omitempty"`
+	// Size is the number of bytes of the manifest's layers in the registry
+	Size             int64     `json:"size"`
+	Layer            int       `json:"layer"`
+	Parent           string    `json:"parent,omitempty"`
+	ParentRepository string    `json:"parentRepository,omitempty"`
+	Platform         string    `json:"platform,omitempty"`
+	Created          time.Time `json:"created"`
+	// Missing is set for parents whose manifest is not in the repository
+	Missing bool `json:"missing,omitempty"`
+}
+
+// SnapshotInfo is the detailed description of a snapshot manifest.
+type SnapshotInfo struct {
+	Reference   string            `json:"reference"`
+	Digest      string            `json:"digest"`
+	MediaType   string            `json:"mediaType"`
+	Platform    string            `json:"platform"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations"`
+	Files       []SnapshotFile    `json:"files"`
+	// Parents is the chain of snapshots this one builds on, nearest first
+	Parents  []SnapshotSummary `json:"parents,omitempty"`
+	Manifest Manifest          `json:"manifest"`
+}
+
+// SnapshotFile describes a file of a snapshot artifact.
+type SnapshotFile struct {
+	Name      string `json:"name"`
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	// Size is the number of bytes the file takes in the registry, including
+	// all chunks of a chunked file
+	Size int64 `json:"size"`
+	// FileSize is the size of the file once pulled, if it is known without
+	// downloading it
+	FileSize    int64  `json:"fileSize,omitempty"`
+	Compression string `json:"compression,omitempty"`
+	Encrypted   bool   `json:"encrypted,omitempty"`
+	Chunks      int    `json:"chunks,omitempty"`
+}
+
+// ListTags returns the tags of ref's repository, sorted. For an image layout
+// these are the ref names in its index.
+func (c *Client) ListTags(ctx context.Context, ref Reference) ([]string, error) {
+	if ref.Layout != "" {
+		index, err := layout(ref.Layout).readIndex()
+		if err != nil {
+			return nil, err
+		}
+		var tags []string
+		for _, d := range index.Manifests {
+			if tag := d.Annotations[AnnotationRefName]; tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+		sort.Strings(tags)
+		return tags, nil
+	}
+
+	var tags []string
+	next := c.url(ref, "tags", "list") + "?n=" + strconv.Itoa(tagPageSize)
+	for next != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, next, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.do(req, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode tag list: %w", err)
+		}
+		tags = append(tags, page.Tags...)
+		if next, err = nextPage(req.URL, resp.Header.Get("Link")); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// nextPage returns the URL of the next page of a paginated listing from the
+// Link header of the current page, or "" on the last page.
+func nextPage(current *url.URL, link string) (string, error) {
+	if link == "" {
+		return "", nil
+	}
+	target, params, _ := strings.Cut(link, ";")
+	target = strings.TrimSpace(target)
+	if !strings.Contains(params, `rel="next"`) || !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+		return "", nil
+	}
+	u, err := current.Parse(strings.Trim(target, "<>"))
+	if err != nil {
+		return "", fmt.Errorf("invalid Link header %q: %w", link, err)
+	}
+	return u.String(), nil
+}
+
+// ListSnapshots returns the snapshots tagged in ociRef's repository, ordered
+// by tag. Each platform of an image index is listed separately. Tags that do
+// not hold snapshots, such as signature and referrers tags, are left out.
+func ListSnapshots(ctx context.Context, ociRef string, opts ...Option) ([]SnapshotSummary, error) {
+	ref, err := ParseReference(ociRef)
+	if err != nil {
+		return nil, err
+	}
+	c := newClient(newOptions(opts))
+	all, err := c.ListTags(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tags: %w", err)
+	}
+	// referrers tags list child snapshots, which are listed by their own tags
+	var tags []string
+	for _, tag := range all {
+		if !isReferrersTag(tag) {
+			tags = append(tags, tag)
+		}
+	}
+
+	found := make([][]SnapshotSummary, len(tags))
+	err = parallel(ctx, c.concurrency, len(tags), func(ctx context.Context, i int) error {
+		tag := ref.WithDigest("")
+		tag.Tag = tags[i]
+		var err error
+		found[i], err = c.summarizeTag(ctx, tag)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var out []SnapshotSummary
+	for _, s := range found {
+		out = append(out, s...)
+	}
+	return out, nil
+}
+
+// summarizeTag describes the snapshots ref's tag points at: one for a
+// snapshot manifest, one per snapshot entry for an image index, and none if
+// the tag holds something else.
+func (c *Client) summarizeTag(ctx context.Context, ref Reference) ([]SnapshotSummary, error) {
+	desc, data, err := c.FetchManifest(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", ref, err)
+	}
+	if desc.MediaType != MediaTypeImageIndex {
+		s, ok := summarize(desc, data)
+		if !ok {
+			return nil, nil
+		}
+		s.Tag = ref.Tag
+		return []SnapshotSummary{s}, nil
+	}
+
+	var index Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("failed to decode index %s: %w", ref, err)
+	}
+	var out []SnapshotSummary
+	for _, entry := range index.Manifests {
+		if entry.ArtifactType != "" && entry.ArtifactType != FirecrackerArtifactType {
+			continue
+		}
+		desc, data, err := c.FetchManifest(ctx, ref.WithDigest(entry.Digest))
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch %s: %w", ref.WithDigest(entry.Digest), err)
+		}
+		if s, ok := summarize(desc, data); ok {
+			s.Tag = ref.Tag
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+// summarize describes the manifest desc with content data, if it is a
+// snapshot manifest.
+func summarize(desc Descriptor, data []byte) (SnapshotSummary, bool) {
+	var m Manifest
+	if json.Unmarshal(data, &m) != nil {
+		return SnapshotSummary{}, false
+	}
+	return summarizeManifest(desc, m)
+}
+
+// summarizeManifest describes the manifest m with descriptor desc, if it is
+// a snapshot manifest.
+func summarizeManifest(desc Descriptor, m Manifest) (SnapshotSummary, bool) {
+	if m.ArtifactType != FirecrackerArtifactType {
+		return SnapshotSummary{}, false
+	}
+	md, err := ParseSnapshotMetadata(m.Annotations)
+	if err != nil {
+		return SnapshotSummary{}, false
+	}
+	s := SnapshotSummary{Digest: desc.Digest, Layer: md.Layer, Parent: md.Parent, ParentRepository: md.ParentRepository, Created: md.Created}
+	if md.Architecture != "" {
+		s.Platform = snapshotPlatform(md).String()
+	}
+	for _, l := range m.Layers {
+		s.Size += l.Size
+	}
+	return s, true
+}
+
+// InspectSnapshot describes the snapshot ociRef points at: its manifest,
+// files and the chain of parent snapshots. If ociRef
+// points at an image index, the snapshot for the platform set with
+// WithPlatform is described.
+func InspectSnapshot(ctx context.Context, ociRef string, opts ...Option) (*SnapshotInfo, error) {
+	ref, err := ParseReference(ociRef)
+	if err != nil {
+		return nil, err
+	}
+	c := newClient(newOptions(opts))
+	desc, m, err := c.ResolveSnapshot(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	summary, ok := summarizeManifest(desc, m)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a snapshot manifest", ref)
+	}
+
+	info := &SnapshotInfo{
+		Reference:   ref.String(),
+		Digest:      desc.Digest,
+		MediaType:   desc.MediaType,
+		Platform:    summary.Platform,
+		Size:        summary.Size,
+		Annotations: m.Annotations,
+		Manifest:    m,
+	}
+	if info.Files, err = c.snapshotFiles(ctx, ref, m); err != nil {
+		return nil, err
+	}
+	if info.Parents, err = c.parentChain(ctx, ref, summary); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// snapshotFiles describes the titled layers of a snapshot manifest. The
+// chunk indexes of chunked files are fetched to add up their chunks.
+func (c *Client) snapshotFiles(ctx context.Context, ref Reference, m Manifest) ([]SnapshotFile, error) {
+	var files []SnapshotFile
+	for _, l := range m.Layers {
+		name := l.Annotations[AnnotationTitle]
+		if name == "" {
+			continue
+		}
+		mediaType, compressed := baseMediaType(l.MediaType)
+		f := SnapshotFile{
+			Name:      name,
+			MediaType: mediaType,
+			Digest:    l.Digest,
+			Size:      l.Size,
+			Encrypted: strings.HasSuffix(l.MediaType, SuffixEncrypted),
+		}
+		if compressed {
+			f.Compression = "zstd"
+		}
+		switch {
+		case mediaType == MediaTypeChunkIndex:
+			idx, err := c.fetchChunkIndex(ctx, ref, l, m)
+			if err != nil {
+				return nil, err
+			}
+			f.MediaType, f.Digest, f.FileSize, f.Chunks = idx.MediaType, idx.Digest, idx.Size, len(idx.Chunks)
+			seen := map[string]bool{}
+			for _, ch := range idx.Chunks {
+				if !seen[ch.Digest] {
+					seen[ch.Digest] = true
+					f.Size += ch.Size
+				}
+			}
+		case mediaType == MediaTypeMemoryDelta:
+			f.FileSize, _ = strconv.ParseInt(l.Annotations[AnnotationDeltaSize], 10, 64)
+		case l.Annotations[AnnotationSparseSize] != "":
+			f.FileSize, _ = strconv.ParseInt(l.Annotations[AnnotationSparseSize], 10, 64)
+		case !compressed && !f.Encrypted:
+			f.FileSize = l.Size
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// parentChain follows the parent annotations from the snapshot s stored at
+// ref, through other repositories where the annotations say so. A parent
+// that cannot be found ends the chain and is marked missing.
+func (c *Client) parentChain(ctx context.Context, ref Reference, s SnapshotSummary) ([]SnapshotSummary, error) {
+	var chain []SnapshotSummary
+	seen := map[string]bool{}
+	for {
+		parent, ok := parentOf(ref, s)
+		if !ok || seen[parent.String()] {
+			return chain, nil
+		}
+		seen[parent.String()] = true
+		desc, data, err := c.FetchManifest(ctx, parent)
+		if errors.Is(err, ErrNotFound) {
+			return append(chain, SnapshotSummary{Digest: parent.Digest, Reference: parent.String(), Missing: true}), nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch parent %s: %w", parent, err)
+		}
+		if s, ok = summarize(desc, data); !ok {
+			return nil, fmt.Errorf("parent %s is not a snapshot manifest", parent)
+		}
+		s.Reference = parent.String()
+		chain = append(chain, s)
+		ref = parent
+	}
+}
+
+// parentOf returns the pinned reference of the parent of the snapshot s
+// stored at ref, if it has one.
+func parentOf(ref Reference, s SnapshotSummary) (Reference, bool) {
+	if s.Parent == "" {
+		return Reference{}, false
+	}
+	if s.ParentRepository != "" {
+		repo, err := ParseReference(s.ParentRepository)
+		if err != nil {
+			return Reference{}, false
+		}
+		ref = repo
+	}
+	return ref.WithDigest(s.Parent), true
+}
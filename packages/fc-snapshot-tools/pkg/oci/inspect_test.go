@@ -0,0 +1,115 @@
+package oci
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestListSnapshots(t *testing.T) {
+	reg := newTestRegistry(t)
+	mem, vm, cfg := writeSnapshot(t, t.TempDir())
+	ctx := context.Background()
+	repo := reg.host() + "/sporelet/layer"
+
+	base, err := PushSnapshot(ctx, repo+":base", mem, vm, cfg, WithPlainHTTP(true), WithMetadata(SnapshotMetadata{Layer: Layer1}))
+	if err != nil {
+		t.Fatalf("PushSnapshot: %v", err)
+	}
+	if _, err := PushSnapshot(ctx, repo+":app", mem, vm, cfg, WithPlainHTTP(true), WithMetadata(SnapshotMetadata{Layer: Layer2, Parent: base})); err != nil {
+		t.Fatalf("PushSnapshot: %v", err)
+	}
+	for _, arch := range []string{"amd64", "arm64"} {
+		md := SnapshotMetadata{Layer: Layer1, Architecture: arch}
+		if _, err := PushSnapshot(ctx, repo+":multi", mem, vm, cfg, WithPlainHTTP(true), WithMetadata(md), WithIndex(true)); err != nil {
+			t.Fatalf("PushSnapshot(%s): %v", arch, err)
+		}
+	}
+	_, priv, _ := GenerateKey()
+	key, _ := ParsePrivateKey(priv)
+	if _, err := SignSnapshot(ctx, repo+":base", key, WithPlainHTTP(true)); err != nil {
+		t.Fatalf("SignSnapshot: %v", err)
+	}
+
+	old := tagPageSize
+	tagPageSize = 2
+	defer func() { tagPageSize = old }()
+
+	got, err := ListSnapshots(ctx, repo, WithPlainHTTP(true))
+	if err != nil {
+		t.Fatalf("ListSnapshots: %v", err)
+	}
+	var rows []string
+	for _, s := range got {
+		rows = append(rows, s.Tag+" "+s.Platform)
+		if s.Size == 0 || s.Created.IsZero() {
+			t.Errorf("%s: size %d, created %v", s.Tag, s.Size, s.Created)
+		}
+		if s.Tag == "app" && (s.Layer != Layer2 || s.Parent != base) {
+			t.Errorf("app: layer %d, parent %s", s.Layer, s.Parent)
+		}
+	}
+	want := []string{"app linux/" + HostPlatform().Architecture, "base linux/" + HostPlatform().Architecture, "multi linux/amd64", "multi linux/arm64"}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("snapshots %q, want %q", rows, want)
+	}
+	if n := reg.count("GET", "/v2/sporelet/layer/tags/list"); n < 2 {
+		t.Errorf("%d tag list requests, want pagination", n)
+	}
+}
+
+func TestInspectSnapshot(t *testing.T) {
+	reg := newTestRegistry(t)
+	mem, vm, cfg := writeSnapshot(t, t.TempDir())
+	ctx := context.Background()
+	repo := reg.host() + "/sporelet/layer"
+
+	layer0, err := PushSnapshot(ctx, repo+":kernel", mem, vm, cfg, WithPlainHTTP(true), WithMetadata(SnapshotMetadata{Layer: Layer0}))
+	if err != nil {
+		t.Fatalf("PushSnapshot: %v", err)
+	}
+	layer1, err := PushSnapshot(ctx, repo+":base", mem, vm, cfg, WithPlainHTTP(true), WithMetadata(SnapshotMetadata{Layer: Layer1, Parent: layer0}))
+	if err != nil {
+		t.Fatalf("PushSnapshot: %v", err)
+	}
+	layer2, err := PushSnapshot(ctx, repo+":app", mem, vm, cfg, WithPlainHTTP(true), WithChunking(true), WithMetadata(SnapshotMetadata{Layer: Layer2, Parent: layer1}))
+	if err != nil {
+		t.Fatalf("PushSnapshot: %v", err)
+	}
+	// the kernel layer has since been deleted
+	delete(reg.manifests, "sporelet/layer:kernel")
+	delete(reg.manifests, "sporelet/layer:"+layer0)
+
+	info, err := InspectSnapshot(ctx, repo+":app", WithPlainHTTP(true))
+	if err != nil {
+		t.Fatalf("InspectSnapshot: %v", err)
+	}
+	if info.Digest != layer2 || info.Annotations[AnnotationLayerLevel] != "2" {
+		t.Errorf("digest %s, annotations %v", info.Digest, info.Annotations)
+	}
+
+	memInfo, _ := os.Stat(mem)
+	files := map[string]SnapshotFile{}
+	for _, f := range info.Files {
+		files[f.Name] = f
+	}
+	if f := files[filepath.Base(mem)]; f.MediaType != MediaTypeMemory || f.Chunks == 0 || f.FileSize != memInfo.Size() || f.Size == 0 {
+		t.Errorf("memory file %+v", f)
+	}
+	if f := files[filepath.Base(vm)]; f.MediaType != MediaTypeVMState || f.FileSize != f.Size {
+		t.Errorf("vmstate file %+v", f)
+	}
+
+	var chain []string
+	for _, p := range info.Parents {
+		chain = append(chain, p.Digest)
+	}
+	if want := []string{layer1, layer0}; !reflect.DeepEqual(chain, want) {
+		t.Errorf("parents %v, want %v", chain, want)
+	}
+	if last := info.Parents[len(info.Parents)-1]; !last.Missing || info.Parents[0].Missing || info.Parents[0].Layer != Layer1 {
+		t.Errorf("parents %+v", info.Parents)
+	}
+}
@@ -0,0 +1,215 @@
+package oci
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// AnnotationRefName tags a manifest in the index of an image layout
+	AnnotationRefName = "org.opencontainers.image.ref.name"
+
+	layoutFile    = "oci-layout"
+	layoutIndex   = "index.json"
+	layoutVersion = "1.0.0"
+)
+
+// layout is an OCI image layout directory. Clients read and write references
+// with a Layout through it instead of a registry; tags are the ref name
+// annotations of the index entries.
+type layout string
+
+// init creates the layout if the directory does not hold one yet.
+func (l layout) init() error {
+	if err := os.MkdirAll(filepath.Join(string(l), "blobs", "sha256"), 0755); err != nil {
+		return fmt.Errorf("failed to create image layout: %w", err)
+	}
+	marker := filepath.Join(string(l), layoutFile)
+	if _, err := os.Stat(marker); err == nil {
+		return nil
+	}
+	data, _ := json.Marshal(map[string]string{"imageLayoutVersion": layoutVersion})
+	if err := os.WriteFile(marker, data, 0644); err != nil {
+		return fmt.Errorf("failed to create image layout: %w", err)
+	}
+	return l.writeIndex(Index{SchemaVersion: 2, MediaType: MediaTypeImageIndex})
+}
+
+func (l layout) blobPath(digest string) string {
+	algo, hex, _ := strings.Cut(digest, ":")
+	return filepath.Join(string(l), "blobs", algo, hex)
+}
+
+// readIndex returns the index of the layout, which is empty if the layout
+// does not exist.
+func (l layout) readIndex() (Index, error) {
+	index := Index{SchemaVersion: 2, MediaType: MediaTypeImageIndex}
+	data, err := os.ReadFile(filepath.Join(string(l), layoutIndex))
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return index, err
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return index, fmt.Errorf("failed to decode %s: %w", layoutIndex, err)
+	}
+	return index, nil
+}
+
+func (l layout) writeIndex(index Index) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(string(l), layoutIndex+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(string(l), layoutIndex))
+}
+
+// fetchManifest returns the descriptor and content of the manifest ref
+// points at. A reference without tag or digest addresses the only manifest
+// of a layout that has one, and the "latest" tag otherwise.
+func (l layout) fetchManifest(ref Reference) (Descriptor, []byte, error) {
+	index, err := l.readIndex()
+	if err != nil {
+		return Descriptor{}, nil, err
+	}
+	desc, found := Descriptor{Digest: ref.Digest}, false
+	for _, d := range index.Manifests {
+		switch {
+		case ref.Digest != "":
+			found = d.Digest == ref.Digest
+		case ref.Tag != "":
+			found = d.Annotations[AnnotationRefName] == ref.Tag
+		default:
+			found = len(index.Manifests) == 1 || d.Annotations[AnnotationRefName] == "latest"
+		}
+		if found {
+			desc = Descriptor{MediaType: d.MediaType, Digest: d.Digest}
+			break
+		}
+	}
+	// manifests pushed by digest need no index entry
+	if !found && ref.Digest == "" {
+		return Descriptor{}, nil, fmt.Errorf("manifest %s: %w", ref, ErrNotFound)
+	}
+
+	f, err := l.openBlob(desc.Digest)
+	if err != nil {
+		return Descriptor{}, nil, fmt.Errorf("manifest %s: %w", ref, err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxManifestSize+1))
+	if err != nil {
+		return Descriptor{}, nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if len(data) > maxManifestSize {
+		return Descriptor{}, nil, fmt.Errorf("manifest %s exceeds %d bytes", ref, maxManifestSize)
+	}
+	if got := digestBytes(data); got != desc.Digest {
+		return Descriptor{}, nil, fmt.Errorf("manifest %s: %w: got %s", ref, ErrDigestMismatch, got)
+	}
+	if desc.MediaType == "" {
+		var m struct {
+			MediaType string `json:"mediaType"`
+		}
+		json.Unmarshal(data, &m)
+		desc.MediaType = m.MediaType
+	}
+	desc.Size = int64(len(data))
+	return desc, data, nil
+}
+
+// pushManifest stores a manifest and tags it with ref's tag. Untagged
+// manifests are still listed in the index so that they are part of the
+// layout.
+func (l layout) pushManifest(ref Reference, mediaType string, data []byte) (Descriptor, error) {
+	desc := Descriptor{MediaType: mediaType, Digest: digestBytes(data), Size: int64(len(data))}
+	if err := l.init(); err != nil {
+		return Descriptor{}, err
+	}
+	if err := os.WriteFile(l.blobPath(desc.Digest), data, 0644); err != nil {
+		return Descriptor{}, fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	index, err := l.readIndex()
+	if err != nil {
+		return Descriptor{}, err
+	}
+	entry := desc
+	var manifests []Descriptor
+	for _, d := range index.Manifests {
+		switch {
+		case ref.Tag != "" && d.Annotations[AnnotationRefName] == ref.Tag:
+			continue
+		case ref.Tag != "" && d.Digest == desc.Digest && d.Annotations[AnnotationRefName] == "":
+			// the tagged entry keeps the manifest in the layout
+			continue
+		case ref.Tag == "" && d.Digest == desc.Digest:
+			return desc, nil
+		}
+		manifests = append(manifests, d)
+	}
+	if ref.Tag != "" {
+		entry.Annotations = map[string]string{AnnotationRefName: ref.Tag}
+	}
+	index.Manifests = append(manifests, entry)
+	if err := l.writeIndex(index); err != nil {
+		return Descriptor{}, fmt.Errorf("failed to update %s: %w", layoutIndex, err)
+	}
+	return desc, nil
+}
+
+func (l layout) blobExists(digest string) bool {
+	_, err := os.Stat(l.blobPath(digest))
+	return err == nil
+}
+
+func (l layout) openBlob(digest string) (*os.File, error) {
+	if err := validateDigest(digest); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(l.blobPath(digest))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("blob %s: %w", digest, ErrNotFound)
+	}
+	return f, err
+}
+
+// pushBlob stores the content of r as the blob described by desc after
+// checking it against the digest.
+func (l layout) pushBlob(desc Descriptor, r io.Reader) error {
+	if err := validateDigest(desc.Digest); err != nil {
+		return err
+	}
+	if err := l.init(); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Join(string(l), "blobs"), "upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write blob %s: %w", desc.Digest, err)
+	}
+	if got := fmt.Sprintf("sha256:%x", h.Sum(nil)); got != desc.Digest || n != desc.Size {
+		return fmt.Errorf("blob %s: %w: got %s of %d bytes", desc.Digest, ErrDigestMismatch, got, n)
+	}
+	return os.Rename(tmp.Name(), l.blobPath(desc.Digest))
+}
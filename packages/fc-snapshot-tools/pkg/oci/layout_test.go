@@ -0,0 +1,114 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPushPullLayout(t *testing.T) {
+	src := t.TempDir()
+	mem, vm, cfg := writeSnapshot(t, src)
+	ctx := context.Background()
+
+	dir := filepath.Join(t.TempDir(), "layout")
+	ref := LayoutScheme + dir + ":dev"
+	digest, err := PushSnapshot(ctx, ref, mem, vm, cfg)
+	if err != nil {
+		t.Fatalf("PushSnapshot: %v", err)
+	}
+	for _, f := range []string{layoutFile, layoutIndex} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+			t.Fatalf("layout has no %s: %v", f, err)
+		}
+	}
+
+	for _, r := range []string{ref, LayoutScheme + dir + "@" + digest} {
+		out := t.TempDir()
+		if err := PullSnapshot(ctx, r, out); err != nil {
+			t.Fatalf("PullSnapshot(%s): %v", r, err)
+		}
+		for _, f := range []string{mem, vm, cfg} {
+			want, _ := os.ReadFile(f)
+			got, err := os.ReadFile(filepath.Join(out, filepath.Base(f)))
+			if err != nil || !bytes.Equal(got, want) {
+				t.Fatalf("pulled %s = %q, %v", filepath.Base(f), got, err)
+			}
+		}
+	}
+
+	if err := PullSnapshot(ctx, LayoutScheme+dir+":missing", t.TempDir()); err == nil {
+		t.Fatal("pull of an unknown tag succeeded")
+	}
+}
+
+func TestCopySnapshotThroughLayoutTar(t *testing.T) {
+	reg := newTestRegistry(t)
+	src := t.TempDir()
+	mem, vm, cfg := writeSnapshot(t, src)
+	ctx := context.Background()
+
+	ref := reg.host() + "/sporelet/layer1:dev"
+	digest, err := PushSnapshot(ctx, ref, mem, vm, cfg, WithPlainHTTP(true))
+	if err != nil {
+		t.Fatalf("PushSnapshot: %v", err)
+	}
+	pubPEM, privPEM, _ := GenerateKey()
+	priv, _ := ParsePrivateKey(privPEM)
+	pub, _ := ParsePublicKeys(pubPEM)
+	if _, err := SignSnapshot(ctx, ref, priv, WithPlainHTTP(true)); err != nil {
+		t.Fatalf("SignSnapshot: %v", err)
+	}
+
+	// export: registry -> layout -> tar
+	exported := t.TempDir()
+	if got, err := CopySnapshot(ctx, ref, LayoutScheme+exported, WithPlainHTTP(true)); err != nil || got != digest {
+		t.Fatalf("CopySnapshot to layout = %s, %v, want %s", got, err, digest)
+	}
+	if tags, err := LayoutTags(exported); err != nil || len(tags) != 1 || tags[0] != "dev" {
+		t.Fatalf("LayoutTags = %v, %v", tags, err)
+	}
+	var archive bytes.Buffer
+	if err := WriteLayoutTar(&archive, exported); err != nil {
+		t.Fatalf("WriteLayoutTar: %v", err)
+	}
+
+	// import: tar -> layout -> registry, keeping the digest and signature
+	imported := t.TempDir()
+	if err := ExtractLayoutTar(&archive, imported); err != nil {
+		t.Fatalf("ExtractLayoutTar: %v", err)
+	}
+	if _, err := VerifySnapshot(ctx, LayoutScheme+imported+":dev", pub); err != nil {
+		t.Fatalf("VerifySnapshot on layout: %v", err)
+	}
+	dst := reg.host() + "/airgap/layer1"
+	if got, err := CopySnapshot(ctx, LayoutScheme+imported+":dev", dst, WithPlainHTTP(true)); err != nil || got != digest {
+		t.Fatalf("CopySnapshot to registry = %s, %v, want %s", got, err, digest)
+	}
+	if _, err := VerifySnapshot(ctx, dst+":dev", pub, WithPlainHTTP(true)); err != nil {
+		t.Fatalf("VerifySnapshot after import: %v", err)
+	}
+}
+
+func TestExtractLayoutTarRejectsEscapes(t *testing.T) {
+	dir := t.TempDir()
+	layoutDir := filepath.Join(dir, "layout")
+	if err := layout(layoutDir).init(); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "outside"), []byte("x"), 0644)
+	os.Symlink("../outside", filepath.Join(layoutDir, "link"))
+
+	var archive bytes.Buffer
+	if err := WriteLayoutTar(&archive, layoutDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := ExtractLayoutTar(&archive, t.TempDir()); err == nil {
+		t.Fatal("archive with a symlink was extracted")
+	}
+	if err := ExtractLayoutTar(bytes.NewReader(nil), t.TempDir()); err == nil {
+		t.Fatal("empty archive was accepted as an image layout")
+	}
+}
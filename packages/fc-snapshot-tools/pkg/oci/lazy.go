@@ -0,0 +1,306 @@
+package oci
+
+import (
+	"context"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	// lazyBlockSize is the size of range reads of unchunked layers
+	lazyBlockSize = 2 << 20
+	// lazyCachedBlocks is the number of blocks or chunks kept in memory
+	lazyCachedBlocks = 8
+)
+
+// LayerReader reads a file of a snapshot artifact at random offsets without
+// pulling the whole file first. Chunked files are read chunk by chunk through
+// the local chunk store, downloading and storing chunks it does not have;
+// unchunked files are read with range requests, one zstd frame at a time if
+// compressed and decrypting only the blocks read if encrypted, and the zero
+// extents of sparse files are not read at all. Recently read chunks and
+// blocks are kept in memory, so sequential page-sized reads make few
+// requests.
+type LayerReader struct {
+	ctx    context.Context
+	c      *Client
+	ref    Reference
+	desc   Descriptor
+	index  *ChunkIndex
+	layout *sparseLayout
+	frames *seekTable
+	enc    *encryption
+	aead   cipher.AEAD
+	store  string
+
+	mu      sync.Mutex
+	cache   []cachedBlock // most recently used first
+	loading map[int64]*blockLoad
+}
+
+type cachedBlock struct {
+	offset int64
+	data   []byte
+}
+
+// blockLoad is a chunk or block being loaded, done once it is.
+type blockLoad struct {
+	done  chan struct{}
+	block cachedBlock
+	err   error
+}
+
+// OpenLayer opens the file with the given media type, such as
+// MediaTypeMemory, of the snapshot artifact at ociRef. ctx bounds every
+// registry request made by the returned reader. WithChunkStore sets where
+// chunks are cached. WithKeyProvider unwraps the data key of an encrypted
+// layer.
+func OpenLayer(ctx context.Context, ociRef, mediaType string, opts ...Option) (*LayerReader, error) {
+	o := newOptions(opts)
+	ref, err := ParseReference(ociRef)
+	if err != nil {
+		return nil, err
+	}
+	c := newClient(o)
+	_, manifest, err := c.ResolveSnapshot(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &LayerReader{ctx: ctx, c: c, ref: ref, store: o.chunkStore}
+	for _, layer := range manifest.Layers {
+		base, compressed := baseMediaType(layer.MediaType)
+		switch {
+		case base == mediaType:
+			r.desc = layer
+			r.layout, err = parseSparseLayout(layer)
+			if err != nil {
+				return nil, err
+			}
+			if r.enc, err = parseEncryption(layer); err != nil {
+				return nil, err
+			}
+			if r.enc != nil {
+				if r.aead, err = r.enc.aead(ctx, c.keys); err != nil {
+					return nil, err
+				}
+			}
+			if compressed {
+				if r.frames, err = readSeekTable(r.storedSize(), r.readStored); err != nil {
+					return nil, err
+				}
+			}
+			return r, nil
+		case base == MediaTypeMemoryDelta && mediaType == MediaTypeMemory:
+			return nil, fmt.Errorf("snapshot %s stores its memory as a delta, which cannot be loaded lazily", ref)
+		case layer.MediaType == MediaTypeChunkIndex && layer.Annotations[AnnotationChunkedMediaType] == mediaType:
+			idx, err := c.fetchChunkIndex(ctx, ref, layer, manifest)
+			if err != nil {
+				return nil, err
+			}
+			r.desc = layer
+			r.index = &idx
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("snapshot %s has no %s layer: %w", ref, mediaType, ErrNotFound)
+}
+
+// Size returns the size of the file.
+func (r *LayerReader) Size() int64 {
+	if r.index != nil {
+		return r.index.Size
+	}
+	if r.layout != nil {
+		return r.layout.size
+	}
+	return r.blobSize()
+}
+
+// blobSize returns the uncompressed size of an unchunked layer.
+func (r *LayerReader) blobSize() int64 {
+	if r.frames != nil {
+		return r.frames.size
+	}
+	return r.storedSize()
+}
+
+// storedSize returns the size of the decrypted content of an unchunked
+// layer.
+func (r *LayerReader) storedSize() int64 {
+	if r.enc != nil {
+		return r.enc.Size
+	}
+	return r.desc.Size
+}
+
+// readStored reads n bytes of the decrypted content of an unchunked layer at
+// off with range requests.
+func (r *LayerReader) readStored(off, n int64) ([]byte, error) {
+	fetch := func(off, n int64) ([]byte, error) {
+		return r.c.FetchBlobRange(r.ctx, r.ref, r.desc.Digest, off, n)
+	}
+	if r.enc != nil {
+		return r.enc.readRange(r.aead, off, n, fetch)
+	}
+	return fetch(off, n)
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *LayerReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	n := 0
+	for n < len(p) {
+		if off >= r.Size() {
+			return n, io.EOF
+		}
+		// zero extents of sparse layers are not stored in the blob
+		pos, avail := off, r.Size()-off
+		if r.layout != nil {
+			var hole bool
+			if pos, avail, hole = r.layout.locate(off); hole {
+				c := min(int64(len(p)-n), avail)
+				clear(p[n : n+int(c)])
+				n += int(c)
+				off += c
+				continue
+			}
+		}
+		b, err := r.block(pos)
+		if err != nil {
+			return n, err
+		}
+		end := n + int(min(avail, int64(len(p)-n)))
+		c := copy(p[n:end], b.data[pos-b.offset:])
+		n += c
+		off += int64(c)
+	}
+	return n, nil
+}
+
+// block returns the cached chunk or block containing off, loading it if
+// needed. The lock is only held to look up and insert blocks, so reads of
+// cached blocks do not wait for loads, and concurrent reads of a block that
+// is being loaded wait for that load instead of starting another.
+func (r *LayerReader) block(off int64) (cachedBlock, error) {
+	start, load := r.locate(off)
+
+	r.mu.Lock()
+	for i, b := range r.cache {
+		if b.offset == start {
+			copy(r.cache[1:i+1], r.cache[:i])
+			r.cache[0] = b
+			r.mu.Unlock()
+			return b, nil
+		}
+	}
+	if l, ok := r.loading[start]; ok {
+		r.mu.Unlock()
+		<-l.done
+		return l.block, l.err
+	}
+	if r.loading == nil {
+		r.loading = map[int64]*blockLoad{}
+	}
+	l := &blockLoad{done: make(chan struct{})}
+	r.loading[start] = l
+	r.mu.Unlock()
+
+	l.block.offset = start
+	l.block.data, l.err = load()
+
+	r.mu.Lock()
+	delete(r.loading, start)
+	if l.err == nil {
+		r.cache = append([]cachedBlock{l.block}, r.cache...)
+		if len(r.cache) > lazyCachedBlocks {
+			r.cache = r.cache[:lazyCachedBlocks]
+		}
+	}
+	r.mu.Unlock()
+	close(l.done)
+	return l.block, l.err
+}
+
+// locate returns the offset of the chunk or block containing off and a
+// function loading its content.
+func (r *LayerReader) locate(off int64) (int64, func() ([]byte, error)) {
+	if r.index != nil {
+		i := sort.Search(len(r.index.Chunks), func(i int) bool {
+			c := r.index.Chunks[i]
+			return c.Offset+c.Size > off
+		})
+		chunk := r.index.Chunks[i]
+		return chunk.Offset, func() ([]byte, error) { return r.readChunk(chunk) }
+	}
+	if r.frames != nil {
+		f := r.frames.find(off)
+		return f.start, func() ([]byte, error) { return r.readFrame(f) }
+	}
+	start := off / lazyBlockSize * lazyBlockSize
+	return start, func() ([]byte, error) {
+		return r.readStored(start, min(lazyBlockSize, r.storedSize()-start))
+	}
+}
+
+// readFrame returns the uncompressed content of a zstd frame.
+func (r *LayerReader) readFrame(f seekFrame) ([]byte, error) {
+	data, err := r.readStored(f.offset, f.size)
+	if err != nil {
+		return nil, err
+	}
+	data, err = zstdDecoder.DecodeAll(data, make([]byte, 0, f.n))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress frame at %d: %w", f.start, err)
+	}
+	if int64(len(data)) != f.n {
+		return nil, fmt.Errorf("frame at %d has %d bytes, expected %d", f.start, len(data), f.n)
+	}
+	return data, nil
+}
+
+// readChunk returns the content of a chunk from the local store, downloading
+// it into the store first if it is missing. Chunks are checked against their
+// digest however they are read.
+func (r *LayerReader) readChunk(chunk Chunk) ([]byte, error) {
+	desc := Descriptor{MediaType: MediaTypeChunk, Digest: chunk.Digest, Size: chunk.Size}
+	if r.store == "" {
+		rc, err := r.c.FetchBlob(r.ctx, r.ref, desc)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	}
+
+	// a chunk damaged in the store is fetched again
+	path := chunkPath(r.store, chunk.Digest)
+	data, err := os.ReadFile(path)
+	if err == nil && digestBytes(data) == chunk.Digest {
+		return data, nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := r.c.fetchBlobToFile(r.ctx, r.ref, desc, path); err != nil {
+		return nil, fmt.Errorf("failed to fetch chunk %s: %w", chunk.Digest, err)
+	}
+	if data, err = os.ReadFile(path); err != nil {
+		return nil, err
+	}
+	if got := digestBytes(data); got != chunk.Digest {
+		return nil, fmt.Errorf("chunk %s: %w: got %s", chunk.Digest, ErrDigestMismatch, got)
+	}
+	return data, nil
+}
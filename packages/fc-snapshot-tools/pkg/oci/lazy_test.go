@@ -0,0 +1,200 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOpenLayer(t *testing.T) {
+	reg := newTestRegistry(t)
+	mem, vm, cfg := writeSnapshot(t, t.TempDir())
+	data := make([]byte, lazyBlockSize+300<<10+123)
+	rand.New(rand.NewSource(3)).Read(data)
+	os.WriteFile(mem, data, 0644)
+
+	ctx := context.Background()
+	repo := reg.host() + "/sporelet/layer1"
+	if _, err := PushSnapshot(ctx, repo+":plain", mem, vm, cfg, WithPlainHTTP(true)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PushSnapshot(ctx, repo+":chunked", mem, vm, cfg, WithPlainHTTP(true), withTestChunking()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tag := range []string{"plain", "chunked"} {
+		store := t.TempDir()
+		r, err := OpenLayer(ctx, repo+":"+tag, MediaTypeMemory, WithPlainHTTP(true), WithChunkStore(store))
+		if err != nil {
+			t.Fatalf("OpenLayer(%s): %v", tag, err)
+		}
+		if r.Size() != int64(len(data)) {
+			t.Fatalf("%s: size %d, want %d", tag, r.Size(), len(data))
+		}
+
+		// page reads across block boundaries and at the end of the file
+		for _, off := range []int64{0, 4096, lazyBlockSize - 100, int64(len(data)) - 4096} {
+			page := make([]byte, 4096)
+			if n, err := r.ReadAt(page, off); err != nil || n != len(page) {
+				t.Fatalf("%s: ReadAt(%d) = %d, %v", tag, off, n, err)
+			}
+			if !bytes.Equal(page, data[off:off+4096]) {
+				t.Fatalf("%s: ReadAt(%d) returned wrong content", tag, off)
+			}
+		}
+		page := make([]byte, 4096)
+		if n, _ := r.ReadAt(page, int64(len(data))-10); n != 10 {
+			t.Fatalf("%s: short read at end returned %d bytes", tag, n)
+		}
+
+		entries, _ := os.ReadDir(filepath.Join(store, "sha256"))
+		if tag == "chunked" && len(entries) == 0 {
+			t.Fatal("chunks were not added to the store")
+		}
+	}
+
+	// block reads of an unchunked layer use range requests
+	if n := reg.count(http.MethodGet, "/v2/sporelet/layer1/blobs/"); n == 0 {
+		t.Fatal("expected blob requests")
+	}
+}
+
+func TestPullSnapshotLazyMemory(t *testing.T) {
+	reg := newTestRegistry(t)
+	mem, vm, cfg := writeSnapshot(t, t.TempDir())
+	ctx := context.Background()
+	ref := reg.host() + "/sporelet/layer1:dev"
+	if _, err := PushSnapshot(ctx, ref, mem, vm, cfg, WithPlainHTTP(true)); err != nil {
+		t.Fatal(err)
+	}
+
+	out := t.TempDir()
+	if err := PullSnapshot(ctx, ref, out, WithPlainHTTP(true), WithLazyMemory(true)); err != nil {
+		t.Fatalf("PullSnapshot: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "snapshot.mem")); !os.IsNotExist(err) {
+		t.Fatal("memory file was pulled")
+	}
+	if _, err := os.Stat(filepath.Join(out, "snapshot.vmstate")); err != nil {
+		t.Fatalf("vmstate not pulled: %v", err)
+	}
+}
+
+func TestLayerReaderConcurrentLoads(t *testing.T) {
+	reg := newTestRegistry(t)
+	mem, vm, cfg := writeSnapshot(t, t.TempDir())
+	data := make([]byte, 3*lazyBlockSize)
+	rand.New(rand.NewSource(4)).Read(data)
+	os.WriteFile(mem, data, 0644)
+
+	ctx := context.Background()
+	ref := reg.host() + "/sporelet/layer1:dev"
+	if _, err := PushSnapshot(ctx, ref, mem, vm, cfg, WithPlainHTTP(true)); err != nil {
+		t.Fatal(err)
+	}
+	r, err := OpenLayer(ctx, ref, MediaTypeMemory, WithPlainHTTP(true))
+	if err != nil {
+		t.Fatalf("OpenLayer: %v", err)
+	}
+	page := make([]byte, 4096)
+	if _, err := r.ReadAt(page, 0); err != nil {
+		t.Fatalf("ReadAt(0): %v", err)
+	}
+
+	// blob requests hang until released
+	started, release := make(chan struct{}, 2), make(chan struct{})
+	reg.mu.Lock()
+	reg.authorize = func(w http.ResponseWriter, req *http.Request) bool {
+		if strings.Contains(req.URL.Path, "/blobs/") {
+			started <- struct{}{}
+			<-release
+		}
+		return true
+	}
+	reg.mu.Unlock()
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	defer unblock()
+	before := reg.count(http.MethodGet, "/v2/sporelet/layer1/blobs/")
+
+	last := int64(len(data)) - 4096
+	errs := make(chan error, 2)
+	for range 2 {
+		go func() {
+			p := make([]byte, 4096)
+			_, err := r.ReadAt(p, last)
+			if err == nil && !bytes.Equal(p, data[last:]) {
+				err = errors.New("wrong content")
+			}
+			errs <- err
+		}()
+	}
+
+	// a cached block is served while another one is being fetched
+	<-started
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.ReadAt(page, 4096)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("ReadAt(cached): %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read of a cached block waited for a fetch")
+	}
+
+	unblock()
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatalf("ReadAt(%d): %v", last, err)
+		}
+	}
+	if n := reg.count(http.MethodGet, "/v2/sporelet/layer1/blobs/") - before; n != 1 {
+		t.Errorf("concurrent reads of a block made %d requests, want 1", n)
+	}
+}
+
+func TestLayerReaderDamagedChunk(t *testing.T) {
+	reg := newTestRegistry(t)
+	mem, vm, cfg := writeSnapshot(t, t.TempDir())
+	data := make([]byte, 256<<10)
+	rand.New(rand.NewSource(5)).Read(data)
+	os.WriteFile(mem, data, 0644)
+
+	ctx := context.Background()
+	ref := reg.host() + "/sporelet/layer1:dev"
+	if _, err := PushSnapshot(ctx, ref, mem, vm, cfg, WithPlainHTTP(true), withTestChunking()); err != nil {
+		t.Fatal(err)
+	}
+	store := t.TempDir()
+	r, err := OpenLayer(ctx, ref, MediaTypeMemory, WithPlainHTTP(true), WithChunkStore(store))
+	if err != nil {
+		t.Fatalf("OpenLayer: %v", err)
+	}
+	page := make([]byte, 4096)
+	r.ReadAt(page, 0)
+
+	// the chunk in the store is damaged before the next reader reads it
+	path := chunkPath(store, r.index.Chunks[0].Digest)
+	os.WriteFile(path, bytes.Repeat([]byte{0xff}, int(r.index.Chunks[0].Size)), 0644)
+	if r, err = OpenLayer(ctx, ref, MediaTypeMemory, WithPlainHTTP(true), WithChunkStore(store)); err != nil {
+		t.Fatalf("OpenLayer: %v", err)
+	}
+	if _, err := r.ReadAt(page, 0); err != nil {
+		t.Fatalf("ReadAt: %v", err)
+	}
+	if !bytes.Equal(page, data[:4096]) {
+		t.Fatal("read the damaged chunk from the store")
+	}
+}
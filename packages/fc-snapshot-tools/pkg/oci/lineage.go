@@ -0,0 +1,264 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	// ArtifactTypeLineageLink is the artifact type of the referrer that links
+	// a parent snapshot to a child pushed to another repository
+	ArtifactTypeLineageLink = "application/vnd.sporelet.snapshot.link.v1"
+	// AnnotationChild holds the child snapshot of a lineage link, pinned by
+	// digest
+	AnnotationChild = "ai.sporelet.layer.child"
+
+	// SnapshotRefFile is written next to pulled snapshot files and holds the
+	// snapshot reference, pinned by digest
+	SnapshotRefFile = "snapshot.ref"
+	// ParentRefFile is written next to diff layer files and holds the pinned
+	// reference of the snapshot the layer was diffed against
+	ParentRefFile = "snapshot.parent"
+)
+
+// ErrParentMismatch is returned when a snapshot is pushed with a parent that
+// does not match the snapshot its files were derived from, or that cannot be
+// its parent.
+var ErrParentMismatch = errors.New("parent mismatch")
+
+// WithParent sets the pinned reference of the snapshot the pushed files were
+// derived from, such as the base of a diff layer. It becomes the parent of
+// the pushed snapshot, and a push whose metadata names another parent is
+// refused.
+func WithParent(ref string) Option {
+	return func(o *options) { o.parent = ref }
+}
+
+// lineageArtifact reports whether referrers of the given artifact type are
+// children of their subject rather than artifacts about it.
+func lineageArtifact(artifactType string) bool {
+	return artifactType == FirecrackerArtifactType || artifactType == ArtifactTypeLineageLink
+}
+
+// resolveParent returns the pinned reference of the parent of a snapshot
+// pushed to ref with metadata md, if it has one. The parent is taken from
+// derived, the reference the files were derived from, if md does not name
+// one. md is updated to name the parent, with its repository only if that
+// is not ref's.
+func resolveParent(ref Reference, md *SnapshotMetadata, derived string) (Reference, bool, error) {
+	if derived != "" {
+		d, err := ParseReference(derived)
+		if err != nil {
+			return Reference{}, false, fmt.Errorf("invalid parent reference: %w", err)
+		}
+		if d.Digest == "" {
+			return Reference{}, false, fmt.Errorf("parent reference %s is not pinned by digest", derived)
+		}
+		if md.Parent != "" && md.Parent != d.Digest {
+			return Reference{}, false, fmt.Errorf("%w: snapshot was derived from %s, not %s", ErrParentMismatch, d, md.Parent)
+		}
+		md.Parent = d.Digest
+		if md.ParentRepository == "" {
+			md.ParentRepository = d.Name()
+		}
+	}
+	if md.Parent == "" {
+		return Reference{}, false, nil
+	}
+	parent, ok := parentOf(ref, SnapshotSummary{Parent: md.Parent, ParentRepository: md.ParentRepository})
+	if !ok {
+		return Reference{}, false, fmt.Errorf("invalid parent repository %q", md.ParentRepository)
+	}
+	if parent.Name() == ref.Name() {
+		md.ParentRepository = ""
+	} else {
+		md.ParentRepository = parent.Name()
+	}
+	return parent, true, nil
+}
+
+// checkParent fetches the parent of a snapshot with metadata md and checks
+// that it is a snapshot of a lower layer and the same architecture. It
+// returns the descriptor of the parent manifest and the manifest.
+func (c *Client) checkParent(ctx context.Context, parent Reference, md SnapshotMetadata) (Descriptor, Manifest, error) {
+	desc, data, err := c.direct().FetchManifest(ctx, parent)
+	if errors.Is(err, ErrNotFound) {
+		return Descriptor{}, Manifest{}, fmt.Errorf("%w: parent %s not found", ErrParentMismatch, parent)
+	}
+	if err != nil {
+		return Descriptor{}, Manifest{}, fmt.Errorf("failed to fetch parent %s: %w", parent, err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil || m.ArtifactType != FirecrackerArtifactType {
+		return Descriptor{}, Manifest{}, fmt.Errorf("%w: parent %s is not a snapshot manifest", ErrParentMismatch, parent)
+	}
+	pmd, err := ParseSnapshotMetadata(m.Annotations)
+	if err != nil {
+		return Descriptor{}, Manifest{}, fmt.Errorf("invalid parent %s: %w", parent, err)
+	}
+	if pmd.Layer >= md.Layer {
+		return Descriptor{}, Manifest{}, fmt.Errorf("%w: parent %s is layer %d, not below layer %d", ErrParentMismatch, parent, pmd.Layer, md.Layer)
+	}
+	if pmd.Architecture != "" && md.Architecture != "" && pmd.Architecture != md.Architecture {
+		return Descriptor{}, Manifest{}, fmt.Errorf("%w: parent %s is %s, not %s", ErrParentMismatch, parent, pmd.Architecture, md.Architecture)
+	}
+	return Descriptor{MediaType: desc.MediaType, Digest: desc.Digest, Size: desc.Size}, m, nil
+}
+
+// linkChild pushes a lineage link to the parent's repository, so that a
+// child in another repository is found among the parent's referrers.
+func (c *Client) linkChild(ctx context.Context, parent Reference, subject Descriptor, child Reference) error {
+	empty := Descriptor{MediaType: MediaTypeEmptyJSON, Digest: digestBytes(emptyJSON), Size: int64(len(emptyJSON))}
+	if err := c.pushBlobIfMissing(ctx, parent, empty, func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(emptyJSON)), nil
+	}); err != nil {
+		return err
+	}
+	_, err := c.PushReferrer(ctx, parent, Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeImageManifest,
+		ArtifactType:  ArtifactTypeLineageLink,
+		Config:        empty,
+		Layers:        []Descriptor{empty},
+		Subject:       &subject,
+		Annotations:   map[string]string{AnnotationChild: child.String()},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to link %s to parent %s: %w", child, parent, err)
+	}
+	return nil
+}
+
+// LineageNode is a snapshot in a lineage tree with the snapshots built on it.
+type LineageNode struct {
+	SnapshotSummary
+	Children []LineageNode `json:"children,omitempty"`
+}
+
+// SnapshotLineage is the ancestry of a snapshot and the tree of its
+// descendants.
+type SnapshotLineage struct {
+	LineageNode
+	// Parents is the chain of snapshots this one builds on, nearest first
+	Parents []SnapshotSummary `json:"parents,omitempty"`
+}
+
+// Lineage describes the parents of the snapshot ociRef points at and,
+// through the referrers of each snapshot, its children and their
+// descendants, in any repository they were linked from. Children that no
+// longer exist are left out.
+func Lineage(ctx context.Context, ociRef string, opts ...Option) (*SnapshotLineage, error) {
+	ref, err := ParseReference(ociRef)
+	if err != nil {
+		return nil, err
+	}
+	c := newClient(newOptions(opts))
+	desc, m, err := c.ResolveSnapshot(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	summary, ok := summarizeManifest(desc, m)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a snapshot manifest", ref)
+	}
+	pinned := ref.WithDigest(desc.Digest)
+	summary.Tag = ref.Tag
+	summary.Reference = pinned.String()
+
+	lineage := &SnapshotLineage{LineageNode: LineageNode{SnapshotSummary: summary}}
+	if lineage.Parents, err = c.parentChain(ctx, ref, summary); err != nil {
+		return nil, err
+	}
+	if lineage.Children, err = c.children(ctx, pinned, map[string]bool{pinned.String(): true}); err != nil {
+		return nil, err
+	}
+	return lineage, nil
+}
+
+// children returns the snapshots whose parent is the snapshot pinned by ref,
+// oldest first, with their own children. Snapshots in seen are skipped.
+func (c *Client) children(ctx context.Context, ref Reference, seen map[string]bool) ([]LineageNode, error) {
+	referrers, err := c.Referrers(ctx, ref, ref.Digest, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list referrers of %s: %w", ref, err)
+	}
+	var out []LineageNode
+	for _, r := range referrers {
+		var child Reference
+		switch r.ArtifactType {
+		case FirecrackerArtifactType:
+			child = ref.WithDigest(r.Digest)
+		case ArtifactTypeLineageLink:
+			if child, err = c.linkedChild(ctx, ref, r); err != nil {
+				return nil, err
+			}
+			if child.Digest == "" {
+				continue
+			}
+		default:
+			continue
+		}
+		if seen[child.String()] {
+			continue
+		}
+		seen[child.String()] = true
+
+		desc, data, err := c.FetchManifest(ctx, child)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch child %s: %w", child, err)
+		}
+		s, ok := summarize(desc, data)
+		if !ok {
+			continue
+		}
+		// a link may outlive a retag of the child to another parent
+		if parent, ok := parentOf(child, s); !ok || parent.String() != ref.String() {
+			continue
+		}
+		s.Reference = child.String()
+		node := LineageNode{SnapshotSummary: s}
+		if node.Children, err = c.children(ctx, child, seen); err != nil {
+			return nil, err
+		}
+		out = append(out, node)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Created.Equal(out[j].Created) {
+			return out[i].Created.Before(out[j].Created)
+		}
+		return out[i].Digest < out[j].Digest
+	})
+	return out, nil
+}
+
+// linkedChild returns the child a lineage link among ref's referrers points
+// at. Registries that leave annotations out of the referrers list have the
+// link manifest fetched. A link without a pinned child yields an empty
+// reference.
+func (c *Client) linkedChild(ctx context.Context, ref Reference, link Descriptor) (Reference, error) {
+	child, ok := link.Annotations[AnnotationChild]
+	if !ok {
+		_, data, err := c.FetchManifest(ctx, ref.WithDigest(link.Digest))
+		if err != nil {
+			return Reference{}, fmt.Errorf("failed to fetch lineage link %s: %w", link.Digest, err)
+		}
+		var m Manifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return Reference{}, fmt.Errorf("failed to decode lineage link %s: %w", link.Digest, err)
+		}
+		child = m.Annotations[AnnotationChild]
+	}
+	r, err := ParseReference(child)
+	if err != nil {
+		return Reference{}, nil
+	}
+	return r, nil
+}
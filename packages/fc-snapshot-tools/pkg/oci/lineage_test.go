@@ -0,0 +1,141 @@
+package oci
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLineage(t *testing.T) {
+	for _, referrers := range []bool{false, true} {
+		reg := newTestRegistry(t)
+		reg.referrers = referrers
+		mem, vm, cfg := writeSnapshot(t, t.TempDir())
+		ctx := context.Background()
+		repo := reg.host() + "/sporelet/layer"
+		created := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+
+		kernel, err := PushSnapshot(ctx, repo+":kernel", mem, vm, cfg, WithPlainHTTP(true), WithMetadata(SnapshotMetadata{Layer: Layer0}))
+		if err != nil {
+			t.Fatalf("PushSnapshot: %v", err)
+		}
+		base, err := PushSnapshot(ctx, repo+":base", mem, vm, cfg, WithPlainHTTP(true), WithMetadata(SnapshotMetadata{Layer: Layer1, Parent: kernel}))
+		if err != nil {
+			t.Fatalf("PushSnapshot: %v", err)
+		}
+		app, err := PushSnapshot(ctx, repo+":app", mem, vm, cfg, WithPlainHTTP(true), WithMetadata(SnapshotMetadata{Layer: Layer2, Parent: base, Created: created}))
+		if err != nil {
+			t.Fatalf("PushSnapshot: %v", err)
+		}
+
+		// a workload layer diffed against the pulled base, in its own repository
+		pulled := t.TempDir()
+		if err := PullSnapshot(ctx, repo+":base", pulled, WithPlainHTTP(true)); err != nil {
+			t.Fatalf("PullSnapshot: %v", err)
+		}
+		pinned, _ := os.ReadFile(filepath.Join(pulled, SnapshotRefFile))
+		if want := repo + "@" + base; strings.TrimSpace(string(pinned)) != want {
+			t.Fatalf("%s = %q, want %q", SnapshotRefFile, pinned, want)
+		}
+		other := reg.host() + "/sporelet/model"
+		model, err := PushSnapshot(ctx, other+":dev", mem, vm, cfg, WithPlainHTTP(true), WithParent(strings.TrimSpace(string(pinned))),
+			WithMetadata(SnapshotMetadata{Layer: Layer2, Created: created.Add(time.Hour)}))
+		if err != nil {
+			t.Fatalf("PushSnapshot(model): %v", err)
+		}
+
+		c := NewClient(WithPlainHTTP(true))
+		_, m, err := c.ResolveSnapshot(ctx, mustParse(t, repo+":app"))
+		if err != nil {
+			t.Fatalf("ResolveSnapshot: %v", err)
+		}
+		if m.Subject == nil || m.Subject.Digest != base {
+			t.Errorf("app subject %+v, want %s", m.Subject, base)
+		}
+		_, m, err = c.ResolveSnapshot(ctx, mustParse(t, other+":dev"))
+		if err != nil {
+			t.Fatalf("ResolveSnapshot: %v", err)
+		}
+		if m.Subject != nil || m.Annotations[AnnotationParentRepository] != repo || m.Annotations[AnnotationParentDigest] != base {
+			t.Errorf("model subject %+v, annotations %v", m.Subject, m.Annotations)
+		}
+
+		lineage, err := Lineage(ctx, repo+":base", WithPlainHTTP(true))
+		if err != nil {
+			t.Fatalf("Lineage: %v", err)
+		}
+		if len(lineage.Parents) != 1 || lineage.Parents[0].Digest != kernel {
+			t.Errorf("parents %+v, want %s", lineage.Parents, kernel)
+		}
+		var children []string
+		for _, n := range lineage.Children {
+			children = append(children, n.Reference)
+		}
+		if want := []string{repo + "@" + app, other + "@" + model}; !reflect.DeepEqual(children, want) {
+			t.Errorf("referrers API %v: children %v, want %v", referrers, children, want)
+		}
+
+		lineage, err = Lineage(ctx, other+":dev", WithPlainHTTP(true))
+		if err != nil {
+			t.Fatalf("Lineage: %v", err)
+		}
+		var parents []string
+		for _, p := range lineage.Parents {
+			parents = append(parents, p.Reference)
+		}
+		if want := []string{repo + "@" + base, repo + "@" + kernel}; !reflect.DeepEqual(parents, want) {
+			t.Errorf("parents %v, want %v", parents, want)
+		}
+	}
+}
+
+func TestPushParentMismatch(t *testing.T) {
+	reg := newTestRegistry(t)
+	mem, vm, cfg := writeSnapshot(t, t.TempDir())
+	ctx := context.Background()
+	repo := reg.host() + "/sporelet/layer"
+
+	kernel, err := PushSnapshot(ctx, repo+":kernel", mem, vm, cfg, WithPlainHTTP(true), WithMetadata(SnapshotMetadata{Layer: Layer0}))
+	if err != nil {
+		t.Fatalf("PushSnapshot: %v", err)
+	}
+	base, err := PushSnapshot(ctx, repo+":base", mem, vm, cfg, WithPlainHTTP(true), WithMetadata(SnapshotMetadata{Layer: Layer1, Parent: kernel}))
+	if err != nil {
+		t.Fatalf("PushSnapshot: %v", err)
+	}
+
+	const gone = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	for name, opts := range map[string][]Option{
+		"other parent":   {WithParent(repo + "@" + base), WithMetadata(SnapshotMetadata{Layer: Layer2, Parent: kernel})},
+		"missing parent": {WithMetadata(SnapshotMetadata{Layer: Layer2, Parent: gone})},
+		"higher layer":   {WithMetadata(SnapshotMetadata{Layer: Layer0, Parent: base})},
+		"other arch":     {WithMetadata(SnapshotMetadata{Layer: Layer2, Parent: base, Architecture: "riscv64"})},
+	} {
+		puts := reg.count("PUT", "/v2/sporelet/layer/manifests/")
+		_, err := PushSnapshot(ctx, repo+":app", mem, vm, cfg, append(opts, WithPlainHTTP(true))...)
+		if !errors.Is(err, ErrParentMismatch) {
+			t.Errorf("%s: err = %v, want ErrParentMismatch", name, err)
+		}
+		if n := reg.count("PUT", "/v2/sporelet/layer/manifests/") - puts; n != 0 {
+			t.Errorf("%s: %d manifests pushed", name, n)
+		}
+	}
+
+	if _, err := PushSnapshot(ctx, repo+":app", mem, vm, cfg, WithPlainHTTP(true), WithParent(repo+":base"), WithMetadata(SnapshotMetadata{Layer: Layer2})); err == nil {
+		t.Error("expected error for parent reference without digest")
+	}
+}
+
+func mustParse(t *testing.T, s string) Reference {
+	t.Helper()
+	ref, err := ParseReference(s)
+	if err != nil {
+		t.Fatalf("ParseReference(%s): %v", s, err)
+	}
+	return ref
+}
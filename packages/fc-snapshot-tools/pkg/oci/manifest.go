@@ -0,0 +1,56 @@
+package oci
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+)
+
+const (
+	// MediaTypeImageManifest is the media type of an OCI image manifest
+	MediaTypeImageManifest = "application/vnd.oci.image.manifest.v1+json"
+	// MediaTypeEmptyJSON is the media type of the empty config blob used by artifacts
+	MediaTypeEmptyJSON = "application/vnd.oci.empty.v1+json"
+
+	// AnnotationTitle names the file a layer is written to on pull
+	AnnotationTitle = "org.opencontainers.image.title"
+)
+
+// emptyJSON is the content of the empty config blob.
+var emptyJSON = []byte("{}")
+
+// Descriptor describes a blob or manifest stored in a registry.
+type Descriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	Platform     *Platform         `json:"platform,omitempty"` // of image index entries
+}
+
+// Manifest is an OCI image manifest.
+type Manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        Descriptor        `json:"config"`
+	Layers        []Descriptor      `json:"layers"`
+	Subject       *Descriptor       `json:"subject,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// digestBytes returns the sha256 digest of data.
+func digestBytes(data []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
+
+// digestReader returns the sha256 digest and size of the content of r.
+func digestReader(r io.Reader) (string, int64, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return "", 0, err
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), n, nil
+}
@@ -0,0 +1,229 @@
+package oci
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// DefaultRegistryConfigPath is where sporectl and the operator look for the
+// registries config unless told otherwise.
+const DefaultRegistryConfigPath = "/etc/sporelet/registries.json"
+
+// RegistryConfig configures how registry hosts are reached, keyed by the
+// registry name used in references, e.g. ghcr.io or localhost:5000:
+//
+//	{
+//	  "registries": {
+//	    "ghcr.io": {"mirrors": [{"host": "mirror.internal:5000", "plainHTTP": true}]},
+//	    "registry.lab": {"insecure": true}
+//	  }
+//	}
+type RegistryConfig struct {
+	Registries map[string]RegistryHost `json:"registries"`
+}
+
+// RegistryHost configures a registry and the mirrors pulls from it try first.
+type RegistryHost struct {
+	// Mirrors are tried in order before the registry itself
+	Mirrors []Mirror `json:"mirrors,omitempty"`
+	// PlainHTTP talks to the registry over HTTP instead of HTTPS
+	PlainHTTP bool `json:"plainHTTP,omitempty"`
+	// Insecure skips verification of the registry's TLS certificate
+	Insecure bool `json:"insecure,omitempty"`
+}
+
+// Mirror is a registry serving copies of another registry's repositories.
+type Mirror struct {
+	Host string `json:"host"`
+	// Prefix is prepended to repository names on the mirror, for mirrors
+	// that keep each upstream registry in its own namespace
+	Prefix    string `json:"prefix,omitempty"`
+	PlainHTTP bool   `json:"plainHTTP,omitempty"`
+	Insecure  bool   `json:"insecure,omitempty"`
+}
+
+// ParseRegistryConfig decodes a registries config.
+func ParseRegistryConfig(data []byte) (*RegistryConfig, error) {
+	var cfg RegistryConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to decode registries config: %w", err)
+	}
+	for name, host := range cfg.Registries {
+		for _, m := range host.Mirrors {
+			if m.Host == "" || strings.Contains(m.Host, "/") {
+				return nil, fmt.Errorf("registry %s: invalid mirror host %q", name, m.Host)
+			}
+		}
+	}
+	return &cfg, nil
+}
+
+// LoadRegistryConfig reads the registries config at path. A missing file
+// gives an empty config.
+func LoadRegistryConfig(path string) (*RegistryConfig, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &RegistryConfig{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseRegistryConfig(data)
+}
+
+// WithRegistryConfig sets the mirrors and connection settings of registry
+// hosts. Manifests and blobs are fetched from the mirrors of a registry in
+// order, falling back to the registry itself; pushes always go to the
+// registry.
+func WithRegistryConfig(cfg *RegistryConfig) Option {
+	return func(o *options) { o.registries = cfg }
+}
+
+// WithEndpointReport calls fn once for each endpoint that serves content of a
+// pull, as host or host/prefix for a mirror with a repository prefix.
+func WithEndpointReport(fn func(endpoint string)) Option {
+	return func(o *options) { o.endpointReport = fn }
+}
+
+// endpoint is a host serving a registry's repositories: the registry itself
+// or one of its mirrors.
+type endpoint struct {
+	host      string
+	prefix    string
+	plainHTTP bool
+}
+
+func (e endpoint) String() string {
+	if e.prefix != "" {
+		return e.host + "/" + e.prefix
+	}
+	return e.host
+}
+
+// url builds the API URL for a manifest or blob path in ref's repository.
+func (e endpoint) url(ref Reference, kind, name string) string {
+	scheme := "https"
+	if e.plainHTTP {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/v2/%s/%s/%s", scheme, e.host, path.Join(e.prefix, ref.Repository), kind, name)
+}
+
+// registry returns the endpoint of ref's registry itself.
+func (c *Client) registry(ref Reference) endpoint {
+	host := c.registries.Registries[ref.Registry]
+	return endpoint{host: ref.endpoint(), plainHTTP: c.plainHTTP || host.PlainHTTP}
+}
+
+// direct returns a copy of c that reads from registries without going
+// through their mirrors, for reads that must see the current state, such as
+// those of an index about to be updated.
+func (c *Client) direct() *Client {
+	d := *c
+	d.noMirrors = true
+	return &d
+}
+
+// endpoints returns where reads of ref are sent: the mirrors of its registry
+// in order, then the registry.
+func (c *Client) endpoints(ref Reference) []endpoint {
+	if c.noMirrors {
+		return []endpoint{c.registry(ref)}
+	}
+	var out []endpoint
+	for _, m := range c.registries.Registries[ref.Registry].Mirrors {
+		out = append(out, endpoint{host: m.Host, prefix: strings.Trim(m.Prefix, "/"), plainHTTP: c.plainHTTP || m.PlainHTTP})
+	}
+	return append(out, c.registry(ref))
+}
+
+// fetch sends a read request for a manifest or blob of ref to each endpoint
+// in turn until one responds with the expected status. It returns the
+// response and the URL that served it. If every endpoint fails, the error of
+// the registry itself is returned.
+func (c *Client) fetch(ctx context.Context, ref Reference, method, kind, name string, header http.Header, expect int) (*http.Response, string, error) {
+	var err error
+	for _, e := range c.endpoints(ref) {
+		u := e.url(ref, kind, name)
+		req, rerr := http.NewRequestWithContext(ctx, method, u, nil)
+		if rerr != nil {
+			return nil, "", rerr
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		var resp *http.Response
+		if resp, err = c.do(req, expect); err == nil {
+			c.served.report(e.String())
+			return resp, u, nil
+		}
+		if ctx.Err() != nil {
+			return nil, "", err
+		}
+	}
+	return nil, "", err
+}
+
+// insecureHosts returns the hosts whose certificates are not verified.
+func (cfg *RegistryConfig) insecureHosts() map[string]bool {
+	hosts := map[string]bool{}
+	for name, host := range cfg.Registries {
+		if host.Insecure {
+			hosts[Reference{Registry: name}.endpoint()] = true
+		}
+		for _, m := range host.Mirrors {
+			if m.Insecure {
+				hosts[m.Host] = true
+			}
+		}
+	}
+	return hosts
+}
+
+// insecureClient returns a copy of hc that does not verify TLS certificates,
+// or hc itself if its transport cannot be configured.
+func insecureClient(hc *http.Client) *http.Client {
+	base := hc.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	t, ok := base.(*http.Transport)
+	if !ok {
+		return hc
+	}
+	t = t.Clone()
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	t.TLSClientConfig.InsecureSkipVerify = true
+	c := *hc
+	c.Transport = t
+	return &c
+}
+
+// endpointReport calls a report function once per endpoint.
+type endpointReport struct {
+	mu   sync.Mutex
+	fn   func(string)
+	seen map[string]bool
+}
+
+func (r *endpointReport) report(endpoint string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.seen[endpoint] {
+		r.seen[endpoint] = true
+		r.fn(endpoint)
+	}
+}
@@ -0,0 +1,102 @@
+package oci
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRegistryConfig(t *testing.T) {
+	cfg, err := ParseRegistryConfig([]byte(`{"registries": {
+		"ghcr.io": {"mirrors": [{"host": "mirror.internal:5000", "prefix": "ghcr", "plainHTTP": true}]},
+		"registry.lab": {"insecure": true}
+	}}`))
+	if err != nil {
+		t.Fatalf("ParseRegistryConfig: %v", err)
+	}
+	want := []Mirror{{Host: "mirror.internal:5000", Prefix: "ghcr", PlainHTTP: true}}
+	if got := cfg.Registries["ghcr.io"].Mirrors; !reflect.DeepEqual(got, want) {
+		t.Errorf("mirrors = %+v, want %+v", got, want)
+	}
+	if !cfg.insecureHosts()["registry.lab"] {
+		t.Error("registry.lab is not insecure")
+	}
+
+	if _, err := ParseRegistryConfig([]byte(`{"registries": {"ghcr.io": {"mirrors": [{"host": "mirror/ghcr"}]}}}`)); err == nil {
+		t.Error("expected error for mirror host with a path")
+	}
+
+	cfg, err = LoadRegistryConfig(filepath.Join(t.TempDir(), "registries.json"))
+	if err != nil || len(cfg.Registries) != 0 {
+		t.Errorf("LoadRegistryConfig(missing) = %+v, %v; want empty config", cfg, err)
+	}
+}
+
+func TestPullFromMirror(t *testing.T) {
+	upstream := newTestRegistry(t)
+	mirror := newTestRegistry(t)
+	mem, vm, cfg := writeSnapshot(t, t.TempDir())
+	ctx := context.Background()
+
+	ref := upstream.host() + "/sporelet/layer1:dev"
+	if _, err := PushSnapshot(ctx, ref, mem, vm, cfg, WithPlainHTTP(true)); err != nil {
+		t.Fatalf("PushSnapshot: %v", err)
+	}
+	if _, err := PushSnapshot(ctx, mirror.host()+"/upstream/sporelet/layer1:dev", mem, vm, cfg, WithPlainHTTP(true)); err != nil {
+		t.Fatalf("PushSnapshot(mirror): %v", err)
+	}
+	// the mirror has not fetched the vmstate yet
+	vmData, _ := os.ReadFile(vm)
+	delete(mirror.blobs, digestBytes(vmData))
+
+	registries := &RegistryConfig{Registries: map[string]RegistryHost{
+		upstream.host(): {PlainHTTP: true, Mirrors: []Mirror{
+			{Host: "127.0.0.1:1", PlainHTTP: true},
+			{Host: mirror.host(), Prefix: "upstream", PlainHTTP: true},
+		}},
+	}}
+	var served []string
+	out := t.TempDir()
+	upstreamBlobs := upstream.count("GET", "/v2/sporelet/layer1/blobs/")
+	err := PullSnapshot(ctx, ref, out, WithRegistryConfig(registries), WithEndpointReport(func(e string) { served = append(served, e) }))
+	if err != nil {
+		t.Fatalf("PullSnapshot: %v", err)
+	}
+	got, _ := os.ReadFile(filepath.Join(out, filepath.Base(vm)))
+	if string(got) != string(vmData) {
+		t.Error("vmstate differs after pull")
+	}
+
+	want := []string{mirror.host() + "/upstream", upstream.host()}
+	if !reflect.DeepEqual(served, want) {
+		t.Errorf("served by %v, want %v", served, want)
+	}
+	if n := upstream.count("GET", "/v2/sporelet/layer1/blobs/") - upstreamBlobs; n != 1 {
+		t.Errorf("upstream served %d blobs, want only the one missing from the mirror", n)
+	}
+	if n := upstream.count("GET", "/v2/sporelet/layer1/manifests/"); n != 0 {
+		t.Errorf("upstream served %d manifests, want 0", n)
+	}
+}
+
+func TestPullMirrorFallbackError(t *testing.T) {
+	upstream := newTestRegistry(t)
+	mirror := newTestRegistry(t)
+	registries := &RegistryConfig{Registries: map[string]RegistryHost{
+		upstream.host(): {PlainHTTP: true, Mirrors: []Mirror{{Host: mirror.host(), PlainHTTP: true}}},
+	}}
+	err := PullSnapshot(context.Background(), upstream.host()+"/sporelet/none:dev", t.TempDir(), WithRegistryConfig(registries))
+	if err == nil {
+		t.Fatal("expected error for missing snapshot")
+	}
+	// the error is the upstream's, not the mirror's
+	if !strings.Contains(err.Error(), upstream.host()) {
+		t.Errorf("error %q does not name the upstream", err)
+	}
+	if mirror.count("GET", "/v2/sporelet/none/manifests/dev") == 0 {
+		t.Error("mirror was not tried")
+	}
+}
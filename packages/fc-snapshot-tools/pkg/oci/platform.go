@@ -0,0 +1,180 @@
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// Platform identifies the hosts a snapshot restores on: its CPU architecture
+// and, as the variant, the Firecracker CPU template it was taken with.
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// HostPlatform returns the platform of the running host without a CPU
+// template.
+func HostPlatform() Platform {
+	return Platform{Architecture: runtime.GOARCH, OS: "linux"}
+}
+
+// ParsePlatform parses a platform of the form [os/]architecture[/variant],
+// e.g. linux/amd64/T2. The OS defaults to linux.
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) > 1 && parts[0] == "linux" {
+		parts = parts[1:]
+	}
+	p := Platform{OS: "linux", Architecture: parts[0]}
+	if len(parts) == 2 {
+		p.Variant = parts[1]
+	}
+	if p.Architecture == "" || len(parts) > 2 || (len(parts) == 2 && p.Variant == "") {
+		return Platform{}, fmt.Errorf("invalid platform %q", s)
+	}
+	return p, nil
+}
+
+func (p Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// WithPlatform selects the snapshot pulled from an image index. Entries for
+// the architecture with the same CPU template are preferred, then entries
+// without one. The default is HostPlatform.
+func WithPlatform(p Platform) Option {
+	return func(o *options) { o.platform = &p }
+}
+
+// WithIndex makes PushSnapshot add the snapshot to the image index at the
+// tag instead of replacing what the tag points at, so that snapshots of the
+// same layer for several architectures and CPU templates share a tag. An
+// entry for the same platform is replaced.
+func WithIndex(index bool) Option {
+	return func(o *options) { o.index = index }
+}
+
+// snapshotPlatform returns the platform of a snapshot with the given
+// metadata.
+func snapshotPlatform(m SnapshotMetadata) Platform {
+	return Platform{Architecture: m.Architecture, OS: "linux", Variant: m.CPUTemplate}
+}
+
+// selectPlatform picks the manifest for want from the entries of an index.
+func selectPlatform(manifests []Descriptor, want Platform) (Descriptor, error) {
+	var candidates []Descriptor
+	for _, d := range manifests {
+		if d.Platform != nil && d.Platform.Architecture == want.Architecture && (d.Platform.OS == "" || d.Platform.OS == want.OS) {
+			candidates = append(candidates, d)
+		}
+	}
+	for _, d := range candidates {
+		if d.Platform.Variant == want.Variant {
+			return d, nil
+		}
+	}
+	for _, d := range candidates {
+		if d.Platform.Variant == "" {
+			return d, nil
+		}
+	}
+	// without a preference, a single template for the architecture will do
+	if want.Variant == "" && len(candidates) == 1 {
+		return candidates[0], nil
+	}
+
+	var have []string
+	for _, d := range manifests {
+		if d.Platform != nil {
+			have = append(have, d.Platform.String())
+		}
+	}
+	return Descriptor{}, fmt.Errorf("no snapshot for platform %s in index (have %s)", want, strings.Join(have, ", "))
+}
+
+// ResolveSnapshot fetches the snapshot manifest ref points at and validates
+// it. If ref points at an image index, the manifest for the platform set
+// with WithPlatform is selected from it. It returns the descriptor of the
+// snapshot manifest, which is the selected entry for an index.
+func (c *Client) ResolveSnapshot(ctx context.Context, ref Reference) (Descriptor, Manifest, error) {
+	desc, data, err := c.FetchManifest(ctx, ref)
+	if err != nil {
+		return Descriptor{}, Manifest{}, fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+	if desc.MediaType == MediaTypeImageIndex {
+		var index Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return Descriptor{}, Manifest{}, fmt.Errorf("failed to decode index: %w", err)
+		}
+		entry, err := selectPlatform(index.Manifests, c.platform)
+		if err != nil {
+			return Descriptor{}, Manifest{}, fmt.Errorf("%s: %w", ref, err)
+		}
+		if desc, data, err = c.FetchManifest(ctx, ref.WithDigest(entry.Digest)); err != nil {
+			return Descriptor{}, Manifest{}, fmt.Errorf("failed to fetch manifest for %s: %w", entry.Platform, err)
+		}
+		desc.Platform = entry.Platform
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return Descriptor{}, Manifest{}, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	if err := ValidateManifest(manifest); err != nil {
+		return Descriptor{}, Manifest{}, fmt.Errorf("invalid snapshot manifest %s: %w", ref, err)
+	}
+	return desc, manifest, nil
+}
+
+// addToIndex adds the snapshot manifest desc to the image index at ref's
+// tag, replacing the entry for the same platform. A tag pointing at a single
+// snapshot manifest is turned into an index holding it.
+func (c *Client) addToIndex(ctx context.Context, ref Reference, desc Descriptor) (Descriptor, error) {
+	if ref.Tag == "" {
+		return Descriptor{}, fmt.Errorf("adding to an index requires a tag")
+	}
+	index := Index{SchemaVersion: 2, MediaType: MediaTypeImageIndex}
+	current, data, err := c.direct().FetchManifest(ctx, ref)
+	switch {
+	case errors.Is(err, ErrNotFound):
+	case err != nil:
+		return Descriptor{}, fmt.Errorf("failed to fetch %s: %w", ref, err)
+	case current.MediaType == MediaTypeImageIndex:
+		if err := json.Unmarshal(data, &index); err != nil {
+			return Descriptor{}, fmt.Errorf("failed to decode index: %w", err)
+		}
+	default:
+		var m Manifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return Descriptor{}, fmt.Errorf("failed to decode manifest: %w", err)
+		}
+		md, err := ParseSnapshotMetadata(m.Annotations)
+		if err != nil || md.Architecture == "" {
+			return Descriptor{}, fmt.Errorf("%s is not a snapshot with a known platform", ref)
+		}
+		p := snapshotPlatform(md)
+		index.Manifests = []Descriptor{{MediaType: current.MediaType, Digest: current.Digest, Size: current.Size, ArtifactType: m.ArtifactType, Platform: &p}}
+	}
+
+	var manifests []Descriptor
+	for _, d := range index.Manifests {
+		if d.Platform == nil || *d.Platform != *desc.Platform {
+			manifests = append(manifests, d)
+		}
+	}
+	index.Manifests = append(manifests, desc)
+	data, err = json.Marshal(index)
+	if err != nil {
+		return Descriptor{}, fmt.Errorf("failed to encode index: %w", err)
+	}
+	return c.PushManifest(ctx, ref, MediaTypeImageIndex, data)
+}
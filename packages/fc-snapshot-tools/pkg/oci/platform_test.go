@@ -0,0 +1,127 @@
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParsePlatform(t *testing.T) {
+	for in, want := range map[string]Platform{
+		"amd64":          {OS: "linux", Architecture: "amd64"},
+		"linux/arm64":    {OS: "linux", Architecture: "arm64"},
+		"linux/amd64/T2": {OS: "linux", Architecture: "amd64", Variant: "T2"},
+		"amd64/T2":       {OS: "linux", Architecture: "amd64", Variant: "T2"},
+	} {
+		got, err := ParsePlatform(in)
+		if err != nil || got != want {
+			t.Errorf("ParsePlatform(%q) = %+v, %v, want %+v", in, got, err, want)
+		}
+	}
+	for _, bad := range []string{"", "linux/", "amd64/", "linux/amd64/T2/x"} {
+		if _, err := ParsePlatform(bad); err == nil {
+			t.Errorf("ParsePlatform(%q): expected error", bad)
+		}
+	}
+}
+
+func TestSelectPlatform(t *testing.T) {
+	entry := func(digest, arch, variant string) Descriptor {
+		return Descriptor{Digest: digest, Platform: &Platform{OS: "linux", Architecture: arch, Variant: variant}}
+	}
+	index := []Descriptor{entry("plain", "amd64", ""), entry("t2", "amd64", "T2"), entry("arm", "arm64", "V1N1")}
+	for _, tt := range []struct {
+		want Platform
+		got  string
+	}{
+		{Platform{OS: "linux", Architecture: "amd64", Variant: "T2"}, "t2"},
+		{Platform{OS: "linux", Architecture: "amd64", Variant: "C3"}, "plain"},
+		{Platform{OS: "linux", Architecture: "amd64"}, "plain"},
+		{Platform{OS: "linux", Architecture: "arm64"}, "arm"},
+		{Platform{OS: "linux", Architecture: "arm64", Variant: "V1N1"}, "arm"},
+		{Platform{OS: "linux", Architecture: "arm64", Variant: "T2"}, ""},
+		{Platform{OS: "linux", Architecture: "riscv64"}, ""},
+	} {
+		d, err := selectPlatform(index, tt.want)
+		if tt.got == "" {
+			if err == nil {
+				t.Errorf("selectPlatform(%s) = %s, want error", tt.want, d.Digest)
+			}
+			continue
+		}
+		if err != nil || d.Digest != tt.got {
+			t.Errorf("selectPlatform(%s) = %s, %v, want %s", tt.want, d.Digest, err, tt.got)
+		}
+	}
+}
+
+func TestPushPullIndex(t *testing.T) {
+	reg := newTestRegistry(t)
+	ctx := context.Background()
+	ref := reg.host() + "/sporelet/layer1:dev"
+
+	push := func(arch, template string, index bool) string {
+		t.Helper()
+		dir := t.TempDir()
+		mem, vm, cfg := writeSnapshot(t, dir)
+		os.WriteFile(mem, []byte(arch+template), 0644)
+		md := SnapshotMetadata{Layer: Layer1, Architecture: arch, CPUTemplate: template}
+		digest, err := PushSnapshot(ctx, ref, mem, vm, cfg, WithPlainHTTP(true), WithMetadata(md), WithIndex(index))
+		if err != nil {
+			t.Fatalf("PushSnapshot(%s/%s): %v", arch, template, err)
+		}
+		return digest
+	}
+	entries := func() []Descriptor {
+		t.Helper()
+		var index Index
+		if err := json.Unmarshal(reg.manifests["sporelet/layer1:dev"], &index); err != nil || index.MediaType != MediaTypeImageIndex {
+			t.Fatalf("tag does not point at an index: %s", reg.manifests["sporelet/layer1:dev"])
+		}
+		return index.Manifests
+	}
+
+	// a tag holding a single snapshot is turned into an index
+	push("amd64", "", false)
+	push("arm64", "", true)
+	if n := len(entries()); n != 2 {
+		t.Fatalf("index has %d entries, want 2", n)
+	}
+	push("amd64", "T2", true)
+	t2 := push("amd64", "T2", true)
+	if n := len(entries()); n != 3 {
+		t.Fatalf("index has %d entries after replacing a platform, want 3", n)
+	}
+
+	pull := func(p Platform) (string, error) {
+		out := t.TempDir()
+		err := PullSnapshot(ctx, ref, out, WithPlainHTTP(true), WithPlatform(p))
+		data, _ := os.ReadFile(filepath.Join(out, "snapshot.mem"))
+		return string(data), err
+	}
+	for p, want := range map[Platform]string{
+		{OS: "linux", Architecture: "amd64", Variant: "T2"}: "amd64T2",
+		{OS: "linux", Architecture: "amd64"}:                "amd64",
+		{OS: "linux", Architecture: "arm64", Variant: "T2"}: "arm64",
+	} {
+		if got, err := pull(p); err != nil || got != want {
+			t.Errorf("pull for %s = %q, %v, want %q", p, got, err, want)
+		}
+	}
+	if _, err := pull(Platform{OS: "linux", Architecture: "riscv64"}); err == nil {
+		t.Error("pull for a platform missing from the index succeeded")
+	}
+
+	// the index survives a copy to a layout
+	dir := t.TempDir()
+	if _, err := CopySnapshot(ctx, ref, LayoutScheme+dir, WithPlainHTTP(true)); err != nil {
+		t.Fatalf("CopySnapshot: %v", err)
+	}
+	c := NewClient(WithPlatform(Platform{OS: "linux", Architecture: "amd64", Variant: "T2"}))
+	desc, _, err := c.ResolveSnapshot(ctx, Reference{Layout: dir, Tag: "dev"})
+	if err != nil || desc.Digest != t2 {
+		t.Fatalf("ResolveSnapshot in layout = %s, %v, want %s", desc.Digest, err, t2)
+	}
+}
@@ -0,0 +1,258 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// MediaTypeInToto is the media type of in-toto statements. Provenance
+	// referrers use it as their artifact type and layer media type.
+	MediaTypeInToto = "application/vnd.in-toto+json"
+	// AnnotationPredicateType names the predicate type of an in-toto layer
+	AnnotationPredicateType = "in-toto.io/predicate-type"
+
+	// StatementType is the type of in-toto v1 statements
+	StatementType = "https://in-toto.io/Statement/v1"
+	// PredicateTypeSLSAProvenance is the predicate type of SLSA v1 provenance
+	PredicateTypeSLSAProvenance = "https://slsa.dev/provenance/v1"
+	// BuildTypeSnapshot is the SLSA build type of Firecracker snapshot builds
+	BuildTypeSnapshot = "https://github.com/quinnovator/sporelet/snapshot-build/v1"
+)
+
+// Statement is an in-toto v1 statement about the snapshot manifests in
+// Subject.
+type Statement struct {
+	Type          string               `json:"_type"`
+	Subject       []ResourceDescriptor `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     Provenance           `json:"predicate"`
+}
+
+// ResourceDescriptor identifies an artifact by name or URI and digests, as
+// in the in-toto and SLSA specifications. Digests are keyed by algorithm and
+// hex encoded.
+type ResourceDescriptor struct {
+	Name        string            `json:"name,omitempty"`
+	URI         string            `json:"uri,omitempty"`
+	Digest      map[string]string `json:"digest,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Provenance is a SLSA v1 provenance predicate.
+type Provenance struct {
+	BuildDefinition BuildDefinition `json:"buildDefinition"`
+	RunDetails      RunDetails      `json:"runDetails"`
+}
+
+// BuildDefinition describes the inputs of a build.
+type BuildDefinition struct {
+	BuildType string `json:"buildType"`
+	// ExternalParameters are the settings the build was asked for, such as
+	// the kernel command line and machine size
+	ExternalParameters map[string]any `json:"externalParameters"`
+	// InternalParameters are settings chosen by the builder itself
+	InternalParameters map[string]any `json:"internalParameters,omitempty"`
+	// ResolvedDependencies are the files the snapshot was built from, such
+	// as the kernel, rootfs and compose file, with their digests
+	ResolvedDependencies []ResourceDescriptor `json:"resolvedDependencies,omitempty"`
+}
+
+// RunDetails describes the builder and the run that produced the snapshot.
+type RunDetails struct {
+	Builder  Builder       `json:"builder"`
+	Metadata BuildMetadata `json:"metadata"`
+}
+
+// Builder identifies the builder, with the versions of the tools it ran.
+type Builder struct {
+	ID      string            `json:"id"`
+	Version map[string]string `json:"version,omitempty"`
+}
+
+// BuildMetadata records when a build ran.
+type BuildMetadata struct {
+	InvocationID string    `json:"invocationId,omitempty"`
+	StartedOn    time.Time `json:"startedOn"`
+	FinishedOn   time.Time `json:"finishedOn"`
+}
+
+// ParseProvenance decodes a provenance predicate, as written next to the
+// snapshot files by a snapshot build.
+func ParseProvenance(data []byte) (Provenance, error) {
+	var p Provenance
+	if err := json.Unmarshal(data, &p); err != nil {
+		return p, fmt.Errorf("failed to decode provenance: %w", err)
+	}
+	if p.BuildDefinition.BuildType == "" {
+		return p, fmt.Errorf("provenance has no build type")
+	}
+	if p.RunDetails.Builder.ID == "" {
+		return p, fmt.Errorf("provenance has no builder")
+	}
+	return p, nil
+}
+
+// WithProvenance attaches the provenance predicate in the given file to the
+// pushed snapshot, as an in-toto statement referring to the snapshot
+// manifest.
+func WithProvenance(path string) Option {
+	return func(o *options) { o.provenance = path }
+}
+
+// AttachProvenance attaches an in-toto statement with the provenance p to
+// the snapshot ociRef points at, as a referrer, and returns the digest of the
+// statement manifest. If ociRef points at an image index, the statement
+// refers to the snapshot for the platform set with WithPlatform.
+func AttachProvenance(ctx context.Context, ociRef string, p Provenance, opts ...Option) (string, error) {
+	ref, err := ParseReference(ociRef)
+	if err != nil {
+		return "", err
+	}
+	c := newClient(newOptions(opts))
+	subject, _, err := c.ResolveSnapshot(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+	desc, err := c.attachProvenance(ctx, ref, subject, p)
+	if err != nil {
+		return "", err
+	}
+	return desc.Digest, nil
+}
+
+// attachProvenance pushes an in-toto statement with the provenance p about
+// the manifest subject in ref's repository.
+func (c *Client) attachProvenance(ctx context.Context, ref Reference, subject Descriptor, p Provenance) (Descriptor, error) {
+	alg, hex, _ := strings.Cut(subject.Digest, ":")
+	data, err := json.Marshal(Statement{
+		Type:          StatementType,
+		Subject:       []ResourceDescriptor{{Name: ref.Name(), Digest: map[string]string{alg: hex}}},
+		PredicateType: PredicateTypeSLSAProvenance,
+		Predicate:     p,
+	})
+	if err != nil {
+		return Descriptor{}, fmt.Errorf("failed to encode provenance: %w", err)
+	}
+
+	layer := Descriptor{
+		MediaType:   MediaTypeInToto,
+		Digest:      digestBytes(data),
+		Size:        int64(len(data)),
+		Annotations: map[string]string{AnnotationPredicateType: PredicateTypeSLSAProvenance},
+	}
+	config := Descriptor{MediaType: MediaTypeEmptyJSON, Digest: digestBytes(emptyJSON), Size: int64(len(emptyJSON))}
+	for _, blob := range []struct {
+		desc Descriptor
+		data []byte
+	}{{config, emptyJSON}, {layer, data}} {
+		if err := c.pushBlobIfMissing(ctx, ref, blob.desc, func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(blob.data)), nil
+		}); err != nil {
+			return Descriptor{}, err
+		}
+	}
+
+	subject = Descriptor{MediaType: subject.MediaType, Digest: subject.Digest, Size: subject.Size}
+	desc, err := c.PushReferrer(ctx, ref, Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeImageManifest,
+		ArtifactType:  MediaTypeInToto,
+		Config:        config,
+		Layers:        []Descriptor{layer},
+		Subject:       &subject,
+		Annotations:   map[string]string{AnnotationPredicateType: PredicateTypeSLSAProvenance},
+	})
+	if err != nil {
+		return Descriptor{}, fmt.Errorf("failed to push provenance: %w", err)
+	}
+	return desc, nil
+}
+
+// FetchProvenance returns the provenance statements attached to the snapshot
+// ociRef points at, oldest first by build start. If ociRef points at an image
+// index, those of the snapshot for the platform set with WithPlatform are
+// returned. Statements about another manifest or with another predicate type
+// are left out.
+func FetchProvenance(ctx context.Context, ociRef string, opts ...Option) ([]Statement, error) {
+	ref, err := ParseReference(ociRef)
+	if err != nil {
+		return nil, err
+	}
+	c := newClient(newOptions(opts))
+	subject, _, err := c.ResolveSnapshot(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	referrers, err := c.Referrers(ctx, ref, subject.Digest, MediaTypeInToto)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list referrers: %w", err)
+	}
+
+	alg, hex, _ := strings.Cut(subject.Digest, ":")
+	var out []Statement
+	for _, r := range referrers {
+		_, data, err := c.FetchManifest(ctx, ref.WithDigest(r.Digest))
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch provenance %s: %w", r.Digest, err)
+		}
+		var m Manifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("failed to decode provenance manifest %s: %w", r.Digest, err)
+		}
+		for _, l := range m.Layers {
+			if l.MediaType != MediaTypeInToto || l.Annotations[AnnotationPredicateType] != PredicateTypeSLSAProvenance {
+				continue
+			}
+			s, err := c.fetchStatement(ctx, ref, l)
+			if err != nil {
+				return nil, err
+			}
+			if s.PredicateType != PredicateTypeSLSAProvenance || !s.about(alg, hex) {
+				continue
+			}
+			out = append(out, s)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Predicate.RunDetails.Metadata.StartedOn.Before(out[j].Predicate.RunDetails.Metadata.StartedOn)
+	})
+	return out, nil
+}
+
+// fetchStatement fetches and decodes the in-toto statement in layer.
+func (c *Client) fetchStatement(ctx context.Context, ref Reference, layer Descriptor) (Statement, error) {
+	var s Statement
+	if layer.Size > maxManifestSize {
+		return s, fmt.Errorf("provenance %s exceeds %d bytes", layer.Digest, maxManifestSize)
+	}
+	rc, err := c.FetchBlob(ctx, ref, layer)
+	if err != nil {
+		return s, fmt.Errorf("failed to fetch provenance %s: %w", layer.Digest, err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return s, fmt.Errorf("failed to fetch provenance %s: %w", layer.Digest, err)
+	}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return s, fmt.Errorf("failed to decode provenance %s: %w", layer.Digest, err)
+	}
+	return s, nil
+}
+
+// about reports whether the statement has the given digest as a subject.
+func (s Statement) about(alg, hex string) bool {
+	for _, subject := range s.Subject {
+		if subject.Digest[alg] == hex {
+			return true
+		}
+	}
+	return false
+}
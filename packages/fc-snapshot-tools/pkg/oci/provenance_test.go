@@ -0,0 +1,123 @@
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testProvenance(t *testing.T) string {
+	t.Helper()
+	p := Provenance{
+		BuildDefinition: BuildDefinition{
+			BuildType:          BuildTypeSnapshot,
+			ExternalParameters: map[string]any{"cmdline": "console=ttyS0"},
+			ResolvedDependencies: []ResourceDescriptor{
+				{Name: "kernel", URI: "file:///dist/vmlinux", Digest: map[string]string{"sha256": strings.Repeat("a", 64)}},
+			},
+		},
+		RunDetails: RunDetails{
+			Builder:  Builder{ID: "https://example.com/builder", Version: map[string]string{"firecracker": "1.7.0"}},
+			Metadata: BuildMetadata{StartedOn: time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)},
+		},
+	}
+	data, _ := json.Marshal(p)
+	path := filepath.Join(t.TempDir(), "snapshot.provenance")
+	os.WriteFile(path, data, 0644)
+	return path
+}
+
+func TestPushProvenance(t *testing.T) {
+	for _, referrers := range []bool{false, true} {
+		reg := newTestRegistry(t)
+		reg.referrers = referrers
+		mem, vm, cfg := writeSnapshot(t, t.TempDir())
+		ctx := context.Background()
+		ref := reg.host() + "/sporelet/layer1:dev"
+
+		digest, err := PushSnapshot(ctx, ref, mem, vm, cfg, WithPlainHTTP(true), WithProvenance(testProvenance(t)))
+		if err != nil {
+			t.Fatalf("PushSnapshot: %v", err)
+		}
+		// a signature is not provenance
+		_, priv, _ := GenerateKey()
+		key, _ := ParsePrivateKey(priv)
+		if _, err := SignSnapshot(ctx, ref, key, WithPlainHTTP(true)); err != nil {
+			t.Fatalf("SignSnapshot: %v", err)
+		}
+
+		statements, err := FetchProvenance(ctx, ref, WithPlainHTTP(true))
+		if err != nil {
+			t.Fatalf("FetchProvenance: %v", err)
+		}
+		if len(statements) != 1 {
+			t.Fatalf("referrers API %v: %d statements, want 1", referrers, len(statements))
+		}
+		s := statements[0]
+		if s.Type != StatementType || s.PredicateType != PredicateTypeSLSAProvenance {
+			t.Errorf("statement type %s, predicate type %s", s.Type, s.PredicateType)
+		}
+		if len(s.Subject) != 1 || "sha256:"+s.Subject[0].Digest["sha256"] != digest || s.Subject[0].Name != reg.host()+"/sporelet/layer1" {
+			t.Errorf("subject %+v, want %s", s.Subject, digest)
+		}
+		if deps := s.Predicate.BuildDefinition.ResolvedDependencies; len(deps) != 1 || deps[0].Name != "kernel" {
+			t.Errorf("dependencies %+v", deps)
+		}
+		if v := s.Predicate.RunDetails.Builder.Version["firecracker"]; v != "1.7.0" {
+			t.Errorf("firecracker version %q", v)
+		}
+	}
+}
+
+func TestPushProvenanceInvalid(t *testing.T) {
+	reg := newTestRegistry(t)
+	mem, vm, cfg := writeSnapshot(t, t.TempDir())
+	path := filepath.Join(t.TempDir(), "snapshot.provenance")
+	os.WriteFile(path, []byte(`{"buildDefinition": {}}`), 0644)
+
+	_, err := PushSnapshot(context.Background(), reg.host()+"/sporelet/layer1:dev", mem, vm, cfg, WithPlainHTTP(true), WithProvenance(path))
+	if err == nil {
+		t.Fatal("expected error for provenance without build type")
+	}
+	if n := reg.count("PUT", "/v2/"); n != 0 {
+		t.Errorf("%d uploads before the provenance was checked", n)
+	}
+}
+
+func TestAttachProvenanceIndex(t *testing.T) {
+	reg := newTestRegistry(t)
+	mem, vm, cfg := writeSnapshot(t, t.TempDir())
+	ctx := context.Background()
+	ref := reg.host() + "/sporelet/layer1:dev"
+
+	digests := map[string]string{}
+	for _, arch := range []string{"amd64", "arm64"} {
+		d, err := PushSnapshot(ctx, ref, mem, vm, cfg, WithPlainHTTP(true), WithIndex(true), WithMetadata(SnapshotMetadata{Architecture: arch}))
+		if err != nil {
+			t.Fatalf("PushSnapshot(%s): %v", arch, err)
+		}
+		digests[arch] = d
+	}
+	data, _ := os.ReadFile(testProvenance(t))
+	p, err := ParseProvenance(data)
+	if err != nil {
+		t.Fatalf("ParseProvenance: %v", err)
+	}
+	arm := WithPlatform(Platform{OS: "linux", Architecture: "arm64"})
+	if _, err := AttachProvenance(ctx, ref, p, WithPlainHTTP(true), arm); err != nil {
+		t.Fatalf("AttachProvenance: %v", err)
+	}
+
+	statements, err := FetchProvenance(ctx, ref, WithPlainHTTP(true), arm)
+	if err != nil || len(statements) != 1 || "sha256:"+statements[0].Subject[0].Digest["sha256"] != digests["arm64"] {
+		t.Errorf("arm64 provenance %+v, %v", statements, err)
+	}
+	statements, err = FetchProvenance(ctx, ref, WithPlainHTTP(true), WithPlatform(Platform{OS: "linux", Architecture: "amd64"}))
+	if err != nil || len(statements) != 0 {
+		t.Errorf("amd64 provenance %+v, %v; want none", statements, err)
+	}
+}
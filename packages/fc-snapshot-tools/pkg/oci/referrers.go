@@ -0,0 +1,166 @@
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// MediaTypeImageIndex is the media type of an OCI image index
+const MediaTypeImageIndex = "application/vnd.oci.image.index.v1+json"
+
+// Index is an OCI image index. Registries list the referrers of a manifest
+// as an index.
+type Index struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Manifests     []Descriptor      `json:"manifests"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// Referrers lists the manifests in ref's repository whose subject is the
+// manifest with the given digest. If artifactType is not empty, only
+// referrers of that type are returned. Registries without the referrers API
+// are served from the referrers tag schema.
+func (c *Client) Referrers(ctx context.Context, ref Reference, digest, artifactType string) ([]Descriptor, error) {
+	index, err := c.fetchReferrers(ctx, ref, digest, artifactType)
+	if err != nil {
+		return nil, err
+	}
+
+	// registries may ignore the filter
+	var out []Descriptor
+	for _, d := range index.Manifests {
+		if artifactType == "" || d.ArtifactType == artifactType {
+			out = append(out, d)
+		}
+	}
+	return out, nil
+}
+
+// fetchReferrers fetches the referrers index of a manifest from the
+// referrers API, falling back to the referrers tag schema. Image layouts only
+// have the tag schema.
+func (c *Client) fetchReferrers(ctx context.Context, ref Reference, digest, artifactType string) (Index, error) {
+	if ref.Layout != "" {
+		return c.referrersTagIndex(ctx, ref, digest)
+	}
+	u := c.url(ref, "referrers", digest)
+	if artifactType != "" {
+		u += "?artifactType=" + url.QueryEscape(artifactType)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return Index{}, err
+	}
+	req.Header.Set("Accept", MediaTypeImageIndex)
+	resp, err := c.do(req, http.StatusOK)
+	if errors.Is(err, ErrNotFound) {
+		return c.referrersTagIndex(ctx, ref, digest)
+	}
+	if err != nil {
+		return Index{}, err
+	}
+	defer resp.Body.Close()
+
+	var index Index
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return index, fmt.Errorf("failed to read referrers: %w", err)
+	}
+	if len(data) > maxManifestSize {
+		return index, fmt.Errorf("referrers of %s exceed %d bytes", digest, maxManifestSize)
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return index, fmt.Errorf("failed to decode referrers: %w", err)
+	}
+	return index, nil
+}
+
+// PushReferrer pushes m, whose subject must be set, by digest. On registries
+// without the referrers API the manifest is also added to the referrers tag
+// index of its subject.
+func (c *Client) PushReferrer(ctx context.Context, ref Reference, m Manifest) (Descriptor, error) {
+	if m.Subject == nil {
+		return Descriptor{}, fmt.Errorf("referrer has no subject")
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return Descriptor{}, fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	return c.pushReferrer(ctx, ref.WithDigest(""), m, data)
+}
+
+// pushReferrer is PushReferrer for the manifest m encoded as data, which is
+// tagged with ref's tag if it has one.
+func (c *Client) pushReferrer(ctx context.Context, ref Reference, m Manifest, data []byte) (Descriptor, error) {
+	desc, header, err := c.pushManifest(ctx, ref, m.MediaType, data)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	desc.ArtifactType = m.ArtifactType
+	if desc.ArtifactType == "" {
+		desc.ArtifactType = m.Config.MediaType
+	}
+	desc.Annotations = m.Annotations
+	if header.Get("OCI-Subject") != "" {
+		return desc, nil
+	}
+
+	index, err := c.referrersTagIndex(ctx, ref, m.Subject.Digest)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	for _, d := range index.Manifests {
+		if d.Digest == desc.Digest {
+			return desc, nil
+		}
+	}
+	index.Manifests = append(index.Manifests, desc)
+	data, err = json.Marshal(index)
+	if err != nil {
+		return Descriptor{}, fmt.Errorf("failed to encode referrers index: %w", err)
+	}
+	tag := ref.WithDigest("")
+	tag.Tag = referrersTag(m.Subject.Digest)
+	if _, err := c.PushManifest(ctx, tag, MediaTypeImageIndex, data); err != nil {
+		return Descriptor{}, fmt.Errorf("failed to update referrers tag: %w", err)
+	}
+	return desc, nil
+}
+
+// referrersTagIndex fetches the referrers tag index of a manifest, which is
+// empty if the tag does not exist.
+func (c *Client) referrersTagIndex(ctx context.Context, ref Reference, digest string) (Index, error) {
+	index := Index{SchemaVersion: 2, MediaType: MediaTypeImageIndex}
+	tag := ref.WithDigest("")
+	tag.Tag = referrersTag(digest)
+	// the referrers API is only asked of the registry itself, so is the tag
+	_, data, err := c.direct().FetchManifest(ctx, tag)
+	if errors.Is(err, ErrNotFound) {
+		return index, nil
+	}
+	if err != nil {
+		return index, fmt.Errorf("failed to fetch referrers tag: %w", err)
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return index, fmt.Errorf("failed to decode referrers tag: %w", err)
+	}
+	return index, nil
+}
+
+// referrersTag returns the tag that lists the referrers of a manifest on
+// registries without the referrers API, e.g. sha256-<hex>.
+func referrersTag(digest string) string {
+	return strings.Replace(digest, ":", "-", 1)
+}
+
+// isReferrersTag reports whether tag lists the referrers of a manifest.
+func isReferrersTag(tag string) bool {
+	return validateDigest(strings.Replace(tag, "-", ":", 1)) == nil
+}
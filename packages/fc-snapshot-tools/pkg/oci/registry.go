@@ -0,0 +1,472 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxManifestSize bounds the size of manifests read from a registry.
+const maxManifestSize = 4 << 20
+
+var (
+	// ErrNotFound is returned when a manifest or blob does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrUnauthorized is returned when the registry rejects the credentials.
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrDigestMismatch is returned when fetched content does not match its digest.
+	ErrDigestMismatch = errors.New("digest mismatch")
+)
+
+// RegistryError is returned for failed registry API requests. It carries the
+// HTTP status and the error codes from the response body, if any.
+type RegistryError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Errors     []ErrorDetail
+}
+
+// ErrorDetail is a single entry of an OCI distribution error response.
+type ErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RegistryError) Error() string {
+	msg := fmt.Sprintf("%s %s: status %d", e.Method, e.URL, e.StatusCode)
+	for _, d := range e.Errors {
+		msg += fmt.Sprintf(": %s: %s", d.Code, d.Message)
+	}
+	return msg
+}
+
+// Is lets errors.Is match ErrNotFound and ErrUnauthorized by status code.
+func (e *RegistryError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	}
+	return false
+}
+
+// Client talks to OCI distribution registries.
+type Client struct {
+	httpClient *http.Client
+	plainHTTP  bool
+	chunkSize  int64
+	auth       *authorizer
+	keys       KeyProvider
+	platform   Platform
+	progress   *progress
+	// concurrency is the number of blobs transferred at once
+	concurrency int
+	registries  *RegistryConfig
+	// insecure holds the hosts whose TLS certificates are not verified,
+	// which are reached through insecureHTTP
+	insecure     map[string]bool
+	insecureHTTP *http.Client
+	served       *endpointReport
+	noMirrors    bool
+}
+
+// NewClient creates a registry client configured by opts.
+func NewClient(opts ...Option) *Client {
+	return newClient(newOptions(opts))
+}
+
+func newClient(o *options) *Client {
+	hc := o.httpClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	store := o.credentials
+	if store == nil {
+		store = &dockerConfigCredentials{}
+	}
+	platform := HostPlatform()
+	if o.platform != nil {
+		platform = *o.platform
+	}
+	registries := o.registries
+	if registries == nil {
+		registries = &RegistryConfig{}
+	}
+	var served *endpointReport
+	if o.endpointReport != nil {
+		served = &endpointReport{fn: o.endpointReport, seen: map[string]bool{}}
+	}
+	return &Client{
+		httpClient:   hc,
+		plainHTTP:    o.plainHTTP,
+		chunkSize:    o.chunkSize,
+		auth:         newAuthorizer(store, hc),
+		keys:         o.keys,
+		platform:     platform,
+		progress:     newProgress(o.progress),
+		concurrency:  o.concurrency,
+		registries:   registries,
+		insecure:     registries.insecureHosts(),
+		insecureHTTP: insecureClient(hc),
+		served:       served,
+	}
+}
+
+// Resolve returns the descriptor of the manifest ref points at.
+func (c *Client) Resolve(ctx context.Context, ref Reference) (Descriptor, error) {
+	if ref.Layout != "" {
+		desc, _, err := layout(ref.Layout).fetchManifest(ref)
+		return desc, err
+	}
+	resp, _, err := c.fetch(ctx, ref, http.MethodHead, "manifests", ref.Reference(), http.Header{"Accept": {manifestAccept}}, http.StatusOK)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	resp.Body.Close()
+
+	desc := Descriptor{
+		MediaType: resp.Header.Get("Content-Type"),
+		Digest:    resp.Header.Get("Docker-Content-Digest"),
+		Size:      resp.ContentLength,
+	}
+	if desc.Digest == "" || desc.Size < 0 {
+		// some registries omit the digest on HEAD; fetch the manifest instead
+		desc, _, err = c.FetchManifest(ctx, ref)
+	}
+	return desc, err
+}
+
+// FetchManifest returns the descriptor and raw content of the manifest ref
+// points at. When ref carries a digest, the content is verified against it.
+func (c *Client) FetchManifest(ctx context.Context, ref Reference) (Descriptor, []byte, error) {
+	if ref.Layout != "" {
+		return layout(ref.Layout).fetchManifest(ref)
+	}
+	resp, _, err := c.fetch(ctx, ref, http.MethodGet, "manifests", ref.Reference(), http.Header{"Accept": {manifestAccept}}, http.StatusOK)
+	if err != nil {
+		return Descriptor{}, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return Descriptor{}, nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if len(data) > maxManifestSize {
+		return Descriptor{}, nil, fmt.Errorf("manifest %s exceeds %d bytes", ref, maxManifestSize)
+	}
+
+	desc := Descriptor{
+		MediaType: resp.Header.Get("Content-Type"),
+		Digest:    digestBytes(data),
+		Size:      int64(len(data)),
+	}
+	if ref.Digest != "" && ref.Digest != desc.Digest {
+		return Descriptor{}, nil, fmt.Errorf("manifest %s: %w: got %s", ref, ErrDigestMismatch, desc.Digest)
+	}
+	if desc.MediaType == "" {
+		var m struct {
+			MediaType string `json:"mediaType"`
+		}
+		json.Unmarshal(data, &m)
+		desc.MediaType = m.MediaType
+	}
+	return desc, data, nil
+}
+
+// PushManifest uploads a manifest and tags it with ref's tag, or stores it
+// by digest when ref has no tag.
+func (c *Client) PushManifest(ctx context.Context, ref Reference, mediaType string, data []byte) (Descriptor, error) {
+	desc, _, err := c.pushManifest(ctx, ref, mediaType, data)
+	return desc, err
+}
+
+// pushManifest is PushManifest that also returns the response headers.
+func (c *Client) pushManifest(ctx context.Context, ref Reference, mediaType string, data []byte) (Descriptor, http.Header, error) {
+	if ref.Layout != "" {
+		desc, err := layout(ref.Layout).pushManifest(ref, mediaType, data)
+		return desc, http.Header{}, err
+	}
+	desc := Descriptor{MediaType: mediaType, Digest: digestBytes(data), Size: int64(len(data))}
+	target := ref.Tag
+	if target == "" {
+		target = desc.Digest
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.url(ref, "manifests", target), bytes.NewReader(data))
+	if err != nil {
+		return Descriptor{}, nil, err
+	}
+	req.Header.Set("Content-Type", mediaType)
+	resp, err := c.do(req, http.StatusCreated)
+	if err != nil {
+		return Descriptor{}, nil, err
+	}
+	resp.Body.Close()
+	return desc, resp.Header, nil
+}
+
+// BlobExists reports whether the repository already holds the blob.
+func (c *Client) BlobExists(ctx context.Context, ref Reference, digest string) (bool, error) {
+	if ref.Layout != "" {
+		return layout(ref.Layout).blobExists(digest), nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.url(ref, "blobs", digest), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.do(req, http.StatusOK)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+// FetchBlob opens the blob described by desc. The returned reader fails with
+// ErrDigestMismatch at EOF if the content does not match the digest. If the
+// connection breaks, the download resumes with a range request.
+func (c *Client) FetchBlob(ctx context.Context, ref Reference, desc Descriptor) (io.ReadCloser, error) {
+	if ref.Layout != "" {
+		f, err := layout(ref.Layout).openBlob(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		return &verifyReader{rc: f, h: sha256.New(), digest: desc.Digest}, nil
+	}
+	resp, u, err := c.fetch(ctx, ref, http.MethodGet, "blobs", desc.Digest, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	body := &blobReader{c: c, ctx: ctx, url: u, body: resp.Body}
+	return &verifyReader{rc: body, h: sha256.New(), digest: desc.Digest}, nil
+}
+
+// FetchBlobRange reads n bytes of a blob starting at offset with an HTTP
+// range request. Partial content cannot be checked against the blob digest,
+// so callers must verify it by other means if needed.
+func (c *Client) FetchBlobRange(ctx context.Context, ref Reference, digest string, offset, n int64) ([]byte, error) {
+	if ref.Layout != "" {
+		f, err := layout(ref.Layout).openBlob(digest)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		data := make([]byte, n)
+		if _, err := f.ReadAt(data, offset); err != nil {
+			return nil, fmt.Errorf("failed to read range of blob %s: %w", digest, err)
+		}
+		return data, nil
+	}
+	rng := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+n-1)}}
+	resp, _, err := c.fetch(ctx, ref, http.MethodGet, "blobs", digest, rng, http.StatusPartialContent)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data := make([]byte, n)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, fmt.Errorf("failed to read range of blob %s: %w", digest, err)
+	}
+	return data, nil
+}
+
+// PushBlob uploads the content of r as the blob described by desc. Blobs
+// larger than the configured chunk size are uploaded in chunks, which are
+// resumed if a request is interrupted; otherwise they are uploaded in a
+// single request.
+func (c *Client) PushBlob(ctx context.Context, ref Reference, desc Descriptor, r io.Reader) error {
+	if ref.Layout != "" {
+		return layout(ref.Layout).pushBlob(desc, r)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url(ref, "blobs", "uploads/"), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req, http.StatusAccepted)
+	if err != nil {
+		return fmt.Errorf("failed to start upload: %w", err)
+	}
+	resp.Body.Close()
+	location, err := resp.Location()
+	if err != nil {
+		return fmt.Errorf("failed to start upload: %w", err)
+	}
+
+	if c.chunkSize > 0 && desc.Size > c.chunkSize {
+		location, err = c.uploadChunks(ctx, location, r)
+		if err != nil {
+			return err
+		}
+		r = nil
+	}
+
+	var body io.Reader = http.NoBody
+	size := int64(0)
+	if r != nil {
+		body, size = r, desc.Size
+	}
+	req, err = http.NewRequestWithContext(ctx, http.MethodPut, withDigest(location, desc.Digest), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err = c.do(req, http.StatusCreated)
+	if err != nil {
+		return fmt.Errorf("failed to upload blob %s: %w", desc.Digest, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// uploadChunks sends r in PATCH requests of at most chunkSize bytes and
+// returns the location to complete the upload at. Interrupted requests are
+// resumed from what the registry received.
+func (c *Client) uploadChunks(ctx context.Context, location *url.URL, r io.Reader) (*url.URL, error) {
+	buf := make([]byte, c.chunkSize)
+	var offset int64
+	for {
+		n, rerr := io.ReadFull(r, buf)
+		if n > 0 {
+			var err error
+			if location, err = c.uploadChunk(ctx, location, buf[:n], offset); err != nil {
+				return nil, err
+			}
+			offset += int64(n)
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			return location, nil
+		}
+		if rerr != nil {
+			return nil, rerr
+		}
+	}
+}
+
+// url builds the API URL for a manifest or blob path in ref's repository on
+// the registry itself.
+func (c *Client) url(ref Reference, kind, name string) string {
+	return c.registry(ref).url(ref, kind, name)
+}
+
+// do sends req and returns a RegistryError unless the response has the
+// expected status code. Requests rejected with 401 are authorized according
+// to the registry's challenge and retried once, provided their body can be
+// replayed; the authorization is then reused for the same repository.
+func (c *Client) do(req *http.Request, expect int) (*http.Response, error) {
+	key := authKey(req.URL)
+	if h := c.auth.cached(key); h != "" {
+		req.Header.Set("Authorization", h)
+	}
+	hc := c.httpClient
+	if c.insecure[req.URL.Host] {
+		hc = c.insecureHTTP
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized && (req.Body == nil || req.Body == http.NoBody || req.GetBody != nil) {
+		resp.Body.Close()
+		h, err := c.auth.authorize(req.Context(), key, normalizeRegistry(req.URL.Host), resp)
+		if err != nil {
+			return nil, err
+		}
+		retry := req.Clone(req.Context())
+		if req.GetBody != nil {
+			if retry.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		retry.Header.Set("Authorization", h)
+		if resp, err = hc.Do(retry); err != nil {
+			return nil, err
+		}
+		req = retry
+	}
+
+	if resp.StatusCode != expect {
+		defer resp.Body.Close()
+		return nil, newRegistryError(req, resp)
+	}
+	return resp, nil
+}
+
+func newRegistryError(req *http.Request, resp *http.Response) error {
+	e := &RegistryError{Method: req.Method, URL: req.URL.Redacted(), StatusCode: resp.StatusCode}
+	var body struct {
+		Errors []ErrorDetail `json:"errors"`
+	}
+	if req.Method != http.MethodHead {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(data, &body) == nil {
+			e.Errors = body.Errors
+		}
+	}
+	return e
+}
+
+// authKey identifies the registry repository a request URL addresses, which
+// is the granularity of registry token scopes.
+func authKey(u *url.URL) string {
+	path := strings.TrimPrefix(u.Path, "/v2/")
+	for _, sep := range []string{"/blobs/", "/manifests/", "/tags/", "/referrers/"} {
+		if i := strings.LastIndex(path, sep); i >= 0 {
+			return u.Host + "/" + path[:i]
+		}
+	}
+	return u.Host
+}
+
+// withDigest adds the digest query parameter to an upload location.
+func withDigest(location *url.URL, digest string) string {
+	u := *location
+	q := u.Query()
+	q.Set("digest", digest)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+var manifestAccept = strings.Join([]string{
+	MediaTypeImageManifest,
+	MediaTypeImageIndex,
+}, ", ")
+
+// verifyReader hashes content as it is read and checks the digest at EOF.
+type verifyReader struct {
+	rc     io.ReadCloser
+	h      hash.Hash
+	digest string
+	n      int64
+}
+
+func (v *verifyReader) Read(p []byte) (int, error) {
+	n, err := v.rc.Read(p)
+	v.h.Write(p[:n])
+	v.n += int64(n)
+	if err == io.EOF {
+		if got := fmt.Sprintf("sha256:%x", v.h.Sum(nil)); got != v.digest {
+			return n, fmt.Errorf("blob %s: %w: got %s after %d bytes", v.digest, ErrDigestMismatch, got, v.n)
+		}
+	}
+	return n, err
+}
+
+func (v *verifyReader) Close() error {
+	return v.rc.Close()
+}
@@ -0,0 +1,325 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testRegistry is an in-memory stand-in for an OCI distribution registry.
+type testRegistry struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string][]byte // "<repo>:<tag|digest>" -> manifest
+	types     map[string]string // manifest digest -> media type
+	uploads   map[string]*bytes.Buffer
+	requests  []string
+	nextID    int
+
+	// authorize, if set, rejects requests it returns false for
+	authorize func(w http.ResponseWriter, req *http.Request) bool
+	// referrers enables the referrers API
+	referrers bool
+	// cutDownloads breaks off that many blob downloads halfway
+	cutDownloads int
+	// failPatches keeps half of that many upload chunks and fails them
+	failPatches int
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	r := &testRegistry{
+		blobs:     map[string][]byte{},
+		manifests: map[string][]byte{},
+		types:     map[string]string{},
+		uploads:   map[string]*bytes.Buffer{},
+	}
+	r.Server = httptest.NewServer(r)
+	t.Cleanup(r.Close)
+	return r
+}
+
+// host returns the registry host for use in references.
+func (r *testRegistry) host() string {
+	return strings.TrimPrefix(r.URL, "http://")
+}
+
+// count returns the number of requests with the given method and path prefix.
+func (r *testRegistry) count(method, prefix string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, req := range r.requests {
+		if strings.HasPrefix(req, method+" "+prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req.Method+" "+req.URL.Path)
+	if r.authorize != nil && !r.authorize(w, req) {
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	switch {
+	case strings.Contains(path, "/blobs/uploads/"):
+		i := strings.Index(path, "/blobs/uploads/")
+		r.serveUpload(w, req, path[:i], path[i+len("/blobs/uploads/"):])
+	case strings.Contains(path, "/blobs/"):
+		i := strings.LastIndex(path, "/blobs/")
+		r.serveBlob(w, req, path[i+len("/blobs/"):])
+	case strings.Contains(path, "/manifests/"):
+		i := strings.LastIndex(path, "/manifests/")
+		r.serveManifest(w, req, path[:i], path[i+len("/manifests/"):])
+	case strings.HasSuffix(path, "/tags/list"):
+		r.serveTags(w, req, strings.TrimSuffix(path, "/tags/list"))
+	case strings.Contains(path, "/referrers/") && r.referrers:
+		i := strings.LastIndex(path, "/referrers/")
+		r.serveReferrers(w, path[:i], path[i+len("/referrers/"):])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (r *testRegistry) serveUpload(w http.ResponseWriter, req *http.Request, repo, id string) {
+	switch req.Method {
+	case http.MethodPost:
+		r.nextID++
+		id = fmt.Sprint(r.nextID)
+		r.uploads[id] = &bytes.Buffer{}
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", repo, id))
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPatch:
+		buf, ok := r.uploads[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if cr := req.Header.Get("Content-Range"); cr != "" && !strings.HasPrefix(cr, fmt.Sprintf("%d-", buf.Len())) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if r.failPatches > 0 {
+			r.failPatches--
+			data, _ := io.ReadAll(req.Body)
+			buf.Write(data[:len(data)/2])
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		io.Copy(buf, req.Body)
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", repo, id))
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		buf, ok := r.uploads[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		io.Copy(buf, req.Body)
+		digest := req.URL.Query().Get("digest")
+		if digestBytes(buf.Bytes()) != digest {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"errors":[{"code":"DIGEST_INVALID","message":"digest did not match content"}]}`)
+			return
+		}
+		r.blobs[digest] = buf.Bytes()
+		delete(r.uploads, id)
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet:
+		buf, ok := r.uploads[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if buf.Len() > 0 {
+			w.Header().Set("Range", fmt.Sprintf("0-%d", buf.Len()-1))
+		}
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", repo, id))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *testRegistry) serveBlob(w http.ResponseWriter, req *http.Request, digest string) {
+	data, ok := r.blobs[digest]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, `{"errors":[{"code":"BLOB_UNKNOWN","message":"blob unknown to registry"}]}`)
+		return
+	}
+	w.Header().Set("Docker-Content-Digest", digest)
+	if r.cutDownloads > 0 && req.Method == http.MethodGet && req.Header.Get("Range") == "" && len(data) > 1 {
+		r.cutDownloads--
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		w.Write(data[:len(data)/2])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(data))
+}
+
+func (r *testRegistry) serveManifest(w http.ResponseWriter, req *http.Request, repo, reference string) {
+	switch req.Method {
+	case http.MethodPut:
+		data, _ := io.ReadAll(req.Body)
+		digest := digestBytes(data)
+		r.manifests[repo+":"+reference] = data
+		r.manifests[repo+":"+digest] = data
+		r.types[digest] = req.Header.Get("Content-Type")
+		w.Header().Set("Docker-Content-Digest", digest)
+		var m Manifest
+		if json.Unmarshal(data, &m) == nil && m.Subject != nil && r.referrers {
+			w.Header().Set("OCI-Subject", m.Subject.Digest)
+		}
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet, http.MethodHead:
+		data, ok := r.manifests[repo+":"+reference]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`)
+			return
+		}
+		digest := digestBytes(data)
+		w.Header().Set("Content-Type", r.types[digest])
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		w.Header().Set("Docker-Content-Digest", digest)
+		if req.Method == http.MethodGet {
+			w.Write(data)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// serveTags lists the tags of a repository in pages of the requested size,
+// continuing after the tag given as last.
+func (r *testRegistry) serveTags(w http.ResponseWriter, req *http.Request, repo string) {
+	var tags []string
+	for key := range r.manifests {
+		if tag, ok := strings.CutPrefix(key, repo+":"); ok && !strings.HasPrefix(tag, "sha256:") {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	if last := req.URL.Query().Get("last"); last != "" {
+		i := sort.SearchStrings(tags, last)
+		if i < len(tags) && tags[i] == last {
+			i++
+		}
+		tags = tags[i:]
+	}
+	if n, _ := strconv.Atoi(req.URL.Query().Get("n")); n > 0 && len(tags) > n {
+		tags = tags[:n]
+		w.Header().Set("Link", fmt.Sprintf(`</v2/%s/tags/list?n=%d&last=%s>; rel="next"`, repo, n, tags[n-1]))
+	}
+	json.NewEncoder(w).Encode(map[string]any{"name": repo, "tags": tags})
+}
+
+func (r *testRegistry) serveReferrers(w http.ResponseWriter, repo, digest string) {
+	index := Index{SchemaVersion: 2, MediaType: MediaTypeImageIndex, Manifests: []Descriptor{}}
+	for key, data := range r.manifests {
+		var m Manifest
+		if !strings.HasPrefix(key, repo+":sha256:") || json.Unmarshal(data, &m) != nil || m.Subject == nil || m.Subject.Digest != digest {
+			continue
+		}
+		index.Manifests = append(index.Manifests, Descriptor{
+			MediaType:    m.MediaType,
+			Digest:       digestBytes(data),
+			Size:         int64(len(data)),
+			ArtifactType: m.ArtifactType,
+		})
+	}
+	w.Header().Set("Content-Type", MediaTypeImageIndex)
+	json.NewEncoder(w).Encode(index)
+}
+
+func TestParseReference(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Reference
+	}{
+		{"ghcr.io/quinnovator/sporelet/layer1:dev", Reference{Registry: "ghcr.io", Repository: "quinnovator/sporelet/layer1", Tag: "dev"}},
+		{"localhost:5000/snap", Reference{Registry: "localhost:5000", Repository: "snap"}},
+		{"busybox", Reference{Registry: "docker.io", Repository: "library/busybox"}},
+		{"ghcr.io/a/b@sha256:" + strings.Repeat("a", 64), Reference{Registry: "ghcr.io", Repository: "a/b", Digest: "sha256:" + strings.Repeat("a", 64)}},
+		{"oci-layout:///mnt/snapshots:layer1", Reference{Layout: "/mnt/snapshots", Tag: "layer1"}},
+		{"oci-layout://snapshots", Reference{Layout: "snapshots"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseReference(tt.in)
+		if err != nil {
+			t.Fatalf("ParseReference(%q): %v", tt.in, err)
+		}
+		if got != tt.want {
+			t.Errorf("ParseReference(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"", "ghcr.io/a@sha256:abc", "ghcr.io/Upper/case", "oci-layout://:tag"} {
+		if _, err := ParseReference(bad); err == nil {
+			t.Errorf("ParseReference(%q): expected error", bad)
+		}
+	}
+}
+
+func TestPushBlobChunked(t *testing.T) {
+	reg := newTestRegistry(t)
+	ref, _ := ParseReference(reg.host() + "/snap:dev")
+	c := NewClient(WithPlainHTTP(true), WithChunkSize(4))
+
+	data := []byte("0123456789")
+	desc := Descriptor{Digest: digestBytes(data), Size: int64(len(data))}
+	if err := c.PushBlob(context.Background(), ref, desc, bytes.NewReader(data)); err != nil {
+		t.Fatalf("PushBlob: %v", err)
+	}
+	if n := reg.count(http.MethodPatch, "/v2/snap/blobs/uploads/"); n != 3 {
+		t.Fatalf("expected 3 chunk uploads, got %d", n)
+	}
+
+	rc, err := c.FetchBlob(context.Background(), ref, desc)
+	if err != nil {
+		t.Fatalf("FetchBlob: %v", err)
+	}
+	defer rc.Close()
+	got, err := io.ReadAll(rc)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("FetchBlob = %q, %v", got, err)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	reg := newTestRegistry(t)
+	ref, _ := ParseReference(reg.host() + "/snap:missing")
+	c := NewClient(WithPlainHTTP(true))
+
+	_, err := c.Resolve(context.Background(), ref)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	data := []byte("content")
+	desc := Descriptor{Digest: digestBytes([]byte("other")), Size: int64(len(data))}
+	err = c.PushBlob(context.Background(), ref, desc, bytes.NewReader(data))
+	var regErr *RegistryError
+	if !errors.As(err, &regErr) || len(regErr.Errors) == 0 || regErr.Errors[0].Code != "DIGEST_INVALID" {
+		t.Fatalf("expected DIGEST_INVALID registry error, got %v", err)
+	}
+}
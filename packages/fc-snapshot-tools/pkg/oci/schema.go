@@ -0,0 +1,273 @@
+package oci
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Media types of the files in a Sporelet snapshot artifact.
+const (
+	MediaTypeMemory   = "application/vnd.sporelet.snapshot.memory.v1"
+	MediaTypeVMState  = "application/vnd.sporelet.snapshot.vmstate.v1"
+	MediaTypeVMConfig = "application/vnd.sporelet.snapshot.config.v1+json"
+	MediaTypeRootfs   = "application/vnd.sporelet.rootfs.v1"
+	MediaTypeKernel   = "application/vnd.sporelet.kernel.v1"
+
+	// MediaTypeMemoryDelta is a memory file encoded as page operations
+	// against the memory of the parent snapshot, in place of a memory layer
+	MediaTypeMemoryDelta = "application/vnd.sporelet.snapshot.memory.delta.v1"
+
+	// MediaTypeWorkingSet lists the memory pages a VM touches first after
+	// resuming, so that restores can prefetch them
+	MediaTypeWorkingSet = "application/vnd.sporelet.snapshot.working-set.v1+json"
+	// MediaTypeIntegrity records the digests of the snapshot files, checked
+	// before a restore
+	MediaTypeIntegrity = "application/vnd.sporelet.snapshot.integrity.v1+json"
+)
+
+// Annotations set on Sporelet snapshot manifests.
+const (
+	AnnotationFirecrackerVersion = "ai.sporelet.firecracker.version"
+	AnnotationVCPUCount          = "ai.sporelet.vcpu.count"
+	AnnotationMemSizeMB          = "ai.sporelet.mem.size-mib"
+	AnnotationLayerLevel         = "ai.sporelet.layer.level"
+	AnnotationParentDigest       = "ai.sporelet.layer.parent"
+	AnnotationParentRepository   = "ai.sporelet.layer.parent.repository"
+	AnnotationArchitecture       = "ai.sporelet.architecture"
+	AnnotationCPUTemplate        = "ai.sporelet.cpu.template"
+	AnnotationCreated            = "org.opencontainers.image.created"
+)
+
+// Snapshot layer levels.
+const (
+	Layer0 = 0 // kernel and init
+	Layer1 = 1 // containerd and pre-warmed Compose services
+	Layer2 = 2 // workload specific state such as mmap-hot models
+)
+
+// SnapshotMetadata describes a snapshot and is stored as manifest annotations.
+type SnapshotMetadata struct {
+	FirecrackerVersion string
+	VCPUCount          int
+	MemSizeMB          int
+	Layer              int    // Layer level, one of Layer0, Layer1 or Layer2
+	Parent             string // Manifest digest of the snapshot this layer builds on
+	ParentRepository   string // Repository holding the parent if it is not the snapshot's own
+	Architecture       string
+	CPUTemplate        string // Firecracker CPU template, empty for none
+	Created            time.Time
+}
+
+// Annotations encodes m as manifest annotations. Unset fields are omitted.
+func (m SnapshotMetadata) Annotations() map[string]string {
+	a := map[string]string{
+		AnnotationLayerLevel: strconv.Itoa(m.Layer),
+	}
+	if m.FirecrackerVersion != "" {
+		a[AnnotationFirecrackerVersion] = m.FirecrackerVersion
+	}
+	if m.VCPUCount > 0 {
+		a[AnnotationVCPUCount] = strconv.Itoa(m.VCPUCount)
+	}
+	if m.MemSizeMB > 0 {
+		a[AnnotationMemSizeMB] = strconv.Itoa(m.MemSizeMB)
+	}
+	if m.Parent != "" {
+		a[AnnotationParentDigest] = m.Parent
+	}
+	if m.ParentRepository != "" {
+		a[AnnotationParentRepository] = m.ParentRepository
+	}
+	if m.Architecture != "" {
+		a[AnnotationArchitecture] = m.Architecture
+	}
+	if m.CPUTemplate != "" {
+		a[AnnotationCPUTemplate] = m.CPUTemplate
+	}
+	if !m.Created.IsZero() {
+		a[AnnotationCreated] = m.Created.UTC().Format(time.RFC3339)
+	}
+	return a
+}
+
+// ParseSnapshotMetadata decodes snapshot metadata from manifest annotations.
+func ParseSnapshotMetadata(a map[string]string) (SnapshotMetadata, error) {
+	var m SnapshotMetadata
+	var err error
+
+	level, ok := a[AnnotationLayerLevel]
+	if !ok {
+		return m, fmt.Errorf("missing annotation %s", AnnotationLayerLevel)
+	}
+	if m.Layer, err = strconv.Atoi(level); err != nil || m.Layer < Layer0 || m.Layer > Layer2 {
+		return m, fmt.Errorf("invalid annotation %s: %q", AnnotationLayerLevel, level)
+	}
+	if v, ok := a[AnnotationVCPUCount]; ok {
+		if m.VCPUCount, err = strconv.Atoi(v); err != nil || m.VCPUCount <= 0 {
+			return m, fmt.Errorf("invalid annotation %s: %q", AnnotationVCPUCount, v)
+		}
+	}
+	if v, ok := a[AnnotationMemSizeMB]; ok {
+		if m.MemSizeMB, err = strconv.Atoi(v); err != nil || m.MemSizeMB <= 0 {
+			return m, fmt.Errorf("invalid annotation %s: %q", AnnotationMemSizeMB, v)
+		}
+	}
+	if v, ok := a[AnnotationParentDigest]; ok {
+		if err := validateDigest(v); err != nil {
+			return m, fmt.Errorf("invalid annotation %s: %w", AnnotationParentDigest, err)
+		}
+		m.Parent = v
+	}
+	if v, ok := a[AnnotationParentRepository]; ok {
+		if m.Parent == "" {
+			return m, fmt.Errorf("annotation %s without %s", AnnotationParentRepository, AnnotationParentDigest)
+		}
+		if _, err := ParseReference(v); err != nil {
+			return m, fmt.Errorf("invalid annotation %s: %w", AnnotationParentRepository, err)
+		}
+		m.ParentRepository = v
+	}
+	if v, ok := a[AnnotationCreated]; ok {
+		if m.Created, err = time.Parse(time.RFC3339, v); err != nil {
+			return m, fmt.Errorf("invalid annotation %s: %w", AnnotationCreated, err)
+		}
+	}
+	m.FirecrackerVersion = a[AnnotationFirecrackerVersion]
+	m.Architecture = a[AnnotationArchitecture]
+	m.CPUTemplate = a[AnnotationCPUTemplate]
+	return m, nil
+}
+
+// ValidateManifest checks that m is a well-formed Sporelet snapshot manifest:
+// it must carry exactly one memory, vmstate and config layer, at most one
+// rootfs, kernel, working set and integrity layer, a title for every layer
+// and valid metadata. The memory and rootfs layers may be chunk indexes, in which case
+// their chunks are listed as untitled chunk layers. Unchunked memory and
+// rootfs layers may be zstd compressed, the memory and vmstate layers may be
+// encrypted, and the memory layer may leave out zero extents listed in its
+// annotations. The memory layer may be a memory delta instead if the snapshot
+// has a parent.
+func ValidateManifest(m Manifest) error {
+	if m.SchemaVersion != 2 {
+		return fmt.Errorf("unsupported schema version %d", m.SchemaVersion)
+	}
+	if m.MediaType != MediaTypeImageManifest {
+		return fmt.Errorf("unsupported manifest media type %q", m.MediaType)
+	}
+	if m.ArtifactType != FirecrackerArtifactType {
+		return fmt.Errorf("unexpected artifact type %q", m.ArtifactType)
+	}
+
+	counts := map[string]int{}
+	titles := map[string]bool{}
+	for _, l := range m.Layers {
+		mediaType, _ := baseMediaType(l.MediaType)
+		switch mediaType {
+		case MediaTypeMemory, MediaTypeVMState, MediaTypeVMConfig, MediaTypeRootfs, MediaTypeKernel, MediaTypeWorkingSet, MediaTypeIntegrity:
+		case MediaTypeMemoryDelta:
+			if err := validateDelta(l); err != nil {
+				return fmt.Errorf("layer %s: %w", mediaType, err)
+			}
+		case MediaTypeChunk:
+			if err := validateDigest(l.Digest); err != nil {
+				return fmt.Errorf("layer %s: %w", mediaType, err)
+			}
+			continue
+		case MediaTypeChunkIndex:
+			mediaType = l.Annotations[AnnotationChunkedMediaType]
+			if mediaType != MediaTypeMemory && mediaType != MediaTypeRootfs {
+				return fmt.Errorf("chunk index for unsupported media type %q", mediaType)
+			}
+		default:
+			return fmt.Errorf("unknown layer media type %q", l.MediaType)
+		}
+		counts[mediaType]++
+		if err := validateDigest(l.Digest); err != nil {
+			return fmt.Errorf("layer %s: %w", mediaType, err)
+		}
+		if _, ok := l.Annotations[AnnotationZeroExtents]; ok && mediaType != MediaTypeMemory {
+			return fmt.Errorf("layer %s: only memory layers can be sparse", mediaType)
+		}
+		if _, err := parseSparseLayout(l); err != nil {
+			return fmt.Errorf("layer %s: %w", mediaType, err)
+		}
+		if _, err := parseEncryption(l); err != nil {
+			return fmt.Errorf("layer %s: %w", mediaType, err)
+		}
+		title := l.Annotations[AnnotationTitle]
+		if title == "" || strings.ContainsAny(title, `/\`) || title == "." || title == ".." {
+			return fmt.Errorf("layer %s: invalid title %q", mediaType, title)
+		}
+		if titles[title] {
+			return fmt.Errorf("duplicate layer title %q", title)
+		}
+		titles[title] = true
+	}
+	if n := counts[MediaTypeMemory] + counts[MediaTypeMemoryDelta]; n != 1 {
+		return fmt.Errorf("expected exactly one %s or %s layer, found %d", MediaTypeMemory, MediaTypeMemoryDelta, n)
+	}
+	for _, mt := range []string{MediaTypeVMState, MediaTypeVMConfig} {
+		if counts[mt] != 1 {
+			return fmt.Errorf("expected exactly one %s layer, found %d", mt, counts[mt])
+		}
+	}
+	for _, mt := range []string{MediaTypeRootfs, MediaTypeKernel, MediaTypeWorkingSet, MediaTypeIntegrity} {
+		if counts[mt] > 1 {
+			return fmt.Errorf("expected at most one %s layer, found %d", mt, counts[mt])
+		}
+	}
+
+	md, err := ParseSnapshotMetadata(m.Annotations)
+	if err != nil {
+		return fmt.Errorf("invalid snapshot metadata: %w", err)
+	}
+	if counts[MediaTypeMemoryDelta] > 0 && md.Parent == "" {
+		return fmt.Errorf("memory delta layer without a parent snapshot")
+	}
+	return nil
+}
+
+// metadataFromConfig fills unset metadata fields from the VM config file
+// written by CreateSnapshot and from the host.
+func metadataFromConfig(m SnapshotMetadata, configFile string) (SnapshotMetadata, error) {
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return m, err
+	}
+	var cfg struct {
+		Machine struct {
+			VCPUCount   int    `json:"vcpu_count"`
+			MemSizeMB   int    `json:"mem_size_mib"`
+			CPUTemplate string `json:"cpu_template"`
+		} `json:"machine-config"`
+		FirecrackerVersion string `json:"firecracker-version"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return m, fmt.Errorf("failed to parse VM config: %w", err)
+	}
+
+	if m.VCPUCount == 0 {
+		m.VCPUCount = cfg.Machine.VCPUCount
+	}
+	if m.MemSizeMB == 0 {
+		m.MemSizeMB = cfg.Machine.MemSizeMB
+	}
+	if m.FirecrackerVersion == "" {
+		m.FirecrackerVersion = cfg.FirecrackerVersion
+	}
+	if m.Architecture == "" {
+		m.Architecture = runtime.GOARCH
+	}
+	if m.CPUTemplate == "" && cfg.Machine.CPUTemplate != "None" {
+		m.CPUTemplate = cfg.Machine.CPUTemplate
+	}
+	if m.Created.IsZero() {
+		m.Created = time.Now()
+	}
+	return m, nil
+}
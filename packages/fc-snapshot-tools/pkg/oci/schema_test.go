@@ -0,0 +1,122 @@
+package oci
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func validManifest() Manifest {
+	layer := func(mt, title string) Descriptor {
+		return Descriptor{MediaType: mt, Digest: "sha256:" + strings.Repeat("a", 64), Size: 1, Annotations: map[string]string{AnnotationTitle: title}}
+	}
+	return Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeImageManifest,
+		ArtifactType:  FirecrackerArtifactType,
+		Layers: []Descriptor{
+			layer(MediaTypeMemory, "snapshot.mem"),
+			layer(MediaTypeVMState, "snapshot.vmstate"),
+			layer(MediaTypeVMConfig, "snapshot.config"),
+		},
+		Annotations: SnapshotMetadata{Layer: Layer1}.Annotations(),
+	}
+}
+
+func TestValidateManifest(t *testing.T) {
+	if err := ValidateManifest(validManifest()); err != nil {
+		t.Fatalf("valid manifest rejected: %v", err)
+	}
+
+	chunked := validManifest()
+	chunked.Layers[0].MediaType = MediaTypeChunkIndex
+	chunked.Layers[0].Annotations[AnnotationChunkedMediaType] = MediaTypeMemory
+	chunked.Layers = append(chunked.Layers, Descriptor{MediaType: MediaTypeChunk, Digest: "sha256:" + strings.Repeat("c", 64), Size: 1})
+	if err := ValidateManifest(chunked); err != nil {
+		t.Fatalf("chunked manifest rejected: %v", err)
+	}
+
+	compressed := validManifest()
+	compressed.Layers[0].MediaType = MediaTypeMemory + SuffixZstd
+	if err := ValidateManifest(compressed); err != nil {
+		t.Fatalf("compressed manifest rejected: %v", err)
+	}
+
+	sparse := validManifest()
+	sparse.Layers[0].Annotations[AnnotationSparseSize] = "8193"
+	sparse.Layers[0].Annotations[AnnotationZeroExtents] = "[[0,4096],[4097,4096]]"
+	if err := ValidateManifest(sparse); err != nil {
+		t.Fatalf("sparse manifest rejected: %v", err)
+	}
+
+	encrypted := validManifest()
+	encrypted.Layers[1].MediaType = MediaTypeVMState + SuffixEncrypted
+	encrypted.Layers[1].Size = 1 + aesGCMTagSize
+	encrypted.Layers[1].Annotations[AnnotationEncryption] = `{"provider":"keyfile","keyId":"k","wrappedKey":"","blockSize":65536,"size":1}`
+	if err := ValidateManifest(encrypted); err != nil {
+		t.Fatalf("encrypted manifest rejected: %v", err)
+	}
+
+	tests := map[string]func(m *Manifest){
+		"missing memory":     func(m *Manifest) { m.Layers = m.Layers[1:] },
+		"unknown layer":      func(m *Manifest) { m.Layers[0].MediaType = "application/octet-stream" },
+		"path in title":      func(m *Manifest) { m.Layers[0].Annotations[AnnotationTitle] = "../etc/passwd" },
+		"duplicate title":    func(m *Manifest) { m.Layers[1].Annotations[AnnotationTitle] = "snapshot.mem" },
+		"artifact type":      func(m *Manifest) { m.ArtifactType = "application/vnd.other" },
+		"missing level":      func(m *Manifest) { delete(m.Annotations, AnnotationLayerLevel) },
+		"bad level":          func(m *Manifest) { m.Annotations[AnnotationLayerLevel] = "3" },
+		"bad parent":         func(m *Manifest) { m.Annotations[AnnotationParentDigest] = "sha256:xyz" },
+		"memory twice":       func(m *Manifest) { m.Layers = append(m.Layers, m.Layers[0]) },
+		"schema version 1":   func(m *Manifest) { m.SchemaVersion = 1 },
+		"compressed vmstate": func(m *Manifest) { m.Layers[1].MediaType = MediaTypeVMState + SuffixZstd },
+		"sparse vmstate": func(m *Manifest) {
+			m.Layers[1].Annotations[AnnotationSparseSize] = "1"
+			m.Layers[1].Annotations[AnnotationZeroExtents] = "[]"
+		},
+		"zero extents overlap": func(m *Manifest) {
+			m.Layers[0].Annotations[AnnotationSparseSize] = "8193"
+			m.Layers[0].Annotations[AnnotationZeroExtents] = "[[0,4096],[4095,4097]]"
+		},
+		"zero extents past end": func(m *Manifest) {
+			m.Layers[0].Annotations[AnnotationSparseSize] = "4097"
+			m.Layers[0].Annotations[AnnotationZeroExtents] = "[[4096,4096]]"
+		},
+		"encrypted config": func(m *Manifest) { m.Layers[2].MediaType = MediaTypeVMConfig + SuffixEncrypted },
+		"missing key":      func(m *Manifest) { m.Layers[1].MediaType = MediaTypeVMState + SuffixEncrypted },
+		"encrypted size": func(m *Manifest) {
+			m.Layers[1].MediaType = MediaTypeVMState + SuffixEncrypted
+			m.Layers[1].Annotations[AnnotationEncryption] = `{"provider":"keyfile","keyId":"k","wrappedKey":"","blockSize":65536,"size":1}`
+		},
+		"chunked vmstate": func(m *Manifest) {
+			m.Layers[1].MediaType = MediaTypeChunkIndex
+			m.Layers[1].Annotations[AnnotationChunkedMediaType] = MediaTypeVMState
+		},
+	}
+	for name, mutate := range tests {
+		m := validManifest()
+		mutate(&m)
+		if err := ValidateManifest(m); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+}
+
+func TestSnapshotMetadataRoundTrip(t *testing.T) {
+	in := SnapshotMetadata{
+		FirecrackerVersion: "1.5.2",
+		VCPUCount:          2,
+		MemSizeMB:          1024,
+		Layer:              Layer2,
+		Parent:             "sha256:" + strings.Repeat("b", 64),
+		Architecture:       "arm64",
+		CPUTemplate:        "V1N1",
+		Created:            time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	out, err := ParseSnapshotMetadata(in.Annotations())
+	if err != nil {
+		t.Fatalf("ParseSnapshotMetadata: %v", err)
+	}
+	if out != in {
+		t.Fatalf("round trip = %+v, want %+v", out, in)
+	}
+}
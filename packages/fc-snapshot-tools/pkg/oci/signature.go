@@ -0,0 +1,250 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// ArtifactTypeSignature is the artifact type of cosign signatures
+	// attached as referrers
+	ArtifactTypeSignature = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	// MediaTypeSimpleSigning is the media type of the signed payload layer
+	MediaTypeSimpleSigning = "application/vnd.dev.cosign.simplesigning.v1+json"
+	// AnnotationSignature holds the base64 signature of the payload layer
+	AnnotationSignature = "dev.cosignproject.cosign/signature"
+
+	// simpleSigningType identifies cosign image signature payloads
+	simpleSigningType = "cosign container image signature"
+	// maxPayloadSize bounds the size of signature payloads read from a registry
+	maxPayloadSize = 64 << 10
+)
+
+// ErrNoValidSignature is returned when a snapshot carries no signature by a
+// trusted key.
+var ErrNoValidSignature = errors.New("no valid signature")
+
+// simpleSigning is the payload signed for a manifest, in the format cosign
+// uses.
+type simpleSigning struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]string `json:"optional"`
+}
+
+// GenerateKey creates an ed25519 key pair and returns the public key as a
+// PKIX PEM block and the private key as a PKCS #8 PEM block.
+func GenerateKey() ([]byte, []byte, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), nil
+}
+
+// ParsePrivateKey parses an unencrypted PKCS #8 PEM ed25519 private key.
+func ParsePrivateKey(data []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("no PRIVATE KEY PEM block found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is %T, not ed25519", key)
+	}
+	return priv, nil
+}
+
+// ParsePublicKeys parses the PKIX PEM ed25519 public keys in data. Several
+// keys may be concatenated.
+func ParsePublicKeys(data []byte) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "PUBLIC KEY" {
+			continue
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key: %w", err)
+		}
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("public key is %T, not ed25519", key)
+		}
+		keys = append(keys, pub)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no PUBLIC KEY PEM block found")
+	}
+	return keys, nil
+}
+
+// SignSnapshot signs the manifest ociRef points at and attaches the
+// signature as a referrer in the layout cosign uses, so that cosign can
+// verify it too. It returns the digest of the signature manifest.
+func SignSnapshot(ctx context.Context, ociRef string, key ed25519.PrivateKey, opts ...Option) (string, error) {
+	ref, err := ParseReference(ociRef)
+	if err != nil {
+		return "", err
+	}
+	c := newClient(newOptions(opts))
+	subject, err := c.Resolve(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", ref, err)
+	}
+
+	var payload simpleSigning
+	payload.Critical.Identity.DockerReference = ref.Name()
+	payload.Critical.Image.DockerManifestDigest = subject.Digest
+	payload.Critical.Type = simpleSigningType
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode signature payload: %w", err)
+	}
+	sig := ed25519.Sign(key, data)
+
+	layer := Descriptor{
+		MediaType:   MediaTypeSimpleSigning,
+		Digest:      digestBytes(data),
+		Size:        int64(len(data)),
+		Annotations: map[string]string{AnnotationSignature: base64.StdEncoding.EncodeToString(sig)},
+	}
+	config := Descriptor{MediaType: MediaTypeEmptyJSON, Digest: digestBytes(emptyJSON), Size: int64(len(emptyJSON))}
+	for _, blob := range []struct {
+		desc Descriptor
+		data []byte
+	}{{config, emptyJSON}, {layer, data}} {
+		if err := c.pushBlobIfMissing(ctx, ref, blob.desc, func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(blob.data)), nil
+		}); err != nil {
+			return "", err
+		}
+	}
+
+	subject = Descriptor{MediaType: subject.MediaType, Digest: subject.Digest, Size: subject.Size}
+	desc, err := c.PushReferrer(ctx, ref, Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeImageManifest,
+		ArtifactType:  ArtifactTypeSignature,
+		Config:        config,
+		Layers:        []Descriptor{layer},
+		Subject:       &subject,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to push signature: %w", err)
+	}
+	return desc.Digest, nil
+}
+
+// VerifySnapshot checks that the manifest ociRef points at carries a
+// signature by one of keys and returns its digest. Pull the snapshot by that
+// digest so that the verified manifest is the one restored. It returns an
+// error wrapping ErrNoValidSignature if no signature verifies.
+func VerifySnapshot(ctx context.Context, ociRef string, keys []ed25519.PublicKey, opts ...Option) (string, error) {
+	ref, err := ParseReference(ociRef)
+	if err != nil {
+		return "", err
+	}
+	if len(keys) == 0 {
+		return "", fmt.Errorf("no trusted keys")
+	}
+	c := newClient(newOptions(opts))
+	subject, err := c.Resolve(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", ref, err)
+	}
+
+	sigs, err := c.Referrers(ctx, ref, subject.Digest, ArtifactTypeSignature)
+	if err != nil {
+		return "", fmt.Errorf("failed to list signatures: %w", err)
+	}
+	for _, sig := range sigs {
+		ok, err := c.verifySignature(ctx, ref, sig, subject.Digest, keys)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return subject.Digest, nil
+		}
+	}
+	return "", fmt.Errorf("%s: %w among %d signatures", ref, ErrNoValidSignature, len(sigs))
+}
+
+// verifySignature reports whether a signature manifest holds a payload for
+// digest signed by one of keys. Malformed signatures do not verify.
+func (c *Client) verifySignature(ctx context.Context, ref Reference, sig Descriptor, digest string, keys []ed25519.PublicKey) (bool, error) {
+	_, data, err := c.FetchManifest(ctx, ref.WithDigest(sig.Digest))
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch signature %s: %w", sig.Digest, err)
+	}
+	var m Manifest
+	if json.Unmarshal(data, &m) != nil {
+		return false, nil
+	}
+	for _, layer := range m.Layers {
+		if layer.MediaType != MediaTypeSimpleSigning || layer.Size > maxPayloadSize {
+			continue
+		}
+		signature, err := base64.StdEncoding.DecodeString(layer.Annotations[AnnotationSignature])
+		if err != nil {
+			continue
+		}
+		rc, err := c.FetchBlob(ctx, ref, layer)
+		if err != nil {
+			return false, fmt.Errorf("failed to fetch signature payload: %w", err)
+		}
+		payload, err := io.ReadAll(io.LimitReader(rc, maxPayloadSize))
+		rc.Close()
+		if err != nil {
+			return false, fmt.Errorf("failed to read signature payload: %w", err)
+		}
+		if digestBytes(payload) != layer.Digest {
+			continue
+		}
+
+		var p simpleSigning
+		if json.Unmarshal(payload, &p) != nil || p.Critical.Type != simpleSigningType || p.Critical.Image.DockerManifestDigest != digest {
+			continue
+		}
+		for _, key := range keys {
+			if ed25519.Verify(key, payload, signature) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
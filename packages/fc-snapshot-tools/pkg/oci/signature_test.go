@@ -0,0 +1,66 @@
+package oci
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestSignVerifySnapshot(t *testing.T) {
+	for _, referrers := range []bool{true, false} {
+		reg := newTestRegistry(t)
+		reg.referrers = referrers
+		mem, vm, cfg := writeSnapshot(t, t.TempDir())
+		ref := reg.host() + "/sporelet/layer1:dev"
+		ctx := context.Background()
+		digest, err := PushSnapshot(ctx, ref, mem, vm, cfg, WithPlainHTTP(true))
+		if err != nil {
+			t.Fatalf("PushSnapshot: %v", err)
+		}
+
+		pubPEM, privPEM, err := GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		priv, err := ParsePrivateKey(privPEM)
+		if err != nil {
+			t.Fatalf("ParsePrivateKey: %v", err)
+		}
+		keys, err := ParsePublicKeys(pubPEM)
+		if err != nil || len(keys) != 1 {
+			t.Fatalf("ParsePublicKeys = %d keys, %v", len(keys), err)
+		}
+		otherPub, _, _ := ed25519.GenerateKey(nil)
+
+		if _, err := VerifySnapshot(ctx, ref, keys, WithPlainHTTP(true)); !errors.Is(err, ErrNoValidSignature) {
+			t.Fatalf("VerifySnapshot of unsigned snapshot: %v", err)
+		}
+		if _, err := SignSnapshot(ctx, ref, priv, WithPlainHTTP(true)); err != nil {
+			t.Fatalf("SignSnapshot: %v", err)
+		}
+		if n := reg.count("PUT", "/v2/sporelet/layer1/manifests/"+referrersTag(digest)); referrers == (n > 0) {
+			t.Fatalf("referrers API %v: %d referrers tag pushes", referrers, n)
+		}
+
+		got, err := VerifySnapshot(ctx, ref, keys, WithPlainHTTP(true))
+		if err != nil || got != digest {
+			t.Fatalf("VerifySnapshot = %s, %v, want %s", got, err, digest)
+		}
+		if _, err := VerifySnapshot(ctx, ref, []ed25519.PublicKey{otherPub}, WithPlainHTTP(true)); !errors.Is(err, ErrNoValidSignature) {
+			t.Fatalf("VerifySnapshot with untrusted key: %v", err)
+		}
+
+		// a new snapshot under the same tag is not covered by the signature
+		if err := os.WriteFile(vm, []byte("changed"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := PushSnapshot(ctx, ref, mem, vm, cfg, WithPlainHTTP(true)); err != nil {
+			t.Fatalf("PushSnapshot: %v", err)
+		}
+		if _, err := VerifySnapshot(ctx, ref, keys, WithPlainHTTP(true)); !errors.Is(err, ErrNoValidSignature) {
+			t.Fatalf("VerifySnapshot of replaced snapshot: %v", err)
+		}
+	}
+}
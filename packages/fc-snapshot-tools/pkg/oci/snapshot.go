@@ -2,10 +2,18 @@
 package oci
 
 import (
+	"bytes"
 	"context"
+	"crypto/cipher"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
-	"os/exec"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/sparse"
 )
 
 const (
@@ -13,44 +21,331 @@ const (
 	FirecrackerArtifactType = "application/vnd.firecracker.layer.v1"
 )
 
-// PushSnapshot pushes a snapshot to an OCI registry using the ORAS tool
-func PushSnapshot(ctx context.Context, ociRef, memFile, vmstateFile, configFile string) error {
-	// Check if ORAS is installed
-	if _, err := exec.LookPath("oras"); err != nil {
-		return fmt.Errorf("oras command not found, please install it: %w", err)
+// Option configures optional settings for pushing and pulling snapshots.
+type Option func(*options)
+
+type options struct {
+	rootfs      string
+	kernel      string
+	workingSet  string
+	integrity   string
+	httpClient  *http.Client
+	plainHTTP   bool
+	chunkSize   int64
+	metadata    SnapshotMetadata
+	credentials CredentialStore
+	chunking    *chunkerParams
+	chunkStore  string
+	lazyMemory  bool
+	sparse      bool
+	compression Compression
+	keys        KeyProvider
+	layerFilter func(Descriptor) bool
+	progress    func(Progress)
+	concurrency int
+	platform    *Platform
+	index       bool
+	registries  *RegistryConfig
+	parent      string
+	provenance  string
+	deltaBase   string
+	// endpointReport is called with each endpoint that serves a pull
+	endpointReport func(endpoint string)
+}
+
+// WithRootfs bundles the rootfs image into the pushed artifact so that the
+// snapshot can be restored on nodes that do not have the image locally.
+func WithRootfs(path string) Option {
+	return func(o *options) { o.rootfs = path }
+}
+
+// WithKernel bundles the kernel image into the pushed artifact.
+func WithKernel(path string) Option {
+	return func(o *options) { o.kernel = path }
+}
+
+// WithWorkingSet bundles a working set recorded during a restore, so that
+// restores of the pulled snapshot prefetch the pages it lists first.
+func WithWorkingSet(path string) Option {
+	return func(o *options) { o.workingSet = path }
+}
+
+// WithIntegrity bundles the integrity manifest of the snapshot files, so
+// that restores of the pulled snapshot can verify them.
+func WithIntegrity(path string) Option {
+	return func(o *options) { o.integrity = path }
+}
+
+// WithHTTPClient sets the HTTP client used to talk to the registry.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(o *options) { o.httpClient = hc }
+}
+
+// WithPlainHTTP talks to the registry over plain HTTP instead of HTTPS.
+func WithPlainHTTP(plain bool) Option {
+	return func(o *options) { o.plainHTTP = plain }
+}
+
+// WithChunkSize uploads blobs larger than size bytes in chunks of that size.
+// A size of zero uploads every blob in a single request, which cannot be
+// resumed. The default is 16 MiB.
+func WithChunkSize(size int64) Option {
+	return func(o *options) { o.chunkSize = size }
+}
+
+// WithCredentialStore sets where registry credentials are looked up. By
+// default the Docker config of the current user and its credential helpers
+// are used.
+func WithCredentialStore(store CredentialStore) Option {
+	return func(o *options) { o.credentials = store }
+}
+
+// WithChunking splits the memory file and rootfs into content-defined chunks
+// pushed as separate blobs, so that a push only uploads the chunks that
+// changed since earlier pushes to the repository.
+func WithChunking(enabled bool) Option {
+	return func(o *options) {
+		o.chunking = nil
+		if enabled {
+			p := defaultChunkerParams
+			o.chunking = &p
+		}
+	}
+}
+
+// WithChunkStore keeps the chunks of chunked snapshots in dir when pulling,
+// so that later pulls only download chunks not already in the store.
+func WithChunkStore(dir string) Option {
+	return func(o *options) { o.chunkStore = dir }
+}
+
+// WithLazyMemory leaves the memory file out of a pull, for restores that
+// load guest memory on demand through OpenLayer.
+func WithLazyMemory(lazy bool) Option {
+	return func(o *options) { o.lazyMemory = lazy }
+}
+
+// WithLayerFilter pulls only the layers keep returns true for, so that
+// callers holding some of the files already can skip them.
+func WithLayerFilter(keep func(layer Descriptor) bool) Option {
+	return func(o *options) { o.layerFilter = keep }
+}
+
+// WithSparse pushes the memory file without its holes, listing them in the
+// layer annotations instead, so that zero pages punched out of the file are
+// neither read nor uploaded. It is enabled by default. Pulls always recreate
+// the holes.
+func WithSparse(enabled bool) Option {
+	return func(o *options) { o.sparse = enabled }
+}
+
+// WithMetadata sets the snapshot metadata recorded in the manifest
+// annotations. vCPU count, memory size and Firecracker version default to the
+// values in the snapshot config file; architecture and creation time default
+// to the pushing host and the current time.
+func WithMetadata(m SnapshotMetadata) Option {
+	return func(o *options) { o.metadata = m }
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{sparse: true, chunkSize: defaultChunkSize, concurrency: defaultConcurrency}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// PushSnapshot pushes the snapshot files as an OCI artifact and returns the
+// digest of the pushed manifest. Blobs already present in the repository are
+// not uploaded again. A memory delta is only pushed on a parent whose
+// integrity layer records the memory the delta was encoded against.
+func PushSnapshot(ctx context.Context, ociRef, memFile, vmstateFile, configFile string, opts ...Option) (string, error) {
+	o := newOptions(opts)
+
+	memType := MediaTypeMemory
+	if isDelta(memFile) {
+		memType = MediaTypeMemoryDelta
+	}
+	files := []snapshotFile{
+		{memFile, memType},
+		{vmstateFile, MediaTypeVMState},
+		{configFile, MediaTypeVMConfig},
+	}
+	if o.rootfs != "" {
+		files = append(files, snapshotFile{o.rootfs, MediaTypeRootfs})
+	}
+	if o.kernel != "" {
+		files = append(files, snapshotFile{o.kernel, MediaTypeKernel})
+	}
+	if o.workingSet != "" {
+		files = append(files, snapshotFile{o.workingSet, MediaTypeWorkingSet})
+	}
+	if o.integrity != "" {
+		files = append(files, snapshotFile{o.integrity, MediaTypeIntegrity})
+	}
+
+	if o.keys != nil && o.chunking != nil {
+		return "", fmt.Errorf("chunked snapshots cannot be encrypted")
 	}
 
 	// Check if files exist
-	for _, file := range []string{memFile, vmstateFile, configFile} {
-		if _, err := os.Stat(file); err != nil {
-			return fmt.Errorf("file not found: %s: %w", file, err)
+	for _, file := range files {
+		if _, err := os.Stat(file.path); err != nil {
+			return "", fmt.Errorf("file not found: %s: %w", file.path, err)
+		}
+	}
+
+	metadata, err := metadataFromConfig(o.metadata, configFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read snapshot metadata: %w", err)
+	}
+	var provenance *Provenance
+	if o.provenance != "" {
+		data, err := os.ReadFile(o.provenance)
+		if err != nil {
+			return "", fmt.Errorf("failed to read provenance: %w", err)
+		}
+		p, err := ParseProvenance(data)
+		if err != nil {
+			return "", err
 		}
+		provenance = &p
 	}
 
-	// Run ORAS command to push the snapshot
-	cmd := exec.CommandContext(
-		ctx,
-		"oras",
-		"push",
-		ociRef,
-		"--artifact-type", FirecrackerArtifactType,
-		memFile, vmstateFile, configFile,
-	)
+	ref, err := ParseReference(ociRef)
+	if err != nil {
+		return "", err
+	}
+	c := newClient(o)
 
-	// Capture output
-	output, err := cmd.CombinedOutput()
+	// the parent is checked before anything is uploaded
+	parent, hasParent, err := resolveParent(ref, &metadata, o.parent)
 	if err != nil {
-		return fmt.Errorf("failed to push snapshot: %s: %w", output, err)
+		return "", err
+	}
+	if memType == MediaTypeMemoryDelta && !hasParent {
+		return "", fmt.Errorf("memory delta %s needs the parent snapshot it was encoded against", memFile)
+	}
+	var subject Descriptor
+	if hasParent {
+		var pm Manifest
+		if subject, pm, err = c.checkParent(ctx, parent, metadata); err != nil {
+			return "", err
+		}
+		if memType == MediaTypeMemoryDelta {
+			if err := c.checkDeltaBase(ctx, parent, pm, memFile); err != nil {
+				return "", err
+			}
+		}
 	}
 
-	return nil
+	manifest := Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeImageManifest,
+		ArtifactType:  FirecrackerArtifactType,
+		Annotations:   metadata.Annotations(),
+	}
+	// a parent in the same repository is the subject of the manifest, one in
+	// another repository is linked to the pushed snapshot once it exists
+	if hasParent && metadata.ParentRepository == "" {
+		manifest.Subject = &subject
+	}
+
+	config := Descriptor{MediaType: MediaTypeEmptyJSON, Digest: digestBytes(emptyJSON), Size: int64(len(emptyJSON))}
+	if err := c.pushBlobIfMissing(ctx, ref, config, func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(emptyJSON)), nil
+	}); err != nil {
+		return "", err
+	}
+	manifest.Config = config
+
+	// files are pushed in parallel; their layers keep the order of files so
+	// that the manifest does not depend on which upload finishes first
+	layers := make([]Descriptor, len(files))
+	chunked := make([][]Descriptor, len(files))
+	err = parallel(ctx, c.concurrency, len(files), func(ctx context.Context, i int) error {
+		file := files[i]
+		var err error
+		if o.chunking != nil && (file.mediaType == MediaTypeMemory || file.mediaType == MediaTypeRootfs) {
+			layers[i], chunked[i], err = c.pushChunked(ctx, ref, file, *o.chunking)
+		} else {
+			layers[i], err = c.pushFile(ctx, ref, file, o)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to push %s: %w", file.path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	manifest.Layers = append(manifest.Layers, layers...)
+	seen := map[string]bool{}
+	for _, chunks := range chunked {
+		for _, chunk := range chunks {
+			if !seen[chunk.Digest] {
+				seen[chunk.Digest] = true
+				manifest.Layers = append(manifest.Layers, chunk)
+			}
+		}
+	}
+
+	if err := ValidateManifest(manifest); err != nil {
+		return "", fmt.Errorf("invalid snapshot manifest: %w", err)
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	target := ref
+	if o.index {
+		target = ref.WithDigest("")
+	}
+	var desc Descriptor
+	if manifest.Subject != nil {
+		desc, err = c.pushReferrer(ctx, target, manifest, data)
+	} else {
+		desc, err = c.PushManifest(ctx, target, MediaTypeImageManifest, data)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to push manifest: %w", err)
+	}
+	if hasParent && manifest.Subject == nil {
+		if err := c.linkChild(ctx, parent, subject, ref.WithDigest(desc.Digest)); err != nil {
+			return "", err
+		}
+	}
+	if provenance != nil {
+		if _, err := c.attachProvenance(ctx, ref, desc, *provenance); err != nil {
+			return "", err
+		}
+	}
+	if !o.index {
+		return desc.Digest, nil
+	}
+
+	platform := snapshotPlatform(metadata)
+	desc.ArtifactType = manifest.ArtifactType
+	desc.Annotations = nil
+	desc.Platform = &platform
+	if _, err := c.addToIndex(ctx, ref, desc); err != nil {
+		return "", fmt.Errorf("failed to add %s to index: %w", platform, err)
+	}
+	return desc.Digest, nil
 }
 
-// PullSnapshot pulls a snapshot from an OCI registry using the ORAS tool
-func PullSnapshot(ctx context.Context, ociRef, outDir string) error {
-	// Check if ORAS is installed
-	if _, err := exec.LookPath("oras"); err != nil {
-		return fmt.Errorf("oras command not found, please install it: %w", err)
+// PullSnapshot pulls a snapshot artifact and writes its files to outDir,
+// named after their title annotations. The manifest is validated against the
+// snapshot schema before any file is downloaded. Chunked files are
+// reassembled from their chunks. Zero pages are written as holes. A
+// reference to an image index pulls the snapshot for the platform set with
+// WithPlatform. Layers are downloaded in parallel, see WithConcurrency.
+func PullSnapshot(ctx context.Context, ociRef, outDir string, opts ...Option) error {
+	o := newOptions(opts)
+
+	ref, err := ParseReference(ociRef)
+	if err != nil {
+		return err
 	}
 
 	// Create output directory if it doesn't exist
@@ -58,20 +353,243 @@ func PullSnapshot(ctx context.Context, ociRef, outDir string) error {
 		return fmt.Errorf("failed to create output directory: %w", err)
 	}
 
-	// Run ORAS command to pull the snapshot
-	cmd := exec.CommandContext(
-		ctx,
-		"oras",
-		"pull",
-		ociRef,
-		"--output", outDir,
-	)
+	c := newClient(o)
+	desc, manifest, err := c.ResolveSnapshot(ctx, ref)
+	if err != nil {
+		return err
+	}
+	// the pinned reference lets snapshots diffed against the pulled one
+	// name it as their parent
+	pinned := ref.WithDigest(desc.Digest).String() + "\n"
+	if err := os.WriteFile(filepath.Join(outDir, SnapshotRefFile), []byte(pinned), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", SnapshotRefFile, err)
+	}
+
+	var layers []Descriptor
+	for _, layer := range manifest.Layers {
+		if mt, _ := baseMediaType(layer.MediaType); o.lazyMemory && (mt == MediaTypeMemory || layer.Annotations[AnnotationChunkedMediaType] == MediaTypeMemory) {
+			continue
+		}
+		if o.layerFilter != nil && layer.MediaType != MediaTypeChunk && !o.layerFilter(layer) {
+			continue
+		}
+		switch layer.MediaType {
+		case MediaTypeChunk:
+			// fetched through the chunk index that lists it
+			continue
+		case MediaTypeChunkIndex:
+			// the chunk sizes are added once the index is read
+		default:
+			c.progress.add(layer.Size)
+		}
+		layers = append(layers, layer)
+	}
+
+	return parallel(ctx, c.concurrency, len(layers), func(ctx context.Context, i int) error {
+		layer := layers[i]
+		title := layer.Annotations[AnnotationTitle]
+		path := filepath.Join(outDir, title)
+		var err error
+		if layer.MediaType == MediaTypeChunkIndex {
+			err = c.fetchChunked(ctx, ref, layer, manifest, path, o.chunkStore)
+		} else if mt, _ := baseMediaType(layer.MediaType); mt == MediaTypeMemoryDelta {
+			err = c.fetchDelta(ctx, ref, manifest, layer, path, o, opts)
+		} else {
+			err = c.fetchBlobToFile(ctx, ref, layer, path)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to pull %s: %w", title, err)
+		}
+		return nil
+	})
+}
 
-	// Capture output
-	output, err := cmd.CombinedOutput()
+// ResolveDigest returns the digest of the snapshot manifest ociRef points at,
+// so that a moving tag can be pinned. For an image index it is the digest of
+// the entry for the platform set with WithPlatform. The manifest is validated
+// against the snapshot schema.
+func ResolveDigest(ctx context.Context, ociRef string, opts ...Option) (string, error) {
+	ref, err := ParseReference(ociRef)
 	if err != nil {
-		return fmt.Errorf("failed to pull snapshot: %s: %w", output, err)
+		return "", err
+	}
+	desc, _, err := newClient(newOptions(opts)).ResolveSnapshot(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+	return desc.Digest, nil
+}
+
+// snapshotFile is a file pushed as a layer of a snapshot artifact.
+type snapshotFile struct {
+	path      string
+	mediaType string
+}
+
+// pushFile uploads a file as a single layer, leaving out the holes of a
+// sparse memory file, compressing it if that is worthwhile and encrypting it
+// if a key provider is set.
+func (c *Client) pushFile(ctx context.Context, ref Reference, file snapshotFile, o *options) (Descriptor, error) {
+	var layout *sparseLayout
+	if o.sparse && file.mediaType == MediaTypeMemory {
+		var err error
+		if layout, err = sparseLayoutOf(file.path); err != nil {
+			return Descriptor{}, fmt.Errorf("failed to find holes: %w", err)
+		}
+	}
+	open := func() (io.ReadCloser, error) {
+		f, err := os.Open(file.path)
+		if err != nil || layout == nil {
+			return f, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{layout.pack(f), f}, nil
 	}
 
-	return nil
+	mediaType := file.mediaType
+	if o.compression != CompressionNone && compressible(mediaType) {
+		compressed, err := compressFile(open, o.compression)
+		if err != nil {
+			return Descriptor{}, fmt.Errorf("failed to compress: %w", err)
+		}
+		if compressed != "" {
+			defer os.Remove(compressed)
+			mediaType += SuffixZstd
+			open = func() (io.ReadCloser, error) { return os.Open(compressed) }
+		}
+	}
+
+	var enc *encryption
+	if o.keys != nil && encryptable(file.mediaType) {
+		encrypted, e, err := encryptFile(ctx, open, o.keys)
+		if err != nil {
+			return Descriptor{}, fmt.Errorf("failed to encrypt: %w", err)
+		}
+		defer os.Remove(encrypted)
+		enc = e
+		mediaType += SuffixEncrypted
+		open = func() (io.ReadCloser, error) { return os.Open(encrypted) }
+	}
+
+	r, err := open()
+	if err != nil {
+		return Descriptor{}, err
+	}
+	digest, size, err := digestReader(r)
+	r.Close()
+	if err != nil {
+		return Descriptor{}, fmt.Errorf("failed to digest: %w", err)
+	}
+	layer := Descriptor{
+		MediaType:   mediaType,
+		Digest:      digest,
+		Size:        size,
+		Annotations: map[string]string{AnnotationTitle: filepath.Base(file.path)},
+	}
+	if layout != nil {
+		layout.annotate(layer.Annotations)
+	}
+	if file.mediaType == MediaTypeMemoryDelta {
+		if err := annotateDelta(file.path, layer.Annotations); err != nil {
+			return Descriptor{}, err
+		}
+	}
+	if enc != nil {
+		enc.annotate(layer.Annotations)
+	}
+	if err := c.pushBlobIfMissing(ctx, ref, layer, open); err != nil {
+		return Descriptor{}, err
+	}
+	return layer, nil
+}
+
+// pushBlobIfMissing uploads a blob unless the repository already has it.
+func (c *Client) pushBlobIfMissing(ctx context.Context, ref Reference, desc Descriptor, open func() (io.ReadCloser, error)) error {
+	exists, err := c.BlobExists(ctx, ref, desc.Digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	r, err := open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	c.progress.add(desc.Size)
+	return c.PushBlob(ctx, ref, desc, c.progress.reader(r))
+}
+
+// fetchBlobToFile downloads a blob to path via a temporary file so that an
+// interrupted pull never leaves a truncated file behind. Zero pages and the
+// zero extents of sparse layers are left as holes. Encrypted and compressed
+// layers are decrypted and decompressed as they stream in.
+func (c *Client) fetchBlobToFile(ctx context.Context, ref Reference, desc Descriptor, path string) error {
+	layout, err := parseSparseLayout(desc)
+	if err != nil {
+		return err
+	}
+	enc, err := parseEncryption(desc)
+	if err != nil {
+		return err
+	}
+	var aead cipher.AEAD
+	if enc != nil {
+		if aead, err = enc.aead(ctx, c.keys); err != nil {
+			return err
+		}
+	}
+	rc, err := c.FetchBlob(ctx, ref, desc)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	// src is the stored content, r the file content
+	body := c.progress.reader(rc)
+	src := body
+	if enc != nil {
+		src = newDecryptReader(enc, aead, body)
+	}
+	r := src
+	if _, compressed := baseMediaType(desc.MediaType); compressed {
+		zr, err := zstd.NewReader(src)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	w := sparse.NewWriter(tmp)
+	if layout != nil {
+		err = layout.unpack(w, r)
+	} else {
+		_, err = io.Copy(w, r)
+	}
+	if err == nil && r != body {
+		// read past the seek table so that the digest is checked
+		_, err = io.Copy(io.Discard, src)
+	}
+	if err == nil {
+		err = w.Finish()
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
 }
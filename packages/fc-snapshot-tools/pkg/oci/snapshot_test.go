@@ -2,29 +2,28 @@ package oci
 
 import (
 	"context"
+	"encoding/json"
+	"net/http"
 	"os"
 	"path/filepath"
 	"testing"
 )
 
-func TestPushSnapshot_NoOras(t *testing.T) {
-	dir := t.TempDir()
-	mem := filepath.Join(dir, "snapshot.mem")
-	vm := filepath.Join(dir, "snapshot.vmstate")
-	cfg := filepath.Join(dir, "snapshot.config")
-	for _, f := range []string{mem, vm, cfg} {
-		if err := os.WriteFile(f, []byte("dummy"), 0644); err != nil {
+func writeSnapshot(t *testing.T, dir string) (mem, vm, cfg string) {
+	t.Helper()
+	mem = filepath.Join(dir, "snapshot.mem")
+	vm = filepath.Join(dir, "snapshot.vmstate")
+	cfg = filepath.Join(dir, "snapshot.config")
+	for _, f := range []string{mem, vm} {
+		if err := os.WriteFile(f, []byte("dummy "+filepath.Base(f)), 0644); err != nil {
 			t.Fatal(err)
 		}
 	}
-
-	oldPath := os.Getenv("PATH")
-	os.Setenv("PATH", "")
-	defer os.Setenv("PATH", oldPath)
-
-	if err := PushSnapshot(context.Background(), "test", mem, vm, cfg); err == nil {
-		t.Fatal("expected error when oras is missing")
+	config := `{"machine-config":{"vcpu_count":2,"mem_size_mib":512},"firecracker-version":"1.5.2"}`
+	if err := os.WriteFile(cfg, []byte(config), 0644); err != nil {
+		t.Fatal(err)
 	}
+	return mem, vm, cfg
 }
 
 func TestPushSnapshot_FileMissing(t *testing.T) {
@@ -35,18 +34,122 @@ func TestPushSnapshot_FileMissing(t *testing.T) {
 	vm := filepath.Join(dir, "snapshot.vmstate")
 	cfg := filepath.Join(dir, "snapshot.config")
 
-	if err := PushSnapshot(context.Background(), "test", mem, vm, cfg); err == nil {
+	if _, err := PushSnapshot(context.Background(), "test", mem, vm, cfg); err == nil {
 		t.Fatal("expected error for missing files")
 	}
 }
 
-func TestPullSnapshot_NoOras(t *testing.T) {
-	dir := t.TempDir()
-	oldPath := os.Getenv("PATH")
-	os.Setenv("PATH", "")
-	defer os.Setenv("PATH", oldPath)
+func TestPushPullSnapshot(t *testing.T) {
+	reg := newTestRegistry(t)
+	src := t.TempDir()
+	mem, vm, cfg := writeSnapshot(t, src)
+	rootfs := filepath.Join(src, "rootfs.ext4")
+	os.WriteFile(rootfs, []byte("ext4"), 0644)
+	ws := filepath.Join(src, "snapshot.workingset")
+	os.WriteFile(ws, []byte(`{"pageSize":4096,"offsets":[0]}`), 0644)
+	integrity := filepath.Join(src, "snapshot.integrity")
+	os.WriteFile(integrity, []byte(`{"blockSize":4194304,"files":{}}`), 0644)
+
+	ref := reg.host() + "/sporelet/layer1:dev"
+	ctx := context.Background()
+	digest, err := PushSnapshot(ctx, ref, mem, vm, cfg, WithPlainHTTP(true), WithRootfs(rootfs), WithWorkingSet(ws), WithIntegrity(integrity), WithMetadata(SnapshotMetadata{Layer: Layer1}))
+	if err != nil {
+		t.Fatalf("PushSnapshot: %v", err)
+	}
+	if err := validateDigest(digest); err != nil {
+		t.Fatalf("PushSnapshot returned %q: %v", digest, err)
+	}
 
-	if err := PullSnapshot(context.Background(), "test", dir); err == nil {
-		t.Fatal("expected error when oras is missing")
+	var manifest Manifest
+	json.Unmarshal(reg.manifests["sporelet/layer1:dev"], &manifest)
+	md, err := ParseSnapshotMetadata(manifest.Annotations)
+	if err != nil {
+		t.Fatalf("ParseSnapshotMetadata: %v", err)
+	}
+	if md.Layer != Layer1 || md.VCPUCount != 2 || md.MemSizeMB != 512 || md.FirecrackerVersion != "1.5.2" || md.Architecture == "" || md.Created.IsZero() {
+		t.Fatalf("unexpected metadata %+v", md)
+	}
+	if manifest.Layers[0].MediaType != MediaTypeMemory || manifest.Layers[3].MediaType != MediaTypeRootfs || manifest.Layers[4].MediaType != MediaTypeWorkingSet || manifest.Layers[5].MediaType != MediaTypeIntegrity {
+		t.Fatalf("unexpected layer media types %+v", manifest.Layers)
+	}
+
+	// pulling by tag and by digest yields the same files
+	for _, r := range []string{ref, reg.host() + "/sporelet/layer1@" + digest} {
+		out := t.TempDir()
+		if err := PullSnapshot(ctx, r, out, WithPlainHTTP(true)); err != nil {
+			t.Fatalf("PullSnapshot(%s): %v", r, err)
+		}
+		for _, f := range []string{mem, vm, cfg, rootfs, ws, integrity} {
+			want, _ := os.ReadFile(f)
+			got, err := os.ReadFile(filepath.Join(out, filepath.Base(f)))
+			if err != nil || string(got) != string(want) {
+				t.Fatalf("pulled %s = %q, %v", filepath.Base(f), got, err)
+			}
+		}
+	}
+
+	// blobs already in the registry are not uploaded again
+	uploads := reg.count(http.MethodPost, "/v2/sporelet/layer1/blobs/uploads/")
+	if _, err := PushSnapshot(ctx, ref, mem, vm, cfg, WithPlainHTTP(true), WithRootfs(rootfs)); err != nil {
+		t.Fatalf("second PushSnapshot: %v", err)
+	}
+	if n := reg.count(http.MethodPost, "/v2/sporelet/layer1/blobs/uploads/"); n != uploads {
+		t.Fatalf("expected no new uploads, got %d", n-uploads)
+	}
+}
+
+func TestPullSnapshot_NotFound(t *testing.T) {
+	reg := newTestRegistry(t)
+	if err := PullSnapshot(context.Background(), reg.host()+"/sporelet/none:dev", t.TempDir(), WithPlainHTTP(true)); err == nil {
+		t.Fatal("expected error for missing manifest")
+	}
+}
+
+func TestPullLayerFilter(t *testing.T) {
+	reg := newTestRegistry(t)
+	mem, vm, cfg := writeSnapshot(t, t.TempDir())
+	ctx := context.Background()
+	ref := reg.host() + "/sporelet/layer1:dev"
+	if _, err := PushSnapshot(ctx, ref, mem, vm, cfg, WithPlainHTTP(true)); err != nil {
+		t.Fatalf("PushSnapshot: %v", err)
+	}
+
+	out := t.TempDir()
+	keep := func(l Descriptor) bool { return l.MediaType != MediaTypeVMState }
+	if err := PullSnapshot(ctx, ref, out, WithPlainHTTP(true), WithLayerFilter(keep)); err != nil {
+		t.Fatalf("PullSnapshot: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "snapshot.vmstate")); !os.IsNotExist(err) {
+		t.Fatal("filtered layer was pulled")
+	}
+	if _, err := os.Stat(filepath.Join(out, "snapshot.mem")); err != nil {
+		t.Fatalf("memory not pulled: %v", err)
+	}
+}
+
+func TestResolveDigest(t *testing.T) {
+	reg := newTestRegistry(t)
+	ctx := context.Background()
+	ref := reg.host() + "/sporelet/layer1:dev"
+
+	var digests []string
+	for _, content := range []string{"v1", "v2"} {
+		mem, vm, cfg := writeSnapshot(t, t.TempDir())
+		os.WriteFile(mem, []byte(content), 0644)
+		pushed, err := PushSnapshot(ctx, ref, mem, vm, cfg, WithPlainHTTP(true))
+		if err != nil {
+			t.Fatalf("PushSnapshot: %v", err)
+		}
+		got, err := ResolveDigest(ctx, ref, WithPlainHTTP(true))
+		if err != nil || got != pushed {
+			t.Fatalf("ResolveDigest = %s, %v, want %s", got, err, pushed)
+		}
+		digests = append(digests, got)
+	}
+	if digests[0] == digests[1] {
+		t.Fatal("digest did not follow the tag")
+	}
+	if _, err := ResolveDigest(ctx, reg.host()+"/sporelet/none:dev", WithPlainHTTP(true)); err == nil {
+		t.Fatal("expected error for missing manifest")
 	}
 }
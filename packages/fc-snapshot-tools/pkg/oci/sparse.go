@@ -0,0 +1,172 @@
+package oci
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/sparse"
+)
+
+const (
+	// AnnotationSparseSize records the size of a sparse file whose layer
+	// only holds its data. It is set together with AnnotationZeroExtents.
+	AnnotationSparseSize = "ai.sporelet.sparse.size"
+	// AnnotationZeroExtents lists the holes left out of a sparse layer as a
+	// JSON array of [offset, length] pairs in file order
+	AnnotationZeroExtents = "ai.sporelet.sparse.zero-extents"
+
+	// minZeroExtent is the smallest hole left out of a sparse layer. Smaller
+	// holes are pushed as zeros to keep the manifest small.
+	minZeroExtent = 64 << 10
+)
+
+// sparseLayout maps the offsets of a sparse file to the offsets of its layer,
+// which is the file with its zero extents cut out.
+type sparseLayout struct {
+	size    int64
+	zeros   []sparse.Extent
+	skipped []int64 // bytes cut out before each zero extent
+}
+
+func newSparseLayout(size int64, zeros []sparse.Extent) *sparseLayout {
+	l := &sparseLayout{size: size, zeros: zeros, skipped: make([]int64, len(zeros))}
+	var n int64
+	for i, z := range zeros {
+		l.skipped[i] = n
+		n += z.Length
+	}
+	return l
+}
+
+// sparseLayoutOf returns the layout of the file at path, or nil if it has no
+// holes worth leaving out.
+func sparseLayoutOf(path string) (*sparseLayout, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	extents, err := sparse.DataExtents(f, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	zeros := sparse.Holes(extents, info.Size(), minZeroExtent)
+	if len(zeros) == 0 {
+		return nil, nil
+	}
+	return newSparseLayout(info.Size(), zeros), nil
+}
+
+// parseSparseLayout decodes the layout of a sparse layer, or returns nil if
+// the layer is not sparse.
+func parseSparseLayout(desc Descriptor) (*sparseLayout, error) {
+	v, ok := desc.Annotations[AnnotationZeroExtents]
+	if !ok {
+		return nil, nil
+	}
+	size, err := strconv.ParseInt(desc.Annotations[AnnotationSparseSize], 10, 64)
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("invalid annotation %s: %q", AnnotationSparseSize, desc.Annotations[AnnotationSparseSize])
+	}
+	var pairs [][2]int64
+	if err := json.Unmarshal([]byte(v), &pairs); err != nil {
+		return nil, fmt.Errorf("invalid annotation %s: %w", AnnotationZeroExtents, err)
+	}
+
+	zeros := make([]sparse.Extent, len(pairs))
+	var off, cut int64
+	for i, p := range pairs {
+		z := sparse.Extent{Offset: p[0], Length: p[1]}
+		if z.Offset < off || z.Length <= 0 || z.End() > size {
+			return nil, fmt.Errorf("invalid annotation %s: extent %v out of order or bounds", AnnotationZeroExtents, p)
+		}
+		zeros[i] = z
+		off = z.End()
+		cut += z.Length
+	}
+	if base, _ := baseMediaType(desc.MediaType); base == desc.MediaType && size-cut != desc.Size {
+		return nil, fmt.Errorf("sparse layer has %d bytes, expected %d", desc.Size, size-cut)
+	}
+	return newSparseLayout(size, zeros), nil
+}
+
+// annotate records the layout in the annotations of a layer.
+func (l *sparseLayout) annotate(a map[string]string) {
+	pairs := make([][2]int64, len(l.zeros))
+	for i, z := range l.zeros {
+		pairs[i] = [2]int64{z.Offset, z.Length}
+	}
+	data, _ := json.Marshal(pairs)
+	a[AnnotationSparseSize] = strconv.FormatInt(l.size, 10)
+	a[AnnotationZeroExtents] = string(data)
+}
+
+// data returns the extents of the file that are stored in the layer.
+func (l *sparseLayout) data() []sparse.Extent {
+	var extents []sparse.Extent
+	var off int64
+	for _, z := range append(l.zeros, sparse.Extent{Offset: l.size}) {
+		if z.Offset > off {
+			extents = append(extents, sparse.Extent{Offset: off, Length: z.Offset - off})
+		}
+		off = z.End()
+	}
+	return extents
+}
+
+// pack returns a reader of the layer content of f.
+func (l *sparseLayout) pack(f *os.File) io.Reader {
+	var readers []io.Reader
+	for _, e := range l.data() {
+		readers = append(readers, io.NewSectionReader(f, e.Offset, e.Length))
+	}
+	return io.MultiReader(readers...)
+}
+
+// unpack writes the file from the layer content in r, leaving the zero
+// extents as holes. r is read to EOF so that a verifying reader checks its
+// digest.
+func (l *sparseLayout) unpack(w *sparse.Writer, r io.Reader) error {
+	var off int64
+	for _, e := range l.data() {
+		w.Skip(e.Offset - off)
+		if _, err := io.CopyN(w, r, e.Length); err != nil {
+			return err
+		}
+		off = e.End()
+	}
+	w.Skip(l.size - off)
+	if n, err := io.Copy(io.Discard, r); err != nil {
+		return err
+	} else if n > 0 {
+		return fmt.Errorf("sparse layer has %d unexpected trailing bytes", n)
+	}
+	return nil
+}
+
+// locate maps an offset of the file to the layer. It returns the layer
+// offset, the number of bytes from off until the next change between data
+// and hole, and whether off is in a hole.
+func (l *sparseLayout) locate(off int64) (int64, int64, bool) {
+	i := sort.Search(len(l.zeros), func(i int) bool { return l.zeros[i].End() > off })
+	if i < len(l.zeros) && l.zeros[i].Offset <= off {
+		return 0, l.zeros[i].End() - off, true
+	}
+	next := l.size
+	if i < len(l.zeros) {
+		next = l.zeros[i].Offset
+	}
+	var skipped int64
+	if i > 0 {
+		skipped = l.skipped[i-1] + l.zeros[i-1].Length
+	}
+	return off - skipped, next - off, false
+}
@@ -0,0 +1,165 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/sparse"
+)
+
+// writeSparseMemory writes a memory file with data at the given offsets and
+// holes everywhere else, and returns its content.
+func writeSparseMemory(t *testing.T, path string, size int64, data map[int64]int) []byte {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	content := make([]byte, size)
+	for off, n := range data {
+		b := bytes.Repeat([]byte{byte(off>>12) | 1}, n)
+		copy(content[off:], b)
+		if _, err := f.WriteAt(b, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	if extents, _ := sparse.DataExtents(f, size); len(extents) == 1 && extents[0].Length == size {
+		t.Skip("filesystem does not report holes")
+	}
+	return content
+}
+
+func allocated(t *testing.T, path string) int64 {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, _ := f.Stat()
+	extents, err := sparse.DataExtents(f, info.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int64
+	for _, e := range extents {
+		n += e.Length
+	}
+	return n
+}
+
+func TestPushPullSparse(t *testing.T) {
+	reg := newTestRegistry(t)
+	mem, vm, cfg := writeSnapshot(t, t.TempDir())
+	size := int64(4 << 20)
+	content := writeSparseMemory(t, mem, size, map[int64]int{
+		0:       4096,
+		1 << 20: 3 * 4096,
+		3 << 20: 100,
+	})
+
+	ctx := context.Background()
+	ref := reg.host() + "/sporelet/layer1:dev"
+	if _, err := PushSnapshot(ctx, ref, mem, vm, cfg, WithPlainHTTP(true)); err != nil {
+		t.Fatalf("PushSnapshot: %v", err)
+	}
+
+	// only the data is uploaded; the holes are listed in the annotations
+	var manifest Manifest
+	json.Unmarshal(reg.manifests["sporelet/layer1:dev"], &manifest)
+	layer := manifest.Layers[0]
+	if layer.Annotations[AnnotationSparseSize] != "4194304" || layer.Size >= size/2 {
+		t.Fatalf("memory layer not sparse: %+v", layer)
+	}
+
+	out := t.TempDir()
+	if err := PullSnapshot(ctx, ref, out, WithPlainHTTP(true)); err != nil {
+		t.Fatalf("PullSnapshot: %v", err)
+	}
+	pulled := filepath.Join(out, "snapshot.mem")
+	got, _ := os.ReadFile(pulled)
+	if !bytes.Equal(got, content) {
+		t.Fatal("pulled memory file differs")
+	}
+	if n := allocated(t, pulled); n >= size/2 {
+		t.Fatalf("pulled memory file has %d bytes allocated", n)
+	}
+
+	// lazy reads return zeros for holes and data around them
+	r, err := OpenLayer(ctx, ref, MediaTypeMemory, WithPlainHTTP(true))
+	if err != nil {
+		t.Fatalf("OpenLayer: %v", err)
+	}
+	if r.Size() != size {
+		t.Fatalf("size %d, want %d", r.Size(), size)
+	}
+	for _, off := range []int64{0, 2048, 1<<20 - 2048, 1<<20 + 4096, 3<<20 - 50, size - 8192} {
+		buf := make([]byte, 8192)
+		if _, err := r.ReadAt(buf, off); err != nil {
+			t.Fatalf("ReadAt(%d): %v", off, err)
+		}
+		if !bytes.Equal(buf, content[off:off+8192]) {
+			t.Fatalf("ReadAt(%d) returned wrong content", off)
+		}
+	}
+
+	// sparse layers can also be compressed
+	if _, err := PushSnapshot(ctx, ref, mem, vm, cfg, WithPlainHTTP(true), WithCompression(CompressionZstd)); err != nil {
+		t.Fatal(err)
+	}
+	r, err = OpenLayer(ctx, ref, MediaTypeMemory, WithPlainHTTP(true))
+	if err != nil {
+		t.Fatalf("OpenLayer: %v", err)
+	}
+	buf := make([]byte, 8192)
+	if _, err := r.ReadAt(buf, 1<<20-2048); err != nil || !bytes.Equal(buf, content[1<<20-2048:1<<20+6144]) {
+		t.Fatalf("compressed sparse ReadAt returned wrong content, %v", err)
+	}
+	out = t.TempDir()
+	if err := PullSnapshot(ctx, ref, out, WithPlainHTTP(true)); err != nil {
+		t.Fatalf("PullSnapshot: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(out, "snapshot.mem")); !bytes.Equal(got, content) {
+		t.Fatal("pulled compressed sparse memory file differs")
+	}
+
+	// and encrypted, with or without compression
+	kp := writeKeyfile(t)
+	for _, c := range []Compression{CompressionNone, CompressionZstd} {
+		if _, err := PushSnapshot(ctx, ref, mem, vm, cfg, WithPlainHTTP(true), WithCompression(c), WithKeyProvider(kp)); err != nil {
+			t.Fatal(err)
+		}
+		r, err = OpenLayer(ctx, ref, MediaTypeMemory, WithPlainHTTP(true), WithKeyProvider(kp))
+		if err != nil {
+			t.Fatalf("OpenLayer: %v", err)
+		}
+		if _, err := r.ReadAt(buf, 1<<20-2048); err != nil || !bytes.Equal(buf, content[1<<20-2048:1<<20+6144]) {
+			t.Fatalf("encrypted sparse ReadAt returned wrong content, %v", err)
+		}
+		out = t.TempDir()
+		if err := PullSnapshot(ctx, ref, out, WithPlainHTTP(true), WithKeyProvider(kp)); err != nil {
+			t.Fatalf("PullSnapshot: %v", err)
+		}
+		if got, _ := os.ReadFile(filepath.Join(out, "snapshot.mem")); !bytes.Equal(got, content) {
+			t.Fatal("pulled encrypted sparse memory file differs")
+		}
+	}
+
+	// pushing without sparse layers uploads the whole file
+	if _, err := PushSnapshot(ctx, ref, mem, vm, cfg, WithPlainHTTP(true), WithSparse(false), WithCompression(CompressionNone)); err != nil {
+		t.Fatal(err)
+	}
+	var dense Manifest
+	json.Unmarshal(reg.manifests["sporelet/layer1:dev"], &dense)
+	if layer := dense.Layers[0]; layer.Size != size || layer.Annotations[AnnotationZeroExtents] != "" {
+		t.Fatalf("dense memory layer %+v", layer)
+	}
+}
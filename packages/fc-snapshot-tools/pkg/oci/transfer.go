@@ -0,0 +1,313 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultConcurrency is the number of blobs transferred at once.
+	defaultConcurrency = 4
+	// defaultChunkSize is the size of the PATCH requests of upload sessions,
+	// which are the unit an interrupted upload is resumed at.
+	defaultChunkSize = 16 << 20
+	// maxRetries bounds how often a single blob transfer is resumed.
+	maxRetries = 5
+)
+
+// retryDelay is the backoff before the first resume of a transfer; it grows
+// linearly with each further attempt.
+var retryDelay = time.Second
+
+// Progress reports how far a push or pull has come.
+type Progress struct {
+	Done  int64 // bytes transferred
+	Total int64 // bytes of the blobs to transfer known so far
+}
+
+// WithProgress calls fn whenever bytes of a blob are transferred. Pulls know
+// the total up front; pushes add each blob once it is prepared, so the total
+// grows while files are compressed or encrypted. Calls are serialized and
+// made from the transferring goroutines, but never hold up a transfer: bytes
+// transferred while fn runs are reported together in the next call.
+func WithProgress(fn func(Progress)) Option {
+	return func(o *options) { o.progress = fn }
+}
+
+// WithConcurrency sets how many blobs are transferred at once. The default
+// is 4.
+func WithConcurrency(n int) Option {
+	return func(o *options) { o.concurrency = n }
+}
+
+// progress accumulates the bytes of a transfer and reports them. A nil
+// progress ignores everything.
+type progress struct {
+	mu      sync.Mutex
+	fn      func(Progress)
+	p       Progress
+	calling sync.Mutex // held while fn runs
+}
+
+func newProgress(fn func(Progress)) *progress {
+	if fn == nil {
+		return nil
+	}
+	return &progress{fn: fn}
+}
+
+// add adds n bytes to the total.
+func (t *progress) add(n int64) {
+	if t == nil || n == 0 {
+		return
+	}
+	t.mu.Lock()
+	t.p.Total += n
+	t.mu.Unlock()
+	t.report()
+}
+
+// report calls fn with the current progress unless another call is running,
+// in which case that one reports again once it returns.
+func (t *progress) report() {
+	if !t.calling.TryLock() {
+		return
+	}
+	for {
+		t.mu.Lock()
+		p := t.p
+		t.mu.Unlock()
+		t.fn(p)
+		t.calling.Unlock()
+
+		t.mu.Lock()
+		changed := t.p != p
+		t.mu.Unlock()
+		if !changed || !t.calling.TryLock() {
+			return
+		}
+	}
+}
+
+// reader counts the bytes read from r as done.
+func (t *progress) reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &progressReader{r: r, t: t}
+}
+
+type progressReader struct {
+	r io.Reader
+	t *progress
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.t.mu.Lock()
+		p.t.p.Done += int64(n)
+		p.t.mu.Unlock()
+		p.t.report()
+	}
+	return n, err
+}
+
+// parallel calls fn for the indexes 0 to n-1 with at most limit calls
+// running at once. It returns the first error; the context passed to fn is
+// cancelled once a call fails.
+func parallel(ctx context.Context, limit, n int, fn func(ctx context.Context, i int) error) error {
+	if limit < 1 {
+		limit = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg    sync.WaitGroup
+		once  sync.Once
+		first error
+	)
+	sem := make(chan struct{}, limit)
+	for i := 0; i < n && ctx.Err() == nil; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			if err := fn(ctx, i); err != nil {
+				once.Do(func() { first = err; cancel() })
+			}
+		}(i)
+	}
+	wg.Wait()
+	if first == nil {
+		first = ctx.Err()
+	}
+	return first
+}
+
+// retryable reports whether a failed request is worth resuming: network
+// errors and server-side failures are, rejected requests are not.
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var regErr *RegistryError
+	if errors.As(err, &regErr) {
+		return regErr.StatusCode >= 500 || regErr.StatusCode == http.StatusRequestTimeout || regErr.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// backoff waits before the given resume attempt.
+func backoff(ctx context.Context, attempt int) error {
+	t := time.NewTimer(time.Duration(attempt) * retryDelay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// blobReader reads a blob response and, if the connection breaks, resumes
+// with a range request where the response left off.
+type blobReader struct {
+	c       *Client
+	ctx     context.Context
+	url     string
+	body    io.ReadCloser
+	offset  int64
+	retries int
+}
+
+func (b *blobReader) Read(p []byte) (int, error) {
+	for {
+		n, err := b.body.Read(p)
+		b.offset += int64(n)
+		if err == nil || err == io.EOF || b.retries >= maxRetries || !retryable(err) || b.ctx.Err() != nil {
+			return n, err
+		}
+		b.body.Close()
+		b.retries++
+		if rerr := b.resume(); rerr != nil {
+			return n, fmt.Errorf("%w (resume at %d failed: %v)", err, b.offset, rerr)
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resume requests the rest of the blob from the current offset.
+func (b *blobReader) resume() error {
+	if err := backoff(b.ctx, b.retries); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(b.ctx, http.MethodGet, b.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", b.offset))
+	resp, err := b.c.do(req, http.StatusPartialContent)
+	if err != nil {
+		b.body = io.NopCloser(strings.NewReader(""))
+		return err
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", b.offset)) {
+		resp.Body.Close()
+		b.body = io.NopCloser(strings.NewReader(""))
+		return fmt.Errorf("unexpected content range %q", resp.Header.Get("Content-Range"))
+	}
+	b.body = resp.Body
+	return nil
+}
+
+func (b *blobReader) Close() error {
+	return b.body.Close()
+}
+
+// uploadChunk sends data at offset of an upload session and returns the
+// location to continue at. If the request fails, the session is asked how
+// much it received and the rest of data is sent again.
+func (c *Client) uploadChunk(ctx context.Context, location *url.URL, data []byte, offset int64) (*url.URL, error) {
+	var sent int64
+	for attempt := 1; ; attempt++ {
+		next, err := c.patch(ctx, location, data[sent:], offset+sent)
+		if err == nil {
+			return next, nil
+		}
+		if attempt > maxRetries || !retryable(err) {
+			return nil, fmt.Errorf("failed to upload chunk at %d: %w", offset+sent, err)
+		}
+		if err := backoff(ctx, attempt); err != nil {
+			return nil, err
+		}
+		next, committed, serr := c.uploadStatus(ctx, location)
+		if serr != nil {
+			return nil, fmt.Errorf("failed to upload chunk at %d: %w (upload status: %v)", offset+sent, err, serr)
+		}
+		if committed < offset || committed > offset+int64(len(data)) {
+			return nil, fmt.Errorf("failed to upload chunk at %d: upload session is at %d", offset+sent, committed)
+		}
+		location, sent = next, committed-offset
+		if sent == int64(len(data)) {
+			return location, nil
+		}
+	}
+}
+
+// patch sends a single PATCH request of an upload session.
+func (c *Client) patch(ctx context.Context, location *url.URL, data []byte, offset int64) (*url.URL, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, location.String(), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+int64(len(data))-1))
+	resp, err := c.do(req, http.StatusAccepted)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp.Location()
+}
+
+// uploadStatus returns the location of an upload session and the number of
+// bytes the registry has received.
+func (c *Client) uploadStatus(ctx context.Context, location *url.URL) (*url.URL, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := c.do(req, http.StatusNoContent)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp.Body.Close()
+	next, err := resp.Location()
+	if err != nil {
+		next = location
+	}
+	// Range is "0-<last byte received>" and absent for an empty session
+	rng := resp.Header.Get("Range")
+	if rng == "" {
+		return next, 0, nil
+	}
+	_, last, ok := strings.Cut(strings.TrimPrefix(rng, "bytes="), "-")
+	end, err := strconv.ParseInt(last, 10, 64)
+	if !ok || err != nil {
+		return nil, 0, fmt.Errorf("malformed upload range %q", rng)
+	}
+	return next, end + 1, nil
+}
@@ -0,0 +1,188 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func init() {
+	retryDelay = 0
+}
+
+func TestFetchBlobResumes(t *testing.T) {
+	reg := newTestRegistry(t)
+	ref, _ := ParseReference(reg.host() + "/snap:dev")
+	c := NewClient(WithPlainHTTP(true))
+
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	desc := Descriptor{Digest: digestBytes(data), Size: int64(len(data))}
+	if err := c.PushBlob(context.Background(), ref, desc, bytes.NewReader(data)); err != nil {
+		t.Fatalf("PushBlob: %v", err)
+	}
+
+	reg.cutDownloads = 2
+	rc, err := c.FetchBlob(context.Background(), ref, desc)
+	if err != nil {
+		t.Fatalf("FetchBlob: %v", err)
+	}
+	defer rc.Close()
+	got, err := io.ReadAll(rc)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("FetchBlob read %d bytes, %v", len(got), err)
+	}
+	if n := reg.count(http.MethodGet, "/v2/snap/blobs/"); n != 2 {
+		t.Fatalf("expected the download to resume once, got %d requests", n)
+	}
+}
+
+func TestPushBlobResumesChunk(t *testing.T) {
+	reg := newTestRegistry(t)
+	ref, _ := ParseReference(reg.host() + "/snap:dev")
+	c := NewClient(WithPlainHTTP(true), WithChunkSize(4))
+
+	reg.failPatches = 2
+	data := []byte("0123456789")
+	desc := Descriptor{Digest: digestBytes(data), Size: int64(len(data))}
+	if err := c.PushBlob(context.Background(), ref, desc, bytes.NewReader(data)); err != nil {
+		t.Fatalf("PushBlob: %v", err)
+	}
+	if !bytes.Equal(reg.blobs[desc.Digest], data) {
+		t.Fatalf("registry holds %q", reg.blobs[desc.Digest])
+	}
+	if n := reg.count(http.MethodGet, "/v2/snap/blobs/uploads/"); n != 2 {
+		t.Fatalf("expected 2 upload status requests, got %d", n)
+	}
+}
+
+func TestPushBlobGivesUp(t *testing.T) {
+	reg := newTestRegistry(t)
+	ref, _ := ParseReference(reg.host() + "/snap:dev")
+	c := NewClient(WithPlainHTTP(true), WithChunkSize(4))
+
+	reg.failPatches = maxRetries + 1
+	data := []byte("0123456789")
+	desc := Descriptor{Digest: digestBytes(data), Size: int64(len(data))}
+	if err := c.PushBlob(context.Background(), ref, desc, bytes.NewReader(data)); err == nil {
+		t.Fatal("expected the upload to fail")
+	}
+}
+
+func TestTransferProgress(t *testing.T) {
+	reg := newTestRegistry(t)
+	ctx := context.Background()
+	ref := reg.host() + "/sporelet/layer1:dev"
+	mem, vm, cfg := writeSnapshot(t, t.TempDir())
+	os.WriteFile(mem, bytes.Repeat([]byte{1, 2, 3, 4}, 1<<16), 0644)
+
+	var pushed Progress
+	_, err := PushSnapshot(ctx, ref, mem, vm, cfg, WithPlainHTTP(true), WithChunkSize(1<<14), WithCompression(CompressionNone),
+		WithProgress(func(p Progress) { pushed = p }))
+	if err != nil {
+		t.Fatalf("PushSnapshot: %v", err)
+	}
+	var stored int64
+	for _, blob := range reg.blobs {
+		stored += int64(len(blob))
+	}
+	if pushed.Done != pushed.Total || pushed.Total != stored {
+		t.Fatalf("push progress %+v, registry stores %d bytes", pushed, stored)
+	}
+
+	reg.cutDownloads = 1
+	var pulled Progress
+	var calls atomic.Int64
+	out := t.TempDir()
+	err = PullSnapshot(ctx, ref, out, WithPlainHTTP(true), WithConcurrency(2),
+		WithProgress(func(p Progress) { pulled = p; calls.Add(1) }))
+	if err != nil {
+		t.Fatalf("PullSnapshot: %v", err)
+	}
+	// everything but the empty config is pulled
+	want := pushed.Total - int64(len(emptyJSON))
+	if pulled.Done != pulled.Total || pulled.Total != want || calls.Load() == 0 {
+		t.Fatalf("pull progress %+v after %d calls, want %d bytes", pulled, calls.Load(), want)
+	}
+	got, _ := os.ReadFile(filepath.Join(out, "snapshot.mem"))
+	if data, _ := os.ReadFile(mem); !bytes.Equal(got, data) {
+		t.Fatal("pulled memory differs")
+	}
+}
+
+func TestProgressDoesNotBlock(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	var last Progress
+	calls := 0
+	p := newProgress(func(pr Progress) {
+		if calls++; calls == 1 {
+			close(started)
+			<-release
+		}
+		last = pr
+	})
+	added := make(chan struct{})
+	go func() {
+		p.add(10)
+		close(added)
+	}()
+	<-started
+
+	// bytes read while the callback is busy are reported after it returns
+	read := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(p.reader(bytes.NewReader(make([]byte, 10))))
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("transfer waited for the progress callback")
+	}
+	close(release)
+	<-added
+	if last != (Progress{Done: 10, Total: 10}) || calls != 2 {
+		t.Fatalf("last report %+v after %d calls", last, calls)
+	}
+}
+
+func TestParallel(t *testing.T) {
+	var running, peak atomic.Int64
+	err := parallel(context.Background(), 3, 20, func(ctx context.Context, i int) error {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil || peak.Load() > 3 {
+		t.Fatalf("parallel = %v with %d calls at once", err, peak.Load())
+	}
+
+	boom := errors.New("boom")
+	var started atomic.Int64
+	err = parallel(context.Background(), 1, 10, func(ctx context.Context, i int) error {
+		started.Add(1)
+		if i == 2 {
+			return boom
+		}
+		return nil
+	})
+	if !errors.Is(err, boom) || started.Load() > 4 {
+		t.Fatalf("parallel = %v after %d calls", err, started.Load())
+	}
+}
@@ -0,0 +1,26 @@
+package sparse
+
+import (
+	"io"
+	"os"
+)
+
+// Copy copies the first size bytes of src into dst, copying only the data
+// extents and leaving holes unallocated. Filesystems without SEEK_DATA
+// support are copied in full.
+func Copy(dst, src *os.File, size int64) error {
+	if err := dst.Truncate(size); err != nil {
+		return err
+	}
+	extents, err := DataExtents(src, size)
+	if err != nil {
+		return err
+	}
+	for _, e := range extents {
+		r := io.NewSectionReader(src, e.Offset, e.Length)
+		if _, err := io.Copy(io.NewOffsetWriter(dst, e.Offset), r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
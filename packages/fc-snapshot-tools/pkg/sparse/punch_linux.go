@@ -0,0 +1,88 @@
+package sparse
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+const (
+	fallocKeepSize  = 0x01 // FALLOC_FL_KEEP_SIZE
+	fallocPunchHole = 0x02 // FALLOC_FL_PUNCH_HOLE
+
+	// punchScanSize is the amount of data read at a time when looking for
+	// zero pages
+	punchScanSize = 1 << 20
+)
+
+// PunchZeroPages deallocates the pages of the file at path that only contain
+// zeros, leaving its content and size unchanged. It returns the number of
+// bytes punched out. Existing holes are not read. Filesystems that cannot
+// punch holes return an error matching errors.ErrUnsupported.
+func PunchZeroPages(path string) (int64, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	extents, err := DataExtents(f, info.Size())
+	if err != nil {
+		return 0, fmt.Errorf("failed to find data extents of %s: %w", path, err)
+	}
+
+	var punched int64
+	buf := make([]byte, punchScanSize)
+	for _, e := range extents {
+		// only whole pages inside the extent can be punched
+		start := (e.Offset + PageSize - 1) / PageSize * PageSize
+		end := e.End() / PageSize * PageSize
+		var zeroStart int64 = -1
+		for off := start; off < end; off += punchScanSize {
+			n := min(int64(len(buf)), end-off)
+			if _, err := f.ReadAt(buf[:n], off); err != nil && !errors.Is(err, io.EOF) {
+				return punched, err
+			}
+			for p := int64(0); p < n; p += PageSize {
+				if IsZero(buf[p : p+PageSize]) {
+					if zeroStart < 0 {
+						zeroStart = off + p
+					}
+					continue
+				}
+				if zeroStart >= 0 {
+					if err := punch(f, zeroStart, off+p-zeroStart); err != nil {
+						return punched, err
+					}
+					punched += off + p - zeroStart
+					zeroStart = -1
+				}
+			}
+		}
+		if zeroStart >= 0 {
+			if err := punch(f, zeroStart, end-zeroStart); err != nil {
+				return punched, err
+			}
+			punched += end - zeroStart
+		}
+	}
+	return punched, nil
+}
+
+// punch deallocates n bytes at off without changing the file size.
+func punch(f *os.File, off, n int64) error {
+	err := syscall.Fallocate(int(f.Fd()), fallocPunchHole|fallocKeepSize, off, n)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return fmt.Errorf("failed to punch hole in %s: %w", f.Name(), errors.ErrUnsupported)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to punch hole in %s: %w", f.Name(), err)
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package sparse
+
+import (
+	"errors"
+	"fmt"
+)
+
+// PunchZeroPages deallocates the pages of the file at path that only contain
+// zeros. Punching holes is only supported on Linux.
+func PunchZeroPages(path string) (int64, error) {
+	return 0, fmt.Errorf("failed to punch zero pages of %s: %w", path, errors.ErrUnsupported)
+}
@@ -0,0 +1,19 @@
+package sparse
+
+import (
+	"os"
+	"syscall"
+)
+
+const ficlone = 0x40049409 // FICLONE ioctl request
+
+// Reflink makes dst share the extents of src using the FICLONE ioctl, so
+// that neither file's data is copied until one of them is written.
+// Filesystems without reflink support return an error.
+func Reflink(dst, src *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
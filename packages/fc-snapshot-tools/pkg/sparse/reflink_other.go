@@ -0,0 +1,14 @@
+//go:build !linux
+
+package sparse
+
+import (
+	"errors"
+	"os"
+)
+
+// Reflink makes dst share the extents of src. Reflinks are only supported on
+// Linux.
+func Reflink(dst, src *os.File) error {
+	return errors.ErrUnsupported
+}
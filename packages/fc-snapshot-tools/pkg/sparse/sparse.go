@@ -0,0 +1,167 @@
+// Package sparse finds, reads and writes the holes of sparse files, such as
+// snapshot memory files whose zero pages have been punched out.
+package sparse
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+const (
+	seekData = 3 // SEEK_DATA whence
+	seekHole = 4 // SEEK_HOLE whence
+
+	// PageSize is the granularity at which zero pages are detected
+	PageSize = 4096
+)
+
+// Extent is a byte range of a file.
+type Extent struct {
+	Offset int64
+	Length int64
+}
+
+// End returns the offset just past the extent.
+func (e Extent) End() int64 {
+	return e.Offset + e.Length
+}
+
+// DataExtents returns the allocated ranges of the first size bytes of f in
+// order. Filesystems without SEEK_DATA support report the whole file as data.
+func DataExtents(f *os.File, size int64) ([]Extent, error) {
+	var extents []Extent
+	var off int64
+	for off < size {
+		start, err := f.Seek(off, seekData)
+		if err != nil {
+			if errors.Is(err, syscall.ENXIO) {
+				// no more data, the rest of the file is a hole
+				break
+			}
+			if errors.Is(err, syscall.EINVAL) && off == 0 {
+				return []Extent{{0, size}}, nil
+			}
+			return nil, err
+		}
+		if start >= size {
+			break
+		}
+		end, err := f.Seek(start, seekHole)
+		if err != nil {
+			return nil, err
+		}
+		end = min(end, size)
+		extents = append(extents, Extent{start, end - start})
+		off = end
+	}
+	return extents, nil
+}
+
+// Holes returns the ranges of [0, size) not covered by the ordered extents
+// that are at least minLength bytes long.
+func Holes(extents []Extent, size, minLength int64) []Extent {
+	var holes []Extent
+	var off int64
+	for _, e := range append(extents, Extent{size, 0}) {
+		if e.Offset-off >= minLength && e.Offset > off {
+			holes = append(holes, Extent{off, e.Offset - off})
+		}
+		off = max(off, e.End())
+	}
+	return holes
+}
+
+// NewReader returns a reader of the content of f that reads the data
+// extents from f and produces zeros for holes without touching the disk.
+func NewReader(f *os.File) (io.Reader, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	extents, err := DataExtents(f, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	var readers []io.Reader
+	var off int64
+	for _, e := range append(extents, Extent{info.Size(), 0}) {
+		if e.Offset > off {
+			readers = append(readers, io.LimitReader(zeroReader{}, e.Offset-off))
+		}
+		if e.Length > 0 {
+			readers = append(readers, io.NewSectionReader(f, e.Offset, e.Length))
+		}
+		off = e.End()
+	}
+	return io.MultiReader(readers...), nil
+}
+
+// zeroReader produces an endless stream of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// IsZero reports whether b only contains zeros.
+func IsZero(b []byte) bool {
+	for len(b) >= 8 {
+		if b[0]|b[1]|b[2]|b[3]|b[4]|b[5]|b[6]|b[7] != 0 {
+			return false
+		}
+		b = b[8:]
+	}
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Writer writes a file sequentially, leaving holes where whole pages are
+// zero. Finish must be called once everything has been written to set the
+// size of the file.
+type Writer struct {
+	f   *os.File
+	off int64
+}
+
+// NewWriter returns a writer starting at the beginning of f, which should be
+// empty.
+func NewWriter(f *os.File) *Writer {
+	return &Writer{f: f}
+}
+
+// Write implements io.Writer.
+func (w *Writer) Write(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		// split at page boundaries of the file so that pages are skipped
+		// whole
+		end := min(len(p), n+int(PageSize-w.off%PageSize))
+		page := p[n:end]
+		if len(page) < PageSize || !IsZero(page) {
+			if _, err := w.f.WriteAt(page, w.off); err != nil {
+				return n, err
+			}
+		}
+		w.off += int64(len(page))
+		n = end
+	}
+	return n, nil
+}
+
+// Skip leaves a hole of n bytes.
+func (w *Writer) Skip(n int64) {
+	w.off += n
+}
+
+// Finish sets the size of the file to the number of bytes written or
+// skipped, so that trailing holes are part of the file.
+func (w *Writer) Finish() error {
+	return w.f.Truncate(w.off)
+}
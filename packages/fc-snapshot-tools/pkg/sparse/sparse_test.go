@@ -0,0 +1,141 @@
+package sparse
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testContent returns pages alternating between zeros and data, with a
+// trailing partial page of data.
+func testContent() []byte {
+	data := make([]byte, 16*PageSize+100)
+	for _, page := range []int{1, 2, 7, 15, 16} {
+		for i := page * PageSize; i < min(len(data), (page+1)*PageSize); i++ {
+			data[i] = byte(page)
+		}
+	}
+	return data
+}
+
+func TestPunchZeroPages(t *testing.T) {
+	data := testContent()
+	path := filepath.Join(t.TempDir(), "snapshot.mem")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	punched, err := PunchZeroPages(path)
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("filesystem cannot punch holes")
+	}
+	if err != nil {
+		t.Fatalf("PunchZeroPages: %v", err)
+	}
+	if punched != 12*PageSize {
+		t.Fatalf("punched %d bytes, want %d", punched, 12*PageSize)
+	}
+	got, _ := os.ReadFile(path)
+	if !bytes.Equal(got, data) {
+		t.Fatal("punching changed the file content")
+	}
+
+	// punched pages are reported as holes and read back as zeros
+	f, _ := os.Open(path)
+	defer f.Close()
+	extents, err := DataExtents(f, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(extents) > 1 && extents[0].Offset != PageSize {
+		t.Fatalf("first data extent %+v, want offset %d", extents[0], PageSize)
+	}
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = io.ReadAll(r)
+	if !bytes.Equal(got, data) {
+		t.Fatal("reader returned wrong content")
+	}
+
+	// punching again finds nothing left to punch
+	if punched, err := PunchZeroPages(path); err != nil || punched != 0 {
+		t.Fatalf("second PunchZeroPages = %d, %v", punched, err)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	data := testContent()
+	f, err := os.Create(filepath.Join(t.TempDir(), "snapshot.mem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w := NewWriter(f)
+	// odd write sizes still leave whole zero pages as holes
+	for r := bytes.NewReader(data); r.Len() > 0; {
+		if _, err := io.CopyN(w, r, 3000); err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+	}
+	w.Skip(2 * PageSize)
+	if err := w.Finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := os.ReadFile(f.Name())
+	want := append(data, make([]byte, 2*PageSize)...)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("wrote %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestHoles(t *testing.T) {
+	extents := []Extent{{4096, 4096}, {16384, 100}}
+	holes := Holes(extents, 65536, 8192)
+	want := []Extent{{8192, 8192}, {16484, 65536 - 16484}}
+	if len(holes) != 2 || holes[0] != want[0] || holes[1] != want[1] {
+		t.Fatalf("Holes = %+v, want %+v", holes, want)
+	}
+	if holes := Holes(extents, 65536, 0); len(holes) != 3 || holes[0] != (Extent{0, 4096}) {
+		t.Fatalf("Holes = %+v", holes)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	data := testContent()
+	dir := t.TempDir()
+	src, err := os.Create(filepath.Join(dir, "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	w := NewWriter(src)
+	w.Write(data)
+	if err := w.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	dst, err := os.Create(filepath.Join(dir, "dst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	if err := Copy(dst, src, int64(len(data))); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	got, _ := os.ReadFile(dst.Name())
+	if !bytes.Equal(got, data) {
+		t.Fatal("copy differs from the source")
+	}
+	srcExtents, _ := DataExtents(src, int64(len(data)))
+	dstExtents, _ := DataExtents(dst, int64(len(data)))
+	if len(dstExtents) != len(srcExtents) {
+		t.Errorf("copy has %d data extents, source %d", len(dstExtents), len(srcExtents))
+	}
+}
@@ -0,0 +1,282 @@
+// Package uffd serves Firecracker guest memory on demand through
+// userfaultfd, so that a VM can resume before its memory file is local.
+package uffd
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// userfaultfd event types
+const (
+	eventPagefault = 0x12
+	eventRemove    = 0x15
+	eventUnmap     = 0x16
+
+	msgSize = 32 // sizeof(struct uffd_msg)
+)
+
+// page states
+const (
+	pageMissing = iota
+	pagePresent
+	pageRemoved
+)
+
+// errExist is returned by a device when the page is already populated.
+var errExist = errors.New("page already populated")
+
+// Region is a guest memory region as described by Firecracker when it hands
+// over the userfaultfd.
+type Region struct {
+	BaseHostVirtAddr uint64 `json:"base_host_virt_addr"`
+	Size             uint64 `json:"size"`
+	Offset           uint64 `json:"offset"` // offset of the region in the memory file
+	PageSizeKiB      uint64 `json:"page_size_kib,omitempty"`
+	PageSize         uint64 `json:"page_size,omitempty"` // bytes, newer Firecracker releases
+}
+
+// pageSize returns the page size of the region in bytes.
+func (r Region) pageSize() uint64 {
+	if r.PageSize != 0 {
+		return r.PageSize
+	}
+	if r.PageSizeKiB != 0 {
+		return r.PageSizeKiB << 10
+	}
+	return 4096
+}
+
+// parseRegions decodes the region mappings sent by Firecracker, which are
+// either a bare list or wrapped in a "mappings" object.
+func parseRegions(data []byte) ([]Region, error) {
+	var regions []Region
+	if err := json.Unmarshal(data, &regions); err == nil {
+		return regions, nil
+	}
+	var wrapped struct {
+		Mappings []Region `json:"mappings"`
+	}
+	if err := json.Unmarshal(data, &wrapped); err != nil {
+		return nil, fmt.Errorf("failed to parse memory mappings: %w", err)
+	}
+	return wrapped.Mappings, nil
+}
+
+// device populates guest memory. The real implementation issues
+// userfaultfd ioctls; tests substitute a fake.
+type device interface {
+	copy(addr uint64, data []byte) error
+	zero(addr, n uint64) error
+	wake(addr, n uint64) error
+}
+
+// Stats counts how guest pages were populated.
+type Stats struct {
+	Faults     int // pages populated in response to a fault
+	Prefetched int // pages populated ahead of a fault
+	Zeroed     int // removed pages populated with zeros
+}
+
+// Handler serves page faults for the guest memory regions of one VM from a
+// memory file source.
+type Handler struct {
+	src     io.ReaderAt
+	regions []Region
+	dev     device
+
+	mu      sync.Mutex
+	state   [][]uint8 // per region, per page
+	stats   Stats
+	touched []int64 // memory file offsets of faulted pages, in fault order
+}
+
+func newHandler(src io.ReaderAt, regions []Region, dev device) (*Handler, error) {
+	h := &Handler{src: src, regions: regions, dev: dev}
+	for _, r := range regions {
+		ps := r.pageSize()
+		if r.Size%ps != 0 || r.BaseHostVirtAddr%ps != 0 {
+			return nil, fmt.Errorf("region at %#x is not page aligned", r.BaseHostVirtAddr)
+		}
+		h.state = append(h.state, make([]uint8, r.Size/ps))
+	}
+	return h, nil
+}
+
+// Stats returns how many pages have been populated so far.
+func (h *Handler) Stats() Stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stats
+}
+
+// WorkingSet returns the pages populated by faults so far, in fault order.
+// With prefetching disabled this is the order in which the guest first
+// touched its memory.
+func (h *Handler) WorkingSet() WorkingSet {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ws := WorkingSet{PageSize: 4096, Offsets: append([]int64{}, h.touched...)}
+	if len(h.regions) > 0 {
+		ws.PageSize = int64(h.regions[0].pageSize())
+	}
+	return ws
+}
+
+// handleMessage processes one userfaultfd message.
+func (h *Handler) handleMessage(msg []byte) error {
+	if len(msg) < msgSize {
+		return fmt.Errorf("short userfaultfd message of %d bytes", len(msg))
+	}
+	switch msg[0] {
+	case eventPagefault:
+		return h.fault(binary.LittleEndian.Uint64(msg[16:]))
+	case eventRemove, eventUnmap:
+		h.remove(binary.LittleEndian.Uint64(msg[8:]), binary.LittleEndian.Uint64(msg[16:]))
+		return nil
+	default:
+		return nil
+	}
+}
+
+// fault populates the page containing addr.
+func (h *Handler) fault(addr uint64) error {
+	i, page, ok := h.find(addr)
+	if !ok {
+		return fmt.Errorf("page fault at %#x outside guest memory", addr)
+	}
+	populated, err := h.populate(i, page, true)
+	if err != nil {
+		return err
+	}
+	if !populated {
+		// another path populated the page without waking this fault
+		r := h.regions[i]
+		return h.dev.wake(r.BaseHostVirtAddr+page*r.pageSize(), r.pageSize())
+	}
+	return nil
+}
+
+// remove records that the guest released a range, for example through the
+// balloon. Faults in the range are then served with zero pages.
+func (h *Handler) remove(start, end uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, r := range h.regions {
+		ps := r.pageSize()
+		for addr := max(start, r.BaseHostVirtAddr); addr < min(end, r.BaseHostVirtAddr+r.Size); addr += ps {
+			h.state[i][(addr-r.BaseHostVirtAddr)/ps] = pageRemoved
+		}
+	}
+}
+
+// find returns the region and page index containing addr.
+func (h *Handler) find(addr uint64) (int, uint64, bool) {
+	for i, r := range h.regions {
+		if addr >= r.BaseHostVirtAddr && addr < r.BaseHostVirtAddr+r.Size {
+			return i, (addr - r.BaseHostVirtAddr) / r.pageSize(), true
+		}
+	}
+	return 0, 0, false
+}
+
+// populate copies a page from the source into guest memory unless it is
+// already present. It reports whether this call populated the page.
+func (h *Handler) populate(region int, page uint64, fault bool) (bool, error) {
+	h.mu.Lock()
+	state := h.state[region][page]
+	h.mu.Unlock()
+	if state == pagePresent {
+		return false, nil
+	}
+
+	r := h.regions[region]
+	ps := r.pageSize()
+	addr := r.BaseHostVirtAddr + page*ps
+	var err error
+	if state == pageRemoved {
+		err = h.dev.zero(addr, ps)
+	} else {
+		buf := make([]byte, ps)
+		n, rerr := h.src.ReadAt(buf, int64(r.Offset+page*ps))
+		if rerr != nil && !errors.Is(rerr, io.EOF) {
+			return false, fmt.Errorf("failed to read page at offset %d: %w", r.Offset+page*ps, rerr)
+		}
+		clear(buf[n:]) // the memory file may end before the region
+		err = h.dev.copy(addr, buf)
+	}
+	if errors.Is(err, errExist) {
+		h.mu.Lock()
+		h.state[region][page] = pagePresent
+		h.mu.Unlock()
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to populate page at %#x: %w", addr, err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.state[region][page] = pagePresent
+	switch {
+	case state == pageRemoved:
+		h.stats.Zeroed++
+	case fault:
+		h.stats.Faults++
+		h.touched = append(h.touched, int64(r.Offset+page*ps))
+	default:
+		h.stats.Prefetched++
+	}
+	return true, nil
+}
+
+// prefetch populates every page not yet present until done or ctx is
+// cancelled: first the pages at the given memory file offsets, in order, then
+// the rest in memory file order. Removed pages are left for faults to zero.
+func (h *Handler) prefetch(ctx context.Context, order []int64) error {
+	for _, off := range order {
+		if i, page, ok := h.findOffset(uint64(off)); ok {
+			if err := h.prefetchPage(ctx, i, page); err != nil {
+				return err
+			}
+		}
+	}
+	for i, r := range h.regions {
+		for page := uint64(0); page < r.Size/r.pageSize(); page++ {
+			if err := h.prefetchPage(ctx, i, page); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// prefetchPage populates a page if it is still missing.
+func (h *Handler) prefetchPage(ctx context.Context, region int, page uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	state := h.state[region][page]
+	h.mu.Unlock()
+	if state != pageMissing {
+		return nil
+	}
+	_, err := h.populate(region, page, false)
+	return err
+}
+
+// findOffset returns the region and page backed by a memory file offset.
+func (h *Handler) findOffset(off uint64) (int, uint64, bool) {
+	for i, r := range h.regions {
+		if off >= r.Offset && off < r.Offset+r.Size {
+			return i, (off - r.Offset) / r.pageSize(), true
+		}
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,278 @@
+package uffd
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// fakeDevice records populated pages instead of issuing ioctls.
+type fakeDevice struct {
+	mu    sync.Mutex
+	pages map[uint64][]byte
+	woken []uint64
+}
+
+func newFakeDevice() *fakeDevice {
+	return &fakeDevice{pages: map[uint64][]byte{}}
+}
+
+func (d *fakeDevice) copy(addr uint64, data []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.pages[addr]; ok {
+		return errExist
+	}
+	d.pages[addr] = append([]byte{}, data...)
+	return nil
+}
+
+func (d *fakeDevice) zero(addr, n uint64) error {
+	return d.copy(addr, make([]byte, n))
+}
+
+func (d *fakeDevice) wake(addr, n uint64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.woken = append(d.woken, addr)
+	return nil
+}
+
+func faultMsg(addr uint64) []byte {
+	msg := make([]byte, msgSize)
+	msg[0] = eventPagefault
+	binary.LittleEndian.PutUint64(msg[16:], addr)
+	return msg
+}
+
+func removeMsg(start, end uint64) []byte {
+	msg := make([]byte, msgSize)
+	msg[0] = eventRemove
+	binary.LittleEndian.PutUint64(msg[8:], start)
+	binary.LittleEndian.PutUint64(msg[16:], end)
+	return msg
+}
+
+// testMemory returns a memory file whose pages are filled with their index plus one.
+func testMemory(pages int) []byte {
+	mem := make([]byte, pages*4096)
+	for i := 0; i < pages; i++ {
+		for j := 0; j < 4096; j++ {
+			mem[i*4096+j] = byte(i + 1)
+		}
+	}
+	return mem
+}
+
+func TestHandlerFault(t *testing.T) {
+	mem := testMemory(8)
+	regions := []Region{
+		{BaseHostVirtAddr: 0x10000, Size: 4 * 4096, Offset: 0, PageSizeKiB: 4},
+		{BaseHostVirtAddr: 0x80000, Size: 4 * 4096, Offset: 4 * 4096, PageSizeKiB: 4},
+	}
+	dev := newFakeDevice()
+	h, err := newHandler(bytes.NewReader(mem), regions, dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a fault anywhere in a page populates that page from the region offset
+	if err := h.handleMessage(faultMsg(0x80000 + 2*4096 + 123)); err != nil {
+		t.Fatalf("fault: %v", err)
+	}
+	got := dev.pages[0x80000+2*4096]
+	if !bytes.Equal(got, mem[6*4096:7*4096]) {
+		t.Fatalf("page populated with %d, want %d", got[0], mem[6*4096])
+	}
+
+	// a second fault on a present page only wakes the faulting thread
+	if err := h.handleMessage(faultMsg(0x80000 + 2*4096)); err != nil {
+		t.Fatalf("repeated fault: %v", err)
+	}
+	if len(dev.woken) != 1 {
+		t.Fatalf("expected one wake, got %d", len(dev.woken))
+	}
+
+	if err := h.handleMessage(faultMsg(0x40000)); err == nil {
+		t.Fatal("expected error for fault outside guest memory")
+	}
+	if s := h.Stats(); s.Faults != 1 {
+		t.Fatalf("stats %+v", s)
+	}
+}
+
+func TestHandlerPrefetch(t *testing.T) {
+	mem := testMemory(6)
+	regions := []Region{{BaseHostVirtAddr: 0x10000, Size: 8 * 4096, PageSize: 4096}}
+	dev := newFakeDevice()
+	h, _ := newHandler(bytes.NewReader(mem), regions, dev)
+
+	h.handleMessage(faultMsg(0x10000 + 4096))
+	h.handleMessage(removeMsg(0x10000+3*4096, 0x10000+4*4096))
+	if err := h.prefetch(context.Background(), nil); err != nil {
+		t.Fatalf("prefetch: %v", err)
+	}
+
+	// removed pages are left for faults, which then get zeros
+	if _, ok := dev.pages[0x10000+3*4096]; ok {
+		t.Fatal("removed page was prefetched")
+	}
+	h.handleMessage(faultMsg(0x10000 + 3*4096))
+	if !bytes.Equal(dev.pages[0x10000+3*4096], make([]byte, 4096)) {
+		t.Fatal("removed page not zeroed")
+	}
+
+	for page := uint64(0); page < 8; page++ {
+		got, ok := dev.pages[0x10000+page*4096]
+		if !ok {
+			t.Fatalf("page %d not populated", page)
+		}
+		want := make([]byte, 4096)
+		if page < 6 && page != 3 {
+			want = mem[page*4096 : (page+1)*4096]
+		}
+		// pages past the end of the memory file are zero
+		if !bytes.Equal(got, want) {
+			t.Fatalf("page %d populated with %d", page, got[0])
+		}
+	}
+	if s := h.Stats(); s.Faults != 1 || s.Prefetched != 6 || s.Zeroed != 1 {
+		t.Fatalf("stats %+v", s)
+	}
+}
+
+func TestParseRegions(t *testing.T) {
+	for _, data := range []string{
+		`[{"base_host_virt_addr":4096,"size":8192,"offset":0,"page_size_kib":4}]`,
+		`{"mappings":[{"base_host_virt_addr":4096,"size":8192,"offset":0,"page_size":4096}]}`,
+	} {
+		regions, err := parseRegions([]byte(data))
+		if err != nil {
+			t.Fatalf("parseRegions(%s): %v", data, err)
+		}
+		if len(regions) != 1 || regions[0].BaseHostVirtAddr != 4096 || regions[0].pageSize() != 4096 {
+			t.Fatalf("parseRegions(%s) = %+v", data, regions)
+		}
+	}
+	if _, err := newHandler(nil, []Region{{BaseHostVirtAddr: 100, Size: 4096}}, nil); err == nil {
+		t.Fatal("expected error for unaligned region")
+	}
+}
+
+func TestReceive(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "uffd.sock")
+	l, err := Listen(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	// stand in for Firecracker handing over its userfaultfd
+	rights := syscall.UnixRights(int(r.Fd()))
+	go func() {
+		conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: sock, Net: "unix"})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		mappings := []byte(`[{"base_host_virt_addr":4096,"size":4096,"offset":0,"page_size_kib":4}]`)
+		conn.WriteMsgUnix(mappings, rights, nil)
+	}()
+
+	conn, err := l.ln.AcceptUnix()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	regions, f, err := receive(conn)
+	if err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	defer f.Close()
+	if len(regions) != 1 || regions[0].Size != 4096 {
+		t.Fatalf("regions %+v", regions)
+	}
+
+	// the received fd refers to the same pipe
+	w.Write([]byte("ok"))
+	buf := make([]byte, 2)
+	if _, err := f.Read(buf); err != nil || string(buf) != "ok" {
+		t.Fatalf("read from received fd = %q, %v", buf, err)
+	}
+}
+
+func TestHandlerWorkingSet(t *testing.T) {
+	mem := testMemory(8)
+	regions := []Region{
+		{BaseHostVirtAddr: 0x10000, Size: 4 * 4096, Offset: 0, PageSizeKiB: 4},
+		{BaseHostVirtAddr: 0x80000, Size: 4 * 4096, Offset: 4 * 4096, PageSizeKiB: 4},
+	}
+
+	// record: faults are logged as memory file offsets in first-touch order
+	rec, _ := newHandler(bytes.NewReader(mem), regions, newFakeDevice())
+	for _, addr := range []uint64{0x80000 + 4096, 0x80000 + 2*4096, 0x10000 + 2*4096, 0x80000 + 4096} {
+		rec.handleMessage(faultMsg(addr))
+	}
+	ws := rec.WorkingSet()
+	want := []int64{5 * 4096, 6 * 4096, 2 * 4096}
+	if ws.PageSize != 4096 || len(ws.Offsets) != len(want) {
+		t.Fatalf("working set %+v, want offsets %v", ws, want)
+	}
+	for i := range want {
+		if ws.Offsets[i] != want[i] {
+			t.Fatalf("working set %v, want %v", ws.Offsets, want)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "snapshot.workingset")
+	if err := ws.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadWorkingSet(path)
+	if err != nil {
+		t.Fatalf("LoadWorkingSet: %v", err)
+	}
+	if runs := loaded.Runs(); len(runs) != 2 || runs[0] != [2]int64{5 * 4096, 2 * 4096} {
+		t.Fatalf("runs %v", runs)
+	}
+
+	// replay: working set pages are prefetched first, in order
+	dev := &orderDevice{fakeDevice: newFakeDevice()}
+	h, _ := newHandler(bytes.NewReader(mem), regions, dev)
+	if err := h.prefetch(context.Background(), loaded.Offsets); err != nil {
+		t.Fatal(err)
+	}
+	first := []uint64{0x80000 + 4096, 0x80000 + 2*4096, 0x10000 + 2*4096, 0x10000}
+	for i, addr := range first {
+		if dev.order[i] != addr {
+			t.Fatalf("prefetch order %x, want prefix %x", dev.order, first)
+		}
+	}
+	if len(dev.order) != 8 {
+		t.Fatalf("prefetched %d pages, want 8", len(dev.order))
+	}
+}
+
+// orderDevice records the order pages are populated in.
+type orderDevice struct {
+	*fakeDevice
+	order []uint64
+}
+
+func (d *orderDevice) copy(addr uint64, data []byte) error {
+	d.order = append(d.order, addr)
+	return d.fakeDevice.copy(addr, data)
+}
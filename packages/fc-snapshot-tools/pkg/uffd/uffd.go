@@ -0,0 +1,238 @@
+package uffd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// userfaultfd ioctl requests
+const (
+	ioctlWake     = 0x8010aa02 // UFFDIO_WAKE
+	ioctlCopy     = 0xc028aa03 // UFFDIO_COPY
+	ioctlZeropage = 0xc020aa04 // UFFDIO_ZEROPAGE
+)
+
+// uffdioRange mirrors struct uffdio_range.
+type uffdioRange struct {
+	start, len uint64
+}
+
+// uffdioCopy mirrors struct uffdio_copy.
+type uffdioCopy struct {
+	dst, src, len, mode uint64
+	copy                int64
+}
+
+// uffdioZeropage mirrors struct uffdio_zeropage.
+type uffdioZeropage struct {
+	rng      uffdioRange
+	mode     uint64
+	zeropage int64
+}
+
+// Option configures optional settings for Serve.
+type Option func(*options)
+
+type options struct {
+	prefetch bool
+	order    []int64
+	onReady  func(*Handler)
+}
+
+// WithPrefetch populates pages that have not faulted yet in the background.
+// It is enabled by default. Disable it to record a working set.
+func WithPrefetch(enabled bool) Option {
+	return func(o *options) { o.prefetch = enabled }
+}
+
+// WithWorkingSet prefetches the pages of a recorded working set first, in the
+// order the guest touched them, ahead of the remaining pages.
+func WithWorkingSet(ws WorkingSet) Option {
+	return func(o *options) { o.order = ws.Offsets }
+}
+
+// WithHandler calls fn with the handler once Firecracker has connected, for
+// example to report its Stats or record its WorkingSet.
+func WithHandler(fn func(*Handler)) Option {
+	return func(o *options) { o.onReady = fn }
+}
+
+// Listener accepts the userfaultfd of a Firecracker process restoring a
+// snapshot with the Uffd memory backend.
+type Listener struct {
+	ln   *net.UnixListener
+	path string
+}
+
+// Listen creates the socket that Firecracker's mem_backend backend_path must
+// point to.
+func Listen(path string) (*Listener, error) {
+	os.Remove(path)
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	return &Listener{ln: ln, path: path}, nil
+}
+
+// Path returns the socket path.
+func (l *Listener) Path() string {
+	return l.path
+}
+
+// Close removes the socket.
+func (l *Listener) Close() error {
+	return l.ln.Close()
+}
+
+// Serve accepts one Firecracker connection and serves page faults from src
+// until Firecracker exits or ctx is cancelled. src is read at the offsets of
+// the snapshot memory file.
+func (l *Listener) Serve(ctx context.Context, src io.ReaderAt, opts ...Option) error {
+	o := &options{prefetch: true}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	go func() {
+		<-ctx.Done()
+		l.ln.Close()
+	}()
+	conn, err := l.ln.AcceptUnix()
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("failed to accept Firecracker connection: %w", err)
+	}
+	defer conn.Close()
+
+	regions, f, err := receive(conn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h, err := newHandler(src, regions, &fdDevice{f: f})
+	if err != nil {
+		return err
+	}
+	if o.onReady != nil {
+		o.onReady(h)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Firecracker never writes to the socket again; a read returning means
+	// it has exited
+	go func() {
+		io.Copy(io.Discard, conn)
+		cancel()
+	}()
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+	if o.prefetch {
+		go h.prefetch(ctx, o.order)
+	}
+
+	msg := make([]byte, msgSize)
+	for {
+		if _, err := io.ReadFull(f, msg); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to read userfaultfd event: %w", err)
+		}
+		if err := h.handleMessage(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// receive reads the memory mappings and the userfaultfd sent by Firecracker.
+func receive(conn *net.UnixConn) ([]Region, *os.File, error) {
+	buf := make([]byte, 64<<10)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to receive userfaultfd: %w", err)
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) == 0 {
+		return nil, nil, fmt.Errorf("no userfaultfd received")
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) == 0 {
+		return nil, nil, fmt.Errorf("no userfaultfd received")
+	}
+
+	// a non-blocking fd lets the runtime poller wake reads when closed
+	if err := syscall.SetNonblock(fds[0], true); err != nil {
+		syscall.Close(fds[0])
+		return nil, nil, err
+	}
+	f := os.NewFile(uintptr(fds[0]), "userfaultfd")
+
+	regions, err := parseRegions(buf[:n])
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return regions, f, nil
+}
+
+// fdDevice populates guest memory with userfaultfd ioctls.
+type fdDevice struct {
+	f *os.File
+}
+
+func (d *fdDevice) copy(addr uint64, data []byte) error {
+	arg := uffdioCopy{dst: addr, src: uint64(uintptr(unsafe.Pointer(&data[0]))), len: uint64(len(data))}
+	return d.ioctl(ioctlCopy, unsafe.Pointer(&arg))
+}
+
+func (d *fdDevice) zero(addr, n uint64) error {
+	arg := uffdioZeropage{rng: uffdioRange{start: addr, len: n}}
+	return d.ioctl(ioctlZeropage, unsafe.Pointer(&arg))
+}
+
+func (d *fdDevice) wake(addr, n uint64) error {
+	arg := uffdioRange{start: addr, len: n}
+	return d.ioctl(ioctlWake, unsafe.Pointer(&arg))
+}
+
+// ioctl issues a userfaultfd ioctl, retrying while the kernel asks to and
+// mapping EEXIST to errExist.
+func (d *fdDevice) ioctl(req uintptr, arg unsafe.Pointer) error {
+	rc, err := d.f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	if err := rc.Control(func(fd uintptr) {
+		for {
+			_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+			if errno != syscall.EAGAIN && errno != syscall.EINTR {
+				return
+			}
+		}
+	}); err != nil {
+		return err
+	}
+	switch {
+	case errno == 0:
+		return nil
+	case errors.Is(errno, syscall.EEXIST):
+		return errExist
+	default:
+		return errno
+	}
+}
@@ -0,0 +1,58 @@
+package uffd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// WorkingSet lists the memory file offsets of the pages a VM touched after
+// resuming, in the order it first touched them.
+type WorkingSet struct {
+	PageSize int64   `json:"pageSize"`
+	Offsets  []int64 `json:"offsets"`
+}
+
+// LoadWorkingSet reads a working set file written by Save.
+func LoadWorkingSet(path string) (WorkingSet, error) {
+	var ws WorkingSet
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ws, err
+	}
+	if err := json.Unmarshal(data, &ws); err != nil {
+		return ws, fmt.Errorf("failed to parse working set %s: %w", path, err)
+	}
+	if ws.PageSize <= 0 {
+		return ws, fmt.Errorf("invalid page size %d in working set %s", ws.PageSize, path)
+	}
+	for _, off := range ws.Offsets {
+		if off < 0 || off%ws.PageSize != 0 {
+			return ws, fmt.Errorf("unaligned offset %d in working set %s", off, path)
+		}
+	}
+	return ws, nil
+}
+
+// Save writes the working set to path.
+func (ws WorkingSet) Save(path string) error {
+	data, err := json.Marshal(ws)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// Runs coalesces the offsets into ranges of adjacent pages, keeping the order
+// of first touch. Each run is returned as offset and length.
+func (ws WorkingSet) Runs() [][2]int64 {
+	var runs [][2]int64
+	for _, off := range ws.Offsets {
+		if n := len(runs); n > 0 && runs[n-1][0]+runs[n-1][1] == off {
+			runs[n-1][1] += ws.PageSize
+			continue
+		}
+		runs = append(runs, [2]int64{off, ws.PageSize})
+	}
+	return runs
+}
@@ -0,0 +1,169 @@
+package fc
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/oci"
+)
+
+// BuilderID identifies snapshot builds run with this package in their
+// provenance.
+const BuilderID = "https://github.com/quinnovator/sporelet/packages/fc-snapshot-tools"
+
+// modulePath is the module of this package, whose version is recorded as
+// the builder version.
+const modulePath = "github.com/quinnovator/sporelet/packages/fc-snapshot-tools"
+
+// BuildInputs are the inputs of a snapshot build recorded in its provenance.
+// Files left empty are not recorded.
+type BuildInputs struct {
+	Kernel      string // Path to the kernel image
+	Rootfs      string // Path to the rootfs image, before the VM boots from it
+	ComposeFile string // Compose file of the services preheated in the guest
+	GuestAgent  string // Guest agent binary installed in the rootfs
+	FCBin       string // Firecracker binary, looked up in PATH if it has no directory
+	JailerBin   string // Jailer binary, looked up in PATH if it has no directory
+	// InvocationID identifies the build run, such as the VM ID
+	InvocationID string
+	// Parameters are the settings the build was asked for, such as the
+	// kernel command line and machine size
+	Parameters map[string]any
+}
+
+// ProvenancePath returns where the provenance of the snapshot with the given
+// memory file is stored: next to it, with a .provenance extension.
+func ProvenancePath(memFile string) string {
+	return strings.TrimSuffix(memFile, ".mem") + ".provenance"
+}
+
+// NewProvenance starts the provenance of a snapshot build by digesting its
+// input files. Call it before the VM boots, which changes the rootfs, and
+// complete it with WriteProvenance once the snapshot is taken.
+func NewProvenance(in BuildInputs) (oci.Provenance, error) {
+	p := oci.Provenance{
+		BuildDefinition: oci.BuildDefinition{
+			BuildType:          oci.BuildTypeSnapshot,
+			ExternalParameters: in.Parameters,
+		},
+		RunDetails: oci.RunDetails{
+			Builder: oci.Builder{ID: BuilderID, Version: map[string]string{
+				"fc-snapshot-tools": moduleVersion(),
+				"go":                runtime.Version(),
+			}},
+			Metadata: oci.BuildMetadata{InvocationID: in.InvocationID, StartedOn: time.Now().UTC()},
+		},
+	}
+	if p.BuildDefinition.ExternalParameters == nil {
+		p.BuildDefinition.ExternalParameters = map[string]any{}
+	}
+
+	for _, input := range []struct {
+		name, path string
+		tool       bool
+	}{
+		{"kernel", in.Kernel, false},
+		{"rootfs", in.Rootfs, false},
+		{"compose-file", in.ComposeFile, false},
+		{"guest-agent", in.GuestAgent, false},
+		{"firecracker", in.FCBin, true},
+		{"jailer", in.JailerBin, true},
+	} {
+		path := input.path
+		if path == "" {
+			continue
+		}
+		if input.tool && filepath.Base(path) == path {
+			// a tool that is not installed fails the build itself
+			found, err := exec.LookPath(path)
+			if err != nil {
+				continue
+			}
+			path = found
+		}
+		dep, err := dependency(input.name, path)
+		if err != nil {
+			return p, err
+		}
+		p.BuildDefinition.ResolvedDependencies = append(p.BuildDefinition.ResolvedDependencies, dep)
+	}
+	return p, nil
+}
+
+// WriteProvenance completes the provenance p of a snapshot build with the
+// Firecracker version recorded in the snapshot config and the end of the
+// build, and writes it to ProvenancePath(memFile). PushSnapshot attaches it
+// to the pushed snapshot.
+func WriteProvenance(p oci.Provenance, memFile, configFile string) error {
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot config: %w", err)
+	}
+	var cfg struct {
+		FirecrackerVersion string `json:"firecracker-version"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("failed to parse snapshot config: %w", err)
+	}
+	if cfg.FirecrackerVersion != "" {
+		if p.RunDetails.Builder.Version == nil {
+			p.RunDetails.Builder.Version = map[string]string{}
+		}
+		p.RunDetails.Builder.Version["firecracker"] = cfg.FirecrackerVersion
+	}
+	p.RunDetails.Metadata.FinishedOn = time.Now().UTC()
+
+	data, err = json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode provenance: %w", err)
+	}
+	if err := os.WriteFile(ProvenancePath(memFile), append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write provenance: %w", err)
+	}
+	return nil
+}
+
+// dependency describes an input file of a build by its role and digest.
+func dependency(name, path string) (oci.ResourceDescriptor, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return oci.ResourceDescriptor{}, err
+	}
+	sum, err := fileHash(abs)
+	if err != nil {
+		return oci.ResourceDescriptor{}, fmt.Errorf("failed to digest %s: %w", name, err)
+	}
+	return oci.ResourceDescriptor{
+		Name:   name,
+		URI:    "file://" + abs,
+		Digest: map[string]string{"sha256": sum},
+	}, nil
+}
+
+// moduleVersion returns the version of this module in the running binary,
+// "(devel)" for builds from a checkout.
+func moduleVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "(unknown)"
+	}
+	if info.Main.Path == modulePath {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			if dep.Replace != nil && dep.Replace.Version == "" {
+				return "(devel)"
+			}
+			return dep.Version
+		}
+	}
+	return "(devel)"
+}
@@ -0,0 +1,85 @@
+package fc
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/quinnovator/sporelet/packages/fc-snapshot-tools/pkg/oci"
+)
+
+func TestProvenance(t *testing.T) {
+	dir := t.TempDir()
+	kernel := filepath.Join(dir, "vmlinux")
+	rootfs := filepath.Join(dir, "rootfs.ext4")
+	os.WriteFile(kernel, []byte("kernel"), 0644)
+	os.WriteFile(rootfs, []byte("rootfs"), 0644)
+
+	p, err := NewProvenance(BuildInputs{
+		Kernel:     kernel,
+		Rootfs:     rootfs,
+		FCBin:      "sporelet-no-such-firecracker",
+		Parameters: map[string]any{"vcpuCount": 2},
+	})
+	if err != nil {
+		t.Fatalf("NewProvenance: %v", err)
+	}
+	// the rootfs changes once the VM boots from it
+	os.WriteFile(rootfs, []byte("booted"), 0644)
+
+	mem := filepath.Join(dir, "snapshot.mem")
+	vmstate := filepath.Join(dir, "snapshot.vmstate")
+	config := filepath.Join(dir, "snapshot.config")
+	os.WriteFile(mem, []byte("memory"), 0644)
+	os.WriteFile(vmstate, []byte("vmstate"), 0644)
+	os.WriteFile(config, []byte(`{"machine-config":{"vcpu_count":2,"mem_size_mib":128},"firecracker-version":"1.7.0"}`), 0644)
+	if err := WriteProvenance(p, mem, config); err != nil {
+		t.Fatalf("WriteProvenance: %v", err)
+	}
+
+	data, err := os.ReadFile(ProvenancePath(mem))
+	if err != nil {
+		t.Fatalf("read provenance: %v", err)
+	}
+	p, err = oci.ParseProvenance(data)
+	if err != nil {
+		t.Fatalf("ParseProvenance: %v", err)
+	}
+	deps := map[string]string{}
+	for _, d := range p.BuildDefinition.ResolvedDependencies {
+		deps[d.Name] = d.Digest["sha256"]
+	}
+	want := map[string]string{
+		"kernel": fmt.Sprintf("%x", sha256.Sum256([]byte("kernel"))),
+		"rootfs": fmt.Sprintf("%x", sha256.Sum256([]byte("rootfs"))),
+	}
+	if fmt.Sprint(deps) != fmt.Sprint(want) {
+		t.Errorf("dependencies %v, want %v", deps, want)
+	}
+	if v := p.RunDetails.Builder.Version["firecracker"]; v != "1.7.0" {
+		t.Errorf("firecracker version %q", v)
+	}
+	if p.RunDetails.Metadata.FinishedOn.Before(p.RunDetails.Metadata.StartedOn) {
+		t.Errorf("build metadata %+v", p.RunDetails.Metadata)
+	}
+
+	// PushSnapshot attaches the provenance next to the snapshot files
+	ref := oci.LayoutScheme + t.TempDir() + ":layer1"
+	digest, err := PushSnapshot(context.Background(), ref, mem, vmstate, config)
+	if err != nil {
+		t.Fatalf("PushSnapshot: %v", err)
+	}
+	statements, err := oci.FetchProvenance(context.Background(), ref)
+	if err != nil || len(statements) != 1 || "sha256:"+statements[0].Subject[0].Digest["sha256"] != digest {
+		t.Errorf("provenance of %s: %+v, %v", digest, statements, err)
+	}
+}
+
+func TestNewProvenance_MissingInput(t *testing.T) {
+	if _, err := NewProvenance(BuildInputs{Kernel: filepath.Join(t.TempDir(), "vmlinux")}); err == nil {
+		t.Fatal("expected error for missing kernel")
+	}
+}